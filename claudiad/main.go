@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/commitments"
 	"github.com/applatix/claudia/routers"
 	"github.com/applatix/claudia/server"
 	"github.com/applatix/claudia/userdb"
@@ -99,6 +100,12 @@ func openUserDatabase(userdbURL string, reinitialize bool) (*userdb.UserDatabase
 			log.Println("Failed to initialize database", err)
 			return nil, err
 		}
+	} else if conf.SchemaVersion < userdb.SchemaVersion {
+		err = userDB.Upgrade()
+		if err != nil {
+			log.Println("Failed to upgrade database", err)
+			return nil, err
+		}
 	}
 	return userDB, nil
 }
@@ -120,6 +127,7 @@ func run(c *cli.Context) error {
 	serverPort := c.Int("port")
 	userdbURL := c.String("userdbURL")
 	insecure := c.Bool("insecure")
+	priceSheetPath := c.String("pricesheet")
 
 	var err error
 	var userDB *userdb.UserDatabase
@@ -135,6 +143,15 @@ func run(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	svcContext.PriceSheet, err = commitments.LoadPriceSheet(priceSheetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("Price sheet %s does not exist. Commitment recommendations are disabled", priceSheetPath)
+	} else {
+		log.Printf("Loaded %d rates from price sheet %s", svcContext.PriceSheet.Len(), priceSheetPath)
+	}
 	svcContext.CostDB.Wait()
 	// creates the InfluxDB database if it doesn't exist
 	err = svcContext.CostDB.CreateDatabase()
@@ -187,6 +204,7 @@ func main() {
 		cli.BoolFlag{Name: "reinitialize", Usage: "Re-initialize the database"},
 		cli.IntFlag{Name: "port", Value: claudia.ApplicationPort, Usage: "Server port"},
 		cli.BoolFlag{Name: "insecure", Usage: "Run without https"},
+		cli.StringFlag{Name: "pricesheet", Value: claudia.ApplicationDir + "/pricesheet.csv", Usage: "Location of the EC2 price sheet (CSV) used for commitment recommendations"},
 	}
 	app.Action = run
 	app.Run(os.Args)
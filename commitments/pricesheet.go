@@ -0,0 +1,111 @@
+// Copyright 2017 Applatix, Inc.
+package commitments
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// Offerings of a price sheet. The rates of reservations and savings plans are effective hourly rates, which include
+// the amortized upfront fee
+const (
+	OfferingOnDemand       = "OnDemand"
+	OfferingReserved1yr    = "Reserved1yr"
+	OfferingReserved3yr    = "Reserved3yr"
+	OfferingSavingsPlan1yr = "SavingsPlan1yr"
+	OfferingSavingsPlan3yr = "SavingsPlan3yr"
+)
+
+// commitmentOfferings are the offerings which are recommended
+var commitmentOfferings = []string{OfferingReserved1yr, OfferingReserved3yr, OfferingSavingsPlan1yr, OfferingSavingsPlan3yr}
+
+// isSavingsPlan returns whether or not the offering is a savings plan, which commits to an hourly spend rather than to a
+// quantity of instances
+func isSavingsPlan(offering string) bool {
+	return offering == OfferingSavingsPlan1yr || offering == OfferingSavingsPlan3yr
+}
+
+// priceSheetColumns are the columns of a price sheet CSV file
+var priceSheetColumns = []string{"region", "instance_type", "offering", "hourly_rate"}
+
+// priceKey identifies the rate of an instance type in a region
+type priceKey struct {
+	region       string
+	instanceType string
+	offering     string
+}
+
+// PriceSheet is the hourly rates of EC2 instance types (Linux/UNIX, shared tenancy) per region and offering. Price sheets
+// are CSV files with the header: region,instance_type,offering,hourly_rate (e.g. us-west-2,m4.large,Reserved1yr,0.062)
+type PriceSheet struct {
+	rates map[priceKey]float64
+}
+
+// LoadPriceSheet loads a price sheet from a CSV file
+func LoadPriceSheet(path string) (*PriceSheet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadPriceSheet(file)
+}
+
+// ReadPriceSheet reads a price sheet in CSV format
+func ReadPriceSheet(r io.Reader) (*PriceSheet, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.InternalErrorWithMessage(err, "failed to read price sheet header")
+	}
+	indexes := make(map[string]int, len(header))
+	for i, column := range header {
+		indexes[strings.TrimSpace(column)] = i
+	}
+	for _, column := range priceSheetColumns {
+		if _, ok := indexes[column]; !ok {
+			return nil, errors.Errorf(errors.CodeInternal, "Price sheet is missing column %s", column)
+		}
+	}
+	sheet := PriceSheet{rates: make(map[priceKey]float64)}
+	for lineNum := 2; ; lineNum++ {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.InternalErrorWithMessage(err, "failed to read price sheet")
+		}
+		value := func(column string) string {
+			return strings.TrimSpace(line[indexes[column]])
+		}
+		key := priceKey{region: value("region"), instanceType: value("instance_type"), offering: value("offering")}
+		switch key.offering {
+		case OfferingOnDemand, OfferingReserved1yr, OfferingReserved3yr, OfferingSavingsPlan1yr, OfferingSavingsPlan3yr:
+		default:
+			return nil, errors.Errorf(errors.CodeInternal, "Price sheet line %d has invalid offering: %s", lineNum, key.offering)
+		}
+		rate, err := strconv.ParseFloat(value("hourly_rate"), 64)
+		if err != nil || rate < 0 {
+			return nil, errors.Errorf(errors.CodeInternal, "Price sheet line %d has invalid hourly rate: %s", lineNum, value("hourly_rate"))
+		}
+		sheet.rates[key] = rate
+	}
+	return &sheet, nil
+}
+
+// Len returns the number of rates of the price sheet
+func (ps *PriceSheet) Len() int {
+	return len(ps.rates)
+}
+
+// Rate returns the hourly rate of an instance type in a region for an offering, and whether or not the price sheet has the rate
+func (ps *PriceSheet) Rate(region, instanceType, offering string) (float64, bool) {
+	rate, ok := ps.rates[priceKey{region: region, instanceType: instanceType, offering: offering}]
+	return rate, ok
+}
@@ -0,0 +1,297 @@
+// Copyright 2017 Applatix, Inc.
+package commitments
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/parser"
+)
+
+// hoursPerMonth is the average number of hours in a month, in which estimated costs and savings are expressed
+const hoursPerMonth = 730
+
+// Recommendations are the reservations and savings plans recommended for the OnDemand usage of a lookback window
+// * From/To is the window of usage analyzed (to is exclusive), which ends at the last hour with OnDemand usage
+// * Percentile is the percentile of the hourly usage which is the steady-state baseline of each instance family and region
+// * MissingPrices are the rates which were missing from the price sheet (region, instance type and offering)
+// The most recent hours of billing reports are not yet available, and are excluded from the window
+type Recommendations struct {
+	From            time.Time         `json:"from"`
+	To              time.Time         `json:"to"`
+	LookbackDays    int               `json:"lookback_days"`
+	Percentile      float64           `json:"percentile"`
+	Recommendations []*Recommendation `json:"recommendations"`
+	MissingPrices   []string          `json:"missing_prices"`
+}
+
+// Recommendation is the purchase of a reservation or savings plan for the baseline usage of an instance family in a region.
+// Usage is measured in normalized units per hour (e.g. an hour of m4.large is 4 units), since reservations and savings
+// plans apply to every size of their instance family
+// * InstanceType and Quantity are the reservations to purchase (reservations only)
+// * NormalizedUnits are the units per hour covered by the commitment
+// * HourlyCommitment is the hourly cost of the commitment
+// * OnDemandCost is the monthly cost of the usage without the commitment, and EstimatedCost is the monthly cost with it
+// * Utilization is the percentage of the commitment which would have been used
+// Estimates assume the commitment had been purchased at the start of the window
+type Recommendation struct {
+	InstanceFamily   string  `json:"instance_family"`
+	Region           string  `json:"region"`
+	Offering         string  `json:"offering"`
+	BaselineUnits    float64 `json:"baseline_units"`
+	InstanceType     string  `json:"instance_type,omitempty"`
+	Quantity         int     `json:"quantity,omitempty"`
+	NormalizedUnits  float64 `json:"normalized_units"`
+	HourlyCommitment float64 `json:"hourly_commitment"`
+	OnDemandCost     float64 `json:"on_demand_cost"`
+	EstimatedCost    float64 `json:"estimated_cost"`
+	EstimatedSavings float64 `json:"estimated_savings"`
+	SavingsPercent   float64 `json:"savings_percent"`
+	Utilization      float64 `json:"utilization"`
+}
+
+// familyUsage is the hourly OnDemand usage of an instance family in a region, in normalized units
+// * typeUnits are the total normalized units of each instance type of the family
+type familyUsage struct {
+	family    string
+	region    string
+	hourly    map[time.Time]float64
+	typeUnits map[string]float64
+}
+
+// NormalizationFactor returns the size normalization factor of an instance type (e.g. 4 for m4.large, 16 for m4.2xlarge),
+// or 0 if the size is unknown
+func NormalizationFactor(instanceType string) float64 {
+	parts := strings.SplitN(instanceType, ".", 2)
+	if len(parts) != 2 {
+		return 0
+	}
+	switch parts[1] {
+	case "nano":
+		return 0.25
+	case "micro":
+		return 0.5
+	case "small":
+		return 1
+	case "medium":
+		return 2
+	case "large":
+		return 4
+	case "xlarge":
+		return 8
+	}
+	if multiple, err := strconv.Atoi(strings.TrimSuffix(parts[1], "xlarge")); err == nil && strings.HasSuffix(parts[1], "xlarge") && multiple > 0 {
+		return 8 * float64(multiple)
+	}
+	return 0
+}
+
+// Recommend recommends reservations and savings plans for the OnDemand instance hours of the lookback window before now.
+// Only the Linux/UNIX usage of instances with shared tenancy is analyzed, since it is the usage to which reservations apply
+// regardless of instance size. The filters (e.g. accounts, regions) restrict the usage analyzed
+func Recommend(repCtx *costdb.CostReportContext, sheet *PriceSheet, filters map[string][]string, lookbackDays int, pct float64, now time.Time) (*Recommendations, error) {
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -lookbackDays)
+	usageFilters := make(map[string][]string, len(filters)+4)
+	for columnName, values := range filters {
+		usageFilters[columnName] = values
+	}
+	usageFilters[parser.ColumnService.ColumnName] = []string{claudia.ServiceAWSEC2Instance}
+	usageFilters[parser.ColumnEC2InstancePricing.ColumnName] = []string{"OnDemand"}
+	usageFilters[parser.ColumnUsageFamily.ColumnName] = []string{"BoxUsage"}
+	usageFilters[parser.ColumnOperation.ColumnName] = []string{"RunInstances"}
+	regions, exists := filters[parser.ColumnRegion.ColumnName]
+	if !exists {
+		var err error
+		regions, err = repCtx.TagValues(parser.ColumnRegion, usageFilters)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	usage := make(map[string]*familyUsage)
+	var lastHour time.Time
+	for _, region := range regions {
+		usageFilters[parser.ColumnRegion.ColumnName] = []string{region}
+		costQuery := costdb.CostQuery{
+			Field:    parser.ColumnUsageAmount.ColumnName,
+			From:     from,
+			To:       to.AddDate(0, 0, -1),
+			GroupBy:  parser.ColumnEC2InstanceType.APIName,
+			Interval: costdb.Hour,
+			Filters:  usageFilters,
+			Location: time.UTC,
+		}
+		rows, err := repCtx.Cost(&costQuery)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			instanceType := row.Tags[parser.ColumnEC2InstanceType.ColumnName]
+			factor := NormalizationFactor(instanceType)
+			if factor == 0 {
+				log.Printf("Unknown size of instance type %s. Skipping its usage", instanceType)
+				continue
+			}
+			family := strings.SplitN(instanceType, ".", 2)[0]
+			key := region + "/" + family
+			fu, exists := usage[key]
+			if !exists {
+				fu = &familyUsage{family: family, region: region, hourly: make(map[time.Time]float64), typeUnits: make(map[string]float64)}
+				usage[key] = fu
+			}
+			for _, valueTuple := range row.Values {
+				timestamp, hours, err := costdb.ParseValueTuple(valueTuple)
+				if err != nil {
+					return nil, err
+				}
+				if hours <= 0 {
+					continue
+				}
+				fu.hourly[timestamp.UTC()] += hours * factor
+				fu.typeUnits[instanceType] += hours * factor
+				if timestamp.After(lastHour) {
+					lastHour = timestamp.UTC()
+				}
+			}
+		}
+	}
+
+	result := Recommendations{
+		From:            from,
+		To:              from,
+		LookbackDays:    lookbackDays,
+		Percentile:      pct,
+		Recommendations: make([]*Recommendation, 0),
+		MissingPrices:   make([]string, 0),
+	}
+	if lastHour.IsZero() {
+		return &result, nil
+	}
+	result.To = lastHour.Add(time.Hour)
+	numHours := int(result.To.Sub(from) / time.Hour)
+	missing := make(map[string]bool)
+	for _, fu := range usage {
+		hourly := make([]float64, numHours)
+		for timestamp, units := range fu.hourly {
+			hourly[int(timestamp.Sub(from)/time.Hour)] = units
+		}
+		sorted := make([]float64, numHours)
+		copy(sorted, hourly)
+		sort.Float64s(sorted)
+		baseline := costdb.Percentile(sorted, pct)
+		if baseline <= 0 {
+			continue
+		}
+		instanceType := fu.recommendedInstanceType(baseline)
+		factor := NormalizationFactor(instanceType)
+		onDemandRate, ok := sheet.Rate(fu.region, instanceType, OfferingOnDemand)
+		if !ok {
+			missing[fmt.Sprintf("%s %s %s", fu.region, instanceType, OfferingOnDemand)] = true
+			continue
+		}
+		for _, offering := range commitmentOfferings {
+			rate, ok := sheet.Rate(fu.region, instanceType, offering)
+			if !ok {
+				missing[fmt.Sprintf("%s %s %s", fu.region, instanceType, offering)] = true
+				continue
+			}
+			rec := Recommendation{
+				InstanceFamily: fu.family,
+				Region:         fu.region,
+				Offering:       offering,
+				BaselineUnits:  baseline,
+			}
+			if isSavingsPlan(offering) {
+				rec.NormalizedUnits = baseline
+			} else {
+				rec.InstanceType = instanceType
+				rec.Quantity = int(math.Floor(baseline / factor))
+				rec.NormalizedUnits = float64(rec.Quantity) * factor
+			}
+			if rec.NormalizedUnits <= 0 {
+				continue
+			}
+			rec.HourlyCommitment = rec.NormalizedUnits * rate / factor
+			rec.evaluate(hourly, onDemandRate/factor)
+			if rec.EstimatedSavings > 0 {
+				result.Recommendations = append(result.Recommendations, &rec)
+			}
+		}
+	}
+	for price := range missing {
+		result.MissingPrices = append(result.MissingPrices, price)
+	}
+	sort.Strings(result.MissingPrices)
+	sort.Slice(result.Recommendations, func(i, j int) bool {
+		ri, rj := result.Recommendations[i], result.Recommendations[j]
+		if ri.EstimatedSavings != rj.EstimatedSavings {
+			return ri.EstimatedSavings > rj.EstimatedSavings
+		}
+		if ri.Region != rj.Region {
+			return ri.Region < rj.Region
+		}
+		if ri.InstanceFamily != rj.InstanceFamily {
+			return ri.InstanceFamily < rj.InstanceFamily
+		}
+		return ri.Offering < rj.Offering
+	})
+	return &result, nil
+}
+
+// recommendedInstanceType returns the instance type in which reservations of the family are recommended: the type with
+// the most usage, unless it is larger than the baseline, in which case the largest type which fits in the baseline
+// (or the smallest type if none do)
+func (fu *familyUsage) recommendedInstanceType(baseline float64) string {
+	instanceTypes := make([]string, 0, len(fu.typeUnits))
+	for instanceType := range fu.typeUnits {
+		instanceTypes = append(instanceTypes, instanceType)
+	}
+	sort.Slice(instanceTypes, func(i, j int) bool {
+		if fu.typeUnits[instanceTypes[i]] != fu.typeUnits[instanceTypes[j]] {
+			return fu.typeUnits[instanceTypes[i]] > fu.typeUnits[instanceTypes[j]]
+		}
+		return instanceTypes[i] < instanceTypes[j]
+	})
+	mostUsed := instanceTypes[0]
+	if NormalizationFactor(mostUsed) <= baseline {
+		return mostUsed
+	}
+	sort.Slice(instanceTypes, func(i, j int) bool {
+		return NormalizationFactor(instanceTypes[i]) > NormalizationFactor(instanceTypes[j])
+	})
+	for _, instanceType := range instanceTypes {
+		if NormalizationFactor(instanceType) <= baseline {
+			return instanceType
+		}
+	}
+	return instanceTypes[len(instanceTypes)-1]
+}
+
+// evaluate estimates the monthly cost of the hourly usage (in normalized units) with and without the commitment, given
+// the OnDemand rate of a normalized unit. Usage up to the units of the commitment is covered by it in each hour, and the
+// remainder is charged at the OnDemand rate
+func (rec *Recommendation) evaluate(hourly []float64, onDemandUnitRate float64) {
+	var onDemandCost, estimatedCost, coveredUnits float64
+	for _, units := range hourly {
+		covered := math.Min(units, rec.NormalizedUnits)
+		coveredUnits += covered
+		onDemandCost += units * onDemandUnitRate
+		estimatedCost += rec.HourlyCommitment + (units-covered)*onDemandUnitRate
+	}
+	scale := hoursPerMonth / float64(len(hourly))
+	rec.OnDemandCost = onDemandCost * scale
+	rec.EstimatedCost = estimatedCost * scale
+	rec.EstimatedSavings = rec.OnDemandCost - rec.EstimatedCost
+	if rec.OnDemandCost > 0 {
+		rec.SavingsPercent = 100 * rec.EstimatedSavings / rec.OnDemandCost
+	}
+	rec.Utilization = 100 * coveredUnits / (rec.NormalizedUnits * float64(len(hourly)))
+}
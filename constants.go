@@ -19,6 +19,9 @@ const (
 	ServiceAWSEC2DataTransfer = "AWS EC2 Data Transfer"
 )
 
+// RetentionTierDisabled is the retention in days of a downsampling tier which is disabled. A retention of 0 days keeps data forever
+const RetentionTierDisabled = -1
+
 // Application configuration settings
 var (
 	ApplicationPort                 = 443
@@ -30,10 +33,21 @@ var (
 	IngestdWorkers                  = 2
 	IngestdBatchInterval            = 5000
 	IngestStatusMeasurementName     = "ingest_status"
+	IngestHistoryMeasurementName    = "ingest_history"
 	IngestdWriteRetryDelay          = []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 60 * time.Second, 120 * time.Second}
 	CostDatabaseURL                 = "http://costdb:8086"
 	CostDatabaseName                = "cost_usage"
 	ReportDefaultRetentionDays      = 365
+	ReportDefaultTagValueLimit      = 1000
+	ReportDefaultSeriesBudget       = 100000
+	ResourceAggregateLimit          = 5000
+	ResourceQueryPageSize           = 5000
+	NotificationDeliveryInterval    = 30 * time.Second
+	NotificationRetryDelay          = []time.Duration{1 * time.Minute, 5 * time.Minute, 15 * time.Minute, 1 * time.Hour, 4 * time.Hour}
+	NotificationDedupWindow         = 24 * time.Hour
+	ScheduleCheckInterval           = 1 * time.Minute
+	DownsampleExpiringInterval      = 6 * time.Hour
+	DownsampleExpiringDays          = 2
 )
 
 // ReportStatus is the status of a report. One of: "processing", "error", "current"
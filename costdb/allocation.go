@@ -0,0 +1,266 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Allocation methods of an allocation rule
+const (
+	AllocationMethodProportional = "proportional"
+	AllocationMethodEven         = "even"
+	AllocationMethodFixed        = "fixed"
+)
+
+// ValidAllocationMethod returns whether or not the method of an allocation rule is valid
+func ValidAllocationMethod(method string) bool {
+	switch method {
+	case AllocationMethodProportional, AllocationMethodEven, AllocationMethodFixed:
+		return true
+	}
+	return false
+}
+
+// UnallocatedName is the name of the series of shared costs which could not be allocated (e.g. no value has direct cost)
+const UnallocatedName = "Unallocated"
+
+// allocationPoolCategory is the name of the cost category used to partition costs into shared pools and direct cost
+const allocationPoolCategory = "allocation-pools"
+
+// AllocationRuleset allocates shared costs across the values of a dimension (e.g. tag:user:Team, category:BusinessUnit).
+// Costs matching the filters of a rule form its shared pool, and are only allocated by the first rule they match
+type AllocationRuleset struct {
+	Dimension string
+	Rules     []*AllocationRule
+}
+
+// AllocationRule splits the shared pool of costs matching its filters (column names to values) across values of the
+// ruleset's dimension, either proportionally to their direct cost, evenly, or by fixed percentages (weights)
+type AllocationRule struct {
+	Name    string
+	Filters map[string][]string
+	Method  string
+	Targets []string
+	Weights map[string]float64
+}
+
+// AllocatedCost is the result of a cost query with shared costs allocated. Series are the direct and allocated cost of
+// each value of the ruleset's dimension, and Allocations explain how much of each came from shared pools
+type AllocatedCost struct {
+	Series      []models.Row  `json:"series"`
+	Allocations []*Allocation `json:"allocations"`
+}
+
+// Allocation is the total direct cost of a value of the allocation dimension, and the costs allocated to it from each shared pool
+type Allocation struct {
+	Name          string             `json:"name"`
+	DirectCost    float64            `json:"direct_cost"`
+	AllocatedCost float64            `json:"allocated_cost"`
+	Pools         map[string]float64 `json:"pools"`
+}
+
+// poolCategory returns the cost category which partitions costs into the shared pool of each rule, with the remaining
+// direct costs assigned the empty value
+func (ruleset *AllocationRuleset) poolCategory() *CostCategory {
+	category := CostCategory{Name: allocationPoolCategory, Rules: make([]*CategoryRule, len(ruleset.Rules))}
+	for i, rule := range ruleset.Rules {
+		categoryRule := CategoryRule{Value: rule.Name, MatchAll: true}
+		for columnName, values := range rule.Filters {
+			categoryRule.Conditions = append(categoryRule.Conditions, &CategoryCondition{ColumnName: columnName, Operator: CategoryOperatorEquals, Values: values})
+		}
+		category.Rules[i] = &categoryRule
+	}
+	return &category
+}
+
+// shares returns the fraction of the rule's pool allocated to each value, given the total direct cost of each value.
+// Values without the dimension (the empty value) never receive allocations
+func (rule *AllocationRule) shares(directTotals map[string]float64) map[string]float64 {
+	shares := make(map[string]float64)
+	if rule.Method == AllocationMethodFixed {
+		for value, weight := range rule.Weights {
+			shares[value] = weight / 100
+		}
+		return shares
+	}
+	targets := rule.Targets
+	if len(targets) == 0 {
+		for value, total := range directTotals {
+			if value != "" && total > 0 {
+				targets = append(targets, value)
+			}
+		}
+	}
+	total := 0.0
+	for _, value := range targets {
+		total += directTotals[value]
+	}
+	for _, value := range targets {
+		if rule.Method == AllocationMethodProportional && total > 0 {
+			shares[value] = directTotals[value] / total
+		} else {
+			// Even split, which is also the fallback when no target has direct cost to be proportional to
+			shares[value] = 1 / float64(len(targets))
+		}
+	}
+	return shares
+}
+
+// AllocatedCost performs a cost query grouped by the dimension of the allocation ruleset, with the shared pool of each
+// rule allocated across the values of the dimension. Proportional shares are computed from the direct cost of each value
+// over the entire timeframe, and applied to every interval. Shared costs which cannot be allocated are returned as the
+// Unallocated series, so that the total of all series is the total cost. A filter on the dimension of the ruleset only
+// restricts the series which are returned, since shares depend on the direct cost of every value and shared pools
+// generally lack the dimension
+func (ctx *CostReportContext) AllocatedCost(params *CostQuery, ruleset *AllocationRuleset) (*AllocatedCost, error) {
+	if !params.Statistic.IsTotal() {
+		return nil, errors.New(errors.CodeBadRequest, "Statistics are not supported with cost allocation")
+	}
+	pools := ruleset.poolCategory()
+	poolCtx := *ctx
+	poolCtx.Categories = append(append([]*CostCategory{}, ctx.Categories...), pools)
+
+	directParams := *params
+	directParams.GroupBy = ruleset.Dimension
+	directParams.SeriesLimit = 0
+	directParams.SeriesOffset = 0
+	dimensionFilter := ruleset.Dimension
+	if columnName := parser.APINameToColumnName(ruleset.Dimension); columnName != nil {
+		dimensionFilter = *columnName
+	}
+	requestedValues, filtered := params.Filters[dimensionFilter]
+	directParams.Filters = make(map[string][]string, len(params.Filters)+1)
+	for columnName, filterValues := range params.Filters {
+		if columnName != dimensionFilter {
+			directParams.Filters[columnName] = filterValues
+		}
+	}
+	directParams.Filters[pools.APIName()] = []string{""}
+	directRows, err := poolCtx.Cost(&directParams)
+	if err != nil {
+		return nil, err
+	}
+	poolParams := directParams
+	poolParams.GroupBy = pools.APIName()
+	poolParams.Filters = make(map[string][]string, len(directParams.Filters))
+	for columnName, filterValues := range directParams.Filters {
+		poolParams.Filters[columnName] = filterValues
+	}
+	poolNames := make([]string, len(ruleset.Rules))
+	for i, rule := range ruleset.Rules {
+		poolNames[i] = rule.Name
+	}
+	poolParams.Filters[pools.APIName()] = poolNames
+	poolRows, err := poolCtx.Cost(&poolParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// Costs of each value by timestamp
+	costs := make(map[string]map[time.Time]float64)
+	timestamps := make(map[time.Time]bool)
+	allocations := make(map[string]*Allocation)
+	allocation := func(value string) *Allocation {
+		a, exists := allocations[value]
+		if !exists {
+			a = &Allocation{Name: value, Pools: make(map[string]float64)}
+			allocations[value] = a
+			costs[value] = make(map[time.Time]float64)
+		}
+		return a
+	}
+	directTotals := make(map[string]float64)
+	for _, row := range directRows {
+		value := rowGroupName(row)
+		a := allocation(value)
+		for _, valueTuple := range row.Values {
+			timestamp, cost, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, err
+			}
+			timestamps[timestamp] = true
+			costs[value][timestamp] += cost
+			a.DirectCost += cost
+			directTotals[value] += cost
+		}
+	}
+	rules := make(map[string]*AllocationRule, len(ruleset.Rules))
+	for _, rule := range ruleset.Rules {
+		rules[rule.Name] = rule
+	}
+	for _, row := range poolRows {
+		rule := rules[rowGroupName(row)]
+		shares := rule.shares(directTotals)
+		if len(shares) == 0 {
+			shares = map[string]float64{UnallocatedName: 1}
+		}
+		for value, share := range shares {
+			a := allocation(value)
+			for _, valueTuple := range row.Values {
+				timestamp, cost, err := ParseValueTuple(valueTuple)
+				if err != nil {
+					return nil, err
+				}
+				timestamps[timestamp] = true
+				costs[value][timestamp] += cost * share
+				a.AllocatedCost += cost * share
+				a.Pools[rule.Name] += cost * share
+			}
+		}
+	}
+
+	var sortedTimestamps timeSlice
+	for timestamp := range timestamps {
+		sortedTimestamps = append(sortedTimestamps, timestamp)
+	}
+	sort.Sort(sortedTimestamps)
+	requested := make(map[string]bool, len(requestedValues))
+	for _, value := range requestedValues {
+		requested[value] = true
+	}
+	values := make([]string, 0, len(allocations))
+	for value := range allocations {
+		if !filtered || requested[value] {
+			values = append(values, value)
+		}
+	}
+	// Series are ordered by value, with unallocated costs last
+	sort.Slice(values, func(i, j int) bool {
+		if (values[i] == UnallocatedName) != (values[j] == UnallocatedName) {
+			return values[j] == UnallocatedName
+		}
+		return strings.ToLower(values[i]) < strings.ToLower(values[j])
+	})
+	result := AllocatedCost{Series: make([]models.Row, 0, len(values)), Allocations: make([]*Allocation, 0, len(values))}
+	for _, value := range values {
+		row := models.Row{
+			Name:    ctx.measurementName,
+			Tags:    map[string]string{ruleset.Dimension: value},
+			Columns: []string{"time", "sum"},
+			Values:  make([][]interface{}, len(sortedTimestamps)),
+		}
+		for i, timestamp := range sortedTimestamps {
+			row.Values[i] = []interface{}{timestamp, costs[value][timestamp]}
+		}
+		result.Series = append(result.Series, row)
+		result.Allocations = append(result.Allocations, allocations[value])
+	}
+	if params.SeriesOffset >= len(result.Series) {
+		result.Series = result.Series[:0]
+		result.Allocations = result.Allocations[:0]
+	} else {
+		end := len(result.Series)
+		if params.SeriesLimit > 0 && params.SeriesOffset+params.SeriesLimit < end {
+			end = params.SeriesOffset + params.SeriesLimit
+		}
+		result.Series = result.Series[params.SeriesOffset:end]
+		result.Allocations = result.Allocations[params.SeriesOffset:end]
+	}
+	return &result, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+)
+
+// Anomaly detection settings
+const (
+	// anomalyBaselineDays is the trailing window of daily cost which a day is compared against
+	anomalyBaselineDays = 28
+	// anomalyEvaluationDays is the number of most recent complete days which are checked for anomalies.
+	// More than one day is evaluated since the open billing period is re-ingested with revised data
+	anomalyEvaluationDays = 3
+	// anomalyMinScore is the robust z-score (modified z-score) above which a day is anomalous
+	anomalyMinScore = 3.5
+	// anomalyMinDelta is the minimum increase of daily cost over the baseline for a day to be anomalous.
+	// This ignores relative spikes in negligible costs
+	anomalyMinDelta = 10.0
+	// anomalyMaxContributors is the maximum number of contributing dimension values recorded with an anomaly
+	anomalyMaxContributors = 5
+	// madScaleFactor scales the median absolute deviation to be a consistent estimator of the standard deviation
+	madScaleFactor = 1.4826
+)
+
+// Severities of an anomaly
+const (
+	AnomalySeverityLow    = "low"
+	AnomalySeverityMedium = "medium"
+	AnomalySeverityHigh   = "high"
+)
+
+// CostAnomaly is an unexpected spike in the daily cost of a dimension value (e.g. a single account or service)
+// * Baseline is the median daily cost over the trailing window before the day
+// * Score is the modified z-score of the cost using the median absolute deviation of the trailing window
+type CostAnomaly struct {
+	Day          time.Time
+	Dimension    string
+	Name         string
+	Cost         float64
+	Baseline     float64
+	Score        float64
+	Severity     string
+	Contributors []*AnomalyContributor
+}
+
+// AnomalyContributor is a value of a related dimension which contributed to the increase in cost of an anomaly
+type AnomalyContributor struct {
+	Dimension string  `json:"dimension"`
+	Name      string  `json:"name"`
+	Cost      float64 `json:"cost"`
+	Baseline  float64 `json:"baseline"`
+	Delta     float64 `json:"delta"`
+}
+
+// DetectAnomalies evaluates the daily cost of each value of the dimension (given by its API name, e.g. accounts) over the most
+// recent complete days, and returns any days with anomalous increases in cost. Contributors of each anomaly are broken down
+// by the contributor dimension. The last day with data is considered partially reported and is not evaluated
+func (ctx *CostReportContext) DetectAnomalies(dimension, contributorDimension string, now time.Time) ([]*CostAnomaly, error) {
+	today := truncateDay(now, time.UTC)
+	query := CostQuery{
+		GroupBy:  dimension,
+		Interval: Day,
+		From:     today.AddDate(0, 0, -(anomalyBaselineDays + anomalyEvaluationDays + 1)),
+		To:       today,
+		Filters:  make(map[string][]string),
+	}
+	rows, err := ctx.Cost(&query)
+	if err != nil {
+		return nil, err
+	}
+	series, lastDataDay, err := dailySeries(rows, time.UTC)
+	if err != nil {
+		return nil, err
+	}
+	if lastDataDay.IsZero() {
+		return nil, nil
+	}
+	anomalies := make([]*CostAnomaly, 0)
+	for name, days := range series {
+		for day := lastDataDay.AddDate(0, 0, -anomalyEvaluationDays); day.Before(lastDataDay); day = day.AddDate(0, 0, 1) {
+			baseline, score, anomalous := evaluateDay(days, day)
+			if !anomalous {
+				continue
+			}
+			anomaly := CostAnomaly{
+				Day:       day,
+				Dimension: dimension,
+				Name:      name,
+				Cost:      days[day],
+				Baseline:  baseline,
+				Score:     score,
+				Severity:  anomalySeverity(score),
+			}
+			if contributorDimension != "" {
+				anomaly.Contributors, err = ctx.anomalyContributors(&anomaly, contributorDimension)
+				if err != nil {
+					return nil, err
+				}
+			}
+			anomalies = append(anomalies, &anomaly)
+		}
+	}
+	return anomalies, nil
+}
+
+// anomalyContributors returns the values of the contributor dimension with the largest increases in cost during the day of the anomaly
+func (ctx *CostReportContext) anomalyContributors(anomaly *CostAnomaly, contributorDimension string) ([]*AnomalyContributor, error) {
+	columnName := parser.APINameToColumnName(anomaly.Dimension)
+	if columnName == nil {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Invalid dimension: %s", anomaly.Dimension)
+	}
+	query := CostQuery{
+		GroupBy:  contributorDimension,
+		Interval: Day,
+		From:     anomaly.Day.AddDate(0, 0, -anomalyBaselineDays),
+		To:       anomaly.Day,
+		Filters:  map[string][]string{*columnName: []string{anomaly.Name}},
+	}
+	rows, err := ctx.Cost(&query)
+	if err != nil {
+		return nil, err
+	}
+	series, _, err := dailySeries(rows, time.UTC)
+	if err != nil {
+		return nil, err
+	}
+	contributors := make([]*AnomalyContributor, 0)
+	for name, days := range series {
+		baseline := median(trailingValues(days, anomaly.Day))
+		delta := days[anomaly.Day] - baseline
+		if delta <= 0 {
+			continue
+		}
+		contributors = append(contributors, &AnomalyContributor{
+			Dimension: contributorDimension,
+			Name:      name,
+			Cost:      days[anomaly.Day],
+			Baseline:  baseline,
+			Delta:     delta,
+		})
+	}
+	sort.Slice(contributors, func(i, j int) bool {
+		return contributors[i].Delta > contributors[j].Delta
+	})
+	if len(contributors) > anomalyMaxContributors {
+		contributors = contributors[:anomalyMaxContributors]
+	}
+	return contributors, nil
+}
+
+// evaluateDay compares the cost of a day against the trailing window before it.
+// Returns the baseline, the modified z-score of the day, and whether or not the day is anomalous
+func evaluateDay(days map[time.Time]float64, day time.Time) (float64, float64, bool) {
+	window := trailingValues(days, day)
+	baseline := median(window)
+	deviations := make([]float64, len(window))
+	for i, value := range window {
+		deviations[i] = math.Abs(value - baseline)
+	}
+	// When costs are flat, the MAD is zero. The scale is floored to a fraction of the baseline (and to the scale at which the
+	// minimum delta scores as anomalous) so that steady or new costs which suddenly increase are still scored
+	scale := madScaleFactor * median(deviations)
+	if minScale := math.Max(0.05*baseline, anomalyMinDelta/anomalyMinScore); scale < minScale {
+		scale = minScale
+	}
+	delta := days[day] - baseline
+	if delta < anomalyMinDelta {
+		return baseline, 0, false
+	}
+	score := delta / scale
+	return baseline, score, score >= anomalyMinScore
+}
+
+// trailingValues returns the daily values of the baseline window preceding the day. Days without data count as zero cost
+func trailingValues(days map[time.Time]float64, day time.Time) []float64 {
+	values := make([]float64, anomalyBaselineDays)
+	for i := range values {
+		values[i] = days[day.AddDate(0, 0, -(i+1))]
+	}
+	return values
+}
+
+// median returns the median of the values
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// anomalySeverity returns the severity of an anomaly based on its score
+func anomalySeverity(score float64) string {
+	switch {
+	case score >= 10:
+		return AnomalySeverityHigh
+	case score >= 6:
+		return AnomalySeverityMedium
+	default:
+		return AnomalySeverityLow
+	}
+}
@@ -0,0 +1,591 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+	client "github.com/influxdata/influxdb/client/v2"
+)
+
+// ReportBackupVersion is the version of the report backup format. Version 2 added the downsampling tiers. Version 3
+// dropped the ingest status, which is derived from the ingest history, and made the attempt and assembly IDs of the
+// ingest history fields. Backups of version 1 are restored without tiers
+const ReportBackupVersion = 3
+
+// Points are exported in pages, since queries are subject to the max-row-limit of InfluxDB
+const backupPageSize = 10000
+
+// Roles of the measurements in a report backup. Measurements are identified by their role rather than their name so
+// that a backup can be restored to a different report
+const (
+	backupRoleCost          = "cost"
+	backupRoleCostDaily     = "cost_1d"
+	backupRoleCostMonthly   = "cost_1mo"
+	backupRoleResources     = "resources"
+	backupRoleReservations  = "reservations"
+	backupRoleIngestHistory = "ingest_history"
+	// backupRoleIngestStatus is only found in backups before version 3
+	backupRoleIngestStatus = "ingest_status"
+)
+
+// ReportBackupHeader is the first record of a report backup, describing the report it was taken from.
+// DailyRetention and MonthlyRetention are the retention in days of the downsampling tiers (see RetentionTiers).
+// FieldTypes are the InfluxDB field types (e.g. integer, float) of each measurement, which are needed to restore numbers
+// with their original type
+type ReportBackupHeader struct {
+	Version          int                          `json:"version"`
+	ReportID         string                       `json:"report_id"`
+	CreatedAt        time.Time                    `json:"created_at"`
+	ParserVersion    int                          `json:"parser_version"`
+	RetentionDays    int                          `json:"retention_days"`
+	DailyRetention   int                          `json:"daily_retention"`
+	MonthlyRetention int                          `json:"monthly_retention"`
+	Buckets          []ReportBackupBucket         `json:"buckets"`
+	FieldTypes       map[string]map[string]string `json:"field_types"`
+}
+
+// ReportBackupBucket is a billing bucket and report path with data in a report backup
+type ReportBackupBucket struct {
+	Bucket     string `json:"bucket"`
+	ReportPath string `json:"report_path"`
+}
+
+// backupPoint is a record of a report backup following the header
+type backupPoint struct {
+	Role   string                 `json:"m"`
+	Time   int64                  `json:"t"`
+	Tags   map[string]string      `json:"tags"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// backupMeasurement is a measurement holding data of the report
+// * where restricts a measurement shared by all reports to the points of this report
+type backupMeasurement struct {
+	role            string
+	name            string
+	fqName          string
+	retentionPolicy string
+	where           string
+}
+
+// backupMeasurements returns the measurements of the report which are included in a backup, given the retention
+// policies of the database. The downsampling tiers are only included if they are enabled
+func (ctx *CostReportContext) backupMeasurements(policies map[string]int) []backupMeasurement {
+	reportFilter := fmt.Sprintf("\"reportId\" = '%s'", ctx.ReportID)
+	measurements := []backupMeasurement{
+		{backupRoleCost, ctx.measurementName, ctx.fqMeasurementName, ctx.retentionPolicyName, ""},
+		{backupRoleResources, ctx.resourceMeasurementName, ctx.fqResourceMeasurementName, ctx.retentionPolicyName, ""},
+		{backupRoleReservations, ctx.reservationMeasurementName, ctx.fqReservationMeasurementName, ctx.retentionPolicyName, ""},
+		{backupRoleIngestHistory, claudia.IngestHistoryMeasurementName, claudia.IngestHistoryMeasurementName, "", reportFilter},
+	}
+	for i, role := range []string{backupRoleCostDaily, backupRoleCostMonthly} {
+		interval := downsampleIntervals[i]
+		if _, enabled := policies[ctx.tierRetentionPolicyName(interval)]; enabled {
+			measurements = append(measurements, backupMeasurement{role, ctx.measurementName, ctx.fqTierMeasurementName(interval), ctx.tierRetentionPolicyName(interval), ""})
+		}
+	}
+	return measurements
+}
+
+// queryEpoch performs a InfluxDB query which returns timestamps as epoch nanoseconds
+func (db *CostDatabase) queryEpoch(cmd string) ([]client.Result, error) {
+	q := client.Query{
+		Command:   cmd,
+		Database:  db.databaseName,
+		Precision: "ns",
+	}
+	response, err := db.client.Query(q)
+	if err != nil {
+		return nil, errors.InternalErrorf(err, "Query '%s' failed", cmd)
+	}
+	err = errors.InternalErrorf(response.Error(), "Query '%s' had error response", cmd)
+	if err != nil {
+		return nil, err
+	}
+	return response.Results, nil
+}
+
+// ExportBackup streams the cost data of the report, along with its ingest history, to a gzip compressed
+// backup. The backup is a sequence of JSON records, starting with a ReportBackupHeader followed by every point of the report
+func (ctx *CostReportContext) ExportBackup(w io.Writer) (*ReportBackupHeader, error) {
+	retentionDays, err := ctx.GetRetentionPolicy()
+	if err != nil {
+		return nil, err
+	}
+	policies, err := ctx.CostDB.retentionPolicies()
+	if err != nil {
+		return nil, err
+	}
+	dailyRetention, monthlyRetention, err := ctx.RetentionTiers()
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := ctx.GetReportBuckets()
+	if err != nil {
+		return nil, err
+	}
+	header := ReportBackupHeader{
+		Version:          ReportBackupVersion,
+		ReportID:         ctx.ReportID,
+		CreatedAt:        time.Now().UTC(),
+		ParserVersion:    parser.ParserVersion,
+		RetentionDays:    retentionDays,
+		DailyRetention:   dailyRetention,
+		MonthlyRetention: monthlyRetention,
+		Buckets:          make([]ReportBackupBucket, len(buckets)),
+		FieldTypes:       make(map[string]map[string]string),
+	}
+	for i, b := range buckets {
+		header.Buckets[i] = ReportBackupBucket{Bucket: b.Bucket, ReportPath: b.ReportPath}
+	}
+	measurements := ctx.backupMeasurements(policies)
+	for _, m := range measurements {
+		fieldTypes, err := ctx.CostDB.fieldTypes(m.name)
+		if err != nil {
+			return nil, err
+		}
+		header.FieldTypes[m.role] = fieldTypes
+	}
+	gzWriter := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gzWriter)
+	err = encoder.Encode(header)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	for _, m := range measurements {
+		count, err := ctx.exportMeasurement(m, encoder)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Exported %d points of %s", count, m.name)
+	}
+	err = gzWriter.Close()
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return &header, nil
+}
+
+// fieldTypes returns the field types of a measurement, keyed by field name
+func (db *CostDatabase) fieldTypes(measurementName string) (map[string]string, error) {
+	results, err := db.Query("SHOW FIELD KEYS FROM \"%s\"", measurementName)
+	if err != nil {
+		return nil, err
+	}
+	fieldTypes := make(map[string]string)
+	if len(results) == 0 || len(results[0].Series) == 0 {
+		return fieldTypes, nil
+	}
+	for _, val := range results[0].Series[0].Values {
+		fieldTypes[val[0].(string)] = val[1].(string)
+	}
+	return fieldTypes, nil
+}
+
+// tagKeys returns the set of tag keys of a measurement
+func (db *CostDatabase) tagKeys(measurementName string) (map[string]bool, error) {
+	results, err := db.Query("SHOW TAG KEYS FROM \"%s\"", measurementName)
+	if err != nil {
+		return nil, err
+	}
+	tagKeys := make(map[string]bool)
+	if len(results) == 0 || len(results[0].Series) == 0 {
+		return tagKeys, nil
+	}
+	for _, val := range results[0].Series[0].Values {
+		tagKeys[val[0].(string)] = true
+	}
+	return tagKeys, nil
+}
+
+// measurementTimeBound returns the time of the first (or last) point of a measurement matching the where clause.
+// Returns false if there are no such points
+func (ctx *CostReportContext) measurementTimeBound(fqName, where string, last bool) (time.Time, bool, error) {
+	query := fmt.Sprintf("SELECT * FROM %s", fqName)
+	if where != "" {
+		query += " WHERE " + where
+	}
+	if last {
+		query += " ORDER BY time DESC"
+	}
+	results, err := ctx.CostDB.queryEpoch(query + " LIMIT 1")
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if len(results) == 0 || len(results[0].Series) == 0 || len(results[0].Series[0].Values) == 0 {
+		return time.Time{}, false, nil
+	}
+	nanos, err := results[0].Series[0].Values[0][0].(json.Number).Int64()
+	if err != nil {
+		return time.Time{}, false, errors.InternalError(err)
+	}
+	return time.Unix(0, nanos).UTC(), true, nil
+}
+
+// exportMeasurement encodes every point of the measurement, in pages of points after the last exported timestamp.
+// Returns the number of points exported
+func (ctx *CostReportContext) exportMeasurement(m backupMeasurement, encoder *json.Encoder) (int, error) {
+	first, exists, err := ctx.measurementTimeBound(m.fqName, m.where, false)
+	if err != nil || !exists {
+		return 0, err
+	}
+	tagKeys, err := ctx.CostDB.tagKeys(m.name)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	lastSeen := first.UnixNano() - 1
+	for {
+		filter := fmt.Sprintf("time > %d", lastSeen)
+		if m.where != "" {
+			filter = m.where + " AND " + filter
+		}
+		points, err := ctx.queryBackupPoints(m, tagKeys, fmt.Sprintf("SELECT * FROM %s WHERE %s LIMIT %d", m.fqName, filter, backupPageSize))
+		if err != nil {
+			return count, err
+		}
+		if len(points) < backupPageSize {
+			n, err := encodeBackupPoints(points, encoder)
+			return count + n, err
+		}
+		// Series share timestamps, so the page may end part way through the points of its last timestamp. Those points
+		// are exported separately, and the next page starts after the timestamp
+		lastSeen = points[len(points)-1].Time
+		i := len(points)
+		for i > 0 && points[i-1].Time == lastSeen {
+			i--
+		}
+		n, err := encodeBackupPoints(points[:i], encoder)
+		count += n
+		if err != nil {
+			return count, err
+		}
+		n, err = ctx.exportTimestamp(m, tagKeys, lastSeen, encoder)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+// exportTimestamp encodes the points of the measurement at a single timestamp, which are paged by offset.
+// Returns the number of points exported
+func (ctx *CostReportContext) exportTimestamp(m backupMeasurement, tagKeys map[string]bool, timestamp int64, encoder *json.Encoder) (int, error) {
+	filter := fmt.Sprintf("time = %d", timestamp)
+	if m.where != "" {
+		filter = m.where + " AND " + filter
+	}
+	count := 0
+	for offset := 0; ; offset += backupPageSize {
+		query := fmt.Sprintf("SELECT * FROM %s WHERE %s LIMIT %d OFFSET %d", m.fqName, filter, backupPageSize, offset)
+		points, err := ctx.queryBackupPoints(m, tagKeys, query)
+		if err != nil {
+			return count, err
+		}
+		n, err := encodeBackupPoints(points, encoder)
+		count += n
+		if err != nil || len(points) < backupPageSize {
+			return count, err
+		}
+	}
+}
+
+// queryBackupPoints returns the points of a measurement returned by a query, in time order
+func (ctx *CostReportContext) queryBackupPoints(m backupMeasurement, tagKeys map[string]bool, query string) ([]backupPoint, error) {
+	results, err := ctx.CostDB.queryEpoch(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 || len(results[0].Series) == 0 {
+		return nil, nil
+	}
+	series := results[0].Series[0]
+	points := make([]backupPoint, len(series.Values))
+	for j, values := range series.Values {
+		pt := backupPoint{Role: m.role, Tags: make(map[string]string), Fields: make(map[string]interface{})}
+		for i, val := range values {
+			column := series.Columns[i]
+			if val == nil {
+				continue
+			}
+			if column == "time" {
+				pt.Time, err = val.(json.Number).Int64()
+				if err != nil {
+					return nil, errors.InternalError(err)
+				}
+			} else if tagKeys[column] {
+				pt.Tags[column] = val.(string)
+			} else {
+				pt.Fields[column] = val
+			}
+		}
+		points[j] = pt
+	}
+	return points, nil
+}
+
+// encodeBackupPoints encodes points to the backup. Returns the number of points encoded
+func encodeBackupPoints(points []backupPoint, encoder *json.Encoder) (int, error) {
+	for i := range points {
+		err := encoder.Encode(points[i])
+		if err != nil {
+			return i, errors.InternalError(err)
+		}
+	}
+	return len(points), nil
+}
+
+// isEmpty returns whether or not the report has no points in any of the measurements included in a backup
+func (ctx *CostReportContext) isEmpty() (bool, error) {
+	policies, err := ctx.CostDB.retentionPolicies()
+	if err != nil {
+		return false, err
+	}
+	for _, m := range ctx.backupMeasurements(policies) {
+		if _, exists := policies[m.retentionPolicy]; m.retentionPolicy != "" && !exists {
+			continue
+		}
+		_, exists, err := ctx.measurementTimeBound(m.fqName, m.where, false)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ImportBackup restores a report backup into this report, which may differ from the report the backup was taken from.
+// The report must not have any data, and the backup must have been ingested by the current parser version, since the
+// ingest status of the backup would otherwise prevent its billing periods from being reingested with the current format.
+// The retention policy of the report is created with the retention of the backup if it does not exist, and the
+// downsampling tiers of the backup are restored (see restoreRetentionTiers). Points which are older than the retention of
+// their retention policy are skipped, since InfluxDB would drop them
+func (ctx *CostReportContext) ImportBackup(r io.Reader) (*ReportBackupHeader, error) {
+	decoder, header, err := readBackupHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.ParserVersion != parser.ParserVersion {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Backup was ingested with parser version %d (current: %d)", header.ParserVersion, parser.ParserVersion)
+	}
+	err = ctx.CostDB.CreateDatabase()
+	if err != nil {
+		return nil, err
+	}
+	empty, err := ctx.isEmpty()
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Report %s already has data", ctx.ReportID)
+	}
+	retentionDays, err := ctx.GetRetentionPolicy()
+	if err != nil {
+		retentionDays = header.RetentionDays
+		err = ctx.CreateRetentionPolicy(retentionDays)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = ctx.restoreRetentionTiers(retentionDays, header)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := ctx.CostDB.retentionPolicies()
+	if err != nil {
+		return nil, err
+	}
+	// A retention of 0 days is an infinite retention policy
+	cutoffs := make(map[string]time.Time)
+	for name, days := range policies {
+		if days > 0 {
+			cutoffs[name] = time.Now().AddDate(0, 0, -days)
+		}
+	}
+
+	measurements := make(map[string]backupMeasurement)
+	batches := make(map[string]client.BatchPoints)
+	for _, m := range ctx.backupMeasurements(policies) {
+		measurements[m.role] = m
+		bp, err := ctx.NewBatchPoints()
+		if err != nil {
+			return nil, err
+		}
+		bp.SetRetentionPolicy(m.retentionPolicy)
+		batches[m.role] = bp
+	}
+	flush := func(role string) error {
+		bp := batches[role]
+		if len(bp.Points()) == 0 {
+			return nil
+		}
+		err := ctx.CostDB.Write(bp)
+		if err != nil {
+			return err
+		}
+		bp, err = ctx.NewBatchPoints()
+		if err != nil {
+			return err
+		}
+		bp.SetRetentionPolicy(measurements[role].retentionPolicy)
+		batches[role] = bp
+		return nil
+	}
+	imported := 0
+	skipped := 0
+	for {
+		var pt backupPoint
+		err = decoder.Decode(&pt)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.InternalErrorf(err, "Invalid backup record")
+		}
+		m, ok := measurements[pt.Role]
+		if !ok && pt.Role == backupRoleIngestStatus {
+			// The ingest status is derived from the ingest history
+			continue
+		}
+		if !ok && (pt.Role == backupRoleCostDaily || pt.Role == backupRoleCostMonthly) {
+			// The tier could not be restored
+			skipped++
+			continue
+		}
+		if !ok {
+			return nil, errors.Errorf(errors.CodeBadRequest, "Unknown measurement in backup: %s", pt.Role)
+		}
+		timestamp := time.Unix(0, pt.Time)
+		if m.retentionPolicy != "" && timestamp.Before(cutoffs[m.retentionPolicy]) {
+			skipped++
+			continue
+		}
+		if _, ok := pt.Tags["reportId"]; ok {
+			pt.Tags["reportId"] = ctx.ReportID
+		}
+		if pt.Role == backupRoleIngestHistory && header.Version < 3 {
+			for _, key := range []string{"attemptId", "assemblyId"} {
+				if val, ok := pt.Tags[key]; ok {
+					pt.Fields[key] = val
+					delete(pt.Tags, key)
+				}
+			}
+		}
+		for field, val := range pt.Fields {
+			pt.Fields[field], err = restoreFieldValue(header.FieldTypes[pt.Role][field], val)
+			if err != nil {
+				return nil, err
+			}
+		}
+		point, err := client.NewPoint(m.name, pt.Tags, pt.Fields, timestamp)
+		if err != nil {
+			return nil, errors.InternalError(err)
+		}
+		batches[pt.Role].AddPoint(point)
+		imported++
+		if len(batches[pt.Role].Points()) >= claudia.IngestdBatchInterval {
+			err = flush(pt.Role)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for role := range batches {
+		err = flush(role)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Imported %d points into report %s (%d points outside retention skipped)", imported, ctx.ReportID, skipped)
+	return header, nil
+}
+
+// restoreRetentionTiers enables the downsampling tiers of a backup which are disabled in the report, with the retention
+// of the backup. Tiers which are enabled in the report keep their retention. As with the tier settings of a report, a
+// tier is only restored if it is retained longer than the data it is downsampled from
+func (ctx *CostReportContext) restoreRetentionTiers(retentionDays int, header *ReportBackupHeader) error {
+	dailyDays, monthlyDays, err := ctx.RetentionTiers()
+	if err != nil {
+		return err
+	}
+	tiers := []int{dailyDays, monthlyDays}
+	finerDays := retentionDays
+	restored := false
+	for i, days := range []int{header.DailyRetention, header.MonthlyRetention} {
+		if tiers[i] == claudia.RetentionTierDisabled && days != claudia.RetentionTierDisabled {
+			if finerDays != 0 && (days == 0 || days > finerDays) {
+				tiers[i] = days
+				restored = true
+			} else {
+				log.Printf("Skipping %s tier of backup: retention %s is not longer than the data it is downsampled from", downsampleIntervals[i], retentionDuration(days))
+			}
+		}
+		if tiers[i] != claudia.RetentionTierDisabled {
+			finerDays = tiers[i]
+		}
+	}
+	if !restored {
+		return nil
+	}
+	_, err = ctx.UpdateRetentionTiers(tiers[0], tiers[1])
+	return err
+}
+
+// ReadBackupHeader reads the header of a report backup
+func ReadBackupHeader(r io.Reader) (*ReportBackupHeader, error) {
+	_, header, err := readBackupHeader(r)
+	return header, err
+}
+
+// readBackupHeader decodes the header of a report backup, and returns the decoder positioned at the first point
+func readBackupHeader(r io.Reader) (*json.Decoder, *ReportBackupHeader, error) {
+	gzReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, errors.InternalError(err)
+	}
+	decoder := json.NewDecoder(gzReader)
+	decoder.UseNumber()
+	var header ReportBackupHeader
+	err = decoder.Decode(&header)
+	if err != nil {
+		return nil, nil, errors.InternalErrorf(err, "Invalid backup header")
+	}
+	switch header.Version {
+	case ReportBackupVersion, 2:
+	case 1:
+		header.DailyRetention = claudia.RetentionTierDisabled
+		header.MonthlyRetention = claudia.RetentionTierDisabled
+	default:
+		return nil, nil, errors.Errorf(errors.CodeBadRequest, "Unsupported backup version: %d", header.Version)
+	}
+	return decoder, &header, nil
+}
+
+// restoreFieldValue converts a JSON decoded field value to the value of its InfluxDB field type
+func restoreFieldValue(fieldType string, val interface{}) (interface{}, error) {
+	num, isNumber := val.(json.Number)
+	if !isNumber {
+		return val, nil
+	}
+	var converted interface{}
+	var err error
+	if fieldType == "integer" {
+		converted, err = num.Int64()
+	} else {
+		converted, err = num.Float64()
+	}
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return converted, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// BudgetSpend is the spend of the current budget period (a month or quarter of the query's fiscal calendar)
+// * Actual is the spend incurred so far in the period
+// * Forecast is the projected total spend of the period, including the actual spend
+type BudgetSpend struct {
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Actual      float64   `json:"actual"`
+	Forecast    float64   `json:"forecast"`
+}
+
+// BudgetSpend returns the actual and forecasted spend of the budget period (Month or Quarter) containing now, of the costs
+// matching the query's filters. The query's time zone and fiscal calendar are honored, while its timeframe, interval and grouping are ignored.
+// The forecast of a quarter is the actual spend of its past months, and the month-end forecasts of its current and remaining months
+func (ctx *CostReportContext) BudgetSpend(params *CostQuery, period Interval, now time.Time) (*BudgetSpend, error) {
+	if period != Month && period != Quarter {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Invalid budget period: %s", period)
+	}
+	loc := params.location()
+	truncatePeriod := params.Calendar.truncateFunc(period, loc, params.WeekStart)
+	truncateMonth := params.Calendar.truncateFunc(Month, loc, params.WeekStart)
+	today := truncateDay(now, loc)
+	spend := BudgetSpend{PeriodStart: truncatePeriod(today)}
+	spend.PeriodEnd = nextPeriodStart(spend.PeriodStart, truncatePeriod)
+
+	query := *params
+	query.GroupBy = ""
+	query.Interval = ""
+	query.Aggregator = ""
+	query.Statistic = ""
+	query.SeriesLimit = 0
+	query.SeriesOffset = 0
+	query.From = spend.PeriodStart
+	query.To = today
+	rows, err := ctx.Cost(&query)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for _, valueTuple := range row.Values {
+			_, value, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, err
+			}
+			spend.Actual += value
+		}
+	}
+
+	// Spend of the months of the period which precede the current month are actuals
+	monthStart := truncateMonth(today)
+	horizon := 0
+	for month := nextPeriodStart(monthStart, truncateMonth); month.Before(spend.PeriodEnd); month = nextPeriodStart(month, truncateMonth) {
+		horizon++
+	}
+	if monthStart.After(spend.PeriodStart) {
+		query.To = monthStart.AddDate(0, 0, -1)
+		rows, err = ctx.Cost(&query)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			for _, valueTuple := range row.Values {
+				_, value, err := ParseValueTuple(valueTuple)
+				if err != nil {
+					return nil, err
+				}
+				spend.Forecast += value
+			}
+		}
+	}
+	query.From = time.Time{}
+	query.To = time.Time{}
+	forecast, err := ctx.Forecast(&query, now, horizon)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range forecast.Forecasts {
+		for _, p := range f.Periods {
+			spend.Forecast += p.Forecast
+		}
+	}
+	// The forecast does not trust partially reported days as actuals, which may have exceeded their projections
+	if spend.Forecast < spend.Actual {
+		spend.Forecast = spend.Actual
+	}
+	return &spend, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"time"
+)
+
+// FiscalCalendar describes the fiscal year of a report, used when rolling up costs into months, quarters and years
+// * StartMonth is the month in which the fiscal year begins (e.g. February). Defaults to January
+// * Periods is an optional week pattern of the three fiscal periods in each quarter (e.g. [4, 4, 5] for a 4-4-5 calendar).
+//   When set, fiscal years begin on the week start day nearest to the first of StartMonth and the Month interval
+//   rolls up into fiscal periods instead of calendar months. A 53rd week is added to the last period of the year.
+type FiscalCalendar struct {
+	StartMonth time.Month
+	Periods    []int
+}
+
+// startMonth returns the month in which the fiscal year begins, defaulting to January
+func (cal *FiscalCalendar) startMonth() time.Month {
+	if cal == nil || cal.StartMonth < time.January || cal.StartMonth > time.December {
+		return time.January
+	}
+	return cal.StartMonth
+}
+
+// isWeekBased returns whether fiscal periods are made up of whole weeks (e.g. 4-4-5) instead of calendar months
+func (cal *FiscalCalendar) isWeekBased() bool {
+	return cal != nil && len(cal.Periods) > 0
+}
+
+// truncateDay returns the start of the day of t in the given time zone
+func truncateDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// truncateWeek returns the start of the week of t in the given time zone, with weeks beginning on weekStart
+func truncateWeek(t time.Time, loc *time.Location, weekStart time.Weekday) time.Time {
+	day := truncateDay(t, loc)
+	daysSinceStart := (int(day.Weekday()) - int(weekStart) + 7) % 7
+	return day.AddDate(0, 0, -daysSinceStart)
+}
+
+// truncateMonth returns the start of the month of t in the given time zone
+func truncateMonth(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+}
+
+// truncateQuarter returns the start of the fiscal quarter of t in the given time zone
+func (cal *FiscalCalendar) truncateQuarter(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	monthsSinceStart := (int(t.Month()) - int(cal.startMonth()) + 12) % 12
+	// time.Date normalizes months outside of the range 1-12 into the previous year
+	return time.Date(t.Year(), t.Month()-time.Month(monthsSinceStart%3), 1, 0, 0, 0, 0, loc)
+}
+
+// truncateYear returns the start of the fiscal year of t in the given time zone
+func (cal *FiscalCalendar) truncateYear(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	year := t.Year()
+	if t.Month() < cal.startMonth() {
+		year--
+	}
+	return time.Date(year, cal.startMonth(), 1, 0, 0, 0, 0, loc)
+}
+
+// weekBasedYearStart returns the start of the week based fiscal year which is labeled by the calendar year in which it begins.
+// This is the week start day nearest to the first of the fiscal start month
+func (cal *FiscalCalendar) weekBasedYearStart(year int, loc *time.Location, weekStart time.Weekday) time.Time {
+	first := time.Date(year, cal.startMonth(), 1, 0, 0, 0, 0, loc)
+	start := truncateWeek(first, loc, weekStart)
+	if daysIntoWeek := (int(first.Weekday()) - int(weekStart) + 7) % 7; daysIntoWeek > 3 {
+		// The first of the month falls in the second half of the week, so the following week start is nearer
+		start = start.AddDate(0, 0, 7)
+	}
+	return start
+}
+
+// truncateWeekBased returns the start of the fiscal period, quarter or year of t (depending on interval) in a week based fiscal calendar
+func (cal *FiscalCalendar) truncateWeekBased(t time.Time, loc *time.Location, weekStart time.Weekday, interval Interval) time.Time {
+	day := truncateDay(t, loc)
+	yearStart := cal.weekBasedYearStart(day.Year(), loc, weekStart)
+	if day.Before(yearStart) {
+		yearStart = cal.weekBasedYearStart(day.Year()-1, loc, weekStart)
+	} else if nextYearStart := cal.weekBasedYearStart(day.Year()+1, loc, weekStart); !day.Before(nextYearStart) {
+		yearStart = nextYearStart
+	}
+	if interval == Year {
+		return yearStart
+	}
+	// Calendar days are counted using UTC dates so that daylight saving transitions do not affect the count
+	utcDay := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	utcYearStart := time.Date(yearStart.Year(), yearStart.Month(), yearStart.Day(), 0, 0, 0, 0, time.UTC)
+	weeksSinceStart := int(utcDay.Sub(utcYearStart).Hours()/24) / 7
+
+	// Determine the starting week of every period of the year. Any week beyond the last period (i.e. the 53rd week)
+	// belongs to the last period of the year.
+	periodStartWeeks := make([]int, 0, 4*len(cal.Periods))
+	week := 0
+	for quarter := 0; quarter < 4; quarter++ {
+		for _, periodWeeks := range cal.Periods {
+			periodStartWeeks = append(periodStartWeeks, week)
+			week += periodWeeks
+		}
+	}
+	period := 0
+	for i, startWeek := range periodStartWeeks {
+		if weeksSinceStart >= startWeek {
+			period = i
+		}
+	}
+	if interval == Quarter {
+		period -= period % len(cal.Periods)
+	}
+	return yearStart.AddDate(0, 0, 7*periodStartWeeks[period])
+}
+
+// truncateFunc returns a function which maps a timestamp to the start of the month, quarter or year it belongs to in the fiscal calendar
+func (cal *FiscalCalendar) truncateFunc(interval Interval, loc *time.Location, weekStart time.Weekday) func(time.Time) time.Time {
+	if cal.isWeekBased() {
+		return func(t time.Time) time.Time { return cal.truncateWeekBased(t, loc, weekStart, interval) }
+	}
+	switch interval {
+	case Quarter:
+		return func(t time.Time) time.Time { return cal.truncateQuarter(t, loc) }
+	case Year:
+		return func(t time.Time) time.Time { return cal.truncateYear(t, loc) }
+	default:
+		return func(t time.Time) time.Time { return truncateMonth(t, loc) }
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/influxdata/influxdb/models"
+)
+
+// CategoryPrefix prefixes the dimension name of a cost category (e.g. category:BusinessUnit)
+const CategoryPrefix = "category:"
+
+// Operators of the conditions of a cost category. Conditions with multiple values match if any value matches
+// (or for not_equals, if no value matches)
+const (
+	CategoryOperatorEquals     = "equals"
+	CategoryOperatorNotEquals  = "not_equals"
+	CategoryOperatorStartsWith = "starts_with"
+	CategoryOperatorContains   = "contains"
+)
+
+// CostCategory is a virtual dimension of a report whose values are assigned by ordered rules over the existing dimensions.
+// Costs are assigned the value of the first rule they match, or the default value if none match. Categories are evaluated
+// at query time by translating category values into filters, so they apply to all data without reingest
+type CostCategory struct {
+	Name         string
+	Rules        []*CategoryRule
+	DefaultValue string
+}
+
+// CategoryRule assigns a value of a cost category to costs matching any (or all) of its conditions
+type CategoryRule struct {
+	Value      string
+	MatchAll   bool
+	Conditions []*CategoryCondition
+}
+
+// CategoryCondition compares a column (e.g. lineItem/UsageAccountId, resourceTags/user:Team) to values using an operator
+type CategoryCondition struct {
+	ColumnName string
+	Operator   string
+	Values     []string
+}
+
+// ValidCategoryOperator returns whether or not the operator of a cost category condition is valid
+func ValidCategoryOperator(operator string) bool {
+	switch operator {
+	case CategoryOperatorEquals, CategoryOperatorNotEquals, CategoryOperatorStartsWith, CategoryOperatorContains:
+		return true
+	}
+	return false
+}
+
+// APIName returns the dimension name of the category
+func (c *CostCategory) APIName() string {
+	return CategoryPrefix + c.Name
+}
+
+// Values returns the distinct values of the category, in order of its rules, followed by the default value
+func (c *CostCategory) Values() []string {
+	values := make([]string, 0, len(c.Rules)+1)
+	seen := make(map[string]bool)
+	for _, rule := range append(c.Rules, &CategoryRule{Value: c.DefaultValue}) {
+		if !seen[rule.Value] {
+			seen[rule.Value] = true
+			values = append(values, rule.Value)
+		}
+	}
+	return values
+}
+
+// filterExpression returns the InfluxDB expression matching costs assigned to any of the given category values.
+// Since InfluxQL has no NOT operator, the rules preceding a rule are excluded using their negated expressions
+func (c *CostCategory) filterExpression(values []string) (string, error) {
+	expressions := make([]string, 0)
+	for _, value := range values {
+		matched := false
+		for i, rule := range c.Rules {
+			if rule.Value != value {
+				continue
+			}
+			ruleExpressions := []string{rule.expression(false)}
+			for _, preceding := range c.Rules[:i] {
+				ruleExpressions = append(ruleExpressions, preceding.expression(true))
+			}
+			expressions = append(expressions, "("+strings.Join(ruleExpressions, " AND ")+")")
+			matched = true
+		}
+		if value == c.DefaultValue {
+			defaultExpressions := make([]string, len(c.Rules))
+			for i, rule := range c.Rules {
+				defaultExpressions[i] = rule.expression(true)
+			}
+			expressions = append(expressions, "("+strings.Join(defaultExpressions, " AND ")+")")
+			matched = true
+		}
+		if !matched {
+			return "", errors.Errorf(errors.CodeBadRequest, "Cost category %s has no value %s", c.Name, value)
+		}
+	}
+	return "(" + strings.Join(expressions, " OR ") + ")", nil
+}
+
+// expression returns the InfluxDB expression of the rule, or its negation
+func (rule *CategoryRule) expression(negate bool) string {
+	expressions := make([]string, len(rule.Conditions))
+	for i, cond := range rule.Conditions {
+		expressions[i] = cond.expression(negate)
+	}
+	// By De Morgan's laws, the negation of an expression which matches all conditions matches any negated condition
+	operator := " OR "
+	if rule.MatchAll != negate {
+		operator = " AND "
+	}
+	return "(" + strings.Join(expressions, operator) + ")"
+}
+
+// expression returns the InfluxDB expression of the condition, or its negation. A series without the tag of the
+// condition compares as an empty value
+func (cond *CategoryCondition) expression(negate bool) string {
+	if cond.Operator == CategoryOperatorNotEquals {
+		negate = !negate
+	}
+	expressions := make([]string, len(cond.Values))
+	for i, value := range cond.Values {
+		switch cond.Operator {
+		case CategoryOperatorStartsWith, CategoryOperatorContains:
+			pattern := regexp.QuoteMeta(value)
+			if cond.Operator == CategoryOperatorStartsWith {
+				pattern = "^" + pattern
+			}
+			pattern = strings.Replace(pattern, "/", "\\/", -1)
+			if negate {
+				expressions[i] = fmt.Sprintf("\"%s\" !~ /%s/", cond.ColumnName, pattern)
+			} else {
+				expressions[i] = fmt.Sprintf("\"%s\" =~ /%s/", cond.ColumnName, pattern)
+			}
+		default:
+			if negate {
+				expressions[i] = fmt.Sprintf("\"%s\" != '%s'", cond.ColumnName, escapeSingleQuote(value))
+			} else {
+				expressions[i] = fmt.Sprintf("\"%s\" = '%s'", cond.ColumnName, escapeSingleQuote(value))
+			}
+		}
+	}
+	operator := " OR "
+	if negate {
+		operator = " AND "
+	}
+	return "(" + strings.Join(expressions, operator) + ")"
+}
+
+// category returns the cost category of the report with the given dimension name (e.g. category:BusinessUnit), or nil
+func (ctx *CostReportContext) category(dimension string) *CostCategory {
+	if !strings.HasPrefix(dimension, CategoryPrefix) {
+		return nil
+	}
+	for _, category := range ctx.Categories {
+		if category.APIName() == dimension {
+			return category
+		}
+	}
+	return nil
+}
+
+// costByCategory performs a cost query grouped by a cost category, by performing the query filtered to each value of the
+// category. Values without cost are omitted. The page of series is selected from the values of the category
+func (ctx *CostReportContext) costByCategory(params *CostQuery, category *CostCategory) ([]models.Row, error) {
+	rows := make([]models.Row, 0)
+	for _, value := range category.Values() {
+		if filterValues, ok := params.Filters[category.APIName()]; ok && !containsString(filterValues, value) {
+			continue
+		}
+		valueParams := *params
+		valueParams.GroupBy = ""
+		valueParams.SeriesLimit = 0
+		valueParams.SeriesOffset = 0
+		valueParams.Filters = make(map[string][]string, len(params.Filters)+1)
+		for columnName, filterValues := range params.Filters {
+			valueParams.Filters[columnName] = filterValues
+		}
+		valueParams.Filters[category.APIName()] = []string{value}
+		valueRows, err := ctx.Cost(&valueParams)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range valueRows {
+			row.Tags = map[string]string{category.APIName(): value}
+			rows = append(rows, row)
+		}
+	}
+	if params.SeriesOffset >= len(rows) {
+		return make([]models.Row, 0), nil
+	}
+	rows = rows[params.SeriesOffset:]
+	if params.SeriesLimit > 0 && params.SeriesLimit < len(rows) {
+		rows = rows[:params.SeriesLimit]
+	}
+	return rows, nil
+}
+
+// getCategoryDimension returns the values of a cost category as a dimension
+func (ctx *CostReportContext) getCategoryDimension(dimension string) (*Dimension, error) {
+	category := ctx.category(dimension)
+	if category == nil {
+		return nil, errors.Errorf(errors.CodeNotFound, "Cost category %s does not exist", strings.TrimPrefix(dimension, CategoryPrefix))
+	}
+	values := category.Values()
+	dimValues := make([]*Dimension, len(values))
+	for i, value := range values {
+		dimValues[i] = &Dimension{value, value, nil, nil}
+	}
+	return &Dimension{category.Name, category.APIName(), nil, dimValues}, nil
+}
+
+// containsString returns whether or not the slice contains the string
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"math"
+	"sort"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/influxdata/influxdb/models"
+)
+
+// CostComparison is the total cost of a group in the current period compared to its total in a comparison period
+// * PercentChange is nil if there was no cost in the comparison period
+type CostComparison struct {
+	Dimension     string   `json:"dimension,omitempty"`
+	Name          string   `json:"name"`
+	DisplayName   string   `json:"display_name"`
+	Current       float64  `json:"current"`
+	Comparison    float64  `json:"comparison"`
+	Delta         float64  `json:"delta"`
+	PercentChange *float64 `json:"percent_change"`
+}
+
+// CompareCost performs the current query and the comparison query and returns the change of each group, sorted by the largest movers.
+// Both queries are expected to have the same filters and grouping, and no interval
+func (ctx *CostReportContext) CompareCost(current, comparison *CostQuery) ([]*CostComparison, error) {
+	if current.Interval != "" || comparison.Interval != "" {
+		return nil, errors.New(errors.CodeBadRequest, "Interval is not supported when comparing costs")
+	}
+	currentRows, err := ctx.Cost(current)
+	if err != nil {
+		return nil, err
+	}
+	comparisonRows, err := ctx.Cost(comparison)
+	if err != nil {
+		return nil, err
+	}
+	currentTotals, err := groupTotals(currentRows)
+	if err != nil {
+		return nil, err
+	}
+	comparisonTotals, err := groupTotals(comparisonRows)
+	if err != nil {
+		return nil, err
+	}
+	comparisons := make([]*CostComparison, 0)
+	for name, total := range currentTotals {
+		comparisons = append(comparisons, newCostComparison(current.GroupBy, name, total, comparisonTotals[name]))
+	}
+	for name, total := range comparisonTotals {
+		if _, exists := currentTotals[name]; !exists {
+			comparisons = append(comparisons, newCostComparison(current.GroupBy, name, 0, total))
+		}
+	}
+	sort.Slice(comparisons, func(i, j int) bool {
+		deltaI := math.Abs(comparisons[i].Delta)
+		deltaJ := math.Abs(comparisons[j].Delta)
+		if deltaI != deltaJ {
+			return deltaI > deltaJ
+		}
+		return comparisons[i].Name < comparisons[j].Name
+	})
+	return comparisons, nil
+}
+
+func newCostComparison(dimension, name string, current, comparison float64) *CostComparison {
+	c := CostComparison{
+		Dimension:   dimension,
+		Name:        name,
+		DisplayName: name,
+		Current:     current,
+		Comparison:  comparison,
+		Delta:       current - comparison,
+	}
+	if comparison != 0 {
+		percentChange := c.Delta / comparison * 100
+		c.PercentChange = &percentChange
+	}
+	return &c
+}
+
+// groupTotals returns the total of each series in the rows of a cost query, keyed by the value of the group by column.
+// A query without grouping returns a single series which is keyed by the empty string
+func groupTotals(rows []models.Row) (map[string]float64, error) {
+	totals := make(map[string]float64)
+	for _, row := range rows {
+		name := rowGroupName(row)
+		for _, valueTuple := range row.Values {
+			_, value, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, err
+			}
+			totals[name] += value
+		}
+	}
+	return totals, nil
+}
@@ -31,14 +31,24 @@ type CostReportContext struct {
 	measurementName     string
 	fqMeasurementName   string
 	retentionPolicyName string
+	// resource measurement stores the daily cost of each resource (see ResourceAggregator)
+	resourceMeasurementName   string
+	fqResourceMeasurementName string
+	// reservation measurement stores the daily usage and monthly fees of each reservation (see ReservationAggregator)
+	reservationMeasurementName   string
+	fqReservationMeasurementName string
+	// Categories are the cost categories of the report, which can be grouped by and filtered on like dimensions
+	Categories []*CostCategory
 }
 
 // Interval when aggregating data
 const (
-	Hour  Interval = "1h"
-	Day   Interval = "1d"
-	Week  Interval = "1w"
-	Month Interval = "1M"
+	Hour    Interval = "1h"
+	Day     Interval = "1d"
+	Week    Interval = "1w"
+	Month   Interval = "1M"
+	Quarter Interval = "1Q"
+	Year    Interval = "1Y"
 )
 
 // Interval is a time interval used for grouping cost queries
@@ -55,6 +65,10 @@ func ParseInterval(intervalString string) (Interval, error) {
 		return Week, nil
 	case "1M":
 		return Month, nil
+	case "1Q":
+		return Quarter, nil
+	case "1Y":
+		return Year, nil
 	default:
 		return "", fmt.Errorf("Invalid interval: %s", intervalString)
 	}
@@ -66,15 +80,51 @@ func ParseInterval(intervalString string) (Interval, error) {
 // * From/To is the timeframe in which to perform the query
 // * GroupBy is the column name in which to group the query by
 // * Filters will is a mapping of column names to values in which to filter by
+// * Location is the time zone in which interval boundaries are computed (defaults to UTC)
+// * WeekStart is the day of the week in which weekly intervals begin (defaults to Sunday)
+// * Calendar is the fiscal calendar used for monthly, quarterly and yearly intervals (defaults to calendar year)
+// * SeriesLimit/SeriesOffset selects a page of the series of a grouped query (a zero limit returns all series)
+// * Statistic is the statistic of the hourly sums computed within each interval (defaults to the sum of the interval)
 type CostQuery struct {
-	Aggregator string
-	Field      string
-	From       time.Time
-	To         time.Time
-	GroupBy    string
-	Interval   Interval
-	Blended    bool
-	Filters    map[string][]string
+	Aggregator   string
+	Field        string
+	From         time.Time
+	To           time.Time
+	GroupBy      string
+	Interval     Interval
+	Blended      bool
+	Filters      map[string][]string
+	Location     *time.Location
+	WeekStart    time.Weekday
+	Calendar     *FiscalCalendar
+	SeriesLimit  int
+	SeriesOffset int
+	Statistic    Statistic
+}
+
+// location returns the time zone of the query, defaulting to UTC
+func (params *CostQuery) location() *time.Location {
+	if params.Location == nil {
+		return time.UTC
+	}
+	return params.Location
+}
+
+// maxIntervalQueries is the maximum number of intervals of a cost query which is performed once per interval (see costPerInterval)
+const maxIntervalQueries = 1000
+
+// wholeHourOffset returns whether or not the offset of a time zone from UTC is a whole number of hours at the start and end
+// of a timeframe, and at present. Hourly buckets can only be rolled up into the days of such time zones
+func wholeHourOffset(loc *time.Location, from, to time.Time) bool {
+	for _, t := range []time.Time{from, to, time.Now()} {
+		if t.IsZero() {
+			continue
+		}
+		if _, offset := t.In(loc).Zone(); offset%3600 != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 // NewCostDatabase returns a CostDatabase instance
@@ -154,12 +204,20 @@ func (db *CostDatabase) NewCostReportContext(reportID string) *CostReportContext
 	measurementName := fmt.Sprintf("report_%s", reportID)
 	retentionPolicyName := fmt.Sprintf("rtn_%s", reportID)
 	fqMeasurementName := fmt.Sprintf(`%s."%s"."%s"`, db.databaseName, retentionPolicyName, measurementName)
+	resourceMeasurementName := fmt.Sprintf("resources_%s", reportID)
+	fqResourceMeasurementName := fmt.Sprintf(`%s."%s"."%s"`, db.databaseName, retentionPolicyName, resourceMeasurementName)
+	reservationMeasurementName := fmt.Sprintf("reservations_%s", reportID)
+	fqReservationMeasurementName := fmt.Sprintf(`%s."%s"."%s"`, db.databaseName, retentionPolicyName, reservationMeasurementName)
 	return &CostReportContext{
-		CostDB:              db,
-		ReportID:            reportID,
-		measurementName:     measurementName,
-		fqMeasurementName:   fqMeasurementName,
-		retentionPolicyName: retentionPolicyName,
+		CostDB:                       db,
+		ReportID:                     reportID,
+		measurementName:              measurementName,
+		fqMeasurementName:            fqMeasurementName,
+		retentionPolicyName:          retentionPolicyName,
+		resourceMeasurementName:      resourceMeasurementName,
+		fqResourceMeasurementName:    fqResourceMeasurementName,
+		reservationMeasurementName:   reservationMeasurementName,
+		fqReservationMeasurementName: fqReservationMeasurementName,
 	}
 }
 
@@ -183,7 +241,7 @@ func (ctx *CostReportContext) NewBatchPoints() (client.BatchPoints, error) {
 // TagValues return tag values of a particular column. Filters are mapping from column name to value
 func (ctx *CostReportContext) TagValues(column parser.Column, filters map[string][]string) ([]string, error) {
 	query := fmt.Sprintf("SHOW TAG VALUES FROM %s WITH KEY=\"%s\"", ctx.fqMeasurementName, column.ColumnName)
-	filterQuery, err := constructFilterQuery(filters)
+	filterQuery, err := ctx.constructFilterQuery(filters)
 	if err != nil {
 		return nil, err
 	}
@@ -205,9 +263,22 @@ func (ctx *CostReportContext) TagValues(column parser.Column, filters map[string
 	return tagValues, nil
 }
 
-func constructFilterQuery(filters map[string][]string) ([]string, error) {
+// constructFilterQuery returns the InfluxDB expressions of filters, which map column names (or cost category dimension names) to values
+func (ctx *CostReportContext) constructFilterQuery(filters map[string][]string) ([]string, error) {
 	queries := make([]string, 0)
 	for columnName, filterValues := range filters {
+		if strings.HasPrefix(columnName, CategoryPrefix) {
+			category := ctx.category(columnName)
+			if category == nil {
+				return nil, errors.Errorf(errors.CodeBadRequest, "Cost category %s does not exist", strings.TrimPrefix(columnName, CategoryPrefix))
+			}
+			expression, err := category.filterExpression(filterValues)
+			if err != nil {
+				return nil, err
+			}
+			queries = append(queries, expression)
+			continue
+		}
 		column := parser.GetColumnByName(columnName)
 		if column == nil && !strings.HasPrefix(columnName, "resourceTags") {
 			return nil, errors.Errorf(errors.CodeBadRequest, "Column %s does not exist", columnName)
@@ -223,7 +294,17 @@ func constructFilterQuery(filters map[string][]string) ([]string, error) {
 }
 
 // Cost perform a cost query
+// If the result of the query is too large to be returned by InfluxDB in a single response, the query is performed in chunks
+// of series (and of time, if a single series is too large) which are merged, so that the result is always complete.
+// When SeriesLimit is set, only a page of the series (starting at SeriesOffset) is returned.
+// Queries of timeframes beyond the retention of the hourly data are performed against the downsampling tiers (see costMeasurement)
 func (ctx *CostReportContext) Cost(params *CostQuery) ([]models.Row, error) {
+	if !params.Statistic.IsTotal() {
+		return ctx.costStatistic(params)
+	}
+	if category := ctx.category(params.GroupBy); category != nil {
+		return ctx.costByCategory(params, category)
+	}
 	var field string
 	if params.Field == "" {
 		field = parser.ColumnUnblendedCost.ColumnName
@@ -236,81 +317,365 @@ func (ctx *CostReportContext) Cost(params *CostQuery) ([]models.Row, error) {
 	} else {
 		selector = fmt.Sprintf(params.Aggregator, field)
 	}
-	query := fmt.Sprintf("SELECT %s FROM %s", selector, ctx.fqMeasurementName)
 
-	filters := make([]string, 0)
+	var from, to time.Time
 	if !params.From.IsZero() {
-		filters = append(filters, fmt.Sprintf("time >= '%s'", params.From.Format(time.RFC3339)))
+		from = params.From
 	}
 	if !params.To.IsZero() {
 		// NOTE: the API only accepts date ranges (i.e. not at the time/hour level). The date ranges are
 		// inclusive to the entire end date (e.g. 2017-01-01 to 2017-01-31 should include data from 1/31).
 		// To achieve this, add one day to the 'To' param, truncate any time information, and use the '<' operator to InfluxDB.
-		toDate := time.Date(params.To.Year(), params.To.Month(), params.To.Day(), 0, 0, 0, 0, params.To.Location()).Add(24 * time.Hour)
-		filters = append(filters, fmt.Sprintf("time < '%s'", toDate.Format(time.RFC3339)))
+		// AddDate is used instead of adding 24 hours so that the end date is correct across daylight saving transitions.
+		to = time.Date(params.To.Year(), params.To.Month(), params.To.Day(), 0, 0, 0, 0, params.To.Location()).AddDate(0, 0, 1)
 	}
-	filterQuery, err := constructFilterQuery(params.Filters)
+	measurement, err := ctx.costMeasurement(params, field, from, to)
 	if err != nil {
 		return nil, err
 	}
-	if len(filterQuery) > 0 {
-		filters = append(filters, filterQuery...)
-	} else {
+	filterQuery, err := ctx.constructFilterQuery(params.Filters)
+	if err != nil {
+		return nil, err
+	}
+	if len(filterQuery) == 0 {
 		// This will remove any zero value rows from query
 		switch field {
 		case parser.ColumnUnblendedCost.ColumnName, parser.ColumnBlendedCost.ColumnName, parser.ColumnUsageAmount.ColumnName:
-			filters = append(filters, fmt.Sprintf("\"%s\" > 0", field))
+			filterQuery = append(filterQuery, fmt.Sprintf("\"%s\" > 0", field))
 		}
 	}
-	if len(filters) > 0 {
-		query += " WHERE " + strings.Join(filters, " AND ")
-	}
 
 	groupings := make([]string, 0)
 	// Handle groupings (e.g. account, product, etc...)
+	var groupByColumn string
 	if params.GroupBy != "" {
 		columnName := parser.APINameToColumnName(params.GroupBy)
 		if columnName == nil {
 			return nil, errors.Errorf(errors.CodeBadRequest, "Invalid group by: %s", params.GroupBy)
 		}
-		groupings = append(groupings, "\""+*columnName+"\"")
+		groupByColumn = *columnName
+		groupings = append(groupings, "\""+groupByColumn+"\"")
 	}
 	// Handle interval
-	monthlyRollup := false
+	// InfluxDB can only group by fixed durations relative to the epoch (in UTC). Whenever the interval boundaries
+	// cannot be expressed this way (months, quarters, years, or days/weeks in a time zone other than UTC), we query at a finer
+	// granularity and perform the roll up ourselves.
+	loc := params.location()
+	var rollUpFunc func(time.Time) time.Time
 	if params.Interval != "" {
-		if params.Interval == Month {
-			// For monthly interval, need to perform roll up ourselves since InfluxDB does not support it
-			groupings = append(groupings, fmt.Sprintf("time(%s)", Day))
-			monthlyRollup = true
-		} else if params.Interval == Week {
-			// Weekly groupings need offset for dates to start on Sunday
-			// See: https://github.com/influxdata/influxdb/pull/387
-			groupings = append(groupings, fmt.Sprintf("time(%s, 3d)", Week))
-		} else {
+		switch params.Interval {
+		case Hour:
+			groupings = append(groupings, fmt.Sprintf("time(%s)", Hour))
+		case Day:
+			if loc == time.UTC {
+				groupings = append(groupings, fmt.Sprintf("time(%s)", Day))
+			} else {
+				groupings = append(groupings, fmt.Sprintf("time(%s)", Hour))
+				rollUpFunc = func(t time.Time) time.Time { return truncateDay(t, loc) }
+			}
+		case Week:
+			if loc == time.UTC {
+				// InfluxDB weekly groupings start on Thursday (the epoch, 1970-01-01, was a Thursday) and need
+				// an offset for weeks to start on the desired day (e.g. 3d for Sunday).
+				// See: https://github.com/influxdata/influxdb/pull/387
+				offsetDays := (int(params.WeekStart) - int(time.Thursday) + 7) % 7
+				if offsetDays == 0 {
+					groupings = append(groupings, fmt.Sprintf("time(%s)", Week))
+				} else {
+					groupings = append(groupings, fmt.Sprintf("time(%s, %dd)", Week, offsetDays))
+				}
+			} else {
+				groupings = append(groupings, fmt.Sprintf("time(%s)", Hour))
+				rollUpFunc = func(t time.Time) time.Time { return truncateWeek(t, loc, params.WeekStart) }
+			}
+		case Month, Quarter, Year:
+			// For monthly, quarterly and yearly intervals, need to perform roll up ourselves since InfluxDB does not support it
+			if loc == time.UTC {
+				groupings = append(groupings, fmt.Sprintf("time(%s)", Day))
+			} else {
+				groupings = append(groupings, fmt.Sprintf("time(%s)", Hour))
+			}
+			rollUpFunc = params.Calendar.truncateFunc(params.Interval, loc, params.WeekStart)
+		default:
 			groupings = append(groupings, fmt.Sprintf("time(%s)", params.Interval))
 		}
 	}
-	if len(groupings) > 0 {
-		query += " GROUP BY " + strings.Join(groupings, ",")
+	// Aggregates such as distinct counts cannot be added together across the buckets which are rolled up, and hourly
+	// buckets do not align with the days of a time zone whose offset is not a whole number of hours. These queries are
+	// performed once per interval instead
+	perInterval := rollUpFunc != nil && (params.Aggregator != "" || (loc != time.UTC && !wholeHourOffset(loc, from, to)))
+	if perInterval && groupByColumn != "" {
+		groupings = []string{"\"" + groupByColumn + "\""}
+	} else if perInterval {
+		groupings = nil
+	}
+
+	chunk := costQueryChunk{
+		build: func(c costQueryChunk) string {
+			query := fmt.Sprintf("SELECT %s FROM %s", selector, measurement)
+			filters := make([]string, 0)
+			if !c.from.IsZero() {
+				filters = append(filters, fmt.Sprintf("time >= '%s'", c.from.UTC().Format(time.RFC3339)))
+			}
+			if !c.to.IsZero() {
+				filters = append(filters, fmt.Sprintf("time < '%s'", c.to.UTC().Format(time.RFC3339)))
+			}
+			filters = append(filters, filterQuery...)
+			if c.pinned {
+				// The series of an empty group value is selected with an empty string, which matches points without the tag
+				filters = append(filters, fmt.Sprintf("\"%s\"='%s'", groupByColumn, escapeSingleQuote(c.series)))
+			}
+			if len(filters) > 0 {
+				query += " WHERE " + strings.Join(filters, " AND ")
+			}
+			if len(groupings) > 0 {
+				query += " GROUP BY " + strings.Join(groupings, ",")
+			}
+			query += " fill(0)"
+			if c.limit > 0 {
+				query += fmt.Sprintf(" SLIMIT %d SOFFSET %d", c.limit, c.offset)
+			}
+			return query
+		},
+		from:    from,
+		to:      to,
+		grouped: groupByColumn != "",
+		limit:   params.SeriesLimit,
+		offset:  params.SeriesOffset,
+	}
+	if perInterval {
+		return ctx.costPerInterval(chunk, measurement, loc, rollUpFunc)
+	}
+	rows, err := ctx.queryChunked(chunk)
+	if err != nil {
+		return nil, err
+	}
+	if rollUpFunc != nil {
+		err := rollUp(rows, rollUpFunc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// queryInterval is an interval of a cost query which is performed once per interval. The interval starts at key, and its
+// timeframe (from/to) is limited to the timeframe of the query
+type queryInterval struct {
+	key  time.Time
+	from time.Time
+	to   time.Time
+}
+
+// costPerInterval performs a cost query, which is not grouped by time, once for each interval of the query. Intervals
+// always start on a day in the time zone of the query, so the timeframe is divided wherever the truncate function maps
+// consecutive days to different intervals. A timeframe without a start or end is bounded by the data of the measurement.
+// Returns a series per group with a value for every interval (zero where the group has no data), ordered by group
+func (ctx *CostReportContext) costPerInterval(chunk costQueryChunk, measurement string, loc *time.Location, truncate func(time.Time) time.Time) ([]models.Row, error) {
+	from, to := chunk.from, chunk.to
+	if from.IsZero() || to.IsZero() {
+		first, exists, err := ctx.measurementTimeBound(measurement, "", false)
+		if err != nil || !exists {
+			return nil, err
+		}
+		last, _, err := ctx.measurementTimeBound(measurement, "", true)
+		if err != nil {
+			return nil, err
+		}
+		if from.IsZero() {
+			from = first
+		}
+		if to.IsZero() {
+			to = last.Add(time.Hour)
+		}
+	}
+	intervals := make([]queryInterval, 0)
+	for day := truncateDay(from, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		key := truncate(day)
+		if len(intervals) > 0 && intervals[len(intervals)-1].key.Equal(key) {
+			continue
+		}
+		if len(intervals) > 0 {
+			intervals[len(intervals)-1].to = day
+		}
+		intervalFrom := day
+		if intervalFrom.Before(from) {
+			intervalFrom = from
+		}
+		intervals = append(intervals, queryInterval{key: key, from: intervalFrom, to: to})
+		if len(intervals) > maxIntervalQueries {
+			return nil, errors.Errorf(errors.CodeBadRequest, "Query spans more than %d intervals. Reduce the time range or increase the interval", maxIntervalQueries)
+		}
 	}
-	query += " fill(0)"
+	log.Printf("Querying %d intervals individually", len(intervals))
+	rows := make([]models.Row, 0)
+	index := make(map[string]int)
+	for i, interval := range intervals {
+		c := chunk
+		c.from = interval.from
+		c.to = interval.to
+		c.limit = 0
+		c.offset = 0
+		intervalRows, err := ctx.queryChunked(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range intervalRows {
+			if len(row.Values) == 0 {
+				continue
+			}
+			_, value, err := ParseValueTuple(row.Values[0])
+			if err != nil {
+				return nil, err
+			}
+			name := rowGroupName(row)
+			j, exists := index[name]
+			if !exists {
+				j = len(rows)
+				index[name] = j
+				values := make([][]interface{}, len(intervals))
+				for k := range intervals {
+					values[k] = []interface{}{intervals[k].key, 0.0}
+				}
+				rows = append(rows, models.Row{Name: row.Name, Tags: row.Tags, Columns: row.Columns, Values: values})
+			}
+			rows[j].Values[i][1] = value
+		}
+	}
+	// Series are ordered by group as InfluxDB orders them, and paged after every interval is known
+	sort.Slice(rows, func(i, j int) bool { return rowGroupName(rows[i]) < rowGroupName(rows[j]) })
+	if chunk.offset >= len(rows) {
+		return rows[:0], nil
+	}
+	end := len(rows)
+	if chunk.limit > 0 && chunk.offset+chunk.limit < end {
+		end = chunk.offset + chunk.limit
+	}
+	return rows[chunk.offset:end], nil
+}
+
+// costQueryChunk is a portion of a cost query: a page of its series, a single series, and/or a portion of its timeframe
+// * build returns the InfluxDB query of the chunk
+// * from/to is the timeframe of the chunk (to is exclusive)
+// * grouped indicates if the query is grouped by a column (i.e. returns multiple series)
+// * limit/offset is the page of series of the chunk (limit of zero indicates all series)
+// * pinned indicates if the chunk is a single series, whose value of the group by column (possibly empty) is series
+type costQueryChunk struct {
+	build   func(costQueryChunk) string
+	from    time.Time
+	to      time.Time
+	grouped bool
+	limit   int
+	offset  int
+	pinned  bool
+	series  string
+}
+
+// queryChunked performs a chunk of a cost query. If InfluxDB truncated the result due to reaching max-row-limit,
+// the chunk is split into pages of the number of series which fit in a single result. If a single series does not fit,
+// its timeframe is split in half. The results of the split chunks are merged
+func (ctx *CostReportContext) queryChunked(chunk costQueryChunk) ([]models.Row, error) {
+	query := chunk.build(chunk)
 	log.Println("Query: ", query)
 	res, err := ctx.CostDB.Query(query)
 	if err != nil {
 		return nil, err
 	}
 	rows := res[0].Series
-	if len(rows) > 0 && rows[len(rows)-1].Partial {
-		// The partial flag indicates if InfluxDB truncated the result due to reaching max-row-limit (tuned to: 20000)
+	if len(rows) == 0 || !rows[len(rows)-1].Partial {
+		return rows, nil
+	}
+	// The partial flag indicates if InfluxDB truncated the result due to reaching max-row-limit (tuned to: 20000)
+	truncated := rows[len(rows)-1]
+	log.Printf("Query returned partial result after %d series. Splitting query", len(rows))
+	if chunk.grouped && !chunk.pinned && chunk.limit != 1 {
+		// Page through the series, using the number of complete series which were returned as the page size
+		pageSize := len(rows) - 1
+		if pageSize < 1 {
+			pageSize = 1
+		}
+		merged := make([]models.Row, 0)
+		for offset := chunk.offset; chunk.limit == 0 || offset < chunk.offset+chunk.limit; offset += pageSize {
+			page := chunk
+			page.offset = offset
+			page.limit = pageSize
+			if chunk.limit > 0 && offset+pageSize > chunk.offset+chunk.limit {
+				page.limit = chunk.offset + chunk.limit - offset
+			}
+			pageRows, err := ctx.queryChunked(page)
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, pageRows...)
+			if len(pageRows) < page.limit {
+				break
+			}
+		}
+		return merged, nil
+	}
+	// A single series is too large. Split its timeframe in half (on an hour boundary, the smallest interval)
+	if chunk.from.IsZero() || chunk.to.IsZero() || chunk.to.Sub(chunk.from) < 2*time.Hour {
 		return nil, errors.New(errors.CodeForbidden, "Query returned too many data points. Apply additional filters, increase interval, or reduce time range")
 	}
-	if monthlyRollup {
-		err := rollUpMonthly(rows)
-		if err != nil {
-			return nil, err
+	if chunk.grouped && !chunk.pinned {
+		// Pin the series by its value, since the page of series of each half of the timeframe may differ
+		chunk.pinned = true
+		chunk.series = rowGroupName(truncated)
+		chunk.limit = 0
+		chunk.offset = 0
+	}
+	mid := chunk.from.Add(chunk.to.Sub(chunk.from) / 2).Truncate(time.Hour)
+	first := chunk
+	first.to = mid
+	second := chunk
+	second.from = mid
+	firstRows, err := ctx.queryChunked(first)
+	if err != nil {
+		return nil, err
+	}
+	secondRows, err := ctx.queryChunked(second)
+	if err != nil {
+		return nil, err
+	}
+	return mergeSeriesRows(firstRows, secondRows)
+}
+
+// mergeSeriesRows merges the rows of consecutive timeframes of the same query. Values of a series which share the
+// same timestamp (i.e. an interval which spans both timeframes) are summed
+func mergeSeriesRows(first, second []models.Row) ([]models.Row, error) {
+	merged := make([]models.Row, 0, len(first))
+	index := make(map[string]int)
+	for _, row := range first {
+		index[rowGroupName(row)] = len(merged)
+		merged = append(merged, row)
+	}
+	for _, row := range second {
+		i, exists := index[rowGroupName(row)]
+		if !exists {
+			index[rowGroupName(row)] = len(merged)
+			merged = append(merged, row)
+			continue
+		}
+		values := merged[i].Values
+		for _, valueTuple := range row.Values {
+			if len(values) > 0 && values[len(values)-1][0] == valueTuple[0] {
+				_, prevValue, err := ParseValueTuple(values[len(values)-1])
+				if err != nil {
+					return nil, err
+				}
+				_, value, err := ParseValueTuple(valueTuple)
+				if err != nil {
+					return nil, err
+				}
+				values[len(values)-1] = []interface{}{valueTuple[0], prevValue + value}
+				continue
+			}
+			values = append(values, valueTuple)
 		}
+		merged[i].Values = values
+		merged[i].Partial = false
 	}
-	return rows, nil
+	return merged, nil
 }
 
 // To support sorting by timestamps
@@ -320,7 +685,8 @@ func (s timeSlice) Less(i, j int) bool { return s[i].Before(s[j]) }
 func (s timeSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s timeSlice) Len() int           { return len(s) }
 
-// Helper to mutate the rows by rolling up Values of time series into logical monthly time boundaries
+// Helper to mutate the rows by rolling up Values of time series into logical time boundaries (e.g. months).
+// The truncate function maps the timestamp of each value to the start of the interval it belongs to
 // models.Row has the following example datastructure
 //[
 //  {
@@ -346,38 +712,34 @@ func (s timeSlice) Len() int           { return len(s) }
 //    ]
 //  }
 //]
-func rollUpMonthly(rows []models.Row) error {
-	log.Println("Rolling up monthly")
+func rollUp(rows []models.Row, truncate func(time.Time) time.Time) error {
+	log.Println("Rolling up intervals")
 	for i, row := range rows {
-		var monthlyTotals = make(map[time.Time]float64)
+		var intervalTotals = make(map[time.Time]float64)
 		for _, valueTuple := range row.Values {
-			timestamp, err := time.Parse(time.RFC3339, valueTuple[0].(string))
+			timestamp, value, err := ParseValueTuple(valueTuple)
 			if err != nil {
-				return errors.InternalError(err)
+				return err
 			}
-			tsTruncated := time.Date(timestamp.Year(), timestamp.Month(), 1, 0, 0, 0, 0, timestamp.Location())
-			value, err := valueTuple[1].(json.Number).Float64()
-			if err != nil {
-				return errors.InternalError(err)
-			}
-			prevValue, exists := monthlyTotals[tsTruncated]
+			tsTruncated := truncate(timestamp)
+			prevValue, exists := intervalTotals[tsTruncated]
 			if !exists {
-				monthlyTotals[tsTruncated] = value
+				intervalTotals[tsTruncated] = value
 			} else {
-				monthlyTotals[tsTruncated] = prevValue + value
+				intervalTotals[tsTruncated] = prevValue + value
 			}
 		}
-		// Get months in sorted order
+		// Get intervals in sorted order
 		var keys timeSlice
-		for k := range monthlyTotals {
+		for k := range intervalTotals {
 			keys = append(keys, k)
 		}
 		sort.Sort(keys)
 
-		rows[i].Values = make([][]interface{}, len(monthlyTotals))
-		for j, monthTs := range keys {
-			monthTotal, _ := monthlyTotals[monthTs]
-			tuple := []interface{}{monthTs, monthTotal}
+		rows[i].Values = make([][]interface{}, len(intervalTotals))
+		for j, intervalTs := range keys {
+			intervalTotal, _ := intervalTotals[intervalTs]
+			tuple := []interface{}{intervalTs, intervalTotal}
 			rows[i].Values[j] = tuple
 		}
 	}
@@ -427,21 +789,23 @@ func (ctx *CostReportContext) DeleteReportData() error {
 	if err != nil {
 		return err
 	}
-	_, err = ctx.CostDB.Query("DROP MEASUREMENT \"%s\"", ctx.measurementName)
-	if err != nil {
-		// Influx sdk does not provide a constant for measurement not found
-		origErr := errors.Cause(err)
-		if strings.Contains(strings.ToLower(origErr.Error()), "measurement not found") {
-			return nil
+	for _, measurementName := range []string{ctx.measurementName, ctx.resourceMeasurementName, ctx.reservationMeasurementName} {
+		_, err = ctx.CostDB.Query("DROP MEASUREMENT \"%s\"", measurementName)
+		if err != nil {
+			// Influx sdk does not provide a constant for measurement not found
+			origErr := errors.Cause(err)
+			if !strings.Contains(strings.ToLower(origErr.Error()), "measurement not found") {
+				return err
+			}
 		}
 	}
-	return err
+	return nil
 }
 
 // DeleteReportBillingBucketData deletes all report data for a specific billing bucket/report path
 func (ctx *CostReportContext) DeleteReportBillingBucketData(bucketname, reportPath string) error {
 	log.Printf("Deleting report data for %s (bucket: %s, reportPath: %s)", ctx.measurementName, bucketname, reportPath)
-	err := ctx.DeleteBillingBucketHistory(bucketname, reportPath)
+	err := ctx.InvalidateBillingBucketIngests(bucketname, reportPath)
 	if err != nil {
 		// Influx sdk does not provide a constant for db not found
 		origErr := errors.Cause(err)
@@ -450,8 +814,8 @@ func (ctx *CostReportContext) DeleteReportBillingBucketData(bucketname, reportPa
 		}
 		return err
 	}
-	_, err = ctx.CostDB.Query("DROP SERIES FROM \"%s\" WHERE \"%s\"='%s' AND \"%s\"='%s'",
-		ctx.measurementName,
+	_, err = ctx.CostDB.Query("DROP SERIES FROM \"%s\",\"%s\",\"%s\" WHERE \"%s\"='%s' AND \"%s\"='%s'",
+		ctx.measurementName, ctx.resourceMeasurementName, ctx.reservationMeasurementName,
 		parser.ColumnBillingBucket.ColumnName, bucketname,
 		parser.ColumnBillingReportPath.ColumnName, escapeSingleQuote(reportPath))
 	return err
@@ -460,8 +824,8 @@ func (ctx *CostReportContext) DeleteReportBillingBucketData(bucketname, reportPa
 // PurgeBillingPeriodSeries will drop data points corresponding to the given billing period
 // This is desired for when current month's data needs to be replaced (new report is generated)
 func (ctx *CostReportContext) PurgeBillingPeriodSeries(bucketname, reportPath, billingPeriod string) error {
-	_, err := ctx.CostDB.Query("DROP SERIES FROM \"%s\" WHERE \"%s\"='%s' AND \"%s\"='%s' AND \"%s\"='%s'",
-		ctx.measurementName,
+	_, err := ctx.CostDB.Query("DROP SERIES FROM \"%s\",\"%s\",\"%s\" WHERE \"%s\"='%s' AND \"%s\"='%s' AND \"%s\"='%s'",
+		ctx.measurementName, ctx.resourceMeasurementName, ctx.reservationMeasurementName,
 		parser.ColumnBillingBucket.ColumnName, bucketname,
 		parser.ColumnBillingReportPath.ColumnName, escapeSingleQuote(reportPath),
 		parser.ColumnBillingPeriod.ColumnName, billingPeriod)
@@ -477,13 +841,28 @@ func (ctx *CostReportContext) CreateRetentionPolicy(days int) error {
 
 // GetRetentionPolicy gets the retention policy for this report in days
 func (ctx *CostReportContext) GetRetentionPolicy() (int, error) {
-	res, err := ctx.CostDB.Query("SHOW RETENTION POLICIES ON \"%s\"", ctx.CostDB.databaseName)
+	policies, err := ctx.CostDB.retentionPolicies()
 	if err != nil {
 		return -1, err
 	}
-	if len(res) == 0 || len(res[0].Series) == 0 {
+	days, exists := policies[ctx.retentionPolicyName]
+	if !exists {
 		return -1, errors.Errorf("No retention policy found for report %s", ctx.ReportID)
 	}
+	return days, nil
+}
+
+// retentionPolicies returns the duration in days of every retention policy of the database, keyed by name.
+// A duration of 0 days is an infinite retention policy
+func (db *CostDatabase) retentionPolicies() (map[string]int, error) {
+	res, err := db.Query("SHOW RETENTION POLICIES ON \"%s\"", db.databaseName)
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[string]int)
+	if len(res) == 0 || len(res[0].Series) == 0 {
+		return policies, nil
+	}
 	row := res[0].Series[0]
 	durationIndex := -1
 	nameIndex := -1
@@ -496,23 +875,19 @@ func (ctx *CostReportContext) GetRetentionPolicy() (int, error) {
 		}
 	}
 	for _, val := range row.Values {
-		retentionPolicyName := val[nameIndex]
-		if retentionPolicyName == ctx.retentionPolicyName {
-			durationString := val[durationIndex].(string) // (e.g. 8760h0m0s)
-			var tomlDuration toml.Duration
-			err = tomlDuration.UnmarshalText([]byte(durationString))
-			if err != nil {
-				return -1, errors.InternalError(err)
-			}
-			durationDays := int(time.Duration(tomlDuration).Hours() / 24)
-			return durationDays, nil
+		durationString := val[durationIndex].(string) // (e.g. 8760h0m0s)
+		var tomlDuration toml.Duration
+		err = tomlDuration.UnmarshalText([]byte(durationString))
+		if err != nil {
+			return nil, errors.InternalError(err)
 		}
+		policies[val[nameIndex].(string)] = int(time.Duration(tomlDuration).Hours() / 24)
 	}
-	return -1, errors.Errorf("No retention policy found for report %s", ctx.ReportID)
+	return policies, nil
 }
 
 // UpdateRetentionPolicy updates the retention policy for this report.
-// If retention is increased, it purges ingest_status history during the the increased duration time period
+// If retention is increased, it invalidates the ingest status of billing periods during the the increased duration time period
 func (ctx *CostReportContext) UpdateRetentionPolicy(days int) (bool, error) {
 	existingRetention, err := ctx.GetRetentionPolicy()
 	if err != nil {
@@ -526,8 +901,9 @@ func (ctx *CostReportContext) UpdateRetentionPolicy(days int) (bool, error) {
 			if err != nil {
 				return false, err
 			}
-			// Delete ingest status for any buckets occurring during the increased time period.
-			// This will force (re)processing of the buckets
+			// Invalidate the ingest status of any billing periods occurring during the increased time period.
+			// This will force (re)processing of the billing periods
+			expired := make([]*IngestStatus, 0)
 			for _, ingStatus := range ingestStatuses {
 				parts := strings.Split(ingStatus.BillingPeriod, "-")
 				billingPeriodStart, err := time.Parse("20060102", parts[0])
@@ -544,21 +920,18 @@ func (ctx *CostReportContext) UpdateRetentionPolicy(days int) (bool, error) {
 					continue
 				} else if billingPeriodEnd.Before(prevCutoff) {
 					// The entire time range of this billing report occurs before previous cutoff
-					// and would have been expired by retention. Delete status in case we need to reprocess
-					log.Printf("Billing report %s %s expired. Deleting status", ingStatus.BillingPeriod, ingStatus.AssemblyID)
-					err = ctx.DeleteAssemblyIngestHistory(ingStatus.AssemblyID)
-					if err != nil {
-						return false, err
-					}
+					// and would have been expired by retention. Invalidate status in case we need to reprocess
+					log.Printf("Billing report %s %s expired. Invalidating status", ingStatus.BillingPeriod, ingStatus.AssemblyID)
 				} else {
 					// If we get here, this billing report occurs within the time frame of the previous cutoff
 					// and it's data was partially expired. The report needs to be reingested
-					log.Printf("Billing report %s %s partially expired. Deleting status", ingStatus.BillingPeriod, ingStatus.AssemblyID)
-					err = ctx.DeleteAssemblyIngestHistory(ingStatus.AssemblyID)
-					if err != nil {
-						return false, err
-					}
+					log.Printf("Billing report %s %s partially expired. Invalidating status", ingStatus.BillingPeriod, ingStatus.AssemblyID)
 				}
+				expired = append(expired, ingStatus)
+			}
+			err = ctx.InvalidateIngests(expired)
+			if err != nil {
+				return false, err
 			}
 		}
 		_, err := ctx.CostDB.Query("ALTER RETENTION POLICY \"%s\" ON \"%s\" DURATION %dd REPLICATION 1",
@@ -571,10 +944,15 @@ func (ctx *CostReportContext) UpdateRetentionPolicy(days int) (bool, error) {
 	return false, nil
 }
 
-// DropRetentionPolicy deletes the retention policy for this report
+// DropRetentionPolicy deletes the retention policy for this report, along with the retention policies of its downsampling tiers
 func (ctx *CostReportContext) DropRetentionPolicy() error {
-	_, err := ctx.CostDB.Query("DROP RETENTION POLICY \"%s\" ON \"%s\"", ctx.retentionPolicyName, ctx.CostDB.databaseName)
-	return err
+	for _, retentionPolicyName := range []string{ctx.retentionPolicyName, ctx.tierRetentionPolicyName(Day), ctx.tierRetentionPolicyName(Month)} {
+		_, err := ctx.CostDB.Query("DROP RETENTION POLICY \"%s\" ON \"%s\"", retentionPolicyName, ctx.CostDB.databaseName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Close underlying client
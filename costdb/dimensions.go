@@ -31,6 +31,9 @@ func (ctx *CostReportContext) GetDimension(dimension string, filters map[string]
 	case "resourcetags":
 		return ctx.GetResourceTagDimension(filters)
 	}
+	if strings.HasPrefix(dimension, CategoryPrefix) {
+		return ctx.getCategoryDimension(dimension)
+	}
 	column := parser.APINameToColumn(dimension)
 	if column == nil {
 		return nil, fmt.Errorf("Dimension %s does not exist", dimension)
@@ -205,3 +208,74 @@ func (ctx *CostReportContext) GetResourceTagDimension(filters map[string][]strin
 	rtDimension := Dimension{"Resource Tags", "resourcetags", nil, tagDimensions}
 	return &rtDimension, nil
 }
+
+// RootDimensionNames are the dimensions at the root of the dimension tree of a report
+var RootDimensionNames = []string{
+	parser.ColumnUsageAccountID.APIName,
+	parser.ColumnRegion.APIName,
+	"resourcetags",
+	parser.ColumnService.APIName,
+}
+
+// GetDimensionTree returns the unfiltered root dimensions of the report, including the dimensions of every service.
+// This is expensive as it performs several queries per service, so the tree is built once after ingest and snapshotted
+func (ctx *CostReportContext) GetDimensionTree() ([]*Dimension, error) {
+	tree := make([]*Dimension, len(RootDimensionNames))
+	for i, dimName := range RootDimensionNames {
+		dimension, err := ctx.GetDimension(dimName, nil)
+		if err != nil {
+			return nil, err
+		}
+		tree[i] = dimension
+	}
+	return tree, nil
+}
+
+// CanFilterDimensionTree returns whether or not a root dimension with the given filters can be computed from the unfiltered
+// dimension tree. This is possible when all filters are on the dimension's own column, since filtering then only prunes
+// its values. Resource tags are only computable without filters, since a filter on one tag affects the values of the others
+func CanFilterDimensionTree(dimension string, filters map[string][]string) bool {
+	var columnName string
+	switch dimension {
+	case parser.ColumnUsageAccountID.APIName, parser.ColumnRegion.APIName, parser.ColumnService.APIName:
+		columnName = parser.APINameToColumn(dimension).ColumnName
+	case "resourcetags":
+	default:
+		return false
+	}
+	for filterColumnName := range filters {
+		if filterColumnName != columnName {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterDimensionTree returns a root dimension from the unfiltered dimension tree, with its values pruned to the filters.
+// The filters are expected to have been checked with CanFilterDimensionTree. Returns nil if the dimension is not in the tree
+func FilterDimensionTree(tree []*Dimension, dimension string, filters map[string][]string) *Dimension {
+	for _, dim := range tree {
+		if dim.Name != dimension {
+			continue
+		}
+		if len(filters) == 0 {
+			return dim
+		}
+		var allowed map[string]bool
+		for _, filterValues := range filters {
+			allowed = make(map[string]bool)
+			for _, val := range filterValues {
+				allowed[val] = true
+			}
+		}
+		pruned := *dim
+		pruned.Dimensions = make([]*Dimension, 0)
+		for _, subdim := range dim.Dimensions {
+			if allowed[subdim.Name] {
+				pruned.Dimensions = append(pruned.Dimensions, subdim)
+			}
+		}
+		return &pruned
+	}
+	return nil
+}
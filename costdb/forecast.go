@@ -0,0 +1,323 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Forecast settings
+const (
+	// ForecastMaxHorizon is the maximum number of months beyond the current month which can be forecasted
+	ForecastMaxHorizon = 12
+	// forecastTrainingDays is the number of days of complete history the forecast is fitted to (8 full weeks)
+	forecastTrainingDays = 56
+	// forecastZScore is the z-score of the confidence bounds (95%)
+	forecastZScore = 1.96
+)
+
+// Forecast is the projected spend of a group for the current month and the months following it
+type Forecast struct {
+	Dimension   string            `json:"dimension,omitempty"`
+	Name        string            `json:"name"`
+	DisplayName string            `json:"display_name"`
+	Periods     []*ForecastPeriod `json:"periods"`
+}
+
+// ForecastPeriod is the projected spend of a single month
+// * Actual is the spend already incurred during the month (only non-zero for the current month)
+// * Forecast is the projected total spend of the month, including the actual spend
+// * Lower/Upper are the confidence bounds of the projected total spend
+type ForecastPeriod struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Actual   float64   `json:"actual"`
+	Forecast float64   `json:"forecast"`
+	Lower    float64   `json:"lower"`
+	Upper    float64   `json:"upper"`
+}
+
+// ForecastResult is the result of a forecast
+// * DataThrough is the start of the first day which was not used as actual spend. Days on or after it are forecasted
+type ForecastResult struct {
+	DataThrough time.Time   `json:"data_through"`
+	Forecasts   []*Forecast `json:"forecasts"`
+}
+
+// dailyModel is a linear trend of daily spend with a multiplicative day-of-week seasonality
+type dailyModel struct {
+	start     time.Time
+	intercept float64
+	slope     float64
+	sigma     float64
+	weekday   [7]float64
+}
+
+// Forecast projects the spend of each group of the query to the end of the current month (and horizon months beyond it).
+// The query's filters, grouping, time zone and fiscal calendar are honored, while its timeframe and interval are ignored.
+//
+// The billing period currently being ingested is always incomplete since ingestd purges and re-ingests it with
+// every new billing report. Data from billing periods with an unfinished (or failed) ingest, as well as the last
+// day with data (which is typically only partially reported by AWS), are not trusted as actuals and are forecasted instead.
+func (ctx *CostReportContext) Forecast(params *CostQuery, now time.Time, horizon int) (*ForecastResult, error) {
+	if horizon < 0 || horizon > ForecastMaxHorizon {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Horizon must be between 0 and %d months", ForecastMaxHorizon)
+	}
+	loc := params.location()
+	truncateMonth := params.Calendar.truncateFunc(Month, loc, params.WeekStart)
+	today := truncateDay(now, loc)
+	monthStart := truncateMonth(today)
+
+	cutoff := today.AddDate(0, 0, 1)
+	incompleteStart, err := ctx.incompleteBillingPeriodStart()
+	if err != nil {
+		return nil, err
+	}
+	if !incompleteStart.IsZero() {
+		incompleteStart = time.Date(incompleteStart.Year(), incompleteStart.Month(), incompleteStart.Day(), 0, 0, 0, 0, loc)
+		if incompleteStart.Before(cutoff) {
+			cutoff = incompleteStart
+		}
+	}
+	queryStart := monthStart
+	if cutoff.Before(queryStart) {
+		queryStart = cutoff
+	}
+	query := *params
+	query.Interval = Day
+	query.From = queryStart.AddDate(0, 0, -forecastTrainingDays)
+	query.To = today
+	rows, err := ctx.Cost(&query)
+	if err != nil {
+		return nil, err
+	}
+	series, lastDataDay, err := dailySeries(rows, loc)
+	if err != nil {
+		return nil, err
+	}
+	if !lastDataDay.IsZero() && lastDataDay.Before(cutoff) {
+		// The last day with data is assumed to be partially reported
+		cutoff = lastDataDay
+	}
+
+	// Determine the months to forecast
+	months := []*ForecastPeriod{}
+	periodStart := monthStart
+	for i := 0; i <= horizon; i++ {
+		periodEnd := nextPeriodStart(periodStart, truncateMonth)
+		months = append(months, &ForecastPeriod{Start: periodStart, End: periodEnd})
+		periodStart = periodEnd
+	}
+
+	result := ForecastResult{DataThrough: cutoff, Forecasts: make([]*Forecast, 0)}
+	trainingStart := cutoff.AddDate(0, 0, -forecastTrainingDays)
+	if trainingStart.Before(query.From) {
+		trainingStart = query.From
+	}
+	for name, days := range series {
+		// Groups with a shorter history are only fitted to the days since their first spend, rather than to a
+		// run of zero spend days which would skew the trend and weekday factors
+		start := trainingStart
+		if firstDay := firstDataDay(days); firstDay.After(start) {
+			start = firstDay
+		}
+		model := fitDailyModel(days, start, cutoff)
+		forecast := Forecast{Dimension: params.GroupBy, Name: name, DisplayName: name, Periods: make([]*ForecastPeriod, len(months))}
+		for i, month := range months {
+			period := *month
+			variance := 0.0
+			for day := period.Start; day.Before(period.End); day = day.AddDate(0, 0, 1) {
+				if day.Before(cutoff) {
+					period.Actual += days[day]
+					continue
+				}
+				value, dayVariance := model.predict(day)
+				period.Forecast += value
+				variance += dayVariance
+			}
+			margin := forecastZScore * math.Sqrt(variance)
+			period.Lower = period.Actual + math.Max(period.Forecast-margin, 0)
+			period.Upper = period.Actual + period.Forecast + margin
+			period.Forecast += period.Actual
+			forecast.Periods[i] = &period
+		}
+		result.Forecasts = append(result.Forecasts, &forecast)
+	}
+	sort.Slice(result.Forecasts, func(i, j int) bool {
+		return result.Forecasts[i].Periods[0].Forecast > result.Forecasts[j].Periods[0].Forecast
+	})
+	return &result, nil
+}
+
+// nextPeriodStart returns the start of the period following the period starting at start
+func nextPeriodStart(start time.Time, truncate func(time.Time) time.Time) time.Time {
+	day := start.AddDate(0, 0, 1)
+	for truncate(day).Equal(start) {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}
+
+// incompleteBillingPeriodStart returns the start of the most recent billing period if its ingest has not finished successfully.
+// Returns the zero time if it has been ingested. Older billing periods are not considered, since a period which was never
+// finished (e.g. a failed ingest of a closed period) would otherwise exclude every day since it from the actuals
+func (ctx *CostReportContext) incompleteBillingPeriodStart() (time.Time, error) {
+	var latestStart time.Time
+	var latestComplete bool
+	ingStatuses, err := ctx.GetReportIngestStatuses()
+	if err != nil {
+		return latestStart, err
+	}
+	for _, is := range ingStatuses {
+		periodStart, err := time.Parse("20060102", strings.Split(is.BillingPeriod, "-")[0])
+		if err != nil {
+			return latestStart, errors.InternalError(err)
+		}
+		if latestStart.IsZero() || periodStart.After(latestStart) {
+			latestStart = periodStart
+			latestComplete = is.FinishTime != nil && is.ErrorMessage == ""
+		}
+	}
+	if latestComplete {
+		return time.Time{}, nil
+	}
+	return latestStart, nil
+}
+
+// dailySeries converts the rows of a daily cost query into a mapping of group name to the daily values of the group.
+// Also returns the last day in which any group had a non-zero value
+func dailySeries(rows []models.Row, loc *time.Location) (map[string]map[time.Time]float64, time.Time, error) {
+	var lastDataDay time.Time
+	series := make(map[string]map[time.Time]float64)
+	for _, row := range rows {
+		name := rowGroupName(row)
+		days := make(map[time.Time]float64)
+		for _, valueTuple := range row.Values {
+			timestamp, value, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, lastDataDay, err
+			}
+			day := truncateDay(timestamp, loc)
+			days[day] += value
+			if value != 0 && day.After(lastDataDay) {
+				lastDataDay = day
+			}
+		}
+		series[name] = days
+	}
+	return series, lastDataDay, nil
+}
+
+// firstDataDay returns the first day with a non-zero value, or the zero time if there is none
+func firstDataDay(days map[time.Time]float64) time.Time {
+	var first time.Time
+	for day, value := range days {
+		if value != 0 && (first.IsZero() || day.Before(first)) {
+			first = day
+		}
+	}
+	return first
+}
+
+// ParseValueTuple returns the timestamp and value of a data point from a cost query. Rolled up data points hold
+// native values, whereas data points from InfluxDB hold RFC3339 timestamps and JSON numbers
+func ParseValueTuple(valueTuple []interface{}) (time.Time, float64, error) {
+	var timestamp time.Time
+	var value float64
+	var err error
+	switch ts := valueTuple[0].(type) {
+	case time.Time:
+		timestamp = ts
+	case string:
+		timestamp, err = time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return timestamp, value, errors.InternalError(err)
+		}
+	}
+	switch v := valueTuple[1].(type) {
+	case float64:
+		value = v
+	case json.Number:
+		value, err = v.Float64()
+		if err != nil {
+			return timestamp, value, errors.InternalError(err)
+		}
+	}
+	return timestamp, value, nil
+}
+
+// fitDailyModel fits a daily model to the days in the range [start, end). Days without data count as zero spend
+func fitDailyModel(days map[time.Time]float64, start, end time.Time) *dailyModel {
+	model := dailyModel{start: start}
+	var weekdayTotals [7]float64
+	var weekdayCounts [7]int
+	total := 0.0
+	n := 0
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		weekdayTotals[day.Weekday()] += days[day]
+		weekdayCounts[day.Weekday()]++
+		total += days[day]
+		n++
+	}
+	if n == 0 || total == 0 {
+		return &model
+	}
+	mean := total / float64(n)
+	for i := range model.weekday {
+		if weekdayCounts[i] > 0 {
+			model.weekday[i] = weekdayTotals[i] / float64(weekdayCounts[i]) / mean
+		}
+	}
+	// Least squares fit of the deseasonalized spend
+	var xs, ys []float64
+	offset := 0
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		factor := model.weekday[day.Weekday()]
+		if factor != 0 {
+			xs = append(xs, float64(offset))
+			ys = append(ys, days[day]/factor)
+		}
+		offset++
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXY += xs[i] * ys[i]
+		sumXX += xs[i] * xs[i]
+	}
+	count := float64(len(xs))
+	if denominator := count*sumXX - sumX*sumX; denominator != 0 {
+		model.slope = (count*sumXY - sumX*sumY) / denominator
+	}
+	model.intercept = (sumY - model.slope*sumX) / count
+	if len(xs) > 2 {
+		sumSquares := 0.0
+		for i := range xs {
+			residual := ys[i] - (model.intercept + model.slope*xs[i])
+			sumSquares += residual * residual
+		}
+		model.sigma = math.Sqrt(sumSquares / (count - 2))
+	}
+	return &model
+}
+
+// predict returns the predicted spend of a day and the variance of the prediction
+func (m *dailyModel) predict(day time.Time) (float64, float64) {
+	factor := m.weekday[day.Weekday()]
+	if factor == 0 {
+		return 0, 0
+	}
+	// Days are counted using UTC dates so that daylight saving transitions do not affect the count
+	utcDay := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	utcStart := time.Date(m.start.Year(), m.start.Month(), m.start.Day(), 0, 0, 0, 0, time.UTC)
+	x := utcDay.Sub(utcStart).Hours() / 24
+	value := math.Max(factor*(m.intercept+m.slope*x), 0)
+	return value, factor * factor * m.sigma * m.sigma
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/billingbucket"
+	"github.com/applatix/claudia/errors"
+)
+
+// IngestStats are the statistics of an ingest attempt, accumulated over the report files of the manifest
+type IngestStats struct {
+	RowsRead        int64            `json:"rows_read"`
+	RowsWritten     int64            `json:"rows_written"`
+	RowsSkipped     map[string]int64 `json:"rows_skipped"`
+	BytesDownloaded int64            `json:"bytes_downloaded"`
+}
+
+// AddSkipped counts a row skipped for the given reason
+func (stats *IngestStats) AddSkipped(reason string) {
+	if stats.RowsSkipped == nil {
+		stats.RowsSkipped = make(map[string]int64)
+	}
+	stats.RowsSkipped[reason]++
+}
+
+// IngestAttempt is a single attempt at ingesting a manifest assembly. Every attempt is kept in the ingest history, from
+// which the ingest status (the latest attempt of a billing period) is derived.
+// * Event is the last recorded event of the attempt. An attempt which remains STARTED was interrupted (or is in progress)
+// * FinishTime is the time the attempt finished or errored
+type IngestAttempt struct {
+	ID              string     `json:"id"`
+	ReportID        string     `json:"report_id"`
+	AssemblyID      string     `json:"assembly_id"`
+	Bucket          string     `json:"bucket"`
+	ReportPath      string     `json:"report_path"`
+	BillingPeriod   string     `json:"billing_period"`
+	Event           string     `json:"event"`
+	ErrorMessage    string     `json:"error,omitempty"`
+	ParserVersion   int        `json:"parser_version"`
+	StartTime       *time.Time `json:"start_time"`
+	FinishTime      *time.Time `json:"finish_time"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	IngestStats
+
+	manifest billingbucket.Manifest
+}
+
+// GetReportIngestHistory returns the ingest attempts of the report, most recent first. The history is optionally filtered
+// by billing period, and limited to the given number of attempts (a zero limit returns all attempts)
+func (ctx *CostReportContext) GetReportIngestHistory(billingPeriod string, limit int) ([]*IngestAttempt, error) {
+	query := fmt.Sprintf("SELECT * FROM %s WHERE \"reportId\" = '%s'", claudia.IngestHistoryMeasurementName, ctx.ReportID)
+	if billingPeriod != "" {
+		query += fmt.Sprintf(" AND \"billingPeriod\" = '%s'", escapeSingleQuote(billingPeriod))
+	}
+	results, err := ctx.CostDB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	attempts := make([]*IngestAttempt, 0)
+	if len(results) == 0 || len(results[0].Series) == 0 {
+		return attempts, nil
+	}
+	attemptsByID := make(map[string]*IngestAttempt)
+	for _, dataPoint := range results[0].Series[0].Values {
+		attempt, err := parseIngestAttemptEvent(results[0].Series[0].Columns, dataPoint, attemptsByID)
+		if err != nil {
+			return nil, err
+		}
+		if attempt != nil {
+			attempts = append(attempts, attempt)
+		}
+	}
+	sort.Slice(attempts, func(i, j int) bool {
+		if attempts[i].StartTime == nil || attempts[j].StartTime == nil {
+			return attempts[i].ID > attempts[j].ID
+		}
+		return attempts[i].StartTime.After(*attempts[j].StartTime)
+	})
+	if limit > 0 && len(attempts) > limit {
+		attempts = attempts[:limit]
+	}
+	return attempts, nil
+}
+
+// parseIngestAttemptEvent applies an event of the ingest history to its attempt, which is looked up by the attempt ID of
+// the event. Returns the attempt if it was not yet seen. Events without an attempt (e.g. invalidations) are ignored
+func parseIngestAttemptEvent(columns []string, dataPoint []interface{}, attemptsByID map[string]*IngestAttempt) (*IngestAttempt, error) {
+	var attemptID string
+	for i, colVal := range dataPoint {
+		if columns[i] == "attemptId" && colVal != nil {
+			attemptID = colVal.(string)
+		}
+	}
+	if attemptID == "" {
+		return nil, nil
+	}
+	attempt, seen := attemptsByID[attemptID]
+	if !seen {
+		attempt = &IngestAttempt{ID: attemptID}
+		attemptsByID[attemptID] = attempt
+	}
+	var dpTime time.Time
+	var err error
+	for i, colVal := range dataPoint {
+		if colVal == nil {
+			continue
+		}
+		switch columns[i] {
+		case "time":
+			dpTime, err = time.Parse("2006-01-02T15:04:05.999999999Z", colVal.(string))
+			if err != nil {
+				return nil, errors.InternalErrorf(err, "Failed to parse time: %s", colVal.(string))
+			}
+		case "reportId":
+			attempt.ReportID = colVal.(string)
+		case "assemblyId":
+			attempt.AssemblyID = colVal.(string)
+		case "bucket":
+			attempt.Bucket = colVal.(string)
+		case "reportPath":
+			attempt.ReportPath = colVal.(string)
+		case "billingPeriod":
+			attempt.BillingPeriod = colVal.(string)
+		case "error":
+			attempt.ErrorMessage = colVal.(string)
+		case "parserVersion":
+			attempt.ParserVersion, err = jsonNumberInt(colVal)
+		case "rowsRead":
+			attempt.RowsRead, err = jsonNumberInt64(colVal)
+		case "rowsWritten":
+			attempt.RowsWritten, err = jsonNumberInt64(colVal)
+		case "bytesDownloaded":
+			attempt.BytesDownloaded, err = jsonNumberInt64(colVal)
+		case "duration":
+			attempt.DurationSeconds, err = colVal.(json.Number).Float64()
+		case "rowsSkipped":
+			err = json.Unmarshal([]byte(colVal.(string)), &attempt.RowsSkipped)
+		case "event":
+			attempt.Event = colVal.(string)
+		}
+		if err != nil {
+			return nil, errors.InternalError(err)
+		}
+	}
+	switch attempt.Event {
+	case EventIngestStart:
+		attempt.StartTime = &dpTime
+	case EventIngestFinished, EventIngestError:
+		attempt.FinishTime = &dpTime
+	}
+	if seen {
+		return nil, nil
+	}
+	return attempt, nil
+}
+
+func jsonNumberInt64(val interface{}) (int64, error) {
+	return val.(json.Number).Int64()
+}
+
+func jsonNumberInt(val interface{}) (int, error) {
+	i, err := val.(json.Number).Int64()
+	return int(i), err
+}
+
+// newIngestAttemptID returns the ID of an ingest attempt started at the given time
+func newIngestAttemptID(startTime time.Time) string {
+	return strconv.FormatInt(startTime.UnixNano(), 10)
+}
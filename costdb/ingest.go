@@ -34,6 +34,8 @@ const (
 	EventIngestStart    = "STARTED"
 	EventIngestFinished = "FINISHED"
 	EventIngestError    = "ERROR"
+	// EventIngestInvalidated invalidates the ingest status of a billing period (e.g. when its data was deleted)
+	EventIngestInvalidated = "INVALIDATED"
 )
 
 // NewPoint returns a InfluxDB point ready to be stored in this costDB's measurement
@@ -52,22 +54,27 @@ func (is *IngestStatus) StatusDetail() (claudia.ReportStatus, string) {
 	return claudia.ReportStatusCurrent, ""
 }
 
-// GetIngestStatus returns the ingest status of an Manifest assembly
-func (db *CostDatabase) GetIngestStatus(assemblyID string) (*IngestStatus, error) {
-	query := fmt.Sprintf("SELECT * FROM %s WHERE \"assemblyId\"='%s'", claudia.IngestStatusMeasurementName, assemblyID)
-	results, err := db.Query(query)
+// GetReportBuckets all buckets associated with the report
+func (ctx *CostReportContext) GetReportBuckets() ([]*billingbucket.AWSBillingBucket, error) {
+	bucketNames, err := ctx.TagValues(parser.ColumnBillingBucket, nil)
 	if err != nil {
 		return nil, err
 	}
-	if len(results[0].Series) == 0 {
-		return nil, nil
-	}
-	series := results[0].Series[0]
-	ingStatus, err := parseIngestSeries(series)
-	if err != nil {
-		return nil, err
+	buckets := make([]*billingbucket.AWSBillingBucket, 0)
+	for _, bucketName := range bucketNames {
+		filters := map[string][]string{
+			parser.ColumnBillingBucket.ColumnName: []string{bucketName},
+		}
+		reportPaths, err := ctx.TagValues(parser.ColumnBillingReportPath, filters)
+		if err != nil {
+			return nil, err
+		}
+		for _, reportPath := range reportPaths {
+			billbuck := billingbucket.AWSBillingBucket{Bucket: bucketName, ReportPath: reportPath}
+			buckets = append(buckets, &billbuck)
+		}
 	}
-	return ingStatus, nil
+	return buckets, nil
 }
 
 // GetReportIDs returns all report IDs known by the cost database
@@ -82,7 +89,7 @@ func (db *CostDatabase) GetReportIDs() ([]string, error) {
 		reportID := strings.SplitN(measurementName, "_", 2)[1]
 		reportIDMap[reportID] = true
 	}
-	results, err = db.Query("SHOW TAG VALUES FROM \"%s\" WITH KEY = \"reportId\"", claudia.IngestStatusMeasurementName)
+	results, err = db.Query("SHOW TAG VALUES FROM \"%s\" WITH KEY = \"reportId\"", claudia.IngestHistoryMeasurementName)
 	if err != nil {
 		return nil, err
 	}
@@ -97,198 +104,249 @@ func (db *CostDatabase) GetReportIDs() ([]string, error) {
 	return reportIDs, nil
 }
 
-// GetIngestStatusByBillingPeriod returns the ingest status of a bucket and billing period
-func (db *CostDatabase) GetIngestStatusByBillingPeriod(bucket, reportPath, billingPeriod string) (*IngestStatus, error) {
-	results, err := db.Query("SELECT * FROM \"%s\" WHERE \"bucket\"='%s' AND \"reportPath\"='%s' AND \"billingPeriod\"='%s'",
-		claudia.IngestStatusMeasurementName, bucket, escapeSingleQuote(reportPath), billingPeriod)
+// GetIngestStatus returns the ingest status of the billing period whose latest ingest attempt is of the Manifest assembly.
+// Returns nil if the assembly has not been ingested, or has since been superseded or invalidated
+func (ctx *CostReportContext) GetIngestStatus(assemblyID string) (*IngestStatus, error) {
+	ingStatuses, err := ctx.ingestStatuses(fmt.Sprintf("\"reportId\" = '%s'", ctx.ReportID))
 	if err != nil {
 		return nil, err
 	}
-	if len(results) == 0 {
-		return nil, nil
+	for _, is := range ingStatuses {
+		if is.AssemblyID == assemblyID {
+			return is, nil
+		}
 	}
-	if len(results[0].Series) == 0 {
-		return nil, nil
+	return nil, nil
+}
+
+// GetIngestStatusByBillingPeriod returns the ingest status of a bucket and billing period.
+// Returns nil if the billing period has not been ingested, or has been invalidated
+func (ctx *CostReportContext) GetIngestStatusByBillingPeriod(bucket, reportPath, billingPeriod string) (*IngestStatus, error) {
+	ingStatuses, err := ctx.ingestStatuses(fmt.Sprintf("\"reportId\" = '%s' AND \"bucket\" = '%s' AND \"reportPath\" = '%s' AND \"billingPeriod\" = '%s'",
+		ctx.ReportID, bucket, escapeSingleQuote(reportPath), billingPeriod))
+	if err != nil || len(ingStatuses) == 0 {
+		return nil, err
 	}
-	series := results[0].Series[0]
-	ingStatus, err := parseIngestSeries(series)
+	return ingStatuses[0], nil
+}
+
+// GetReportIngestStatuses returns the ingest status of each billing period of the report (e.g. if there are any errors)
+func (ctx *CostReportContext) GetReportIngestStatuses() ([]*IngestStatus, error) {
+	return ctx.ingestStatuses(fmt.Sprintf("\"reportId\" = '%s'", ctx.ReportID))
+}
+
+// ingestStatuses derives the current ingest status of each billing period matching the where clause from its ingest history.
+// The status of a billing period is that of its latest ingest attempt, unless the attempt was followed by an invalidation
+func (ctx *CostReportContext) ingestStatuses(where string) ([]*IngestStatus, error) {
+	results, err := ctx.CostDB.Query("SELECT \"attemptId\",\"assemblyId\",\"parserVersion\",\"error\",\"event\" FROM \"%s\" WHERE %s GROUP BY \"reportId\",\"bucket\",\"reportPath\",\"billingPeriod\"",
+		claudia.IngestHistoryMeasurementName, where)
 	if err != nil {
 		return nil, err
 	}
-	return ingStatus, nil
+	ingStatuses := make([]*IngestStatus, 0)
+	if len(results) == 0 {
+		return ingStatuses, nil
+	}
+	for _, series := range results[0].Series {
+		ingStatus, err := parseIngestHistorySeries(series)
+		if err != nil {
+			return nil, err
+		}
+		if ingStatus != nil {
+			ingStatuses = append(ingStatuses, ingStatus)
+		}
+	}
+	return ingStatuses, nil
 }
 
-func parseIngestSeries(series models.Row) (*IngestStatus, error) {
-	var err error
-	ingStatus := IngestStatus{}
+// parseIngestHistorySeries replays the ingest history events of a billing period, in time order, into its ingest status.
+// Events of an attempt other than the latest one are ignored. Returns nil if the latest event is an invalidation
+func parseIngestHistorySeries(series models.Row) (*IngestStatus, error) {
+	var ingStatus *IngestStatus
+	var attemptID string
 	for _, dataPoint := range series.Values {
 		var dpTime time.Time
+		var event IngestAttempt
+		var err error
 		for i, colVal := range dataPoint {
-			columnName := series.Columns[i]
-			switch columnName {
+			if colVal == nil {
+				continue
+			}
+			switch series.Columns[i] {
 			case "time":
 				dpTime, err = time.Parse("2006-01-02T15:04:05.999999999Z", colVal.(string))
 				if err != nil {
 					return nil, errors.InternalErrorf(err, "Failed to parse time: %s", colVal.(string))
 				}
-			case "reportId":
-				ingStatus.ReportID = colVal.(string)
-			case "bucket":
-				ingStatus.Bucket = colVal.(string)
-			case "reportPath":
-				ingStatus.ReportPath = colVal.(string)
-			case "billingPeriod":
-				ingStatus.BillingPeriod = colVal.(string)
+			case "attemptId":
+				event.ID = colVal.(string)
 			case "assemblyId":
-				ingStatus.AssemblyID = colVal.(string)
+				event.AssemblyID = colVal.(string)
 			case "parserVersion":
-				parserVersion, err := colVal.(json.Number).Int64()
+				event.ParserVersion, err = jsonNumberInt(colVal)
 				if err != nil {
 					return nil, errors.InternalError(err)
 				}
-				ingStatus.ParserVersion = int(parserVersion)
 			case "error":
-				if colVal != nil {
-					ingStatus.ErrorMessage = colVal.(string)
-				}
+				event.ErrorMessage = colVal.(string)
 			case "event":
-				status := colVal.(string)
-				switch status {
-				case EventIngestStart:
-					ingStatus.StartTime = &dpTime
-				case EventIngestFinished:
-					ingStatus.FinishTime = &dpTime
-				}
+				event.Event = colVal.(string)
 			}
 		}
-	}
-	return &ingStatus, nil
-}
-
-// GetReportBuckets all buckets associated with the report
-func (ctx *CostReportContext) GetReportBuckets() ([]*billingbucket.AWSBillingBucket, error) {
-	bucketNames, err := ctx.TagValues(parser.ColumnBillingBucket, nil)
-	if err != nil {
-		return nil, err
-	}
-	buckets := make([]*billingbucket.AWSBillingBucket, 0)
-	for _, bucketName := range bucketNames {
-		filters := map[string][]string{
-			parser.ColumnBillingBucket.ColumnName: []string{bucketName},
-		}
-		reportPaths, err := ctx.TagValues(parser.ColumnBillingReportPath, filters)
-		if err != nil {
-			return nil, err
-		}
-		for _, reportPath := range reportPaths {
-			billbuck := billingbucket.AWSBillingBucket{Bucket: bucketName, ReportPath: reportPath}
-			buckets = append(buckets, &billbuck)
-		}
-	}
-	return buckets, nil
-}
-
-// GetReportIngestStatuses returns the ingest status of the report (e.g. if there are any errors)
-func (ctx *CostReportContext) GetReportIngestStatuses() ([]*IngestStatus, error) {
-	query := fmt.Sprintf("SELECT * FROM %s WHERE \"reportId\" = '%s' GROUP BY \"assemblyId\"", claudia.IngestStatusMeasurementName, ctx.ReportID)
-	results, err := ctx.CostDB.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	ingStatuses := make([]*IngestStatus, len(results[0].Series))
-	for i, series := range results[0].Series {
-		ingStatus, err := parseIngestSeries(series)
-		if err != nil {
-			return nil, err
-		}
-		// This assignment is necessary because InfluxDB will omit assemblyId from columns since we are grouping by it
-		var assemblyID string
-		for _, aid := range series.Tags {
-			assemblyID = aid
+		switch event.Event {
+		case EventIngestStart:
+			attemptID = event.ID
+			ingStatus = &IngestStatus{
+				ReportID:      series.Tags["reportId"],
+				AssemblyID:    event.AssemblyID,
+				Bucket:        series.Tags["bucket"],
+				ReportPath:    series.Tags["reportPath"],
+				BillingPeriod: series.Tags["billingPeriod"],
+				ParserVersion: event.ParserVersion,
+				StartTime:     &dpTime,
+			}
+		case EventIngestFinished:
+			if ingStatus != nil && event.ID == attemptID {
+				ingStatus.FinishTime = &dpTime
+			}
+		case EventIngestError:
+			if ingStatus != nil && event.ID == attemptID {
+				ingStatus.ErrorMessage = event.ErrorMessage
+			}
+		case EventIngestInvalidated:
+			ingStatus = nil
+			attemptID = ""
 		}
-		ingStatus.AssemblyID = assemblyID
-		ingStatuses[i] = ingStatus
 	}
-	return ingStatuses, nil
-
+	return ingStatus, nil
 }
 
-// DeleteAllIngestHistory deletes all ingest history for this report
+// DeleteAllIngestHistory deletes all ingest history for this report, including the history of every ingest attempt
 func (ctx *CostReportContext) DeleteAllIngestHistory() error {
 	log.Printf("Deleting ingest history for %s", ctx.ReportID)
-	query := fmt.Sprintf("DROP SERIES FROM %s WHERE \"reportId\" = '%s'", claudia.IngestStatusMeasurementName, ctx.ReportID)
+	query := fmt.Sprintf("DROP SERIES FROM %s WHERE \"reportId\" = '%s'", claudia.IngestHistoryMeasurementName, ctx.ReportID)
 	_, err := ctx.CostDB.Query(query)
 	return err
 }
 
-// DeleteBillingBucketHistory deletes all ingest history for the billing bucket & report path
+// InvalidateBillingBucketIngests invalidates the ingest status of every billing period of the billing bucket & report path
 // Called when a report bucket has been deleted
-func (ctx *CostReportContext) DeleteBillingBucketHistory(bucketname, reportPath string) error {
-	log.Printf("Deleting ingest history for reportID %s bucket %s reportPath %s", ctx.ReportID, bucketname, reportPath)
-	query := fmt.Sprintf("DROP SERIES FROM %s WHERE \"reportId\" = '%s' AND \"bucket\" = '%s' AND \"reportPath\" = '%s'",
-		claudia.IngestStatusMeasurementName, ctx.ReportID, bucketname, escapeSingleQuote(reportPath))
-	_, err := ctx.CostDB.Query(query)
-	return err
-}
-
-// DeleteAssemblyIngestHistory deletes ingest history for a given assembly id
-// Called when updating a retention policy results in the need for reprocessing of report data
-func (ctx *CostReportContext) DeleteAssemblyIngestHistory(assemblyID string) error {
-	log.Printf("Deleting ingest history for reportID %s assemblyID %s", ctx.ReportID, assemblyID)
-	query := fmt.Sprintf("DROP SERIES FROM %s WHERE \"reportId\" = '%s' AND \"assemblyId\" = '%s'",
-		claudia.IngestStatusMeasurementName, ctx.ReportID, assemblyID)
-	_, err := ctx.CostDB.Query(query)
-	return err
+func (ctx *CostReportContext) InvalidateBillingBucketIngests(bucketname, reportPath string) error {
+	log.Printf("Invalidating ingests of reportID %s bucket %s reportPath %s", ctx.ReportID, bucketname, reportPath)
+	ingStatuses, err := ctx.ingestStatuses(fmt.Sprintf("\"reportId\" = '%s' AND \"bucket\" = '%s' AND \"reportPath\" = '%s'",
+		ctx.ReportID, bucketname, escapeSingleQuote(reportPath)))
+	if err != nil {
+		return err
+	}
+	return ctx.InvalidateIngests(ingStatuses)
 }
 
-// DeleteBillingPeriodIngestHistory deletes all ingest history for the billing bucket, report path, and billing period of this manifest
-// Called right before we process a monthly report (to ensure data is not counted twice when processing cumulative reports)
-func (ctx *CostReportContext) deleteBillingPeriodIngestHistory(manifest *billingbucket.Manifest) error {
-	log.Printf("Deleting ingest history for reportID %s bucket %s reportPath %s billingPeriod: %s",
-		ctx.ReportID, manifest.Bucket, manifest.ReportPath(), manifest.BillingPeriodString())
-	query := fmt.Sprintf("DROP SERIES FROM %s WHERE \"reportId\" = '%s' AND \"bucket\" = '%s' AND \"reportPath\" = '%s' AND \"billingPeriod\" = '%s'",
-		claudia.IngestStatusMeasurementName, ctx.ReportID, manifest.Bucket, escapeSingleQuote(manifest.ReportPath()), manifest.BillingPeriodString())
-	_, err := ctx.CostDB.Query(query)
-	return err
+// InvalidateIngests records an invalidation event in the ingest history of the billing period of each ingest status.
+// The billing periods are then no longer considered ingested, which forces them to be reingested (e.g. when retention is
+// increased), while the history of their attempts is kept
+func (ctx *CostReportContext) InvalidateIngests(ingStatuses []*IngestStatus) error {
+	if len(ingStatuses) == 0 {
+		return nil
+	}
+	bp, err := ctx.NewBatchPoints()
+	if err != nil {
+		return err
+	}
+	// Don't use the reports retention policy so that this data will never expire
+	bp.SetRetentionPolicy("")
+	now := time.Now().UTC()
+	for _, is := range ingStatuses {
+		log.Printf("Invalidating ingest of reportID %s bucket %s reportPath %s billingPeriod %s", ctx.ReportID, is.Bucket, is.ReportPath, is.BillingPeriod)
+		tags := map[string]string{
+			"reportId":      ctx.ReportID,
+			"bucket":        is.Bucket,
+			"reportPath":    is.ReportPath,
+			"billingPeriod": is.BillingPeriod,
+		}
+		fields := map[string]interface{}{
+			"assemblyId": is.AssemblyID,
+			"event":      EventIngestInvalidated,
+		}
+		pt, err := client.NewPoint(claudia.IngestHistoryMeasurementName, tags, fields, now)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+		bp.AddPoint(pt)
+	}
+	return ctx.CostDB.Write(bp)
 }
 
-// RecordIngestStart will record in the database the start of a processing in the report
-func (ctx *CostReportContext) RecordIngestStart(manifest billingbucket.Manifest) error {
+// RecordIngestStart will record in the database the start of a processing in the report, and returns the new ingest
+// attempt which is appended to the ingest history. The attempt supersedes any previous attempt of the billing period
+func (ctx *CostReportContext) RecordIngestStart(manifest billingbucket.Manifest) (*IngestAttempt, error) {
 	log.Println("Starting ingest")
-	err := ctx.deleteBillingPeriodIngestHistory(&manifest)
+	startTime := time.Now().UTC()
+	attempt := IngestAttempt{
+		ID:            newIngestAttemptID(startTime),
+		ReportID:      ctx.ReportID,
+		AssemblyID:    manifest.AssemblyID,
+		Bucket:        manifest.Bucket,
+		ReportPath:    manifest.ReportPath(),
+		BillingPeriod: manifest.BillingPeriodString(),
+		Event:         EventIngestStart,
+		ParserVersion: parser.ParserVersion,
+		StartTime:     &startTime,
+		manifest:      manifest,
+	}
+	err := ctx.recordIngestHelper(&attempt, startTime)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return ctx.recordIngestHelper(manifest, EventIngestStart, "")
+	return &attempt, nil
 }
 
 // RecordIngestFinish will record in the database the completion of a processing in the report
-func (ctx *CostReportContext) RecordIngestFinish(manifest billingbucket.Manifest) error {
+func (ctx *CostReportContext) RecordIngestFinish(attempt *IngestAttempt) error {
 	log.Println("Finished ingest")
-	return ctx.recordIngestHelper(manifest, EventIngestFinished, "")
+	attempt.Event = EventIngestFinished
+	return ctx.recordIngestHelper(attempt, time.Now().UTC())
 }
 
 // RecordIngestError will record in the database an error processing a report
-func (ctx *CostReportContext) RecordIngestError(manifest billingbucket.Manifest, errorMsg string) error {
+func (ctx *CostReportContext) RecordIngestError(attempt *IngestAttempt, errorMsg string) error {
 	log.Printf("Ingest errored with: %s", errorMsg)
-	return ctx.recordIngestHelper(manifest, EventIngestError, errorMsg)
+	attempt.Event = EventIngestError
+	attempt.ErrorMessage = errorMsg
+	return ctx.recordIngestHelper(attempt, time.Now().UTC())
 }
 
-func (ctx *CostReportContext) recordIngestHelper(manifest billingbucket.Manifest, event string, errorMsg string) error {
+// recordIngestHelper appends the event of an ingest attempt to the ingest history, from which the ingest status of the
+// billing period is derived. The point of a finish or error includes the statistics of the attempt
+func (ctx *CostReportContext) recordIngestHelper(attempt *IngestAttempt, eventTime time.Time) error {
+	manifest := attempt.manifest
 	tags := map[string]string{
 		"reportId":      ctx.ReportID,
-		"assemblyId":    manifest.AssemblyID,
 		"bucket":        manifest.Bucket,
 		"reportPath":    manifest.ReportPath(),
 		"billingPeriod": manifest.BillingPeriodString(),
 	}
 	fields := map[string]interface{}{
+		"attemptId":     attempt.ID,
+		"assemblyId":    manifest.AssemblyID,
 		"reportName":    manifest.ReportName,
 		"parserVersion": parser.ParserVersion,
-		"event":         event,
+		"event":         attempt.Event,
 	}
-	if errorMsg != "" {
-		fields["error"] = errorMsg
+	if attempt.Event == EventIngestError {
+		fields["error"] = attempt.ErrorMessage
+	}
+	if attempt.Event != EventIngestStart {
+		attempt.FinishTime = &eventTime
+		attempt.DurationSeconds = eventTime.Sub(*attempt.StartTime).Seconds()
+		rowsSkipped, err := json.Marshal(attempt.RowsSkipped)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+		fields["rowsRead"] = attempt.RowsRead
+		fields["rowsWritten"] = attempt.RowsWritten
+		fields["rowsSkipped"] = string(rowsSkipped)
+		fields["bytesDownloaded"] = attempt.BytesDownloaded
+		fields["duration"] = attempt.DurationSeconds
 	}
 	bp, err := ctx.NewBatchPoints()
 	// Don't use the reports retention policy so that this data will never expire
@@ -296,7 +354,7 @@ func (ctx *CostReportContext) recordIngestHelper(manifest billingbucket.Manifest
 	if err != nil {
 		return err
 	}
-	pt, err := client.NewPoint(claudia.IngestStatusMeasurementName, tags, fields)
+	pt, err := client.NewPoint(claudia.IngestHistoryMeasurementName, tags, fields, eventTime)
 	if err != nil {
 		return errors.InternalError(err)
 	}
@@ -305,6 +363,72 @@ func (ctx *CostReportContext) recordIngestHelper(manifest billingbucket.Manifest
 	return errors.InternalError(err)
 }
 
+// MigrateIngestStatus converts the ingest_status measurement of earlier versions, which held the events of the latest
+// ingest attempt of each billing period, into ingest history events and drops it. Safe to repeat if interrupted, since
+// the converted points are identical
+func (db *CostDatabase) MigrateIngestStatus() error {
+	results, err := db.Query("SELECT * FROM \"%s\" GROUP BY *", claudia.IngestStatusMeasurementName)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 || len(results[0].Series) == 0 {
+		return nil
+	}
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{Database: db.databaseName})
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	for _, series := range results[0].Series {
+		tags := map[string]string{
+			"reportId":      series.Tags["reportId"],
+			"bucket":        series.Tags["bucket"],
+			"reportPath":    series.Tags["reportPath"],
+			"billingPeriod": series.Tags["billingPeriod"],
+		}
+		var attemptID string
+		for _, dataPoint := range series.Values {
+			var eventTime time.Time
+			fields := map[string]interface{}{"assemblyId": series.Tags["assemblyId"]}
+			for i, colVal := range dataPoint {
+				if colVal == nil {
+					continue
+				}
+				switch columnName := series.Columns[i]; columnName {
+				case "time":
+					eventTime, err = time.Parse("2006-01-02T15:04:05.999999999Z", colVal.(string))
+					if err != nil {
+						return errors.InternalErrorf(err, "Failed to parse time: %s", colVal.(string))
+					}
+				case "parserVersion":
+					fields[columnName], err = colVal.(json.Number).Int64()
+					if err != nil {
+						return errors.InternalError(err)
+					}
+				default:
+					fields[columnName] = colVal
+				}
+			}
+			// Points are in time order, so the attempt is identified by the time of its first (i.e. start) event
+			if attemptID == "" {
+				attemptID = newIngestAttemptID(eventTime)
+			}
+			fields["attemptId"] = attemptID
+			pt, err := client.NewPoint(claudia.IngestHistoryMeasurementName, tags, fields, eventTime)
+			if err != nil {
+				return errors.InternalError(err)
+			}
+			bp.AddPoint(pt)
+		}
+	}
+	err = db.Write(bp)
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated %d ingest statuses to the ingest history", len(results[0].Series))
+	_, err = db.Query("DROP MEASUREMENT \"%s\"", claudia.IngestStatusMeasurementName)
+	return err
+}
+
 // escapeSingleQuote returns a string with an escaping single quote
 func escapeSingleQuote(str string) string {
 	return strings.Replace(str, "'", "\\'", -1)
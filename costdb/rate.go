@@ -0,0 +1,62 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"github.com/applatix/claudia/parser"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Rate performs the query for both cost and usage amount, and returns the effective rate (cost per unit of usage) of each
+// group and interval. The query is expected to be filtered to a single usage unit (e.g. hours of a single instance type),
+// otherwise the rate is meaningless. The rate of an interval without usage is nil
+func (ctx *CostReportContext) Rate(params *CostQuery) ([]models.Row, error) {
+	costQuery := *params
+	usageQuery := *params
+	usageQuery.Field = parser.ColumnUsageAmount.ColumnName
+	rows, err := ctx.Cost(&costQuery)
+	if err != nil {
+		return nil, err
+	}
+	usageRows, err := ctx.Cost(&usageQuery)
+	if err != nil {
+		return nil, err
+	}
+	// Usage amounts keyed by group name and the unix time of the interval
+	usage := make(map[string]map[int64]float64)
+	for _, row := range usageRows {
+		name := rowGroupName(row)
+		amounts := make(map[int64]float64)
+		for _, valueTuple := range row.Values {
+			timestamp, amount, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, err
+			}
+			amounts[timestamp.Unix()] += amount
+		}
+		usage[name] = amounts
+	}
+	for i, row := range rows {
+		amounts := usage[rowGroupName(row)]
+		for j, valueTuple := range row.Values {
+			timestamp, cost, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, err
+			}
+			var rate interface{}
+			if amount := amounts[timestamp.Unix()]; amount != 0 {
+				rate = cost / amount
+			}
+			rows[i].Values[j] = []interface{}{valueTuple[0], rate}
+		}
+		rows[i].Columns = []string{"time", "rate"}
+	}
+	return rows, nil
+}
+
+// rowGroupName returns the value of the group by column of a row. Rows of a query without grouping have an empty name
+func rowGroupName(row models.Row) string {
+	for _, v := range row.Tags {
+		return v
+	}
+	return ""
+}
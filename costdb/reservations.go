@@ -0,0 +1,455 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+	client "github.com/influxdata/influxdb/client/v2"
+)
+
+// Tag and field names of the reservation measurement. The measurement holds two kinds of points, distinguished by their
+// line item type: the daily hours of usage covered by a reservation (DiscountedUsage), and the reserved hours and fee
+// of a reservation during a billing period (RIFee)
+const (
+	reservationTagReservationARN  = "reservation"
+	reservationTagLineItemType    = "lineItemType"
+	reservationLineItemUsage      = "DiscountedUsage"
+	reservationLineItemFee        = "RIFee"
+	reservationFieldUsedHours     = "usedHours"
+	reservationFieldReservedHours = "reservedHours"
+	reservationFieldUnusedHours   = "unusedHours"
+	reservationFieldFee           = "fee"
+)
+
+// reservationBillingTags are the billing tags of a line item which are copied to the reservation measurement, so that
+// the reservation data is purged along with the report data
+var reservationBillingTags = []string{
+	parser.ColumnBillingBucket.ColumnName,
+	parser.ColumnBillingReportPath.ColumnName,
+	parser.ColumnBillingPeriod.ColumnName,
+}
+
+// reservationKey identifies the usage of a reservation during a day, or its fee during a billing period
+type reservationKey struct {
+	reservationARN string
+	timestamp      time.Time
+}
+
+// reservationDay is the usage covered by a reservation during a day
+type reservationDay struct {
+	tags      map[string]string
+	usedHours float64
+}
+
+// ReservationAggregator accumulates the daily usage and the fees of each reservation of a billing report during ingest,
+// which are written to the reservation measurement once the billing report has been read
+type ReservationAggregator struct {
+	days map[reservationKey]*reservationDay
+	fees map[reservationKey]*parser.ReservationFee
+}
+
+// NewReservationAggregator returns a new reservation aggregator
+func NewReservationAggregator() *ReservationAggregator {
+	return &ReservationAggregator{
+		days: make(map[reservationKey]*reservationDay),
+		fees: make(map[reservationKey]*parser.ReservationFee),
+	}
+}
+
+// AddUsage accumulates a line item. Line items which are not covered by a reservation are ignored
+func (ra *ReservationAggregator) AddUsage(lineItem *parser.LineItem) {
+	reservationARN, _ := lineItem.Fields[parser.ColumnReservationARN.ColumnName].(string)
+	if reservationARN == "" {
+		return
+	}
+	key := reservationKey{reservationARN: reservationARN, timestamp: truncateDay(lineItem.Timestamp, time.UTC)}
+	rd, exists := ra.days[key]
+	if !exists {
+		rd = &reservationDay{tags: make(map[string]string)}
+		for _, tagName := range reservationBillingTags {
+			rd.tags[tagName] = lineItem.Tags[tagName]
+		}
+		rd.tags[reservationTagReservationARN] = reservationARN
+		rd.tags[reservationTagLineItemType] = reservationLineItemUsage
+		ra.days[key] = rd
+	}
+	usageAmount, _ := lineItem.Fields[parser.ColumnUsageAmount.ColumnName].(float64)
+	rd.usedHours += usageAmount
+}
+
+// AddFee accumulates the fee of a reservation. The tags of the fee must include the billing tags of the billing report
+func (ra *ReservationAggregator) AddFee(fee *parser.ReservationFee) {
+	key := reservationKey{reservationARN: fee.ReservationARN, timestamp: fee.Timestamp}
+	existing, exists := ra.fees[key]
+	if !exists {
+		ra.fees[key] = fee
+		return
+	}
+	existing.ReservedHours += fee.ReservedHours
+	existing.Fee += fee.Fee
+	if fee.UnusedHours != nil {
+		unusedHours := *fee.UnusedHours
+		if existing.UnusedHours != nil {
+			unusedHours += *existing.UnusedHours
+		}
+		existing.UnusedHours = &unusedHours
+	}
+}
+
+// Write writes the aggregated reservation usage and fees to the reservation measurement
+func (ra *ReservationAggregator) Write(ctx *CostReportContext) error {
+	bp, err := ctx.NewBatchPoints()
+	if err != nil {
+		return err
+	}
+	addPoint := func(tags map[string]string, fields map[string]interface{}, timestamp time.Time) error {
+		pt, err := client.NewPoint(ctx.reservationMeasurementName, tags, fields, timestamp)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+		bp.AddPoint(pt)
+		if len(bp.Points()) >= claudia.IngestdBatchInterval {
+			err = ctx.CostDB.Write(bp)
+			if err != nil {
+				return err
+			}
+			bp, err = ctx.NewBatchPoints()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for key, rd := range ra.days {
+		err = addPoint(rd.tags, map[string]interface{}{reservationFieldUsedHours: rd.usedHours}, key.timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	for _, fee := range ra.fees {
+		tags := make(map[string]string, len(fee.Tags)+2)
+		for tagName, val := range fee.Tags {
+			tags[tagName] = val
+		}
+		tags[reservationTagReservationARN] = fee.ReservationARN
+		tags[reservationTagLineItemType] = reservationLineItemFee
+		fields := map[string]interface{}{
+			reservationFieldReservedHours: fee.ReservedHours,
+			reservationFieldFee:           fee.Fee,
+		}
+		if fee.UnusedHours != nil {
+			fields[reservationFieldUnusedHours] = *fee.UnusedHours
+		}
+		err = addPoint(tags, fields, fee.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	if len(ra.days) > 0 || len(ra.fees) > 0 {
+		log.Printf("Report %s wrote %d days of reservation usage and %d reservation fees", ctx.ReportID, len(ra.days), len(ra.fees))
+	}
+	return ctx.CostDB.Write(bp)
+}
+
+// InstanceHours are the EC2 instance hours by pricing, and the percentage of the hours eligible for a reservation
+// (i.e. reserved and on demand hours) which were covered by a reservation
+type InstanceHours struct {
+	ReservedHours float64 `json:"reserved_hours"`
+	OnDemandHours float64 `json:"on_demand_hours"`
+	SpotHours     float64 `json:"spot_hours"`
+	Coverage      float64 `json:"coverage"`
+}
+
+// add adds hours of the given pricing (OnDemand, Reserved or Spot)
+func (h *InstanceHours) add(pricing string, hours float64) {
+	switch pricing {
+	case "Reserved":
+		h.ReservedHours += hours
+	case "Spot":
+		h.SpotHours += hours
+	default:
+		h.OnDemandHours += hours
+	}
+	if eligible := h.ReservedHours + h.OnDemandHours; eligible > 0 {
+		h.Coverage = 100 * h.ReservedHours / eligible
+	}
+}
+
+// total returns the instance hours of all pricing
+func (h *InstanceHours) total() float64 {
+	return h.ReservedHours + h.OnDemandHours + h.SpotHours
+}
+
+// RICoverage is the reservation coverage of EC2 instance hours during a timeframe, in total and per instance family,
+// region and account. Groups are in descending order of instance hours
+type RICoverage struct {
+	InstanceHours
+	Groups []*RICoverageGroup `json:"groups"`
+}
+
+// RICoverageGroup is the reservation coverage of the instance hours of an instance family in a region and account
+type RICoverageGroup struct {
+	InstanceFamily string `json:"instance_family"`
+	Region         string `json:"region"`
+	Account        string `json:"account"`
+	InstanceHours
+}
+
+// RICoverage returns the share of EC2 instance hours covered by reservations during the timeframe of the query, per
+// instance family, region and account. The filters of the query are applied, but not its grouping or interval
+func (ctx *CostReportContext) RICoverage(params *CostQuery) (*RICoverage, error) {
+	field := parser.ColumnUsageAmount.ColumnName
+	from, to := params.From, params.To
+	if !to.IsZero() {
+		// The 'To' date is inclusive of the entire day (see Cost)
+		to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, to.Location()).AddDate(0, 0, 1)
+	}
+	measurement, err := ctx.costMeasurement(params, field, from, to)
+	if err != nil {
+		return nil, err
+	}
+	filters := []string{
+		fmt.Sprintf("\"%s\"='%s'", parser.ColumnService.ColumnName, claudia.ServiceAWSEC2Instance),
+		fmt.Sprintf("\"%s\"!=''", parser.ColumnEC2InstanceFamily.ColumnName),
+	}
+	filters = append(filters, timeRangeFilters(from, to)...)
+	filterQuery, err := ctx.constructFilterQuery(params.Filters)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, filterQuery...)
+	query := fmt.Sprintf("SELECT SUM(\"%s\") FROM %s WHERE %s GROUP BY \"%s\",\"%s\",\"%s\",\"%s\"", field, measurement, strings.Join(filters, " AND "),
+		parser.ColumnEC2InstancePricing.ColumnName, parser.ColumnEC2InstanceFamily.ColumnName, parser.ColumnRegion.ColumnName, parser.ColumnUsageAccountID.ColumnName)
+	log.Println("Query: ", query)
+	res, err := ctx.CostDB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	rows := res[0].Series
+	if len(rows) > 0 && rows[len(rows)-1].Partial {
+		return nil, errors.New(errors.CodeForbidden, "Query returned too many data points. Apply additional filters or reduce time range")
+	}
+	coverage := RICoverage{Groups: make([]*RICoverageGroup, 0)}
+	groups := make(map[[3]string]*RICoverageGroup)
+	for _, row := range rows {
+		key := [3]string{
+			row.Tags[parser.ColumnEC2InstanceFamily.ColumnName],
+			row.Tags[parser.ColumnRegion.ColumnName],
+			row.Tags[parser.ColumnUsageAccountID.ColumnName],
+		}
+		group, exists := groups[key]
+		if !exists {
+			group = &RICoverageGroup{InstanceFamily: key[0], Region: key[1], Account: key[2]}
+			groups[key] = group
+			coverage.Groups = append(coverage.Groups, group)
+		}
+		pricing := row.Tags[parser.ColumnEC2InstancePricing.ColumnName]
+		for _, valueTuple := range row.Values {
+			_, hours, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, err
+			}
+			group.add(pricing, hours)
+			coverage.add(pricing, hours)
+		}
+	}
+	sort.Slice(coverage.Groups, func(i, j int) bool {
+		gi, gj := coverage.Groups[i], coverage.Groups[j]
+		if gi.total() != gj.total() {
+			return gi.total() > gj.total()
+		}
+		if gi.InstanceFamily != gj.InstanceFamily {
+			return gi.InstanceFamily < gj.InstanceFamily
+		}
+		if gi.Region != gj.Region {
+			return gi.Region < gj.Region
+		}
+		return gi.Account < gj.Account
+	})
+	return &coverage, nil
+}
+
+// ReservationHours are the hours reserved by one or more reservations, the hours which were used, and their fee
+type ReservationHours struct {
+	ReservedHours float64 `json:"reserved_hours"`
+	UsedHours     float64 `json:"used_hours"`
+	UnusedHours   float64 `json:"unused_hours"`
+	Utilization   float64 `json:"utilization"`
+	Fee           float64 `json:"fee"`
+}
+
+// add adds the hours and fee of a reservation
+func (h *ReservationHours) add(other ReservationHours) {
+	h.ReservedHours += other.ReservedHours
+	h.UsedHours += other.UsedHours
+	h.UnusedHours += other.UnusedHours
+	h.Fee += other.Fee
+	if h.ReservedHours > 0 {
+		h.Utilization = 100 * h.UsedHours / h.ReservedHours
+	}
+}
+
+// RIUtilization is the utilization of reservations during whole billing periods (From is the start of the first period
+// and To is the end of the last), in total and per reservation. Reservations are in ascending order of utilization
+type RIUtilization struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	ReservationHours
+	Reservations []*ReservationUtilization `json:"reservations"`
+}
+
+// ReservationUtilization is the utilization of a reservation
+type ReservationUtilization struct {
+	ReservationARN string `json:"reservation_arn"`
+	Account        string `json:"account"`
+	Region         string `json:"region"`
+	InstanceType   string `json:"instance_type"`
+	InstanceFamily string `json:"instance_family"`
+	ReservationHours
+}
+
+// RIUtilization returns the used and reserved hours of each reservation during the billing periods of the timeframe of
+// the query. Reserved hours and fees are those of the RIFee line items of the billing periods. Used hours are the reserved
+// hours less the unused quantity of the RIFee line items, or if the billing reports do not have the unused quantity, the
+// hours of usage covered by the reservation (capped at the reserved hours, since the usage of size flexible reservations
+// may be of instances of other sizes). Only the account and region filters of the query are supported
+func (ctx *CostReportContext) RIUtilization(params *CostQuery) (*RIUtilization, error) {
+	for columnName := range params.Filters {
+		switch columnName {
+		case parser.ColumnUsageAccountID.ColumnName, parser.ColumnRegion.ColumnName:
+		default:
+			return nil, errors.Errorf(errors.CodeBadRequest, "Reservations cannot be filtered by column: %s", columnName)
+		}
+	}
+	// Billing periods are calendar months in UTC
+	utilization := RIUtilization{Reservations: make([]*ReservationUtilization, 0)}
+	if !params.From.IsZero() {
+		utilization.From = truncateMonth(params.From, time.UTC)
+	}
+	if !params.To.IsZero() {
+		utilization.To = truncateMonth(params.To, time.UTC).AddDate(0, 1, 0)
+	}
+	filters := append([]string{fmt.Sprintf("\"%s\"='%s'", reservationTagLineItemType, reservationLineItemFee)}, timeRangeFilters(utilization.From, utilization.To)...)
+	filterQuery, err := ctx.constructFilterQuery(params.Filters)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, filterQuery...)
+	query := fmt.Sprintf("SELECT SUM(\"%s\"), SUM(\"%s\"), SUM(\"%s\"), COUNT(\"%s\"), COUNT(\"%s\") FROM %s WHERE %s GROUP BY \"%s\",\"%s\",\"%s\",\"%s\",\"%s\"",
+		reservationFieldReservedHours, reservationFieldFee, reservationFieldUnusedHours, reservationFieldReservedHours, reservationFieldUnusedHours,
+		ctx.fqReservationMeasurementName, strings.Join(filters, " AND "), reservationTagReservationARN, parser.ColumnUsageAccountID.ColumnName,
+		parser.ColumnRegion.ColumnName, parser.ColumnEC2InstanceType.ColumnName, parser.ColumnEC2InstanceFamily.ColumnName)
+	log.Println("Query: ", query)
+	res, err := ctx.CostDB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	reservations := make(map[string]*ReservationUtilization)
+	// reservations whose used hours are derived from the hours of usage they covered
+	usageDerived := make(map[string]bool)
+	for _, row := range res[0].Series {
+		reservationARN := row.Tags[reservationTagReservationARN]
+		r, exists := reservations[reservationARN]
+		if !exists {
+			r = &ReservationUtilization{
+				ReservationARN: reservationARN,
+				Account:        row.Tags[parser.ColumnUsageAccountID.ColumnName],
+				Region:         row.Tags[parser.ColumnRegion.ColumnName],
+				InstanceType:   row.Tags[parser.ColumnEC2InstanceType.ColumnName],
+				InstanceFamily: row.Tags[parser.ColumnEC2InstanceFamily.ColumnName],
+			}
+			reservations[reservationARN] = r
+			utilization.Reservations = append(utilization.Reservations, r)
+		}
+		for _, valueTuple := range row.Values {
+			r.ReservedHours += jsonNumberFloat(valueTuple[1])
+			r.Fee += jsonNumberFloat(valueTuple[2])
+			r.UnusedHours += jsonNumberFloat(valueTuple[3])
+			if jsonNumberFloat(valueTuple[4]) != jsonNumberFloat(valueTuple[5]) {
+				usageDerived[reservationARN] = true
+			}
+		}
+	}
+	if len(usageDerived) > 0 {
+		usedHours, err := ctx.reservationUsedHours(utilization.From, utilization.To)
+		if err != nil {
+			return nil, err
+		}
+		for reservationARN := range usageDerived {
+			r := reservations[reservationARN]
+			r.UnusedHours = r.ReservedHours - usedHours[reservationARN]
+			if r.UnusedHours < 0 {
+				r.UnusedHours = 0
+			}
+		}
+	}
+	for _, r := range utilization.Reservations {
+		r.UsedHours = r.ReservedHours - r.UnusedHours
+		if r.ReservedHours > 0 {
+			r.Utilization = 100 * r.UsedHours / r.ReservedHours
+		}
+		utilization.add(r.ReservationHours)
+	}
+	sort.Slice(utilization.Reservations, func(i, j int) bool {
+		if utilization.Reservations[i].Utilization != utilization.Reservations[j].Utilization {
+			return utilization.Reservations[i].Utilization < utilization.Reservations[j].Utilization
+		}
+		return utilization.Reservations[i].ReservationARN < utilization.Reservations[j].ReservationARN
+	})
+	return &utilization, nil
+}
+
+// reservationUsedHours returns the hours of usage covered by each reservation during the timeframe (to is exclusive)
+func (ctx *CostReportContext) reservationUsedHours(from, to time.Time) (map[string]float64, error) {
+	filters := append([]string{fmt.Sprintf("\"%s\"='%s'", reservationTagLineItemType, reservationLineItemUsage)}, timeRangeFilters(from, to)...)
+	query := fmt.Sprintf("SELECT SUM(\"%s\") FROM %s WHERE %s GROUP BY \"%s\"", reservationFieldUsedHours, ctx.fqReservationMeasurementName,
+		strings.Join(filters, " AND "), reservationTagReservationARN)
+	log.Println("Query: ", query)
+	res, err := ctx.CostDB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	usedHours := make(map[string]float64)
+	for _, row := range res[0].Series {
+		for _, valueTuple := range row.Values {
+			_, hours, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, err
+			}
+			usedHours[row.Tags[reservationTagReservationARN]] += hours
+		}
+	}
+	return usedHours, nil
+}
+
+// timeRangeFilters returns the InfluxDB expressions of a timeframe (to is exclusive). Zero times are unbounded
+func timeRangeFilters(from, to time.Time) []string {
+	filters := make([]string, 0, 2)
+	if !from.IsZero() {
+		filters = append(filters, fmt.Sprintf("time >= '%s'", from.UTC().Format(time.RFC3339)))
+	}
+	if !to.IsZero() {
+		filters = append(filters, fmt.Sprintf("time < '%s'", to.UTC().Format(time.RFC3339)))
+	}
+	return filters
+}
+
+// jsonNumberFloat returns the value of a numeric column of a query result, or zero if the column is null
+func jsonNumberFloat(val interface{}) float64 {
+	switch v := val.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case float64:
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,329 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+	client "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Tag and field names of the resource measurement. The resource ID is a tag in the resource measurement (unlike the
+// report measurement, where it is a field) so that cost can be grouped by resource
+const (
+	resourceTagResourceID      = "resource"
+	resourceFieldUsageFamilies = "usageFamilies"
+	resourceFieldTags          = "tags"
+)
+
+// DemotedTagsField is the field of the report measurement which stores the values of resource tags which are not
+// stored as tags (see the report's tag cardinality settings), as a JSON object keyed by resource tag column name
+const DemotedTagsField = "demotedTags"
+
+// resourceMeasurementTags are the tags of a line item which are copied to the resource measurement. The account, region,
+// and service tags can be filtered on. The billing tags allow the resource data to be purged along with the report data
+var resourceMeasurementTags = []string{
+	parser.ColumnUsageAccountID.ColumnName,
+	parser.ColumnRegion.ColumnName,
+	parser.ColumnService.ColumnName,
+	parser.ColumnBillingBucket.ColumnName,
+	parser.ColumnBillingReportPath.ColumnName,
+	parser.ColumnBillingPeriod.ColumnName,
+}
+
+// Resource is the cost of a single resource (e.g. an EC2 instance, EBS volume, or S3 bucket) over a timeframe
+type Resource struct {
+	ResourceID    string            `json:"resource_id"`
+	Cost          float64           `json:"cost"`
+	Account       string            `json:"account"`
+	Region        string            `json:"region"`
+	Services      []string          `json:"services"`
+	UsageFamilies []string          `json:"usage_families"`
+	Tags          map[string]string `json:"tags"`
+}
+
+// resourceDayKey identifies the daily aggregate of a resource
+type resourceDayKey struct {
+	resourceID string
+	service    string
+	day        time.Time
+}
+
+// resourceDay is the aggregated cost of a resource during a day
+type resourceDay struct {
+	tags          map[string]string
+	unblendedCost float64
+	blendedCost   float64
+	usageFamilies map[string]bool
+	resourceTags  map[string]string
+}
+
+// ResourceAggregator accumulates the daily cost of each resource of a billing report during ingest,
+// which is written to the resource measurement once the billing report has been read
+type ResourceAggregator struct {
+	days map[resourceDayKey]*resourceDay
+}
+
+// NewResourceAggregator returns a new resource aggregator
+func NewResourceAggregator() *ResourceAggregator {
+	return &ResourceAggregator{days: make(map[resourceDayKey]*resourceDay)}
+}
+
+// Add accumulates a line item. Line items without a resource ID are ignored
+func (ra *ResourceAggregator) Add(lineItem *parser.LineItem) {
+	resourceID, _ := lineItem.Fields[parser.ColumnResourceID.ColumnName].(string)
+	if resourceID == "" {
+		return
+	}
+	key := resourceDayKey{
+		resourceID: resourceID,
+		service:    lineItem.Tags[parser.ColumnService.ColumnName],
+		day:        truncateDay(lineItem.Timestamp, time.UTC),
+	}
+	rd, exists := ra.days[key]
+	if !exists {
+		rd = &resourceDay{
+			tags:          make(map[string]string),
+			usageFamilies: make(map[string]bool),
+			resourceTags:  make(map[string]string),
+		}
+		for _, tagName := range resourceMeasurementTags {
+			if val := lineItem.Tags[tagName]; val != "" {
+				rd.tags[tagName] = val
+			}
+		}
+		rd.tags[resourceTagResourceID] = resourceID
+		ra.days[key] = rd
+	}
+	unblendedCost, _ := lineItem.Fields[parser.ColumnUnblendedCost.ColumnName].(float64)
+	blendedCost, _ := lineItem.Fields[parser.ColumnBlendedCost.ColumnName].(float64)
+	rd.unblendedCost += unblendedCost
+	rd.blendedCost += blendedCost
+	if usageFamily := lineItem.Tags[parser.ColumnUsageFamily.ColumnName]; usageFamily != "" {
+		rd.usageFamilies[usageFamily] = true
+	}
+	for tagName, val := range lineItem.Tags {
+		if strings.HasPrefix(tagName, "resourceTags/") {
+			rd.resourceTags["tag:"+strings.TrimPrefix(tagName, "resourceTags/")] = val
+		}
+	}
+	// Resource tags demoted to a field are resource attributes all the same
+	if demotedJSON, _ := lineItem.Fields[DemotedTagsField].(string); demotedJSON != "" {
+		var demotedTags map[string]string
+		if err := json.Unmarshal([]byte(demotedJSON), &demotedTags); err != nil {
+			log.Printf("Failed to parse demoted tags of resource %s: %s", resourceID, err)
+			return
+		}
+		for tagName, val := range demotedTags {
+			rd.resourceTags["tag:"+strings.TrimPrefix(tagName, "resourceTags/")] = val
+		}
+	}
+}
+
+// Write writes the aggregated resource costs to the resource measurement. To bound the series cardinality of
+// the resource measurement, only the most costly resources (up to claudia.ResourceAggregateLimit) are written
+func (ra *ResourceAggregator) Write(ctx *CostReportContext) error {
+	totals := make(map[string]float64)
+	for key, rd := range ra.days {
+		totals[key.resourceID] += rd.unblendedCost
+	}
+	var keep map[string]bool
+	if len(totals) > claudia.ResourceAggregateLimit {
+		resourceIDs := make([]string, 0, len(totals))
+		for resourceID := range totals {
+			resourceIDs = append(resourceIDs, resourceID)
+		}
+		sort.Slice(resourceIDs, func(i, j int) bool {
+			return totals[resourceIDs[i]] > totals[resourceIDs[j]]
+		})
+		keep = make(map[string]bool, claudia.ResourceAggregateLimit)
+		for _, resourceID := range resourceIDs[:claudia.ResourceAggregateLimit] {
+			keep[resourceID] = true
+		}
+		log.Printf("Report %s has %d resources. Only the %d most costly resources will be aggregated", ctx.ReportID, len(totals), claudia.ResourceAggregateLimit)
+	}
+	bp, err := ctx.NewBatchPoints()
+	if err != nil {
+		return err
+	}
+	for key, rd := range ra.days {
+		if keep != nil && !keep[key.resourceID] {
+			continue
+		}
+		usageFamilies := make([]string, 0, len(rd.usageFamilies))
+		for usageFamily := range rd.usageFamilies {
+			usageFamilies = append(usageFamilies, usageFamily)
+		}
+		sort.Strings(usageFamilies)
+		resourceTags, err := json.Marshal(rd.resourceTags)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+		fields := map[string]interface{}{
+			parser.ColumnUnblendedCost.ColumnName: rd.unblendedCost,
+			parser.ColumnBlendedCost.ColumnName:   rd.blendedCost,
+			resourceFieldUsageFamilies:            strings.Join(usageFamilies, ","),
+			resourceFieldTags:                     string(resourceTags),
+		}
+		pt, err := client.NewPoint(ctx.resourceMeasurementName, rd.tags, fields, key.day)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+		bp.AddPoint(pt)
+		if len(bp.Points()) >= claudia.IngestdBatchInterval {
+			err = ctx.CostDB.Write(bp)
+			if err != nil {
+				return err
+			}
+			bp, err = ctx.NewBatchPoints()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.CostDB.Write(bp)
+}
+
+// TopResources returns the most costly resources during the timeframe of the query. Only the account, region and service
+// filters of the query are supported
+func (ctx *CostReportContext) TopResources(params *CostQuery, limit int) ([]*Resource, error) {
+	field := params.Field
+	if field == "" {
+		field = parser.ColumnUnblendedCost.ColumnName
+	}
+	selector := fmt.Sprintf("SUM(\"%s\"), LAST(\"%s\"), LAST(\"%s\")", field, resourceFieldUsageFamilies, resourceFieldTags)
+	resources := make(map[string]*Resource)
+	err := ctx.queryResourceSeries(params, selector, func(row models.Row) error {
+		resourceID := row.Tags[resourceTagResourceID]
+		r, exists := resources[resourceID]
+		if !exists {
+			r = &Resource{
+				ResourceID:    resourceID,
+				Account:       row.Tags[parser.ColumnUsageAccountID.ColumnName],
+				Region:        row.Tags[parser.ColumnRegion.ColumnName],
+				Services:      make([]string, 0),
+				UsageFamilies: make([]string, 0),
+				Tags:          make(map[string]string),
+			}
+			resources[resourceID] = r
+		}
+		r.Services = appendUnique(r.Services, row.Tags[parser.ColumnService.ColumnName])
+		for _, valueTuple := range row.Values {
+			_, cost, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return err
+			}
+			r.Cost += cost
+			if usageFamilies, ok := valueTuple[2].(string); ok && usageFamilies != "" {
+				for _, usageFamily := range strings.Split(usageFamilies, ",") {
+					r.UsageFamilies = appendUnique(r.UsageFamilies, usageFamily)
+				}
+			}
+			if resourceTags, ok := valueTuple[3].(string); ok && resourceTags != "" {
+				err = json.Unmarshal([]byte(resourceTags), &r.Tags)
+				if err != nil {
+					return errors.InternalError(err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	topResources := make([]*Resource, 0, len(resources))
+	for _, r := range resources {
+		topResources = append(topResources, r)
+	}
+	sortResources(topResources)
+	if len(topResources) > limit {
+		topResources = topResources[:limit]
+	}
+	return topResources, nil
+}
+
+// queryResourceSeries queries the resource measurement during the timeframe of the query, with a series per resource,
+// account, region and service, and calls fn with each series. Only the account, region and service filters of the query
+// are supported. The series are queried in pages (claudia.ResourceQueryPageSize at a time) so that the query result is
+// never truncated, regardless of the number of resources
+func (ctx *CostReportContext) queryResourceSeries(params *CostQuery, selector string, fn func(models.Row) error) error {
+	for columnName := range params.Filters {
+		switch columnName {
+		case parser.ColumnUsageAccountID.ColumnName, parser.ColumnRegion.ColumnName, parser.ColumnService.ColumnName:
+		default:
+			return errors.Errorf(errors.CodeBadRequest, "Resources cannot be filtered by column: %s", columnName)
+		}
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", selector, ctx.fqResourceMeasurementName)
+	filters := make([]string, 0)
+	if !params.From.IsZero() {
+		filters = append(filters, fmt.Sprintf("time >= '%s'", params.From.UTC().Format(time.RFC3339)))
+	}
+	if !params.To.IsZero() {
+		// The 'To' date is inclusive of the entire day (see Cost)
+		toDate := time.Date(params.To.Year(), params.To.Month(), params.To.Day(), 0, 0, 0, 0, params.To.Location()).AddDate(0, 0, 1)
+		filters = append(filters, fmt.Sprintf("time < '%s'", toDate.UTC().Format(time.RFC3339)))
+	}
+	filterQuery, err := ctx.constructFilterQuery(params.Filters)
+	if err != nil {
+		return err
+	}
+	filters = append(filters, filterQuery...)
+	if len(filters) > 0 {
+		query += " WHERE " + strings.Join(filters, " AND ")
+	}
+	query += fmt.Sprintf(" GROUP BY \"%s\",\"%s\",\"%s\",\"%s\"", resourceTagResourceID, parser.ColumnUsageAccountID.ColumnName, parser.ColumnRegion.ColumnName, parser.ColumnService.ColumnName)
+
+	for offset := 0; ; offset += claudia.ResourceQueryPageSize {
+		pageQuery := fmt.Sprintf("%s SLIMIT %d SOFFSET %d", query, claudia.ResourceQueryPageSize, offset)
+		log.Println("Query: ", pageQuery)
+		res, err := ctx.CostDB.Query(pageQuery)
+		if err != nil {
+			return err
+		}
+		rows := res[0].Series
+		if len(rows) > 0 && rows[len(rows)-1].Partial {
+			return errors.New(errors.CodeForbidden, "Query returned too many data points. Apply additional filters or reduce time range")
+		}
+		for _, row := range rows {
+			err = fn(row)
+			if err != nil {
+				return err
+			}
+		}
+		if len(rows) < claudia.ResourceQueryPageSize {
+			return nil
+		}
+	}
+}
+
+// sortResources sorts resources in descending order of cost
+func sortResources(resources []*Resource) {
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Cost != resources[j].Cost {
+			return resources[i].Cost > resources[j].Cost
+		}
+		return resources[i].ResourceID < resources[j].ResourceID
+	})
+}
+
+// appendUnique appends the value to the slice if the slice does not already contain it
+func appendUnique(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
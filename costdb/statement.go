@@ -0,0 +1,190 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+	"github.com/influxdata/influxdb/models"
+)
+
+// StatementGroup is the cost of a value of the dimension of a chargeback statement (e.g. a team) over a billing period.
+// Lines break down the direct cost of the group by service and usage family. When shared costs are allocated, Allocations
+// are the costs allocated to the group from each shared pool
+type StatementGroup struct {
+	Name        string
+	Lines       []*StatementLine
+	Allocations map[string]float64
+}
+
+// StatementLine is the cost of a service and usage family of a statement group
+type StatementLine struct {
+	Service     string  `json:"service"`
+	UsageFamily string  `json:"usage_family"`
+	Cost        float64 `json:"cost"`
+}
+
+// Subtotal returns the direct cost of the group
+func (g *StatementGroup) Subtotal() float64 {
+	subtotal := 0.0
+	for _, line := range g.Lines {
+		subtotal += line.Cost
+	}
+	return subtotal
+}
+
+// StatementGroups returns the cost of each value of a dimension (e.g. account, tag:user:Team, category:BusinessUnit)
+// between from and to (exclusive), broken down by service and usage family. If an allocation ruleset is given, the lines
+// are the direct cost of each group, and the shared pools of the ruleset are allocated across the groups. Groups are
+// ordered by name, and lines by descending cost
+func (ctx *CostReportContext) StatementGroups(from, to time.Time, dimension string, blended bool, ruleset *AllocationRuleset) ([]*StatementGroup, error) {
+	field := parser.ColumnUnblendedCost.ColumnName
+	if blended {
+		field = parser.ColumnBlendedCost.ColumnName
+	}
+	stmtCtx := ctx
+	filters := make(map[string][]string)
+	if ruleset != nil {
+		if ruleset.Dimension != dimension {
+			return nil, errors.Errorf(errors.CodeBadRequest, "Allocation ruleset allocates by %s", ruleset.Dimension)
+		}
+		// Shared pools are excluded from the lines, and are instead allocated
+		pools := ruleset.poolCategory()
+		poolCtx := *ctx
+		poolCtx.Categories = append(append([]*CostCategory{}, ctx.Categories...), pools)
+		stmtCtx = &poolCtx
+		filters[pools.APIName()] = []string{""}
+	}
+	groups := make(map[string]*StatementGroup)
+	group := func(name string) *StatementGroup {
+		g, exists := groups[name]
+		if !exists {
+			g = &StatementGroup{Name: name, Lines: make([]*StatementLine, 0), Allocations: make(map[string]float64)}
+			groups[name] = g
+		}
+		return g
+	}
+	if category := stmtCtx.category(dimension); category != nil {
+		for _, value := range category.Values() {
+			valueFilters := make(map[string][]string, len(filters)+1)
+			for columnName, filterValues := range filters {
+				valueFilters[columnName] = filterValues
+			}
+			valueFilters[category.APIName()] = []string{value}
+			rows, err := stmtCtx.statementRows(field, from, to, "", valueFilters)
+			if err != nil {
+				return nil, err
+			}
+			err = addStatementLines(group, rows, func(models.Row) string { return value })
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if strings.HasPrefix(dimension, CategoryPrefix) {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Cost category %s does not exist", strings.TrimPrefix(dimension, CategoryPrefix))
+	} else {
+		columnName := parser.APINameToColumnName(dimension)
+		if columnName == nil {
+			return nil, errors.Errorf(errors.CodeBadRequest, "Invalid statement dimension: %s", dimension)
+		}
+		rows, err := stmtCtx.statementRows(field, from, to, *columnName, filters)
+		if err != nil {
+			return nil, err
+		}
+		err = addStatementLines(group, rows, func(row models.Row) string { return row.Tags[*columnName] })
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ruleset != nil {
+		params := CostQuery{Field: field, From: from, To: to.AddDate(0, 0, -1), Filters: map[string][]string{}}
+		allocated, err := ctx.AllocatedCost(&params, ruleset)
+		if err != nil {
+			return nil, err
+		}
+		for _, allocation := range allocated.Allocations {
+			if allocation.AllocatedCost == 0 {
+				continue
+			}
+			g := group(allocation.Name)
+			for pool, cost := range allocation.Pools {
+				g.Allocations[pool] += cost
+			}
+		}
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*StatementGroup, len(names))
+	for i, name := range names {
+		g := groups[name]
+		sort.Slice(g.Lines, func(i, j int) bool { return g.Lines[i].Cost > g.Lines[j].Cost })
+		result[i] = g
+	}
+	return result, nil
+}
+
+// statementRows queries the total cost between from and to (exclusive), grouped by service, usage family and optionally a column
+func (ctx *CostReportContext) statementRows(field string, from, to time.Time, groupByColumn string, filters map[string][]string) ([]models.Row, error) {
+	measurement, err := ctx.costMeasurement(&CostQuery{Field: field}, field, from, to)
+	if err != nil {
+		return nil, err
+	}
+	filterQuery, err := ctx.constructFilterQuery(filters)
+	if err != nil {
+		return nil, err
+	}
+	groupings := []string{fmt.Sprintf("\"%s\"", parser.ColumnService.ColumnName), fmt.Sprintf("\"%s\"", parser.ColumnUsageFamily.ColumnName)}
+	if groupByColumn != "" {
+		groupings = append([]string{fmt.Sprintf("\"%s\"", groupByColumn)}, groupings...)
+	}
+	chunk := costQueryChunk{
+		build: func(c costQueryChunk) string {
+			conditions := []string{
+				fmt.Sprintf("time >= '%s'", c.from.UTC().Format(time.RFC3339)),
+				fmt.Sprintf("time < '%s'", c.to.UTC().Format(time.RFC3339)),
+			}
+			conditions = append(conditions, filterQuery...)
+			query := fmt.Sprintf("SELECT SUM(\"%s\") FROM %s WHERE %s GROUP BY %s", field, measurement,
+				strings.Join(conditions, " AND "), strings.Join(groupings, ","))
+			if c.limit > 0 {
+				query += fmt.Sprintf(" SLIMIT %d SOFFSET %d", c.limit, c.offset)
+			}
+			return query
+		},
+		from:    from,
+		to:      to,
+		grouped: true,
+	}
+	return ctx.queryChunked(chunk)
+}
+
+// addStatementLines adds the lines of rows grouped by service and usage family to their statement groups
+func addStatementLines(group func(string) *StatementGroup, rows []models.Row, groupName func(models.Row) string) error {
+	for _, row := range rows {
+		cost := 0.0
+		for _, valueTuple := range row.Values {
+			_, value, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return err
+			}
+			cost += value
+		}
+		if cost == 0 {
+			continue
+		}
+		g := group(groupName(row))
+		g.Lines = append(g.Lines, &StatementLine{
+			Service:     row.Tags[parser.ColumnService.ColumnName],
+			UsageFamily: row.Tags[parser.ColumnUsageFamily.ColumnName],
+			Cost:        cost,
+		})
+	}
+	return nil
+}
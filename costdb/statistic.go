@@ -0,0 +1,157 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Statistic is the statistic computed across the hourly totals within each interval of a cost query
+type Statistic string
+
+// Statistics of a cost query. The sum is the default, and is the total of each interval
+const (
+	StatisticSum Statistic = "sum"
+	StatisticAvg Statistic = "avg"
+	StatisticMax Statistic = "max"
+	StatisticMin Statistic = "min"
+	StatisticP50 Statistic = "p50"
+	StatisticP95 Statistic = "p95"
+)
+
+// ParseStatistic parses a statistic string
+func ParseStatistic(statisticString string) (Statistic, error) {
+	switch Statistic(statisticString) {
+	case StatisticSum, StatisticAvg, StatisticMax, StatisticMin, StatisticP50, StatisticP95:
+		return Statistic(statisticString), nil
+	default:
+		return "", errors.Errorf(errors.CodeBadRequest, "Invalid aggregation: %s", statisticString)
+	}
+}
+
+// StatisticMaxDays is the maximum timeframe of a statistic query, whose hourly totals are all returned by InfluxDB
+const StatisticMaxDays = 366
+
+// IsTotal returns whether or not the statistic is the total of each interval (i.e. values of intervals can be added together)
+func (s Statistic) IsTotal() bool {
+	return s == "" || s == StatisticSum
+}
+
+// costStatistic performs a cost query as a two stage aggregation: the query is first summed by hour, and the statistic
+// is then computed across the hourly sums within each interval (or the entire timeframe if the query has no interval).
+// Hours without cost or usage count as zero
+func (ctx *CostReportContext) costStatistic(params *CostQuery) ([]models.Row, error) {
+	if params.Aggregator != "" {
+		return nil, errors.New(errors.CodeBadRequest, "Aggregation is not supported with this query")
+	}
+	if params.From.IsZero() || params.To.IsZero() {
+		return nil, errors.New(errors.CodeBadRequest, "Aggregation requires a timeframe (from and to)")
+	}
+	// To is inclusive of the entire end date
+	if params.To.AddDate(0, 0, 1).After(params.From.AddDate(0, 0, StatisticMaxDays)) {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Aggregation timeframe cannot exceed %d days", StatisticMaxDays)
+	}
+	// Hourly sums are in UTC hours, which straddle the days of a time zone whose offset is not a whole number of hours
+	if params.Interval != "" && params.Interval != Hour && !wholeHourOffset(params.location(), params.From, params.To) {
+		return nil, errors.New(errors.CodeBadRequest, "Aggregation by day, week or month is not supported in time zones whose offset is not a whole number of hours")
+	}
+	hourly := *params
+	hourly.Statistic = ""
+	hourly.Interval = Hour
+	rows, err := ctx.Cost(&hourly)
+	if err != nil {
+		return nil, err
+	}
+	truncate := params.intervalTruncateFunc()
+	for i, row := range rows {
+		var intervals []time.Time
+		hourlyValues := make(map[time.Time][]float64)
+		for _, valueTuple := range row.Values {
+			timestamp, value, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, err
+			}
+			// Without an interval, all hours belong to a single interval starting at the first hour
+			intervalStart := timestamp
+			if truncate != nil {
+				intervalStart = truncate(timestamp)
+			} else if len(intervals) > 0 {
+				intervalStart = intervals[0]
+			}
+			if _, exists := hourlyValues[intervalStart]; !exists {
+				intervals = append(intervals, intervalStart)
+			}
+			hourlyValues[intervalStart] = append(hourlyValues[intervalStart], value)
+		}
+		sort.Sort(timeSlice(intervals))
+		rows[i].Values = make([][]interface{}, len(intervals))
+		for j, intervalStart := range intervals {
+			rows[i].Values[j] = []interface{}{intervalStart, computeStatistic(params.Statistic, hourlyValues[intervalStart])}
+		}
+		rows[i].Columns = []string{"time", string(params.Statistic)}
+	}
+	return rows, nil
+}
+
+// intervalTruncateFunc returns a function which maps a timestamp to the start of the interval of the query it belongs to.
+// Returns nil if the query has no interval
+func (params *CostQuery) intervalTruncateFunc() func(time.Time) time.Time {
+	loc := params.location()
+	switch params.Interval {
+	case "":
+		return nil
+	case Hour:
+		return func(t time.Time) time.Time { return t.Truncate(time.Hour) }
+	case Day:
+		return func(t time.Time) time.Time { return truncateDay(t, loc) }
+	case Week:
+		return func(t time.Time) time.Time { return truncateWeek(t, loc, params.WeekStart) }
+	default:
+		return params.Calendar.truncateFunc(params.Interval, loc, params.WeekStart)
+	}
+}
+
+// computeStatistic computes the statistic of the values. Percentiles use the nearest rank method
+func computeStatistic(statistic Statistic, values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	switch statistic {
+	case StatisticAvg:
+		total := 0.0
+		for _, v := range sorted {
+			total += v
+		}
+		return total / float64(len(sorted))
+	case StatisticMax:
+		return sorted[len(sorted)-1]
+	case StatisticMin:
+		return sorted[0]
+	case StatisticP50:
+		return Percentile(sorted, 50)
+	case StatisticP95:
+		return Percentile(sorted, 95)
+	default:
+		total := 0.0
+		for _, v := range sorted {
+			total += v
+		}
+		return total
+	}
+}
+
+// Percentile returns the nearest rank percentile of sorted values
+func Percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,265 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+	"github.com/influxdata/influxdb/models"
+)
+
+// TagCoverage is the cost and number of resources missing each of a set of required tag keys, per group and interval
+// * Keys are the required tag keys (API names, e.g. tag:user:owner)
+// * ResourceOnlyKeys are the required tag keys which are not stored as tags of the report measurement (e.g. demoted keys)
+// * UntaggedResources are the most costly resources missing at least one of the keys
+// The missing cost of a resource only key is the cost of the resources missing the key, which excludes line items
+// without a resource ID, and resources beyond claudia.ResourceAggregateLimit
+type TagCoverage struct {
+	Keys              []string            `json:"keys"`
+	ResourceOnlyKeys  []string            `json:"resource_only_keys"`
+	Groups            []*TagCoverageGroup `json:"groups"`
+	UntaggedResources []*UntaggedResource `json:"untagged_resources"`
+}
+
+// TagCoverageGroup is the tag coverage of a group (e.g. an account) in each interval
+type TagCoverageGroup struct {
+	Name        string                 `json:"name"`
+	DisplayName string                 `json:"display_name"`
+	Cost        float64                `json:"cost"`
+	Intervals   []*TagCoverageInterval `json:"intervals"`
+}
+
+// TagCoverageInterval is the total cost and number of resources of a group during an interval, and the cost and number
+// of resources missing each tag key
+type TagCoverageInterval struct {
+	Time        time.Time              `json:"time"`
+	Cost        float64                `json:"cost"`
+	Resources   int                    `json:"resources"`
+	Missing     map[string]*MissingTag `json:"missing"`
+	resourceIDs map[string]bool
+}
+
+// MissingTag is the cost and number of resources missing a tag key, and the percentage of the total cost it represents
+type MissingTag struct {
+	Cost        float64 `json:"cost"`
+	CostPercent float64 `json:"cost_percent"`
+	Resources   int     `json:"resources"`
+	resourceIDs map[string]bool
+}
+
+// UntaggedResource is a resource missing one or more of the required tag keys
+type UntaggedResource struct {
+	*Resource
+	MissingKeys []string `json:"missing_keys"`
+}
+
+// tagCoverageKey identifies an interval of a group
+type tagCoverageKey struct {
+	group string
+	time  int64
+}
+
+// TagCoverage computes the coverage of required tag keys during the timeframe of the query, grouped by account, region or
+// service. The missing cost of a key is the cost of the line items without the tag (queried with an empty tag value).
+// Resources are counted from the resource measurement, in which a resource is missing a key in an interval if any of its
+// days in the interval did not have the tag. Untagged resources are ranked by their cost during the timeframe, and their
+// missing keys are those of their most recent day. Only the account, region and service filters of the query are supported
+func (ctx *CostReportContext) TagCoverage(params *CostQuery, keys []string, resourceOnlyKeys map[string]bool, limit int) (*TagCoverage, error) {
+	var groupByColumn string
+	switch params.GroupBy {
+	case "":
+	case parser.ColumnUsageAccountID.APIName, parser.ColumnRegion.APIName, parser.ColumnService.APIName:
+		groupByColumn = *parser.APINameToColumnName(params.GroupBy)
+	default:
+		return nil, errors.Errorf(errors.CodeBadRequest, "Tag coverage cannot be grouped by %s", params.GroupBy)
+	}
+	if params.Interval == Hour {
+		return nil, errors.New(errors.CodeBadRequest, "Tag coverage does not support hourly intervals")
+	}
+	if !params.Statistic.IsTotal() {
+		return nil, errors.New(errors.CodeBadRequest, "Tag coverage does not support statistics")
+	}
+	loc := params.location()
+	truncate := params.intervalTruncateFunc()
+
+	coverage := TagCoverage{
+		Keys:              keys,
+		ResourceOnlyKeys:  make([]string, 0),
+		Groups:            make([]*TagCoverageGroup, 0),
+		UntaggedResources: make([]*UntaggedResource, 0),
+	}
+	intervals := make(map[tagCoverageKey]*TagCoverageInterval)
+	interval := func(group string, t time.Time) *TagCoverageInterval {
+		if truncate == nil {
+			t = params.From
+		} else {
+			t = truncate(t)
+		}
+		key := tagCoverageKey{group: group, time: t.Unix()}
+		ti, exists := intervals[key]
+		if !exists {
+			ti = &TagCoverageInterval{Time: t, Missing: make(map[string]*MissingTag, len(keys)), resourceIDs: make(map[string]bool)}
+			for _, tagKey := range keys {
+				ti.Missing[tagKey] = &MissingTag{resourceIDs: make(map[string]bool)}
+			}
+			intervals[key] = ti
+		}
+		return ti
+	}
+	addCost := func(q *CostQuery, add func(*TagCoverageInterval, float64)) error {
+		rows, err := ctx.Cost(q)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			for _, valueTuple := range row.Values {
+				timestamp, cost, err := ParseValueTuple(valueTuple)
+				if err != nil {
+					return err
+				}
+				add(interval(row.Tags[groupByColumn], timestamp), cost)
+			}
+		}
+		return nil
+	}
+	err := addCost(params, func(ti *TagCoverageInterval, cost float64) { ti.Cost += cost })
+	if err != nil {
+		return nil, err
+	}
+	for _, tagKey := range keys {
+		if resourceOnlyKeys[tagKey] {
+			coverage.ResourceOnlyKeys = append(coverage.ResourceOnlyKeys, tagKey)
+			continue
+		}
+		missingQuery := *params
+		missingQuery.Filters = make(map[string][]string, len(params.Filters)+1)
+		for columnName, values := range params.Filters {
+			missingQuery.Filters[columnName] = values
+		}
+		missingQuery.Filters[*parser.APINameToColumnName(tagKey)] = []string{""}
+		missingKey := tagKey
+		err = addCost(&missingQuery, func(ti *TagCoverageInterval, cost float64) { ti.Missing[missingKey].Cost += cost })
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	field := params.Field
+	if field == "" {
+		field = parser.ColumnUnblendedCost.ColumnName
+	}
+	resources := make(map[string]*Resource)
+	lastDays := make(map[string]time.Time)
+	selector := fmt.Sprintf("\"%s\", \"%s\", \"%s\"", field, resourceFieldTags, resourceFieldUsageFamilies)
+	err = ctx.queryResourceSeries(params, selector, func(row models.Row) error {
+		resourceID := row.Tags[resourceTagResourceID]
+		r, exists := resources[resourceID]
+		if !exists {
+			r = &Resource{
+				ResourceID:    resourceID,
+				Account:       row.Tags[parser.ColumnUsageAccountID.ColumnName],
+				Region:        row.Tags[parser.ColumnRegion.ColumnName],
+				Services:      make([]string, 0),
+				UsageFamilies: make([]string, 0),
+				Tags:          make(map[string]string),
+			}
+			resources[resourceID] = r
+		}
+		r.Services = appendUnique(r.Services, row.Tags[parser.ColumnService.ColumnName])
+		for _, valueTuple := range row.Values {
+			timestamp, cost, err := ParseValueTuple(valueTuple)
+			if err != nil {
+				return err
+			}
+			r.Cost += cost
+			resourceTags := make(map[string]string)
+			if tagsJSON, ok := valueTuple[2].(string); ok && tagsJSON != "" {
+				err = json.Unmarshal([]byte(tagsJSON), &resourceTags)
+				if err != nil {
+					return errors.InternalError(err)
+				}
+			}
+			if usageFamilies, ok := valueTuple[3].(string); ok && usageFamilies != "" {
+				for _, usageFamily := range strings.Split(usageFamilies, ",") {
+					r.UsageFamilies = appendUnique(r.UsageFamilies, usageFamily)
+				}
+			}
+			if !timestamp.Before(lastDays[resourceID]) {
+				lastDays[resourceID] = timestamp
+				r.Tags = resourceTags
+			}
+			// Resource days are UTC days, which are attributed to the same date in the time zone of the query
+			day := timestamp.UTC()
+			ti := interval(row.Tags[groupByColumn], time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc))
+			ti.resourceIDs[resourceID] = true
+			for _, tagKey := range keys {
+				if resourceTags[tagKey] != "" {
+					continue
+				}
+				missing := ti.Missing[tagKey]
+				missing.resourceIDs[resourceID] = true
+				if resourceOnlyKeys[tagKey] {
+					missing.Cost += cost
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*TagCoverageGroup)
+	for key, ti := range intervals {
+		group, exists := groups[key.group]
+		if !exists {
+			group = &TagCoverageGroup{Name: key.group, DisplayName: key.group, Intervals: make([]*TagCoverageInterval, 0)}
+			groups[key.group] = group
+			coverage.Groups = append(coverage.Groups, group)
+		}
+		group.Cost += ti.Cost
+		group.Intervals = append(group.Intervals, ti)
+		ti.Resources = len(ti.resourceIDs)
+		for _, missing := range ti.Missing {
+			missing.Resources = len(missing.resourceIDs)
+			if ti.Cost > 0 {
+				missing.CostPercent = 100 * missing.Cost / ti.Cost
+			}
+		}
+	}
+	for _, group := range coverage.Groups {
+		sort.Slice(group.Intervals, func(i, j int) bool { return group.Intervals[i].Time.Before(group.Intervals[j].Time) })
+	}
+	sort.Slice(coverage.Groups, func(i, j int) bool {
+		if coverage.Groups[i].Cost != coverage.Groups[j].Cost {
+			return coverage.Groups[i].Cost > coverage.Groups[j].Cost
+		}
+		return coverage.Groups[i].Name < coverage.Groups[j].Name
+	})
+
+	untagged := make([]*Resource, 0)
+	missingKeys := make(map[string][]string)
+	for resourceID, r := range resources {
+		for _, tagKey := range keys {
+			if r.Tags[tagKey] == "" {
+				missingKeys[resourceID] = append(missingKeys[resourceID], tagKey)
+			}
+		}
+		if len(missingKeys[resourceID]) > 0 {
+			untagged = append(untagged, r)
+		}
+	}
+	sortResources(untagged)
+	if len(untagged) > limit {
+		untagged = untagged[:limit]
+	}
+	for _, r := range untagged {
+		coverage.UntaggedResources = append(coverage.UntaggedResources, &UntaggedResource{Resource: r, MissingKeys: missingKeys[r.ResourceID]})
+	}
+	return &coverage, nil
+}
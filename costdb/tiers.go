@@ -0,0 +1,267 @@
+// Copyright 2017 Applatix, Inc.
+package costdb
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/parser"
+)
+
+// Hourly cost data of a report is kept for the duration of the report's retention policy. Optionally, the data is downsampled
+// into daily and monthly tiers, which are kept for longer. Each tier is the same measurement stored under its own retention
+// policy (e.g. rtn_<reportID>_1d), with the same tags as the hourly data. Days and months of the tiers are in UTC.
+// Tiers are downsampled by ingestd after each ingest, so they always hold the data of every billing period while it is
+// still present in the finer data. Ingestd also periodically downsamples the days/months which are about to expire from
+// the finer data, in case a downsample after an ingest failed. Coarser tiers are downsampled from the next finer tier
+// which is enabled.
+
+// downsampleIntervals are the intervals of the downsampling tiers, from finest to coarsest
+var downsampleIntervals = []Interval{Day, Month}
+
+// downsampleColumns are the fields which are summed when downsampling. Tiers are only queried for these fields
+var downsampleColumns = []parser.Column{parser.ColumnUnblendedCost, parser.ColumnBlendedCost, parser.ColumnUsageAmount}
+
+// tierRetentionPolicyName returns the name of the retention policy of the downsampling tier of the given interval
+func (ctx *CostReportContext) tierRetentionPolicyName(interval Interval) string {
+	return fmt.Sprintf("%s_%s", ctx.retentionPolicyName, interval)
+}
+
+// fqTierMeasurementName returns the fully qualified measurement name of the downsampling tier of the given interval
+func (ctx *CostReportContext) fqTierMeasurementName(interval Interval) string {
+	return fmt.Sprintf(`%s."%s"."%s"`, ctx.CostDB.databaseName, ctx.tierRetentionPolicyName(interval), ctx.measurementName)
+}
+
+// retentionDuration returns the InfluxDB duration of a retention in days, where 0 days is infinite
+func retentionDuration(days int) string {
+	if days == 0 {
+		return "INF"
+	}
+	return fmt.Sprintf("%dd", days)
+}
+
+// RetentionTiers returns the retention in days of the daily and monthly downsampling tiers of the report, where 0 keeps
+// data forever and claudia.RetentionTierDisabled is a disabled tier
+func (ctx *CostReportContext) RetentionTiers() (int, int, error) {
+	policies, err := ctx.CostDB.retentionPolicies()
+	if err != nil {
+		return 0, 0, err
+	}
+	tiers := make([]int, len(downsampleIntervals))
+	for i, interval := range downsampleIntervals {
+		days, enabled := policies[ctx.tierRetentionPolicyName(interval)]
+		if !enabled {
+			days = claudia.RetentionTierDisabled
+		}
+		tiers[i] = days
+	}
+	return tiers[0], tiers[1], nil
+}
+
+// UpdateRetentionTiers creates, alters or drops the retention policies of the daily and monthly downsampling tiers of the
+// report. Retention is in days, where 0 keeps data forever and claudia.RetentionTierDisabled disables the tier (dropping
+// its data). Returns true if a tier was created, in which case the existing data of the report should be downsampled
+func (ctx *CostReportContext) UpdateRetentionTiers(dailyDays, monthlyDays int) (bool, error) {
+	policies, err := ctx.CostDB.retentionPolicies()
+	if err != nil {
+		return false, err
+	}
+	created := false
+	for i, days := range []int{dailyDays, monthlyDays} {
+		retentionPolicyName := ctx.tierRetentionPolicyName(downsampleIntervals[i])
+		existingDays, exists := policies[retentionPolicyName]
+		var query string
+		switch {
+		case days == claudia.RetentionTierDisabled && exists:
+			log.Printf("Dropping retention tier %s", retentionPolicyName)
+			query = "DROP RETENTION POLICY \"%s\" ON \"%s\""
+		case days == claudia.RetentionTierDisabled:
+			continue
+		case !exists:
+			log.Printf("Creating retention tier %s (duration: %s)", retentionPolicyName, retentionDuration(days))
+			query = "CREATE RETENTION POLICY \"%s\" ON \"%s\" DURATION " + retentionDuration(days) + " REPLICATION 1"
+			created = true
+		case existingDays != days:
+			log.Printf("Altering retention tier %s (duration: %s)", retentionPolicyName, retentionDuration(days))
+			query = "ALTER RETENTION POLICY \"%s\" ON \"%s\" DURATION " + retentionDuration(days) + " REPLICATION 1"
+		default:
+			continue
+		}
+		_, err = ctx.CostDB.Query(query, retentionPolicyName, ctx.CostDB.databaseName)
+		if err != nil {
+			return false, err
+		}
+	}
+	return created, nil
+}
+
+// Downsample downsamples the cost data between from and to (exclusive) into each enabled tier of the report. The timeframe
+// is extended to whole days/months, but is limited to the days/months which are completely within the retention of the data
+// being downsampled, so that a day or month which has partially expired does not overwrite its previously downsampled total.
+// A zero from downsamples all retained data
+func (ctx *CostReportContext) Downsample(from, to time.Time) error {
+	policies, err := ctx.CostDB.retentionPolicies()
+	if err != nil {
+		return err
+	}
+	sourceDays, exists := policies[ctx.retentionPolicyName]
+	if !exists {
+		return nil
+	}
+	source := ctx.fqMeasurementName
+	for _, interval := range downsampleIntervals {
+		days, enabled := policies[ctx.tierRetentionPolicyName(interval)]
+		if !enabled {
+			continue
+		}
+		err = ctx.downsampleTier(source, sourceDays, interval, from, to)
+		if err != nil {
+			return err
+		}
+		source = ctx.fqTierMeasurementName(interval)
+		sourceDays = days
+	}
+	return nil
+}
+
+// DownsampleExpiring downsamples the days (or months) of each enabled tier which are about to expire from the data it is
+// downsampled from, i.e. those starting within the given number of days after the retention cutoff of the finer data
+func (ctx *CostReportContext) DownsampleExpiring(days int) error {
+	policies, err := ctx.CostDB.retentionPolicies()
+	if err != nil {
+		return err
+	}
+	sourceDays, exists := policies[ctx.retentionPolicyName]
+	if !exists {
+		return nil
+	}
+	source := ctx.fqMeasurementName
+	for _, interval := range downsampleIntervals {
+		tierDays, enabled := policies[ctx.tierRetentionPolicyName(interval)]
+		if !enabled {
+			continue
+		}
+		if sourceDays > 0 {
+			cutoff := time.Now().AddDate(0, 0, -sourceDays)
+			err = ctx.downsampleTier(source, sourceDays, interval, cutoff, cutoff.AddDate(0, 0, days))
+			if err != nil {
+				return err
+			}
+		}
+		source = ctx.fqTierMeasurementName(interval)
+		sourceDays = tierDays
+	}
+	return nil
+}
+
+// downsampleTier sums the data of the source measurement into the tier of the given interval, a month at a time
+func (ctx *CostReportContext) downsampleTier(source string, sourceDays int, interval Interval, from, to time.Time) error {
+	truncate := func(t time.Time) time.Time { return truncateDay(t, time.UTC) }
+	next := func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	if interval == Month {
+		truncate = func(t time.Time) time.Time { return truncateMonth(t, time.UTC) }
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	}
+	if sourceDays > 0 {
+		// The first whole day/month which has not started to expire from the source
+		cutoff := time.Now().AddDate(0, 0, -sourceDays)
+		if from.Before(cutoff) {
+			from = next(truncate(cutoff))
+		}
+	} else if from.IsZero() {
+		first, exists, err := ctx.measurementTimeBound(source, "", false)
+		if err != nil || !exists {
+			return err
+		}
+		from = first
+	}
+	from = truncate(from)
+	if truncate(to).Before(to) {
+		to = next(truncate(to))
+	}
+	selectors := make([]string, len(downsampleColumns))
+	for i, column := range downsampleColumns {
+		selectors[i] = fmt.Sprintf("SUM(\"%s\") AS \"%s\"", column.ColumnName, column.ColumnName)
+	}
+	grouping := "*"
+	if interval == Day {
+		grouping = fmt.Sprintf("time(%s), *", Day)
+	}
+	for windowStart := from; windowStart.Before(to); {
+		// Without a time grouping, InfluxDB writes the result of a monthly window at the start of the window
+		windowEnd := truncateMonth(windowStart, time.UTC).AddDate(0, 1, 0)
+		if windowEnd.After(to) {
+			windowEnd = to
+		}
+		_, err := ctx.CostDB.Query("SELECT %s INTO %s FROM %s WHERE time >= '%s' AND time < '%s' GROUP BY %s",
+			strings.Join(selectors, ", "), ctx.fqTierMeasurementName(interval), source,
+			windowStart.Format(time.RFC3339), windowEnd.Format(time.RFC3339), grouping)
+		if err != nil {
+			return err
+		}
+		windowStart = windowEnd
+	}
+	log.Printf("Downsampled %s into %s tier (%s - %s)", source, interval, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	return nil
+}
+
+// costMeasurement returns the fully qualified measurement which a cost query over the given timeframe (to is exclusive) is
+// performed against. This is the finest tier which retains the entire timeframe and can answer the query, or if none
+// retain it, the tier which retains the most. The hourly data is used for queries which are finer than a tier (e.g. hourly
+// intervals, intervals in other time zones, fiscal calendars of weeks), or which aggregate other than by summing
+func (ctx *CostReportContext) costMeasurement(params *CostQuery, field string, from, to time.Time) (string, error) {
+	if params.Aggregator != "" || params.location() != time.UTC || params.Interval == Hour || !isDownsampleColumn(field) {
+		return ctx.fqMeasurementName, nil
+	}
+	aligned := func(t time.Time, truncate func(time.Time, *time.Location) time.Time) bool {
+		return t.IsZero() || truncate(t, time.UTC).Equal(t)
+	}
+	if !aligned(from, truncateDay) || !aligned(to, truncateDay) {
+		return ctx.fqMeasurementName, nil
+	}
+	policies, err := ctx.CostDB.retentionPolicies()
+	if err != nil {
+		return "", err
+	}
+	covers := func(days int) bool {
+		return days == 0 || (!from.IsZero() && !from.Before(time.Now().AddDate(0, 0, -days)))
+	}
+	if covers(policies[ctx.retentionPolicyName]) {
+		return ctx.fqMeasurementName, nil
+	}
+	measurement := ctx.fqMeasurementName
+	for _, interval := range downsampleIntervals {
+		days, enabled := policies[ctx.tierRetentionPolicyName(interval)]
+		if !enabled {
+			continue
+		}
+		if interval == Month {
+			switch params.Interval {
+			case "", Month, Quarter, Year:
+			default:
+				continue
+			}
+			if params.Calendar.isWeekBased() || !aligned(from, truncateMonth) || !aligned(to, truncateMonth) {
+				continue
+			}
+		}
+		measurement = ctx.fqTierMeasurementName(interval)
+		if covers(days) {
+			break
+		}
+	}
+	return measurement, nil
+}
+
+// isDownsampleColumn returns whether or not the field is summed into the downsampling tiers
+func isDownsampleColumn(field string) bool {
+	for _, column := range downsampleColumns {
+		if column.ColumnName == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Applatix, Inc.
+package costquery
+
+import (
+	"log"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/parser"
+	"github.com/applatix/claudia/userdb"
+	"github.com/influxdata/influxdb/models"
+)
+
+// DisplayNameAliases returns a mapping of the values of a dimension to their display names (e.g. account names)
+func DisplayNameAliases(userDB *userdb.UserDatabase, dimensionName string, report *userdb.Report) map[string]string {
+	var aliases map[string]string
+	switch dimensionName {
+	case parser.ColumnUsageAccountID.APIName:
+		// Substitute accountIDs with names
+		aliases = make(map[string]string)
+		for _, account := range report.Accounts {
+			aliases[account.AWSAccountID] = account.Name
+		}
+
+	case parser.ColumnProductCode.APIName:
+		// Substitute product codes with names
+		products, err := userDB.GetProductAliases()
+		if err != nil {
+			log.Printf("Failed to lookup product codes: %s", err)
+		} else {
+			aliases = make(map[string]string)
+			for k, product := range products {
+				aliases[k] = product.Description
+			}
+		}
+	case parser.ColumnRegion.APIName, parser.ColumnDataTransferDest.APIName, parser.ColumnDataTransferSource.APIName:
+		aliases = make(map[string]string)
+		for regionName, region := range parser.RegionMapping {
+			aliases[regionName] = region.DisplayName
+		}
+	}
+	return aliases
+}
+
+// TransformRows replaces the database column name tag of each series of a cost query with the dimension, name and display name of the series
+func TransformRows(userDB *userdb.UserDatabase, report *userdb.Report, costQuery *costdb.CostQuery, rows []models.Row) {
+	aliases := DisplayNameAliases(userDB, costQuery.GroupBy, report)
+	for _, row := range rows {
+		if row.Tags == nil {
+			continue
+		}
+		var seriesName string
+		// The tag field from the influxdb result will be a mapping of the column name to column value
+		// e.g. "tags": {"claudia/EC2InstanceType": "m3.2xlarge"}
+		// We want to transform this to include: dimension API name, display name, and name
+		// This enables some navigation elements
+		for k, v := range row.Tags {
+			seriesName = v
+			delete(row.Tags, k) // remove the database column name from payload
+			break
+		}
+		displayName := seriesName
+		if aliases != nil {
+			if alias, ok := aliases[seriesName]; ok {
+				displayName = alias
+			}
+		}
+		row.Tags["dimension"] = costQuery.GroupBy
+		row.Tags["name"] = seriesName
+		row.Tags["display_name"] = displayName
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Applatix, Inc.
+package costquery
+
+import (
+	"math"
+	"strings"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+	"github.com/applatix/claudia/userdb"
+)
+
+// AllocationRuleset converts an allocation ruleset of a report to its representation in the cost database, resolving the
+// dimensions of its filters to columns. Returns an error if a dimension, method or the weights of a rule are invalid. Rulesets may allocate across the values
+// of a cost category, which is verified when the ruleset is applied
+func AllocationRuleset(a *userdb.AllocationRuleset) (*costdb.AllocationRuleset, error) {
+	if !strings.HasPrefix(a.Dimension, costdb.CategoryPrefix) && parser.APINameToColumnName(a.Dimension) == nil {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Invalid allocation dimension: %s", a.Dimension)
+	}
+	ruleset := costdb.AllocationRuleset{Dimension: a.Dimension, Rules: make([]*costdb.AllocationRule, len(a.Rules))}
+	for i, rule := range a.Rules {
+		if !costdb.ValidAllocationMethod(rule.Method) {
+			return nil, errors.Errorf(errors.CodeBadRequest, "Invalid method of allocation rule %s: %s", rule.Name, rule.Method)
+		}
+		if rule.Method == costdb.AllocationMethodFixed {
+			total := 0.0
+			for _, weight := range rule.Weights {
+				if weight <= 0 {
+					return nil, errors.Errorf(errors.CodeBadRequest, "Weights of allocation rule %s must be positive", rule.Name)
+				}
+				total += weight
+			}
+			if math.Abs(total-100) > 0.01 {
+				return nil, errors.Errorf(errors.CodeBadRequest, "Weights of allocation rule %s must total 100 (total: %g)", rule.Name, total)
+			}
+		}
+		allocationRule := costdb.AllocationRule{
+			Name:    rule.Name,
+			Filters: make(map[string][]string, len(rule.Filters)),
+			Method:  rule.Method,
+			Targets: rule.Targets,
+			Weights: rule.Weights,
+		}
+		for dimension, values := range rule.Filters {
+			if strings.HasPrefix(dimension, costdb.CategoryPrefix) {
+				return nil, errors.Errorf(errors.CodeBadRequest, "Allocation rule filters cannot refer to cost categories: %s", dimension)
+			}
+			columnName := parser.APINameToColumnName(dimension)
+			if columnName == nil {
+				return nil, errors.Errorf(errors.CodeBadRequest, "Invalid dimension in allocation rule %s: %s", rule.Name, dimension)
+			}
+			allocationRule.Filters[*columnName] = values
+		}
+		ruleset.Rules[i] = &allocationRule
+	}
+	return &ruleset, nil
+}
+
+// AllocatedCost performs a cost query with shared costs allocated by the named allocation ruleset of the report. The query
+// is grouped by the dimension of the ruleset, and cannot be grouped by another dimension
+func AllocatedCost(userDB *userdb.UserDatabase, repCtx *costdb.CostReportContext, reportID string, costQuery *costdb.CostQuery, name string) (*costdb.AllocatedCost, error) {
+	ruleset, err := ReportAllocationRuleset(userDB, reportID, name)
+	if err != nil {
+		return nil, err
+	}
+	if costQuery.GroupBy == "" {
+		costQuery.GroupBy = ruleset.Dimension
+	} else if costQuery.GroupBy != ruleset.Dimension {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Allocation ruleset %s allocates by %s", name, ruleset.Dimension)
+	}
+	return repCtx.AllocatedCost(costQuery, ruleset)
+}
+
+// ReportAllocationRuleset returns the allocation ruleset of a report with the given name, converted for evaluation by the
+// cost database
+func ReportAllocationRuleset(userDB *userdb.UserDatabase, reportID, name string) (*costdb.AllocationRuleset, error) {
+	tx, err := userDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	ruleset, err := tx.GetReportAllocationRulesetByName(reportID, name)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	tx.Commit()
+	return AllocationRuleset(ruleset)
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Applatix, Inc.
+package costquery
+
+import (
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/userdb"
+)
+
+// Statuses of a budget in its current period
+const (
+	BudgetStatusOK       = "ok"
+	BudgetStatusAtRisk   = "at_risk"
+	BudgetStatusExceeded = "exceeded"
+)
+
+// BudgetStatus is the spend-to-date and forecast of a budget in its current period
+// * Status is exceeded if the actual spend reached the budget amount, at_risk if the forecast did, otherwise ok
+// * Crossed are the thresholds of the budget which the actual or forecasted spend has reached
+// * Crossings are the threshold crossings of the period recorded by ingestd
+type BudgetStatus struct {
+	*userdb.Budget
+	*costdb.BudgetSpend
+	Status    string                   `json:"status"`
+	Crossed   userdb.BudgetThresholds  `json:"crossed"`
+	Crossings []*userdb.BudgetCrossing `json:"crossings"`
+}
+
+// BudgetFilters parses the filters of a budget, which are in the same form as the filter query args of a cost query
+func BudgetFilters(b *userdb.Budget) (map[string][]string, error) {
+	params := make(url.Values, len(b.Filters))
+	for dimension, values := range b.Filters {
+		params.Set(dimension, values)
+	}
+	filters, remaining := ParseDimensionFilters(params)
+	for dimension := range remaining {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Invalid budget filter: %s", dimension)
+	}
+	return filters, nil
+}
+
+// BudgetPeriodInterval returns the interval of a budget period
+func BudgetPeriodInterval(period string) costdb.Interval {
+	if period == userdb.BudgetPeriodQuarterly {
+		return costdb.Quarter
+	}
+	return costdb.Month
+}
+
+// EvaluateBudget returns the status of a budget of the report at the given time. Budget periods follow the fiscal calendar of the report
+func EvaluateBudget(repCtx *costdb.CostReportContext, report *userdb.Report, b *userdb.Budget, now time.Time) (*BudgetStatus, error) {
+	filters, err := BudgetFilters(b)
+	if err != nil {
+		return nil, err
+	}
+	params := costdb.CostQuery{Filters: filters, Calendar: ReportFiscalCalendar(report)}
+	spend, err := repCtx.BudgetSpend(&params, BudgetPeriodInterval(b.Period), now)
+	if err != nil {
+		return nil, err
+	}
+	status := BudgetStatus{Budget: b, BudgetSpend: spend, Status: BudgetStatusOK, Crossed: make(userdb.BudgetThresholds, 0)}
+	switch {
+	case spend.Actual >= b.Amount:
+		status.Status = BudgetStatusExceeded
+	case spend.Forecast >= b.Amount:
+		status.Status = BudgetStatusAtRisk
+	}
+	for _, threshold := range b.Thresholds {
+		if ThresholdSpend(spend, threshold) >= b.Amount*threshold.Percent/100 {
+			status.Crossed = append(status.Crossed, threshold)
+		}
+	}
+	sort.Slice(status.Crossed, func(i, j int) bool { return status.Crossed[i].Percent < status.Crossed[j].Percent })
+	return &status, nil
+}
+
+// ThresholdSpend returns the spend which a threshold is evaluated against (the actual or forecasted spend)
+func ThresholdSpend(spend *costdb.BudgetSpend, threshold *userdb.BudgetThreshold) float64 {
+	if threshold.Type == userdb.BudgetThresholdForecasted {
+		return spend.Forecast
+	}
+	return spend.Actual
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Applatix, Inc.
+package costquery
+
+import (
+	"strings"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+	"github.com/applatix/claudia/userdb"
+)
+
+// CostCategory converts a cost category of a report to its representation in the cost database, resolving the dimensions
+// of its conditions to columns. Returns an error if a dimension or operator is invalid
+func CostCategory(c *userdb.CostCategory) (*costdb.CostCategory, error) {
+	category := costdb.CostCategory{Name: c.Name, DefaultValue: c.DefaultValue, Rules: make([]*costdb.CategoryRule, len(c.Rules))}
+	for i, rule := range c.Rules {
+		categoryRule := costdb.CategoryRule{
+			Value:      rule.Value,
+			MatchAll:   rule.Match == userdb.CostCategoryMatchAll,
+			Conditions: make([]*costdb.CategoryCondition, len(rule.Conditions)),
+		}
+		for j, cond := range rule.Conditions {
+			if strings.HasPrefix(cond.Dimension, costdb.CategoryPrefix) {
+				return nil, errors.Errorf(errors.CodeBadRequest, "Cost category conditions cannot refer to cost categories: %s", cond.Dimension)
+			}
+			columnName := parser.APINameToColumnName(cond.Dimension)
+			if columnName == nil {
+				return nil, errors.Errorf(errors.CodeBadRequest, "Invalid dimension in rule %s: %s", rule.Value, cond.Dimension)
+			}
+			if !costdb.ValidCategoryOperator(cond.Operator) {
+				return nil, errors.Errorf(errors.CodeBadRequest, "Invalid operator in rule %s: %s", rule.Value, cond.Operator)
+			}
+			categoryRule.Conditions[j] = &costdb.CategoryCondition{ColumnName: *columnName, Operator: cond.Operator, Values: cond.Values}
+		}
+		category.Rules[i] = &categoryRule
+	}
+	return &category, nil
+}
+
+// ReportCostCategories returns the cost categories of a report, converted for evaluation by the cost database
+func ReportCostCategories(userDB *userdb.UserDatabase, reportID string) ([]*costdb.CostCategory, error) {
+	tx, err := userDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	userCategories, err := tx.GetReportCostCategories(reportID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	tx.Commit()
+	categories := make([]*costdb.CostCategory, len(userCategories))
+	for i, c := range userCategories {
+		categories[i], err = CostCategory(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return categories, nil
+}
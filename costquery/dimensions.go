@@ -0,0 +1,70 @@
+// Copyright 2017 Applatix, Inc.
+package costquery
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/userdb"
+)
+
+// UpdateDimensionSnapshot builds the dimension tree of a report and persists it as the snapshot of the current generation of
+// the report's cost data. The generation is read before the tree is built, so that data which changes during the build
+// invalidates the snapshot
+func UpdateDimensionSnapshot(userDB *userdb.UserDatabase, repCtx *costdb.CostReportContext) ([]*costdb.Dimension, error) {
+	tx, err := userDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	generation, err := tx.GetReportDataGeneration(repCtx.ReportID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	tx.Commit()
+	tree, err := repCtx.GetDimensionTree()
+	if err != nil {
+		return nil, err
+	}
+	dimensionsJSON, err := json.Marshal(tree)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	tx, err = userDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.UpsertDimensionSnapshot(&userdb.DimensionSnapshot{ReportID: repCtx.ReportID, DataGeneration: generation, Dimensions: dimensionsJSON})
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tree, tx.Commit()
+}
+
+// DimensionTree returns the unfiltered dimension tree of a report from its snapshot. If the snapshot is missing or is of an
+// older generation of the report's cost data (e.g. data was ingested or purged since it was built), the snapshot is rebuilt
+func DimensionTree(userDB *userdb.UserDatabase, repCtx *costdb.CostReportContext, report *userdb.Report) ([]*costdb.Dimension, error) {
+	tx, err := userDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := tx.GetDimensionSnapshot(report.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	tx.Commit()
+	if snapshot != nil && snapshot.DataGeneration == report.DataGeneration {
+		var tree []*costdb.Dimension
+		err = json.Unmarshal(snapshot.Dimensions, &tree)
+		if err == nil {
+			return tree, nil
+		}
+		log.Printf("Failed to decode dimension snapshot of report %s: %s", report.ID, err)
+	}
+	log.Printf("Rebuilding dimension snapshot of report %s", report.ID)
+	return UpdateDimensionSnapshot(userDB, repCtx)
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 Applatix, Inc.
+package costquery
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/parser"
+	"github.com/applatix/claudia/userdb"
+)
+
+// ParseTime attempts multiple acceptable time formats. Dates are interpreted in the given time zone
+func ParseTime(timeStr string, loc *time.Location) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", timeStr, loc)
+	if err != nil {
+		return t, errors.Errorf(errors.CodeBadRequest, "Invalid time: %s", timeStr)
+	}
+	return t, nil
+}
+
+// ParseLocation parses a IANA time zone name (e.g. US/Pacific, America/Los_Angeles)
+func ParseLocation(tzStr string) (*time.Location, error) {
+	loc, err := time.LoadLocation(tzStr)
+	if err != nil {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Invalid time zone: %s", tzStr)
+	}
+	return loc, nil
+}
+
+// ParseWeekday parses the name of a day of the week (e.g. monday, mon)
+func ParseWeekday(dayStr string) (time.Weekday, error) {
+	dayStr = strings.ToLower(dayStr)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		dayName := strings.ToLower(day.String())
+		if dayStr == dayName || dayStr == dayName[0:3] {
+			return day, nil
+		}
+	}
+	return time.Sunday, errors.Errorf(errors.CodeBadRequest, "Invalid week start: %s", dayStr)
+}
+
+// ReportFiscalCalendar returns the fiscal calendar configured for a report
+func ReportFiscalCalendar(report *userdb.Report) *costdb.FiscalCalendar {
+	calendar := costdb.FiscalCalendar{StartMonth: time.Month(report.FiscalYearStartMonth)}
+	if report.FiscalPeriods != "" && report.FiscalPeriods != userdb.FiscalPeriodsMonthly {
+		for _, weeks := range strings.Split(report.FiscalPeriods, "-") {
+			periodWeeks, err := strconv.Atoi(weeks)
+			if err != nil {
+				// Fiscal periods are validated when the report is updated
+				log.Printf("Ignoring invalid fiscal periods of report %s: %s", report.ID, report.FiscalPeriods)
+				calendar.Periods = nil
+				break
+			}
+			calendar.Periods = append(calendar.Periods, periodWeeks)
+		}
+	}
+	return &calendar
+}
+
+// ParseDimensionFilters parses query args related to dimensions
+func ParseDimensionFilters(params url.Values) (map[string][]string, url.Values) {
+	filters := make(map[string][]string)
+	remaining := make(url.Values)
+	for k, v := range params {
+		val := v[0]
+		columnName := parser.APINameToColumnName(k)
+		if strings.HasPrefix(k, costdb.CategoryPrefix) {
+			// Cost categories are filtered by name, and resolved by the cost database
+			filters[k] = strings.Split(val, ",")
+		} else if columnName == nil {
+			remaining[k] = v
+		} else {
+			// NOTE: comma is acceptable as a delimiter because resouce tags cannot have commas
+			// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/Using_Tags.html#tag-restrictions
+			filters[*columnName] = strings.Split(val, ",")
+		}
+	}
+	return filters, remaining
+}
+
+// ParseCostQueryParams parses the query args of a cost query
+func ParseCostQueryParams(params url.Values) (*costdb.CostQuery, error) {
+	costQuery := costdb.CostQuery{}
+	var err error
+	filters, remaining := ParseDimensionFilters(params)
+	costQuery.Filters = filters
+	// The time zone needs to be known before parsing any dates
+	costQuery.Location = time.UTC
+	if tz := remaining.Get("tz"); tz != "" {
+		costQuery.Location, err = ParseLocation(tz)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range remaining {
+		val := v[0]
+		switch k {
+		case "from":
+			costQuery.From, err = ParseTime(val, costQuery.Location)
+		case "to":
+			costQuery.To, err = ParseTime(val, costQuery.Location)
+		case "tz":
+			// already parsed
+		case "week_start":
+			costQuery.WeekStart, err = ParseWeekday(val)
+		case "group_by":
+			costQuery.GroupBy = val
+		case "interval":
+			// TODO: decide if we want to round down 'from' date if interval is weekly
+			costQuery.Interval, err = costdb.ParseInterval(val)
+		case "blended":
+			val = strings.ToLower(val)
+			if val == "true" || val == "1" || val == "t" {
+				costQuery.Field = parser.ColumnBlendedCost.ColumnName
+			}
+		default:
+			err = errors.Errorf(errors.CodeBadRequest, "Unknown param: %s", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if costQuery.Interval != "" && costQuery.From.IsZero() && costQuery.To.IsZero() {
+		err = errors.New(errors.CodeBadRequest, "Timeframe required when supplying interval")
+		return nil, err
+	}
+	return &costQuery, nil
+}
+
+// MaxPageLimit is the maximum number of series which can be requested in a single page of a cost query
+const MaxPageLimit = 1000
+
+// cursorPrefix prefixes the series offset encoded in a page cursor
+const cursorPrefix = "series:"
+
+// ParsePageParams parses and removes the 'limit' and 'cursor' query args, which select a page of the series of a cost query.
+// The cursor is an opaque token returned with the previous page. Returns the limit and offset of the page
+func ParsePageParams(params url.Values) (int, int, error) {
+	limitStr := params.Get("limit")
+	cursor := params.Get("cursor")
+	params.Del("limit")
+	params.Del("cursor")
+	if limitStr == "" {
+		if cursor != "" {
+			return 0, 0, errors.New(errors.CodeBadRequest, "Cursor requires a limit")
+		}
+		return 0, 0, nil
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit < 1 || limit > MaxPageLimit {
+		return 0, 0, errors.Errorf(errors.CodeBadRequest, "Limit must be between 1 and %d", MaxPageLimit)
+	}
+	offset := 0
+	if cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || !strings.HasPrefix(string(decoded), cursorPrefix) {
+			return 0, 0, errors.Errorf(errors.CodeBadRequest, "Invalid cursor: %s", cursor)
+		}
+		offset, err = strconv.Atoi(strings.TrimPrefix(string(decoded), cursorPrefix))
+		if err != nil || offset < 0 {
+			return 0, 0, errors.Errorf(errors.CodeBadRequest, "Invalid cursor: %s", cursor)
+		}
+	}
+	return limit, offset, nil
+}
+
+// ParseStatisticParam parses and removes the 'agg' query arg, which is the statistic computed across the hourly sums within each interval
+func ParseStatisticParam(params url.Values) (costdb.Statistic, error) {
+	agg := params.Get("agg")
+	params.Del("agg")
+	if agg == "" {
+		return costdb.StatisticSum, nil
+	}
+	return costdb.ParseStatistic(strings.ToLower(agg))
+}
+
+// ParseReportCostQuery parses the query args of /v1/cost of a report: a cost query (see ParseCostQueryParams) with a page
+// of its series, its statistic and the fiscal calendar of the report. Also parses and removes the 'allocate' query arg,
+// which is returned as the name of the allocation ruleset by which shared costs are allocated (if any)
+func ParseReportCostQuery(params url.Values, report *userdb.Report) (*costdb.CostQuery, string, error) {
+	statistic, err := ParseStatisticParam(params)
+	if err != nil {
+		return nil, "", err
+	}
+	allocate := params.Get("allocate")
+	params.Del("allocate")
+	limit, offset, err := ParsePageParams(params)
+	if err != nil {
+		return nil, "", err
+	}
+	costQuery, err := ParseCostQueryParams(params)
+	if err != nil {
+		return nil, "", err
+	}
+	costQuery.SeriesLimit = limit
+	costQuery.SeriesOffset = offset
+	costQuery.Statistic = statistic
+	costQuery.Calendar = ReportFiscalCalendar(report)
+	return costQuery, allocate, nil
+}
+
+// NextCursor returns the cursor of the page following the page of the query, or the empty string if the page was the last page
+func NextCursor(costQuery *costdb.CostQuery, numSeries int) string {
+	if costQuery.SeriesLimit == 0 || numSeries < costQuery.SeriesLimit {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s%d", cursorPrefix, costQuery.SeriesOffset+costQuery.SeriesLimit)))
+}
+
+// Comparison periods of a cost comparison
+const (
+	CompareToPreviousPeriod = "previous_period"
+	CompareToPreviousYear   = "previous_year"
+)
+
+// ComparisonQuery returns a copy of the cost query with its timeframe shifted to the comparison period.
+// The previous period is the timeframe of equal length immediately preceding the query's timeframe
+func ComparisonQuery(costQuery *costdb.CostQuery, compareTo string) (*costdb.CostQuery, error) {
+	if costQuery.From.IsZero() || costQuery.To.IsZero() {
+		return nil, errors.New(errors.CodeBadRequest, "Timeframe required when comparing costs")
+	}
+	if costQuery.To.Before(costQuery.From) {
+		return nil, errors.New(errors.CodeBadRequest, "Invalid timeframe: 'from' must not be after 'to'")
+	}
+	comparison := *costQuery
+	switch compareTo {
+	case CompareToPreviousPeriod:
+		// The timeframe is inclusive of the 'to' date. Days are counted using UTC dates so that daylight saving
+		// transitions do not affect the count
+		from := time.Date(costQuery.From.Year(), costQuery.From.Month(), costQuery.From.Day(), 0, 0, 0, 0, time.UTC)
+		to := time.Date(costQuery.To.Year(), costQuery.To.Month(), costQuery.To.Day(), 0, 0, 0, 0, time.UTC)
+		days := int(to.Sub(from).Hours()/24) + 1
+		comparison.From = costQuery.From.AddDate(0, 0, -days)
+		comparison.To = costQuery.To.AddDate(0, 0, -days)
+	case CompareToPreviousYear:
+		comparison.From = costQuery.From.AddDate(-1, 0, 0)
+		comparison.To = costQuery.To.AddDate(-1, 0, 0)
+	default:
+		return nil, errors.Errorf(errors.CodeBadRequest, "Invalid compare_to: %s", compareTo)
+	}
+	return &comparison, nil
+}
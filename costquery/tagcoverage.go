@@ -0,0 +1,63 @@
+// Copyright 2017 Applatix, Inc.
+package costquery
+
+import (
+	"strings"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/userdb"
+)
+
+// MaxTagCoverageKeys is the maximum number of required tag keys of a tag coverage query
+const MaxTagCoverageKeys = 20
+
+// ParseTagKeys parses a comma separated list of required tag keys into tag API names. A key without a prefix is a user
+// defined tag (e.g. owner is tag:user:owner), and keys may also be given as user:owner, aws:createdBy, or tag:user:owner
+func ParseTagKeys(keysParam string) ([]string, error) {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(keysParam, ",") {
+		key = strings.TrimPrefix(strings.TrimSpace(key), "tag:")
+		if key == "" {
+			continue
+		}
+		if !strings.Contains(key, ":") {
+			key = "user:" + key
+		}
+		key = "tag:" + key
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New(errors.CodeBadRequest, "At least one tag key is required")
+	}
+	if len(keys) > MaxTagCoverageKeys {
+		return nil, errors.Errorf(errors.CodeBadRequest, "At most %d tag keys can be queried", MaxTagCoverageKeys)
+	}
+	return keys, nil
+}
+
+// ResourceOnlyTagKeys returns the tag keys which are not stored as tags of the report measurement, and whose coverage can
+// only be measured from the resource measurement: denylisted and demoted keys, and keys missing from a non-empty allowlist
+func ResourceOnlyTagKeys(report *userdb.Report, keys []string) map[string]bool {
+	fieldKeys := make(map[string]bool)
+	for _, key := range report.TagKeyDenylistKeys() {
+		fieldKeys[key] = true
+	}
+	for _, key := range report.DemotedTagKeyList() {
+		fieldKeys[key] = true
+	}
+	allowlist := make(map[string]bool)
+	for _, key := range report.TagKeyAllowlistKeys() {
+		allowlist[key] = true
+	}
+	resourceOnly := make(map[string]bool)
+	for _, key := range keys {
+		if fieldKeys[key] || (len(allowlist) > 0 && !allowlist[key]) {
+			resourceOnly[key] = true
+		}
+	}
+	return resourceOnly
+}
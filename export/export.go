@@ -0,0 +1,275 @@
+// Copyright 2017 Applatix, Inc.
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/errors"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Export formats
+const (
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+// Content types of the export formats
+const (
+	ContentTypeCSV  = "text/csv; charset=utf-8"
+	ContentTypeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// unsafeFileNameChars matches characters which are replaced in the names of exported files and directories
+var unsafeFileNameChars = regexp.MustCompile("[^A-Za-z0-9_.-]+")
+
+// SafeFileName replaces the characters of a name (e.g. of a view or statement) which are unsafe in a file name, such as
+// path separators, with underscores
+func SafeFileName(name string) string {
+	return unsafeFileNameChars.ReplaceAllString(name, "_")
+}
+
+// ContentType returns the content type of an export format
+func ContentType(format string) string {
+	if format == FormatXLSX {
+		return ContentTypeXLSX
+	}
+	return ContentTypeCSV
+}
+
+// ParseFormat validates an export format
+func ParseFormat(format string) (string, error) {
+	format = strings.ToLower(format)
+	switch format {
+	case FormatCSV, FormatXLSX:
+		return format, nil
+	default:
+		return "", errors.Errorf(errors.CodeBadRequest, "Invalid format: %s", format)
+	}
+}
+
+// FormatFromAccept returns the export format requested by an Accept header, or the empty string if neither CSV nor XLSX was requested
+func FormatFromAccept(accept string) string {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.Split(mediaRange, ";")[0])
+		switch mediaType {
+		case "text/csv":
+			return FormatCSV
+		case ContentTypeXLSX:
+			return FormatXLSX
+		}
+	}
+	return ""
+}
+
+// tableWriter writes the rows of a table. Cells are either strings or numbers (float64)
+type tableWriter interface {
+	WriteRow(cells []interface{}) error
+	Close() error
+}
+
+// csvTableWriter writes a table as CSV
+type csvTableWriter struct {
+	writer *csv.Writer
+}
+
+func (t *csvTableWriter) WriteRow(cells []interface{}) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		switch v := cell.(type) {
+		case string:
+			record[i] = escapeFormula(v)
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return t.writer.Write(record)
+}
+
+// escapeFormula prefixes a string cell which a spreadsheet application would interpret as a formula (e.g. =HYPERLINK(...))
+// with a single quote. Cells contain dimension values such as resource tag values, which are controlled by any user of the
+// AWS accounts of the report
+func escapeFormula(cell string) string {
+	if cell != "" && strings.ContainsAny(cell[:1], "=+-@") {
+		return "'" + cell
+	}
+	return cell
+}
+
+func (t *csvTableWriter) Close() error {
+	t.writer.Flush()
+	return t.writer.Error()
+}
+
+// WriteCostTable writes the rows of a cost, usage or count query (after the rows have been transformed with display names)
+// as a pivoted table in the given format (see CostTableWriter)
+func WriteCostTable(w io.Writer, format string, costQuery *costdb.CostQuery, rows []models.Row) error {
+	ct, err := NewCostTableWriter(w, format, costQuery)
+	if err != nil {
+		return err
+	}
+	err = ct.WriteRows(rows)
+	if err != nil {
+		return err
+	}
+	return ct.Close()
+}
+
+// CostTableWriter writes the rows of a cost, usage or count query as a pivoted table. Each group is a row of the table, and
+// each interval is a column, followed by the total of the group. The last row of the table is the total of each interval.
+// Totals are omitted if the values of the query are a statistic (e.g. maximum) which cannot be added together.
+// Rows may be written in pages of series, so that large results are streamed. The interval columns are those of the
+// first page, which are the same for every page of a query since empty intervals are filled with zeros
+type CostTableWriter struct {
+	tw           tableWriter
+	costQuery    *costdb.CostQuery
+	loc          *time.Location
+	started      bool
+	timestamps   []time.Time
+	columnIndex  map[int64]int
+	columnTotals []float64
+	withTotals   bool
+	numColumns   int
+}
+
+// NewCostTableWriter returns a writer of the pivoted table of a query in the given format
+func NewCostTableWriter(w io.Writer, format string, costQuery *costdb.CostQuery) (*CostTableWriter, error) {
+	ct := CostTableWriter{costQuery: costQuery, loc: costQuery.Location}
+	switch format {
+	case FormatCSV:
+		ct.tw = &csvTableWriter{writer: csv.NewWriter(w)}
+	case FormatXLSX:
+		xw, err := newXLSXTableWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		ct.tw = xw
+	default:
+		return nil, errors.Errorf(errors.CodeBadRequest, "Invalid format: %s", format)
+	}
+	if ct.loc == nil {
+		ct.loc = time.UTC
+	}
+	return &ct, nil
+}
+
+// writeHeader determines the interval columns of the table from the first page of rows, and writes the header row
+func (ct *CostTableWriter) writeHeader(rows []models.Row) error {
+	costQuery := ct.costQuery
+	if costQuery.Interval != "" {
+		seen := make(map[int64]bool)
+		for _, row := range rows {
+			for _, valueTuple := range row.Values {
+				timestamp, _, err := costdb.ParseValueTuple(valueTuple)
+				if err != nil {
+					return err
+				}
+				if !seen[timestamp.Unix()] {
+					seen[timestamp.Unix()] = true
+					ct.timestamps = append(ct.timestamps, timestamp)
+				}
+			}
+		}
+		sort.Slice(ct.timestamps, func(i, j int) bool { return ct.timestamps[i].Before(ct.timestamps[j]) })
+	}
+	header := []interface{}{"Name", "Display Name"}
+	for _, timestamp := range ct.timestamps {
+		header = append(header, formatTimestamp(timestamp.In(ct.loc), costQuery.Interval))
+	}
+	// The last column is the total of each group. A statistic has no total, but without an interval its single value
+	// takes the place of the total column
+	ct.withTotals = costQuery.Statistic.IsTotal()
+	ct.numColumns = len(ct.timestamps) + 1
+	if ct.withTotals {
+		header = append(header, "Total")
+	} else if costQuery.Interval == "" {
+		header = append(header, strings.ToUpper(string(costQuery.Statistic)))
+	} else {
+		ct.numColumns = len(ct.timestamps)
+	}
+	ct.columnIndex = make(map[int64]int, len(ct.timestamps))
+	for i, timestamp := range ct.timestamps {
+		ct.columnIndex[timestamp.Unix()] = i
+	}
+	ct.columnTotals = make([]float64, len(ct.timestamps)+1)
+	return errors.InternalError(ct.tw.WriteRow(header))
+}
+
+// WriteRows writes a page of rows of the query. The header is written before the first page
+func (ct *CostTableWriter) WriteRows(rows []models.Row) error {
+	if !ct.started {
+		ct.started = true
+		err := ct.writeHeader(rows)
+		if err != nil {
+			return err
+		}
+	}
+	for _, row := range rows {
+		values := make([]float64, len(ct.timestamps)+1)
+		for _, valueTuple := range row.Values {
+			timestamp, value, err := costdb.ParseValueTuple(valueTuple)
+			if err != nil {
+				return err
+			}
+			if ct.costQuery.Interval != "" {
+				i, ok := ct.columnIndex[timestamp.Unix()]
+				if !ok {
+					return errors.Errorf(errors.CodeInternal, "Interval %s of %s is not a column of the table", timestamp.Format(time.RFC3339), row.Tags["name"])
+				}
+				values[i] += value
+			}
+			values[len(ct.timestamps)] += value
+		}
+		name := row.Tags["name"]
+		displayName := row.Tags["display_name"]
+		if displayName == "" {
+			displayName = "All"
+		}
+		cells := []interface{}{name, displayName}
+		for i, value := range values[:ct.numColumns] {
+			cells = append(cells, value)
+			ct.columnTotals[i] += value
+		}
+		err := ct.tw.WriteRow(cells)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+	}
+	return nil
+}
+
+// Close writes the totals row (and the header, if no rows were written) and completes the table
+func (ct *CostTableWriter) Close() error {
+	if !ct.started {
+		err := ct.WriteRows(nil)
+		if err != nil {
+			return err
+		}
+	}
+	if ct.withTotals {
+		cells := []interface{}{"Total", ""}
+		for _, total := range ct.columnTotals {
+			cells = append(cells, total)
+		}
+		err := ct.tw.WriteRow(cells)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+	}
+	return errors.InternalError(ct.tw.Close())
+}
+
+// formatTimestamp formats the start of an interval as a column header
+func formatTimestamp(t time.Time, interval costdb.Interval) string {
+	if interval == costdb.Hour {
+		return t.Format("2006-01-02 15:04")
+	}
+	return t.Format("2006-01-02")
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 Applatix, Inc.
+package export
+
+import (
+	"encoding/csv"
+	"html/template"
+	"io"
+	"strconv"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/errors"
+)
+
+// Statement is the chargeback statement of a group (e.g. a team) for a billing period
+type Statement struct {
+	ReportName    string
+	BillingPeriod string
+	Dimension     string
+	Name          string
+	DisplayName   string
+	Lines         []*costdb.StatementLine
+	Adjustments   []*StatementAdjustment
+}
+
+// StatementAdjustment is an adjustment of a statement, such as shared costs allocated to the group, or a credit
+type StatementAdjustment struct {
+	Description string
+	Amount      float64
+}
+
+// Subtotal returns the total of the lines of the statement
+func (s *Statement) Subtotal() float64 {
+	subtotal := 0.0
+	for _, line := range s.Lines {
+		subtotal += line.Cost
+	}
+	return subtotal
+}
+
+// AdjustmentsTotal returns the total of the adjustments of the statement
+func (s *Statement) AdjustmentsTotal() float64 {
+	total := 0.0
+	for _, adjustment := range s.Adjustments {
+		total += adjustment.Amount
+	}
+	return total
+}
+
+// Total returns the total of the statement, including adjustments
+func (s *Statement) Total() float64 {
+	return s.Subtotal() + s.AdjustmentsTotal()
+}
+
+// formatAmount formats a cost as dollars and cents
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{"amount": formatAmount}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.DisplayName}} - {{.BillingPeriod}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 13px; color: #333; margin: 32px; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 24px; }
+th, td { padding: 6px 8px; border-bottom: 1px solid #ddd; text-align: left; }
+td.amount, th.amount { text-align: right; }
+tr.total td { font-weight: bold; border-top: 2px solid #333; }
+</style>
+</head>
+<body>
+<h1>{{.DisplayName}}</h1>
+<p>{{.ReportName}} &middot; Billing period {{.BillingPeriod}} &middot; {{.Dimension}}: {{.Name}}</p>
+<h2>Usage</h2>
+<table>
+<tr><th>Service</th><th>Usage Family</th><th class="amount">Cost</th></tr>
+{{range .Lines}}<tr><td>{{.Service}}</td><td>{{.UsageFamily}}</td><td class="amount">{{amount .Cost}}</td></tr>
+{{end}}<tr class="total"><td colspan="2">Subtotal</td><td class="amount">{{amount .Subtotal}}</td></tr>
+</table>
+{{if .Adjustments}}<h2>Adjustments</h2>
+<table>
+<tr><th>Description</th><th class="amount">Amount</th></tr>
+{{range .Adjustments}}<tr><td>{{.Description}}</td><td class="amount">{{amount .Amount}}</td></tr>
+{{end}}<tr class="total"><td>Total adjustments</td><td class="amount">{{amount .AdjustmentsTotal}}</td></tr>
+</table>
+{{end}}<table>
+<tr class="total"><td>Total</td><td class="amount">{{amount .Total}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// WriteStatementHTML writes a statement as a printable HTML document
+func WriteStatementHTML(w io.Writer, s *Statement) error {
+	err := statementTemplate.Execute(w, s)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	return nil
+}
+
+// WriteStatementCSV writes a statement as CSV. Each line and adjustment is a row, followed by the subtotal, the total
+// of the adjustments, and the total
+func WriteStatementCSV(w io.Writer, s *Statement) error {
+	tw := &csvTableWriter{writer: csv.NewWriter(w)}
+	rows := [][]interface{}{{"Type", "Service", "Usage Family", "Description", "Amount"}}
+	for _, line := range s.Lines {
+		rows = append(rows, []interface{}{"Usage", line.Service, line.UsageFamily, "", line.Cost})
+	}
+	for _, adjustment := range s.Adjustments {
+		rows = append(rows, []interface{}{"Adjustment", "", "", adjustment.Description, adjustment.Amount})
+	}
+	rows = append(rows,
+		[]interface{}{"Subtotal", "", "", "", s.Subtotal()},
+		[]interface{}{"Adjustments", "", "", "", s.AdjustmentsTotal()},
+		[]interface{}{"Total", "", "", "", s.Total()},
+	)
+	for _, cells := range rows {
+		err := tw.WriteRow(cells)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	return nil
+}
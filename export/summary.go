@@ -0,0 +1,99 @@
+// Copyright 2017 Applatix, Inc.
+package export
+
+import (
+	"html/template"
+	"io"
+	"sort"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/errors"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Summary is the HTML summary of the cost queries of a scheduled delivery, e.g. the query of a saved view, or each
+// section of the summary dashboard
+type Summary struct {
+	Title      string
+	ReportName string
+	From       string
+	To         string
+	Sections   []*SummarySection
+}
+
+// SummarySection is the total of each series of a cost query, in descending order of cost
+type SummarySection struct {
+	Title  string
+	Rows   []*SummaryRow
+	Total  float64
+	Totals bool
+}
+
+// SummaryRow is the total of a series of a cost query
+type SummaryRow struct {
+	DisplayName string
+	Value       float64
+}
+
+// NewSummarySection summarizes the rows of a cost query (after the rows have been transformed with display names).
+// Values are added across intervals, unless the values of the query are a statistic (e.g. maximum) which cannot be
+// added together, in which case the statistic of the last interval is summarized and the section has no total
+func NewSummarySection(title string, costQuery *costdb.CostQuery, rows []models.Row) (*SummarySection, error) {
+	section := SummarySection{Title: title, Rows: make([]*SummaryRow, 0, len(rows)), Totals: costQuery.Statistic.IsTotal()}
+	for _, row := range rows {
+		summaryRow := SummaryRow{DisplayName: row.Tags["display_name"]}
+		if summaryRow.DisplayName == "" {
+			summaryRow.DisplayName = "All"
+		}
+		for _, valueTuple := range row.Values {
+			_, value, err := costdb.ParseValueTuple(valueTuple)
+			if err != nil {
+				return nil, err
+			}
+			if section.Totals {
+				summaryRow.Value += value
+			} else {
+				summaryRow.Value = value
+			}
+		}
+		section.Total += summaryRow.Value
+		section.Rows = append(section.Rows, &summaryRow)
+	}
+	sort.SliceStable(section.Rows, func(i, j int) bool { return section.Rows[i].Value > section.Rows[j].Value })
+	return &section, nil
+}
+
+var summaryTemplate = template.Must(template.New("summary").Funcs(template.FuncMap{"amount": formatAmount}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 13px; color: #333; margin: 32px; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 24px; }
+th, td { padding: 6px 8px; border-bottom: 1px solid #ddd; text-align: left; }
+td.amount, th.amount { text-align: right; }
+tr.total td { font-weight: bold; border-top: 2px solid #333; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.ReportName}} &middot; {{.From}} to {{.To}}</p>
+{{range .Sections}}<h2>{{.Title}}</h2>
+<table>
+<tr><th>Name</th><th class="amount">Cost</th></tr>
+{{range .Rows}}<tr><td>{{.DisplayName}}</td><td class="amount">{{amount .Value}}</td></tr>
+{{end}}{{if .Totals}}<tr class="total"><td>Total</td><td class="amount">{{amount .Total}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// WriteSummaryHTML writes a summary as an HTML document
+func WriteSummaryHTML(w io.Writer, s *Summary) error {
+	err := summaryTemplate.Execute(w, s)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	return nil
+}
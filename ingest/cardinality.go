@@ -0,0 +1,178 @@
+// Copyright 2017 Applatix, Inc.
+package ingest
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/parser"
+	"github.com/applatix/claudia/userdb"
+)
+
+// tagGovernor limits the series cardinality of a report by deciding which resource tags of a line item are stored as
+// (indexed) tags, and which are demoted to a field. A tag key is demoted if it is on the report's denylist, is not on a
+// non-empty allowlist, or was previously demoted. Otherwise, a tag key is demoted once its distinct values during
+// the ingest of a manifest exceed the report's tag value limit, or while the projected series cardinality of the report
+// exceeds its series budget (see countSeries). Allowlisted tag keys are never demoted automatically.
+// Line items ingested before a tag key is demoted keep the tag, and the tag key is demoted in all subsequent ingests.
+// The series already written with a demoted tag key remain until their billing period is reingested (which purges it) or expires
+// * existing is the series cardinality of the report outside of the billing period being ingested
+// * series are the keys of the distinct series of the ingest, as they would be written with the currently demoted tag keys
+type tagGovernor struct {
+	allowlist    map[string]bool
+	denylist     map[string]bool
+	demoted      map[string]bool
+	limit        int
+	values       map[string]map[string]bool
+	newlyDemoted []string
+	budget       int
+	existing     int
+	series       map[string]bool
+}
+
+// newTagGovernor returns a tag governor for the cardinality settings of a report
+func newTagGovernor(report *userdb.Report) *tagGovernor {
+	tg := tagGovernor{
+		allowlist: tagKeyColumns(report.TagKeyAllowlistKeys()),
+		denylist:  tagKeyColumns(report.TagKeyDenylistKeys()),
+		demoted:   tagKeyColumns(report.DemotedTagKeyList()),
+		limit:     report.GetTagValueLimit(),
+		values:    make(map[string]map[string]bool),
+		budget:    report.GetSeriesBudget(),
+		series:    make(map[string]bool),
+	}
+	return &tg
+}
+
+// tagKeyColumns returns the set of resource tag column names (e.g. resourceTags/user:Team) of API tag keys (e.g. tag:user:Team)
+func tagKeyColumns(tagKeys []string) map[string]bool {
+	columns := make(map[string]bool, len(tagKeys))
+	for _, tagKey := range tagKeys {
+		columns["resourceTags/"+strings.TrimPrefix(tagKey, "tag:")] = true
+	}
+	return columns
+}
+
+// isTag returns whether or not the resource tag column should be stored as a tag
+func (tg *tagGovernor) isTag(columnName, value string) bool {
+	if tg.denylist[columnName] || tg.demoted[columnName] {
+		return false
+	}
+	if tg.allowlist[columnName] {
+		return true
+	}
+	if len(tg.allowlist) > 0 {
+		return false
+	}
+	values, ok := tg.values[columnName]
+	if !ok {
+		values = make(map[string]bool)
+		tg.values[columnName] = values
+	}
+	values[value] = true
+	if tg.limit > 0 && len(values) > tg.limit {
+		log.Printf("Demoting %s from tag to field: more than %d distinct values", columnName, tg.limit)
+		tg.demote(columnName)
+		return false
+	}
+	return true
+}
+
+// demote demotes a resource tag column for the remainder of the ingest, and records it to be persisted in the report.
+// The column is removed from the keys of the series counted against the series budget
+func (tg *tagGovernor) demote(columnName string) {
+	tg.demoted[columnName] = true
+	delete(tg.values, columnName)
+	tg.newlyDemoted = append(tg.newlyDemoted, "tag:"+strings.TrimPrefix(columnName, "resourceTags/"))
+	if len(tg.series) == 0 {
+		return
+	}
+	series := make(map[string]bool, len(tg.series))
+	for key := range tg.series {
+		tags := strings.Split(key, seriesKeySeparator)
+		remaining := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			if !strings.HasPrefix(tag, columnName+"=") {
+				remaining = append(remaining, tag)
+			}
+		}
+		series[strings.Join(remaining, seriesKeySeparator)] = true
+	}
+	tg.series = series
+}
+
+// demoteHighestCardinality demotes the tag key with the most distinct values (allowlisted keys are not counted).
+// Returns false if there is no tag key left to demote
+func (tg *tagGovernor) demoteHighestCardinality() bool {
+	var highest string
+	for columnName, values := range tg.values {
+		if highest == "" || len(values) > len(tg.values[highest]) {
+			highest = columnName
+		}
+	}
+	if highest == "" {
+		return false
+	}
+	log.Printf("Demoting %s from tag to field: %d distinct values", highest, len(tg.values[highest]))
+	tg.demote(highest)
+	return true
+}
+
+// seriesKeySeparator separates the tags of a series key. Tag keys and values of line items never contain it
+const seriesKeySeparator = "\x00"
+
+// countSeries counts the series of the tags of a line item against the series budget of the report. Tag keys with the most
+// distinct values are demoted while the projected series cardinality (the existing series, plus the distinct series of the
+// ingest without the demoted tag keys) exceeds the budget. Counting stops once there is no tag key left to demote
+func (tg *tagGovernor) countSeries(tags map[string]string) {
+	if tg.budget <= 0 {
+		return
+	}
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	key := strings.Join(pairs, seriesKeySeparator)
+	if tg.series[key] {
+		return
+	}
+	tg.series[key] = true
+	for tg.existing+len(tg.series) > tg.budget {
+		log.Printf("Projected series cardinality %d exceeds budget %d", tg.existing+len(tg.series), tg.budget)
+		if !tg.demoteHighestCardinality() {
+			log.Printf("No tag keys left to demote. Series budget %d cannot be met", tg.budget)
+			tg.budget = 0
+			tg.series = nil
+			return
+		}
+	}
+}
+
+// Apply moves the resource tags of the line item which should not be stored as tags into the demoted tags field, and
+// counts the series of the line item against the series budget
+func (tg *tagGovernor) Apply(lineItem *parser.LineItem) error {
+	var demotedTags map[string]string
+	for columnName, value := range lineItem.Tags {
+		if !parser.ResourceTagMatcher.MatchString(columnName) || tg.isTag(columnName, value) {
+			continue
+		}
+		if demotedTags == nil {
+			demotedTags = make(map[string]string)
+		}
+		demotedTags[columnName] = value
+		delete(lineItem.Tags, columnName)
+	}
+	if demotedTags != nil {
+		demotedJSON, err := json.Marshal(demotedTags)
+		if err != nil {
+			return err
+		}
+		lineItem.Fields[costdb.DemotedTagsField] = string(demotedJSON)
+	}
+	tg.countSeries(lineItem.Tags)
+	return nil
+}
@@ -78,10 +78,10 @@ func unzipReport(zipPath string) (string, error) {
 func shouldIngest(repCtx *costdb.CostReportContext, manifest *billingbucket.Manifest) bool {
 	log.Printf("Determining if %s/%s/%s AssemblyID %s should be ingested", manifest.Bucket, manifest.ReportPath(), manifest.BillingPeriodString(), manifest.AssemblyID)
 	ingStatusByBillingPeriod := func() (*costdb.IngestStatus, error) {
-		return repCtx.CostDB.GetIngestStatusByBillingPeriod(manifest.Bucket, manifest.ReportPath(), manifest.BillingPeriodString())
+		return repCtx.GetIngestStatusByBillingPeriod(manifest.Bucket, manifest.ReportPath(), manifest.BillingPeriodString())
 	}
 	ingStatusByAssemblyID := func() (*costdb.IngestStatus, error) {
-		return repCtx.CostDB.GetIngestStatus(manifest.AssemblyID)
+		return repCtx.GetIngestStatus(manifest.AssemblyID)
 	}
 	funcs := map[string]func() (*costdb.IngestStatus, error){
 		"billing period": ingStatusByBillingPeriod,
@@ -114,8 +114,10 @@ func shouldIngest(repCtx *costdb.CostReportContext, manifest *billingbucket.Mani
 	return false
 }
 
-// IngestReportFile ingests a report file into the cost database
-func IngestReportFile(repCtx *costdb.CostReportContext, job *manifestJob, reportPath string, run *bool) error {
+// IngestReportFile ingests a report file into the cost database. Line items are also accumulated into the resource and
+// reservation aggregators, and the rows read, written and skipped are counted in the statistics of the ingest attempt. The tag governor decides
+// which resource tags are stored as tags
+func IngestReportFile(repCtx *costdb.CostReportContext, job *manifestJob, reportPath string, resources *costdb.ResourceAggregator, reservations *costdb.ReservationAggregator, stats *costdb.IngestStats, tags *tagGovernor, run *bool) error {
 	var err error
 	log.Printf("Processing %s.\n", reportPath)
 	if strings.HasSuffix(reportPath, ".zip") {
@@ -164,13 +166,26 @@ func IngestReportFile(repCtx *costdb.CostReportContext, job *manifestJob, report
 			return errors.InternalError(err)
 		}
 		lineNum++
+		stats.RowsRead++
 
-		lineItem, err := parser.ParseLine(fields, line)
+		lineItem, skipReason, err := parser.ParseLine(fields, line)
 		if err != nil {
 			return err
 		}
 		if lineItem == nil {
-			log.Printf("Report %s (%s) line %d skipped", repCtx.ReportID, reportPath, lineNum)
+			// RIFee line items are not stored as cost, but record the reserved hours and fee of each reservation
+			fee, err := parser.ParseReservationFee(fields, line)
+			if err != nil {
+				return err
+			}
+			if fee != nil {
+				fee.Tags[parser.ColumnBillingBucket.ColumnName] = job.bucket.Bucketname
+				fee.Tags[parser.ColumnBillingReportPath.ColumnName] = job.bucket.ReportPath
+				fee.Tags[parser.ColumnBillingPeriod.ColumnName] = billingPeriodStr
+				reservations.AddFee(fee)
+			}
+			log.Printf("Report %s (%s) line %d skipped (%s)", repCtx.ReportID, reportPath, lineNum, skipReason)
+			stats.AddSkipped(skipReason)
 			continue
 		}
 		// Add the line number as a nanosecond offset to ensure data points are not deduped by InfluxDB
@@ -179,6 +194,13 @@ func IngestReportFile(repCtx *costdb.CostReportContext, job *manifestJob, report
 		lineItem.Tags[parser.ColumnBillingBucket.ColumnName] = job.bucket.Bucketname
 		lineItem.Tags[parser.ColumnBillingReportPath.ColumnName] = job.bucket.ReportPath
 		lineItem.Tags[parser.ColumnBillingPeriod.ColumnName] = billingPeriodStr
+		reservations.AddUsage(lineItem)
+		err = tags.Apply(lineItem)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+		// The resource aggregator reads demoted tags from the demoted tags field, so resources keep all of their tags
+		resources.Add(lineItem)
 
 		pt, err := repCtx.NewPoint(lineItem.Tags, lineItem.Fields, lineItem.Timestamp)
 		if err != nil {
@@ -195,6 +217,7 @@ func IngestReportFile(repCtx *costdb.CostReportContext, job *manifestJob, report
 			if err != nil {
 				return err
 			}
+			stats.RowsWritten += int64(len(bp.Points()))
 			bp, err = repCtx.NewBatchPoints()
 			if err != nil {
 				return err
@@ -205,6 +228,7 @@ func IngestReportFile(repCtx *costdb.CostReportContext, job *manifestJob, report
 	if err != nil {
 		return err
 	}
+	stats.RowsWritten += int64(len(bp.Points()))
 	elapsed = time.Now().Sub(startTime)
 	currRecords, _ := repCtx.CountRecords()
 	created := currRecords - startRecords
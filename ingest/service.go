@@ -17,8 +17,11 @@ import (
 	"github.com/applatix/claudia"
 	"github.com/applatix/claudia/billingbucket"
 	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/costquery"
 	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/notification"
 	"github.com/applatix/claudia/parser"
+	"github.com/applatix/claudia/scheduler"
 	"github.com/applatix/claudia/userdb"
 	"github.com/applatix/claudia/util"
 	"github.com/aws/aws-sdk-go/aws"
@@ -37,6 +40,8 @@ type IngestSvcContext struct {
 	updateCh    chan bool
 	interruptCh chan bool
 	numWorkers  int
+	notifier    *notification.Notifier
+	scheduler   *scheduler.Scheduler
 }
 
 // This regex will match a billing period, e.g. YYYYMMDD-YYYYMMDD
@@ -49,7 +54,15 @@ func NewIngestSvcContext(userDB *userdb.UserDatabase, costDbURL string, reportDi
 	if err != nil {
 		return nil, errors.InternalError(err)
 	}
-	return &IngestSvcContext{userDB: userDB, costDB: costDB, reportDir: reportDir, numWorkers: workers}, nil
+	return &IngestSvcContext{userDB: userDB, costDB: costDB, reportDir: reportDir, numWorkers: workers, notifier: notification.NewNotifier(userDB), scheduler: scheduler.NewScheduler(userDB, costDB)}, nil
+}
+
+// notify queues a notification of a report event. Failures are logged since notifications never fail the ingest
+func (isc *IngestSvcContext) notify(event *userdb.NotificationEvent, dedupKey string, dedupWindow time.Duration) {
+	err := isc.notifier.Notify(event, dedupKey, dedupWindow)
+	if err != nil {
+		log.Printf("Failed to queue %s notification of report %s: %s", event.Type, event.ReportID, err)
+	}
 }
 
 func reportMonitorHandler(isc *IngestSvcContext) func(http.ResponseWriter, *http.Request) {
@@ -64,10 +77,15 @@ func reportMonitorHandler(isc *IngestSvcContext) func(http.ResponseWriter, *http
 	})
 }
 
-// poller is the background worker which will periodically check the buckets for new reports and process them
+// poller is the background worker which will periodically check the buckets for new reports and process them.
+// Scheduled deliveries are run by the poller between process intervals, so that they are never run mid-processing
 func (isc *IngestSvcContext) poller() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
+	scheduleTicker := time.NewTicker(claudia.ScheduleCheckInterval)
+	defer scheduleTicker.Stop()
+	downsampleTicker := time.NewTicker(claudia.DownsampleExpiringInterval)
+	defer downsampleTicker.Stop()
 	retry := make(chan bool, 32)
 	isc.updateCh <- true
 	for {
@@ -82,6 +100,12 @@ func (isc *IngestSvcContext) poller() {
 		case <-retry:
 			log.Println("Reprocessing due to retry")
 			err = isc.processInterval()
+		case <-scheduleTicker.C:
+			isc.runSchedules()
+			continue
+		case <-downsampleTicker.C:
+			isc.downsampleExpiring()
+			continue
 		}
 		if err != nil {
 			log.Printf("Process interval failed: %s", err)
@@ -101,10 +125,42 @@ func (isc *IngestSvcContext) poller() {
 		} else {
 			isc.cleanReportDir()
 			log.Printf("Process interval completed successfully")
+			isc.runSchedules()
+		}
+	}
+}
+
+// downsampleExpiring downsamples the data of every report which is about to expire into its retention tiers. Failures are
+// logged since the data is normally downsampled after each ingest
+func (isc *IngestSvcContext) downsampleExpiring() {
+	tx, err := isc.userDB.Begin()
+	if err != nil {
+		log.Printf("Failed to downsample expiring data: %s", err)
+		return
+	}
+	reports, err := tx.GetReports()
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to downsample expiring data: %s", err)
+		return
+	}
+	tx.Commit()
+	for _, report := range reports {
+		err = isc.costDB.NewCostReportContext(report.ID).DownsampleExpiring(claudia.DownsampleExpiringDays)
+		if err != nil {
+			log.Printf("Failed to downsample expiring data of report %s: %s", report.ID, err)
 		}
 	}
 }
 
+// runSchedules runs the scheduled deliveries which are due. Failures are logged since schedules never fail the poller
+func (isc *IngestSvcContext) runSchedules() {
+	err := isc.scheduler.RunDue(time.Now())
+	if err != nil {
+		log.Printf("Failed to run schedules: %s", err)
+	}
+}
+
 func (isc *IngestSvcContext) processInterval() error {
 	log.Println("processInterval begin stats:")
 	util.LogStats()
@@ -137,6 +193,18 @@ func (isc *IngestSvcContext) processInterval() error {
 	if upStatusErr != nil {
 		log.Printf("Failed to update all report statuses: %s", upStatusErr)
 	}
+	// Snapshot the dimension tree of every ingested report, including reports with failed ingests since they may have
+	// partially ingested data. Failures are not fatal since the API server will rebuild a missing snapshot
+	ingested := make(map[string]bool)
+	for _, job := range toProcess {
+		if !ingested[job.report.ID] {
+			ingested[job.report.ID] = true
+			_, snapshotErr := costquery.UpdateDimensionSnapshot(isc.userDB, isc.costDB.NewCostReportContext(job.report.ID))
+			if snapshotErr != nil {
+				log.Printf("Failed to update dimension snapshot of report %s: %s", job.report.ID, snapshotErr)
+			}
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -148,9 +216,21 @@ func (isc *IngestSvcContext) processInterval() error {
 			log.Printf("Failed to update report %s accounts: %s", rep.ID, err)
 		}
 	}
-	// AWS Marketplace information rarely ever changes. Only update marketplace information if we processed any jobs.
-	// This effectively means we update once a day (whenever there are new billing reports)
 	if len(toProcess) > 0 {
+		// Anomaly detection and budget evaluation are best effort and do not fail the interval. They run before the
+		// marketplace update so that a failure to reach the AWS Marketplace does not skip them
+		for _, rep := range reports {
+			err = isc.detectAnomalies(rep)
+			if err != nil {
+				log.Printf("Failed to detect anomalies in report %s: %s", rep.ID, err)
+			}
+			err = isc.evaluateBudgets(rep)
+			if err != nil {
+				log.Printf("Failed to evaluate budgets of report %s: %s", rep.ID, err)
+			}
+		}
+		// AWS Marketplace information rarely ever changes. Only update marketplace information if we processed any jobs.
+		// This effectively means we update once a day (whenever there are new billing reports)
 		err = isc.updateAWSMarketplaceInfo(reports)
 		if err != nil {
 			return err
@@ -225,6 +305,7 @@ func (isc *IngestSvcContext) updateReportStatuses(reports []*userdb.Report, repo
 	if err != nil {
 		return err
 	}
+	becameCurrent := make([]*userdb.Report, 0)
 	for _, report := range reports {
 		// If we encountered any errors when even generating jobs (e.g. credentials no longer valid),
 		// we prefer those errors to be displayed, than any ingest errors
@@ -235,6 +316,7 @@ func (isc *IngestSvcContext) updateReportStatuses(reports []*userdb.Report, repo
 					tx.Rollback()
 					return err
 				}
+				report.Status = claudia.ReportStatusError
 				continue
 			}
 		}
@@ -260,14 +342,33 @@ func (isc *IngestSvcContext) updateReportStatuses(reports []*userdb.Report, repo
 		}
 		if reportStatus == claudia.ReportStatusProcessing {
 			statusDetail = fmt.Sprintf("Processing: %s", strings.Join(processing, ", "))
+		} else if reportStatus == claudia.ReportStatusCurrent {
+			cardinality, err := tx.GetReportCardinality(report.ID)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			statusDetail = cardinality.Warning()
 		}
 		err = tx.UpdateUserReportStatus(report.ID, reportStatus, statusDetail)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
+		if report.Status != claudia.ReportStatusCurrent && reportStatus == claudia.ReportStatusCurrent {
+			becameCurrent = append(becameCurrent, report)
+		}
+		report.Status = reportStatus
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, report := range becameCurrent {
+		message := fmt.Sprintf("All billing reports of %s have been processed", report.ReportName)
+		isc.notify(notification.NewEvent(report, userdb.NotificationEventReportCurrent, "Report is current", message, nil), "", 0)
 	}
-	return tx.Commit()
+	return nil
 }
 
 // purgeDeleted will purge any deleted reports and/or buckets from the report
@@ -317,6 +418,12 @@ func (isc *IngestSvcContext) purgeDeleted() error {
 					return err
 				}
 				deleted++
+				// The bucket's dimension values may no longer exist in the report
+				isc.incrementDataGeneration(report.ID)
+				_, err = costquery.UpdateDimensionSnapshot(isc.userDB, repCtx)
+				if err != nil {
+					log.Printf("Failed to update dimension snapshot of report %s: %s", report.ID, err)
+				}
 			}
 		}
 		statuses, err := repCtx.GetReportIngestStatuses()
@@ -326,8 +433,8 @@ func (isc *IngestSvcContext) purgeDeleted() error {
 		for _, is := range statuses {
 			activeBucket := report.GetBucket(is.Bucket, is.ReportPath)
 			if activeBucket == nil {
-				log.Printf("Deleting ingest status report %s bucket %s/%s no longer active. Deleting status data", is.ReportID, is.Bucket, is.ReportPath)
-				err = repCtx.DeleteBillingBucketHistory(is.Bucket, is.ReportPath)
+				log.Printf("Ingest status report %s bucket %s/%s no longer active. Invalidating status", is.ReportID, is.Bucket, is.ReportPath)
+				err = repCtx.InvalidateBillingBucketIngests(is.Bucket, is.ReportPath)
 				if err != nil {
 					return err
 				}
@@ -356,6 +463,10 @@ func (isc *IngestSvcContext) generateJobs(reports []*userdb.Report) ([]*manifest
 				if _, ok := reportErrors[report.ID]; !ok {
 					reportErrors[report.ID] = err
 				}
+				message := fmt.Sprintf("Could not access billing bucket %s (report path: %s): %s", bucket.Bucketname, bucket.ReportPath, err)
+				details := map[string]string{"bucket": bucket.Bucketname, "report_path": bucket.ReportPath}
+				event := notification.NewEvent(report, userdb.NotificationEventBucketError, "Billing bucket error", message, details)
+				isc.notify(event, bucket.ID+":"+err.Error(), claudia.NotificationDedupWindow)
 			}
 		}
 	}
@@ -497,7 +608,7 @@ func (isc *IngestSvcContext) doJob(job *manifestJob, run *bool) error {
 	// 1) a new billing report in an unfinalized billing month where previous data is invalid
 	// 2) a interrupted ingest where there is partially ingested data in the database for the same billing period we are about to ingest
 	repCtx := isc.costDB.NewCostReportContext(job.report.ID)
-	err := repCtx.RecordIngestStart(*job.manifest)
+	attempt, err := repCtx.RecordIngestStart(*job.manifest)
 	if err != nil {
 		return err
 	}
@@ -511,6 +622,10 @@ func (isc *IngestSvcContext) doJob(job *manifestJob, run *bool) error {
 	// credentials suddenly become invalid, we don't delete a months worth of data and left unable
 	// to process more data.
 	firstIteration := true
+	// Resources are aggregated across all report files of the manifest, since a resource's line items may span files
+	resources := costdb.NewResourceAggregator()
+	reservations := costdb.NewReservationAggregator()
+	tags := newTagGovernor(job.report)
 	err = nil
 	for _, reportKey := range job.manifest.ReportKeys {
 		if !*run {
@@ -521,28 +636,42 @@ func (isc *IngestSvcContext) doJob(job *manifestJob, run *bool) error {
 		err = job.billbuck.Download(reportKey, localPath, false)
 		if err != nil {
 			log.Printf("Failed to download %s: %s", reportKey, err)
+			isc.recordIngestError(repCtx, job, attempt, fmt.Sprintf("Failed to download %s: %s", reportKey, err))
 			break
 		}
+		if fi, statErr := os.Stat(localPath); statErr == nil {
+			attempt.BytesDownloaded += fi.Size()
+		}
 		if firstIteration {
 			err := repCtx.PurgeBillingPeriodSeries(job.billbuck.Bucket, job.billbuck.ReportPath, job.manifest.BillingPeriodString())
 			if err != nil {
 				// If we can't purge previous billing series, do not continue with processing additional report keys.
 				// Otherwise, we will double count the data (from previous ingest) and the cost/usage will be over stated.
+				isc.recordIngestError(repCtx, job, attempt, fmt.Sprintf("Failed to purge billing period: %s", err))
 				return err
 			}
+			// The data of the report changes both when the billing period is purged, and as the new data is written
+			isc.incrementDataGeneration(job.report.ID)
+			defer isc.incrementDataGeneration(job.report.ID)
+			// The series of the report outside of the billing period count against its series budget
+			tags.existing, err = repCtx.SeriesCardinality()
+			if err != nil {
+				log.Printf("Failed to get series cardinality of report %s. Series budget is not enforced: %s", job.report.ID, err)
+				tags.budget = 0
+			}
 			firstIteration = false
 		}
-		err = IngestReportFile(repCtx, job, localPath, run)
+		err = IngestReportFile(repCtx, job, localPath, resources, reservations, &attempt.IngestStats, tags, run)
 		if err != nil {
 			errMsg := fmt.Sprintf("Failed to ingest %s: %s", localPath, err)
 			log.Printf(errMsg)
-			// Ignore any failures to record ingest error since we want original to perculate
-			_ = repCtx.RecordIngestError(*job.manifest, errMsg)
+			isc.recordIngestError(repCtx, job, attempt, errMsg)
 			break
 		}
 		log.Printf("Deleting processed report path: %s", localPath)
 		err = os.Remove(localPath)
 		if err != nil {
+			isc.recordIngestError(repCtx, job, attempt, fmt.Sprintf("Failed to delete processed report %s: %s", localPath, err))
 			err = errors.InternalError(err)
 			break
 		}
@@ -556,12 +685,106 @@ func (isc *IngestSvcContext) doJob(job *manifestJob, run *bool) error {
 		// Do not record a finish time. This will result in the report status remaining in "processing" status
 		log.Printf("Ingest interrupted during ingestion of report %s %s/%s/%s",
 			job.report.ID, job.bucket.Bucketname, job.bucket.ReportPath, job.manifest.BillingPeriodString())
-	} else {
-		err = repCtx.RecordIngestFinish(*job.manifest)
+		return nil
 	}
+	err = resources.Write(repCtx)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to write resource costs: %s", err)
+		log.Printf(errMsg)
+		isc.recordIngestError(repCtx, job, attempt, errMsg)
+		return err
+	}
+	err = reservations.Write(repCtx)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to write reservation usage: %s", err)
+		log.Printf(errMsg)
+		isc.recordIngestError(repCtx, job, attempt, errMsg)
+		return err
+	}
+	err = downsampleBillingPeriod(repCtx, job.manifest)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to downsample billing period: %s", err)
+		log.Printf(errMsg)
+		isc.recordIngestError(repCtx, job, attempt, errMsg)
+		return err
+	}
+	isc.updateReportCardinality(repCtx, job.report, tags)
+	err = repCtx.RecordIngestFinish(attempt)
 	return err
 }
 
+// incrementDataGeneration records that the cost data of a report has changed, which invalidates its dimension snapshot.
+// Failures are logged, since the snapshot is rebuilt after every ingest
+func (isc *IngestSvcContext) incrementDataGeneration(reportID string) {
+	tx, err := isc.userDB.Begin()
+	if err != nil {
+		log.Printf("Failed to increment data generation of report %s: %s", reportID, err)
+		return
+	}
+	err = tx.IncrementReportDataGeneration(reportID)
+	if err != nil {
+		log.Printf("Failed to increment data generation of report %s: %s", reportID, err)
+		tx.Rollback()
+		return
+	}
+	tx.Commit()
+}
+
+// recordIngestError records the error of an ingest attempt, and notifies the channels of the report. Failures to record the
+// error are ignored since we want the original error to perculate
+func (isc *IngestSvcContext) recordIngestError(repCtx *costdb.CostReportContext, job *manifestJob, attempt *costdb.IngestAttempt, errMsg string) {
+	_ = repCtx.RecordIngestError(attempt, errMsg)
+	billingPeriod := job.manifest.BillingPeriodString()
+	details := map[string]string{
+		"bucket":         job.bucket.Bucketname,
+		"report_path":    job.bucket.ReportPath,
+		"billing_period": billingPeriod,
+	}
+	event := notification.NewEvent(job.report, userdb.NotificationEventIngestFailed, "Billing report ingest failed", errMsg, details)
+	isc.notify(event, job.bucket.ID+":"+billingPeriod, claudia.NotificationDedupWindow)
+}
+
+// downsampleBillingPeriod downsamples the newly ingested data of a billing period into the retention tiers of the report
+func downsampleBillingPeriod(repCtx *costdb.CostReportContext, manifest *billingbucket.Manifest) error {
+	parts := strings.Split(manifest.BillingPeriodString(), "-")
+	billingPeriodStart, err := time.Parse("20060102", parts[0])
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	billingPeriodEnd, err := time.Parse("20060102", parts[1])
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	return repCtx.Downsample(billingPeriodStart, billingPeriodEnd)
+}
+
+// updateReportCardinality records the series cardinality of a report after an ingest, along with any tag keys demoted by the
+// tag governor, which enforces the series budget of the report during the ingest. The cardinality may still exceed the budget,
+// since series written before their tag keys were demoted remain. This is best effort and does not fail the ingest
+func (isc *IngestSvcContext) updateReportCardinality(repCtx *costdb.CostReportContext, report *userdb.Report, tags *tagGovernor) {
+	cardinality, err := repCtx.SeriesCardinality()
+	if err != nil {
+		log.Printf("Failed to get series cardinality of report %s: %s", report.ID, err)
+		return
+	}
+	if budget := report.GetSeriesBudget(); budget > 0 && cardinality > budget {
+		// Series written before their tag keys were demoted remain until their billing period is reingested or expires
+		log.Printf("Report %s series cardinality %d exceeds budget %d", report.ID, cardinality, budget)
+	}
+	tx, err := isc.userDB.Begin()
+	if err != nil {
+		log.Printf("Failed to update report %s cardinality: %s", report.ID, err)
+		return
+	}
+	err = tx.UpdateReportCardinality(report.ID, cardinality, tags.newlyDemoted)
+	if err != nil {
+		log.Printf("Failed to update report %s cardinality: %s", report.ID, err)
+		tx.Rollback()
+		return
+	}
+	tx.Commit()
+}
+
 // cleanReportDir cleans remnant working directories in the report dir (anything that looks like a report UUID)
 func (isc *IngestSvcContext) cleanReportDir() error {
 	workDirPaths, err := filepath.Glob(fmt.Sprintf("%s/*", isc.reportDir))
@@ -607,12 +830,17 @@ func (isc *IngestSvcContext) updateReportAccounts(report *userdb.Report, append
 			if err != nil {
 				return err
 			}
-			err = tx.AddReportAccount(report.ID, accountID)
+			added, err := tx.AddReportAccount(report.ID, accountID)
 			if err != nil {
 				tx.Rollback()
 				return err
 			}
 			tx.Commit()
+			if added {
+				message := fmt.Sprintf("Usage of account %s was found in the billing reports of %s", accountID, report.ReportName)
+				event := notification.NewEvent(report, userdb.NotificationEventAccountAdded, "New account discovered", message, map[string]string{"account_id": accountID})
+				isc.notify(event, accountID, 0)
+			}
 		}
 	}
 	if !append {
@@ -707,6 +935,121 @@ func (isc *IngestSvcContext) updateAWSMarketplaceInfo(reports []*userdb.Report)
 	return nil
 }
 
+// detectAnomalies evaluates the daily cost of each account, service, and configured tag key of a report for anomalies, and records them in the user database.
+// Contributors of account and tag anomalies are broken down by service, and contributors of service anomalies are broken down by account
+func (isc *IngestSvcContext) detectAnomalies(report *userdb.Report) error {
+	log.Printf("Detecting anomalies in report %s", report.ID)
+	contributorDimensions := map[string]string{
+		parser.ColumnUsageAccountID.APIName: parser.ColumnService.APIName,
+		parser.ColumnService.APIName:        parser.ColumnUsageAccountID.APIName,
+	}
+	for _, tagKey := range report.AnomalyTagKeyList() {
+		contributorDimensions[tagKey] = parser.ColumnService.APIName
+	}
+	rctx := isc.costDB.NewCostReportContext(report.ID)
+	anomalies := make([]*costdb.CostAnomaly, 0)
+	now := time.Now()
+	for dimension, contributorDimension := range contributorDimensions {
+		dimAnomalies, err := rctx.DetectAnomalies(dimension, contributorDimension, now)
+		if err != nil {
+			return err
+		}
+		anomalies = append(anomalies, dimAnomalies...)
+	}
+	tx, err := isc.userDB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, anomaly := range anomalies {
+		a := userdb.Anomaly{
+			ReportID:     report.ID,
+			Day:          anomaly.Day,
+			Dimension:    anomaly.Dimension,
+			Name:         anomaly.Name,
+			Cost:         anomaly.Cost,
+			Baseline:     anomaly.Baseline,
+			Score:        anomaly.Score,
+			Severity:     anomaly.Severity,
+			Contributors: anomaly.Contributors,
+		}
+		err = tx.UpsertAnomaly(&a)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	log.Printf("Detected %d anomalies in report %s", len(anomalies), report.ID)
+	return nil
+}
+
+// evaluateBudgets evaluates the spend of each budget of a report in its current period, and records the thresholds which were crossed.
+// A budget which cannot be evaluated (e.g. its filters refer to a deleted cost category) does not prevent the others from being evaluated
+func (isc *IngestSvcContext) evaluateBudgets(report *userdb.Report) error {
+	tx, err := isc.userDB.Begin()
+	if err != nil {
+		return err
+	}
+	budgets, err := tx.GetReportBudgets(report.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	if len(budgets) == 0 {
+		return nil
+	}
+	log.Printf("Evaluating %d budgets of report %s", len(budgets), report.ID)
+	categories, err := costquery.ReportCostCategories(isc.userDB, report.ID)
+	if err != nil {
+		return err
+	}
+	rctx := isc.costDB.NewCostReportContext(report.ID)
+	rctx.Categories = categories
+	now := time.Now()
+	for _, budget := range budgets {
+		status, err := costquery.EvaluateBudget(rctx, report, budget, now)
+		if err != nil {
+			log.Printf("Failed to evaluate budget %s of report %s: %s", budget.ID, report.ID, err)
+			continue
+		}
+		tx, err := isc.userDB.Begin()
+		if err != nil {
+			return err
+		}
+		newCrossings := make([]*userdb.BudgetCrossing, 0)
+		for _, threshold := range status.Crossed {
+			crossing := userdb.BudgetCrossing{
+				BudgetID:         budget.ID,
+				PeriodStart:      status.PeriodStart,
+				ThresholdType:    threshold.Type,
+				ThresholdPercent: threshold.Percent,
+				Spend:            costquery.ThresholdSpend(status.BudgetSpend, threshold),
+			}
+			recorded, err := tx.RecordBudgetCrossing(&crossing)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if recorded {
+				newCrossings = append(newCrossings, &crossing)
+			}
+		}
+		tx.Commit()
+		for _, crossing := range newCrossings {
+			subject := fmt.Sprintf("Budget %s reached %g%% (%s)", budget.Name, crossing.ThresholdPercent, crossing.ThresholdType)
+			message := fmt.Sprintf("The %s spend of budget %s is %.2f of %.2f in the period starting %s",
+				crossing.ThresholdType, budget.Name, crossing.Spend, budget.Amount, crossing.PeriodStart.Format("2006-01-02"))
+			details := map[string]string{"budget_id": budget.ID, "budget": budget.Name}
+			isc.notify(notification.NewEvent(report, userdb.NotificationEventBudgetThreshold, subject, message, details), "", 0)
+		}
+	}
+	return nil
+}
+
 // identifyProduct looks up a product code in AWS marketplace
 func identifyProduct(productCode, awsAccessKeyID, awsSecretAccessKey string) (*userdb.AWSProductInfo, error) {
 	log.Printf("Identifying product %s", productCode)
@@ -756,8 +1099,13 @@ func (isc *IngestSvcContext) Run(port int) error {
 	if err != nil {
 		return err
 	}
+	err = isc.costDB.MigrateIngestStatus()
+	if err != nil {
+		return err
+	}
 	isc.updateCh = make(chan bool, 64)
 	go isc.poller()
+	go isc.notifier.Run()
 
 	r := mux.NewRouter()
 	r.HandleFunc("/v1/refresh", reportMonitorHandler(isc)).Methods("POST")
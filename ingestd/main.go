@@ -123,6 +123,113 @@ func dropDatabase(c *cli.Context) error {
 	return costDB.DropDatabase()
 }
 
+func exportReport(c *cli.Context) error {
+	costDBURL := c.String("costdb")
+	reportID := c.String("report")
+	path := c.String("file")
+	if reportID == "" {
+		return errors.New("report unspecified")
+	}
+	if path == "" {
+		path = reportID + ".backup.gz"
+	}
+	costDB, err := costdb.NewCostDatabase(costDBURL)
+	if err != nil {
+		return err
+	}
+	defer costDB.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = costDB.NewCostReportContext(reportID).ExportBackup(f)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported report %s to %s", reportID, path)
+	return nil
+}
+
+func importReport(c *cli.Context) error {
+	costDBURL := c.String("costdb")
+	reportID := c.String("report")
+	path := c.String("file")
+	if path == "" {
+		return errors.New("file unspecified")
+	}
+	costDB, err := costdb.NewCostDatabase(costDBURL)
+	if err != nil {
+		return err
+	}
+	defer costDB.Close()
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if reportID == "" {
+		// Peek the header for the report ID the backup was taken from
+		header, err := costdb.ReadBackupHeader(f)
+		if err != nil {
+			return err
+		}
+		reportID = header.ReportID
+		_, err = f.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+	}
+	userDB, err := openUserDatabase()
+	if err != nil {
+		return err
+	}
+	tx, err := userDB.Begin()
+	if err != nil {
+		return err
+	}
+	report, err := tx.GetReport(reportID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	repCtx := costDB.NewCostReportContext(reportID)
+	header, err := repCtx.ImportBackup(f)
+	if err != nil {
+		return err
+	}
+	dailyDays, monthlyDays, err := repCtx.RetentionTiers()
+	if err != nil {
+		return err
+	}
+	// The dimension snapshot of the report does not include the imported data, and the settings of the report
+	// must include any downsampling tiers restored from the backup
+	tx, err = userDB.Begin()
+	if err != nil {
+		return err
+	}
+	err = tx.IncrementReportDataGeneration(reportID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if dailyDays != report.DailyRetentionDays() || monthlyDays != report.MonthlyRetentionDays() {
+		tiers := userdb.Report{ID: reportID, DailyRetention: userdb.FormatRetentionTier(dailyDays), MonthlyRetention: userdb.FormatRetentionTier(monthlyDays)}
+		err = tx.UpdateUserReport(&tiers)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported backup of report %s (taken %s) to report %s", header.ReportID, header.CreatedAt, reportID)
+	return nil
+}
+
 func run(c *cli.Context) error {
 	reportDir := c.String("reportDir")
 	costDBURL := c.String("costdb")
@@ -181,6 +288,26 @@ func main() {
 			},
 			Action: dropDatabase,
 		},
+		{
+			Name:  "export",
+			Usage: "Export the cost data of a report to a compressed backup file",
+			Flags: []cli.Flag{
+				costDBFlag,
+				cli.StringFlag{Name: "report", Value: "", Usage: "ID of the report to export"},
+				cli.StringFlag{Name: "file", Value: "", Usage: "Path of the backup file (default: <report>.backup.gz)"},
+			},
+			Action: exportReport,
+		},
+		{
+			Name:  "import",
+			Usage: "Import the cost data of a report from a compressed backup file",
+			Flags: []cli.Flag{
+				costDBFlag,
+				cli.StringFlag{Name: "report", Value: "", Usage: "ID of the report to import to (default: report of the backup)"},
+				cli.StringFlag{Name: "file", Value: "", Usage: "Path of the backup file"},
+			},
+			Action: importReport,
+		},
 		{
 			Name:  "run",
 			Usage: "Run as a service which periodically polls and fetches/processes reports",
@@ -0,0 +1,144 @@
+// Copyright 2017 Applatix, Inc.
+package notification
+
+import (
+	"log"
+	"time"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/userdb"
+)
+
+// deliveryBatchSize is the maximum number of deliveries attempted in each delivery interval
+const deliveryBatchSize = 100
+
+// Notifier queues notifications of the events of reports to the channels subscribed to them, and delivers them.
+// Deliveries are queued in the user database, so that events raised by the API server are delivered by ingestd
+type Notifier struct {
+	userDB *userdb.UserDatabase
+}
+
+// NewNotifier returns a new Notifier instance
+func NewNotifier(userDB *userdb.UserDatabase) *Notifier {
+	return &Notifier{userDB: userDB}
+}
+
+// NewEvent returns an event of a report
+func NewEvent(report *userdb.Report, eventType, subject, message string, details map[string]string) *userdb.NotificationEvent {
+	return &userdb.NotificationEvent{
+		Type:       eventType,
+		ReportID:   report.ID,
+		ReportName: report.ReportName,
+		Time:       time.Now().UTC(),
+		Subject:    subject,
+		Message:    message,
+		Details:    details,
+	}
+}
+
+// Notify queues the delivery of an event to each enabled channel of the report which is subscribed to it. Events which
+// recur while a condition persists (e.g. invalid bucket credentials) are suppressed for a channel if an event with the same
+// deduplication key was queued to it within the dedup window. A zero window never suppresses the event
+func (n *Notifier) Notify(event *userdb.NotificationEvent, dedupKey string, dedupWindow time.Duration) error {
+	tx, err := n.userDB.Begin()
+	if err != nil {
+		return err
+	}
+	channels, err := tx.GetReportNotificationChannels(event.ReportID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	since := time.Now().Add(-dedupWindow)
+	if dedupWindow == 0 {
+		since = time.Now().Add(time.Hour)
+	}
+	for _, channel := range channels {
+		if !channel.Enabled || !channel.Subscribed(event.Type) {
+			continue
+		}
+		queued, err := tx.QueueNotificationDelivery(channel.ID, event.Type+":"+dedupKey, since, event)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if queued {
+			log.Printf("Queued %s notification to channel %s of report %s", event.Type, channel.Name, event.ReportID)
+		}
+	}
+	return tx.Commit()
+}
+
+// Run delivers due notifications every delivery interval. Blocks forever
+func (n *Notifier) Run() {
+	ticker := time.NewTicker(claudia.NotificationDeliveryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := n.DeliverDue()
+		if err != nil {
+			log.Printf("Failed to deliver notifications: %s", err)
+		}
+	}
+}
+
+// DeliverDue attempts the deliveries whose next attempt is due. A failed delivery is retried after each of the notification
+// retry delays, after which it is marked as failed
+func (n *Notifier) DeliverDue() error {
+	tx, err := n.userDB.Begin()
+	if err != nil {
+		return err
+	}
+	deliveries, err := tx.GetDueNotificationDeliveries(deliveryBatchSize)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	for _, delivery := range deliveries {
+		err = n.deliver(delivery)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver attempts a single delivery, and records its outcome in the delivery log
+func (n *Notifier) deliver(delivery *userdb.NotificationDelivery) error {
+	tx, err := n.userDB.Begin()
+	if err != nil {
+		return err
+	}
+	channel, err := tx.GetNotificationChannel(delivery.ChannelID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	delivery.Attempts++
+	sendErr := send(channel, &delivery.Payload)
+	if sendErr == nil {
+		log.Printf("Delivered %s notification %s to channel %s", delivery.EventType, delivery.ID, channel.Name)
+		delivery.Status = userdb.NotificationDeliveryDelivered
+		delivery.LastError = ""
+	} else if delivery.Attempts > len(claudia.NotificationRetryDelay) {
+		log.Printf("Failed to deliver %s notification %s to channel %s after %d attempts: %s", delivery.EventType, delivery.ID, channel.Name, delivery.Attempts, sendErr)
+		delivery.Status = userdb.NotificationDeliveryFailed
+		delivery.LastError = sendErr.Error()
+	} else {
+		retryDelay := claudia.NotificationRetryDelay[delivery.Attempts-1]
+		log.Printf("Failed to deliver %s notification %s to channel %s (retrying in %s): %s", delivery.EventType, delivery.ID, channel.Name, retryDelay, sendErr)
+		delivery.NextAttempt = time.Now().Add(retryDelay)
+		delivery.LastError = sendErr.Error()
+	}
+	tx, err = n.userDB.Begin()
+	if err != nil {
+		return err
+	}
+	err = tx.UpdateNotificationDelivery(delivery)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Applatix, Inc.
+package notification
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/userdb"
+	"github.com/applatix/claudia/util"
+)
+
+// defaultSMTPPort is the port of SMTP servers when the channel (or schedule destination) does not specify one
+const defaultSMTPPort = 25
+
+// httpClient posts webhook and Slack notifications. It only connects to public addresses, so that channels cannot be used to
+// reach services on the internal network
+var httpClient = util.NewPublicHTTPClient(30 * time.Second)
+
+// send delivers an event to a channel
+func send(channel *userdb.NotificationChannel, event *userdb.NotificationEvent) error {
+	switch channel.Type {
+	case userdb.NotificationChannelWebhook:
+		return sendWebhook(channel, event)
+	case userdb.NotificationChannelSlack:
+		return sendSlack(channel, event)
+	case userdb.NotificationChannelSMTP:
+		return sendSMTP(channel, event)
+	}
+	return errors.Errorf(errors.CodeInternal, "Unsupported notification channel type: %s", channel.Type)
+}
+
+// sendWebhook posts the event as JSON. If the channel has a secret, the payload is signed with HMAC-SHA256 in the
+// X-Claudia-Signature header, as sha256=<hex digest>
+func sendWebhook(channel *userdb.NotificationChannel, event *userdb.NotificationEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	headers := map[string]string{"X-Claudia-Event": event.Type}
+	if channel.Config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(channel.Config.Secret))
+		mac.Write(payload)
+		headers["X-Claudia-Signature"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return postJSON(channel.Config.URL, payload, headers)
+}
+
+// sendSlack posts the event to a Slack-compatible incoming webhook
+func sendSlack(channel *userdb.NotificationChannel, event *userdb.NotificationEvent) error {
+	text := fmt.Sprintf("*%s*\n%s", event.Subject, event.Message)
+	for _, key := range detailKeys(event) {
+		text += fmt.Sprintf("\n• %s: %s", key, event.Details[key])
+	}
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	return postJSON(channel.Config.URL, payload, nil)
+}
+
+// postJSON posts a JSON payload to the URL. Responses other than 2xx are errors
+func postJSON(url string, payload []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sendSMTP emails the event to the recipients of the channel
+func sendSMTP(channel *userdb.NotificationChannel, event *userdb.NotificationEvent) error {
+	config := channel.Config
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[Claudia] "+event.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n", event.Message)
+	fmt.Fprintf(&msg, "Report: %s\r\n", event.ReportName)
+	for _, key := range detailKeys(event) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", key, event.Details[key])
+	}
+	return SendMail(config.Host, config.Port, config.Username, config.Password, config.From, config.To, msg.Bytes())
+}
+
+// SendMail sends a message through an SMTP server, authenticating if a username is given. A port of 0 is the default SMTP port
+func SendMail(host string, port int, username, password, from string, to []string, msg []byte) error {
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	return smtp.SendMail(addr, auth, from, to, msg)
+}
+
+// detailKeys returns the keys of the event details in sorted order
+func detailKeys(event *userdb.NotificationEvent) []string {
+	keys := make([]string, 0, len(event.Details))
+	for key := range event.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
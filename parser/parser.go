@@ -13,11 +13,13 @@ import (
 	"github.com/applatix/claudia/errors"
 )
 
-// ParserVersion is the version of this parser library, which we record in the event that billing
-// data needs to be reingested in later versions of this software. Until we support upgrades,
-// this value can remain at 1. When upgrade is supported, we will need to increment this
-// value every time we make incompatible changes to the parser.
-const ParserVersion = 1
+// ParserVersion is the version of this parser library, which is recorded in the ingest status of each billing period.
+// Billing periods which were ingested with an older version are reingested (see ingest/processor.go), so this value must
+// be incremented every time we make incompatible changes to the parser. Each increment reingests the billing history of
+// every report which is still present in its billing buckets.
+// Version 2: daily resource costs are aggregated during ingest
+// Version 3: reservation ARNs are stored, and usage covered by a reservation is priced as Reserved
+const ParserVersion = 3
 
 // The Column struct represents:
 // * the column name of an AWS Cost & Usage report line item (e.g. lineItem/ProductCode)
@@ -35,14 +37,15 @@ type Column struct {
 // http://docs.aws.amazon.com/awsaccountbilling/latest/aboutv2/detailed-billing-reports.html
 var (
 	// Fields
-	ColumnUnblendedCost = Column{"lineItem/UnblendedCost", "", "", asFloatField} // 1.04  (will be zero for ReservedInstance)
-	ColumnBlendedCost   = Column{"lineItem/BlendedCost", "", "", asFloatField}   // 1.04
-	ColumnUsageAmount   = Column{"lineItem/UsageAmount", "", "", asFloatField}   // 20
-	ColumnUnblendedRate = Column{"lineItem/UnblendedRate", "", "", asFloatField} // 0.052
-	ColumnBlendedRate   = Column{"lineItem/BlendedRate", "", "", asFloatField}   // 0.052
-	ColumnLineItemID    = Column{"identity/LineItemId", "", "", asStringField}   // qwhyoiu7gg3wow4eskqclrsuzfthtct4pwqnjkismbrsvqkepmxq
-	ColumnResourceID    = Column{"lineItem/ResourceId", "", "", asStringField}   // i-abcd1234, vol-abcd1234, my-billing-bucket
-	ColumnUsageType     = Column{"lineItem/UsageType", "", "", usageTypeParser}  // USW2-BoxUsage:t1.micro
+	ColumnUnblendedCost  = Column{"lineItem/UnblendedCost", "", "", asFloatField}      // 1.04  (will be zero for ReservedInstance)
+	ColumnBlendedCost    = Column{"lineItem/BlendedCost", "", "", asFloatField}        // 1.04
+	ColumnUsageAmount    = Column{"lineItem/UsageAmount", "", "", asFloatField}        // 20
+	ColumnUnblendedRate  = Column{"lineItem/UnblendedRate", "", "", asFloatField}      // 0.052
+	ColumnBlendedRate    = Column{"lineItem/BlendedRate", "", "", asFloatField}        // 0.052
+	ColumnLineItemID     = Column{"identity/LineItemId", "", "", asStringField}        // qwhyoiu7gg3wow4eskqclrsuzfthtct4pwqnjkismbrsvqkepmxq
+	ColumnResourceID     = Column{"lineItem/ResourceId", "", "", asStringField}        // i-abcd1234, vol-abcd1234, my-billing-bucket
+	ColumnUsageType      = Column{"lineItem/UsageType", "", "", usageTypeParser}       // USW2-BoxUsage:t1.micro
+	ColumnReservationARN = Column{"reservation/ReservationARN", "", "", asStringField} // arn:aws:ec2:us-west-2:012345678910:reserved-instances/1702ffb5-06cb-48c0-8852-8232a4748fe9
 
 	// Tags
 	ColumnPayerAccountID = Column{"bill/PayerAccountId", "", "", asTag}                                // 012345678910
@@ -86,6 +89,7 @@ var columns = []Column{
 	ColumnLineItemID,
 	ColumnResourceID,
 	ColumnUsageType,
+	ColumnReservationARN,
 
 	// Tags
 	ColumnPayerAccountID,
@@ -132,7 +136,6 @@ var columns = []Column{
 //"product/servicecode":       // AmazonEC2, AWSDataTransfer
 //"product/usagetype":         // USW2-SAE1-AWS-In-Bytes,
 //"product/instanceType":      // m4.large, t2.large, t2.medium, t2.micro
-//"reservation/ReservationARN":// arn:aws:ec2:us-west-2:012345678910:reserved-instances/1702ffb5-06cb-48c0-8852-8232a4748fe9
 
 // ColumnParser returns a ParsedValues structure, which consists of fields, tags, and metadata
 // Fields are the units by which we want to measure. They can be numbers or strings.
@@ -386,8 +389,15 @@ type LineItem struct {
 	Fields    map[string]interface{}
 }
 
-// ParseLine parses a CSV line and return a InfluxDB point
-func ParseLine(columnNames []string, line []string) (*LineItem, error) {
+// Reasons a line is skipped by ParseLine
+const (
+	SkipReasonNonHourly = "non_hourly"
+	SkipReasonNonUsage  = "non_usage"
+)
+
+// ParseLine parses a CSV line and return a InfluxDB point. If the line should not be stored, a nil line item is
+// returned along with the reason the line was skipped
+func ParseLine(columnNames []string, line []string) (*LineItem, string, error) {
 	var lineItem LineItem
 	lineItem.Tags = make(map[string]string)
 	lineItem.Fields = make(map[string]interface{})
@@ -403,16 +413,16 @@ func ParseLine(columnNames []string, line []string) (*LineItem, error) {
 			var startTime, endTime time.Time
 			startTime, err = time.Parse(time.RFC3339, startHr)
 			if err != nil {
-				return nil, errors.InternalError(err)
+				return nil, "", errors.InternalError(err)
 			}
 			endTime, err = time.Parse(time.RFC3339, endHr)
 			if err != nil {
-				return nil, errors.InternalError(err)
+				return nil, "", errors.InternalError(err)
 			}
 			if endTime.Sub(startTime) != time.Hour {
 				// AWS report line items that span more than an hour are aggregated values and should be ignored
 				log.Printf("Skipping non hour duration")
-				return nil, nil
+				return nil, SkipReasonNonHourly, nil
 			}
 			lineItem.Timestamp = startTime
 			continue
@@ -420,7 +430,7 @@ func ParseLine(columnNames []string, line []string) (*LineItem, error) {
 		if columnName == "lineItem/LineItemType" && value != "Usage" && value != "DiscountedUsage" {
 			// Ignore non usage line items
 			log.Printf("Skipping non usage line")
-			return nil, nil
+			return nil, SkipReasonNonUsage, nil
 		}
 		if value == "" {
 			if columnName == ColumnProductFamily.ColumnName {
@@ -445,7 +455,7 @@ func ParseLine(columnNames []string, line []string) (*LineItem, error) {
 		}
 		parsedVals, err := column.Parser(columnName, value)
 		if err != nil {
-			return nil, errors.InternalErrorf(err, "Failed to parse column %s (%s): %s", columnName, value, err)
+			return nil, "", errors.InternalErrorf(err, "Failed to parse column %s (%s): %s", columnName, value, err)
 		}
 		for k, v := range parsedVals.Tags {
 			lineItem.Tags[k] = v
@@ -468,6 +478,9 @@ func ParseLine(columnNames []string, line []string) (*LineItem, error) {
 	pricingTerm, _ := meta[ColumnPricingTerm.ColumnName]
 	if pricingTerm != "" {
 		lineItem.Tags[ColumnEC2InstancePricing.ColumnName] = pricingTerm
+	} else if _, reserved := lineItem.Fields[ColumnReservationARN.ColumnName]; reserved {
+		// Usage covered by a reservation (DiscountedUsage) has no cost, and so no pricing term
+		lineItem.Tags[ColumnEC2InstancePricing.ColumnName] = "Reserved"
 	} else if lineItem.Tags[ColumnUsageFamily.ColumnName] == "SpotUsage" {
 		lineItem.Tags[ColumnEC2InstancePricing.ColumnName] = "Spot"
 	} else if lineItem.Tags[ColumnProductCode.ColumnName] == "AmazonEC2" && lineItem.Tags[ColumnProductFamily.ColumnName] == "Compute Instance" {
@@ -558,5 +571,5 @@ func ParseLine(columnNames []string, line []string) (*LineItem, error) {
 	if pricingUnit, ok := lineItem.Tags[ColumnPricingUnit.ColumnName]; ok {
 		lineItem.Tags[ColumnPricingUnit.ColumnName] = strings.ToLower(pricingUnit)
 	}
-	return &lineItem, nil
+	return &lineItem, "", nil
 }
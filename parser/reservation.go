@@ -0,0 +1,109 @@
+// Copyright 2017 Applatix, Inc.
+package parser
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// Columns of RIFee line items which are only read by ParseReservationFee
+const (
+	columnLineItemType       = "lineItem/LineItemType"
+	columnTimeInterval       = "identity/TimeInterval"
+	columnTotalReservedUnits = "reservation/TotalReservedUnits"
+	columnUnusedQuantity     = "reservation/UnusedQuantity"
+)
+
+// ReservationFee is the recurring fee of a reservation during a billing period, parsed from a RIFee line item.
+// RIFee line items span the entire billing period, and are skipped by ParseLine
+// * Timestamp is the start of the billing period
+// * Tags are the account, region, instance type and instance family of the reservation
+// * ReservedHours is the number of hours reserved during the billing period
+// * UnusedHours is the number of reserved hours which went unused (nil if the report does not have the column)
+// * Fee is the recurring fee of the reservation during the billing period
+type ReservationFee struct {
+	ReservationARN string
+	Timestamp      time.Time
+	Tags           map[string]string
+	ReservedHours  float64
+	UnusedHours    *float64
+	Fee            float64
+}
+
+// ParseReservationFee parses a CSV line which is a RIFee line item. Returns nil if the line is any other type of line item
+func ParseReservationFee(columnNames []string, line []string) (*ReservationFee, error) {
+	values := make(map[string]string, len(columnNames))
+	for i, columnName := range columnNames {
+		if i < len(line) {
+			values[columnName] = line[i]
+		}
+	}
+	if values[columnLineItemType] != "RIFee" || values[ColumnReservationARN.ColumnName] == "" {
+		return nil, nil
+	}
+	fee := ReservationFee{
+		ReservationARN: values[ColumnReservationARN.ColumnName],
+		Tags:           make(map[string]string),
+	}
+	var err error
+	fee.Timestamp, err = time.Parse(time.RFC3339, strings.Split(values[columnTimeInterval], "/")[0])
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	if accountID := values[ColumnUsageAccountID.ColumnName]; accountID != "" {
+		fee.Tags[ColumnUsageAccountID.ColumnName] = accountID
+	}
+	if usageType := values[ColumnUsageType.ColumnName]; usageType != "" {
+		// e.g. USW2-HeavyUsage:m4.large
+		parsedVals, err := usageTypeParser(ColumnUsageType.ColumnName, usageType)
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range []Column{ColumnRegion, ColumnEC2InstanceType, ColumnEC2InstanceFamily} {
+			if val := parsedVals.Tags[column.ColumnName]; val != "" {
+				fee.Tags[column.ColumnName] = val
+			}
+		}
+	}
+	if _, ok := fee.Tags[ColumnRegion.ColumnName]; !ok {
+		// Regional reservations have the region in their ARN (arn:aws:ec2:us-west-2:012345678910:reserved-instances/...)
+		if arnParts := strings.Split(fee.ReservationARN, ":"); len(arnParts) > 3 && arnParts[3] != "" {
+			fee.Tags[ColumnRegion.ColumnName] = arnParts[3]
+		}
+	}
+	if fee.ReservedHours, _, err = parseFloatColumn(values, columnTotalReservedUnits); err != nil {
+		return nil, err
+	}
+	if fee.ReservedHours == 0 {
+		if fee.ReservedHours, _, err = parseFloatColumn(values, ColumnUsageAmount.ColumnName); err != nil {
+			return nil, err
+		}
+	}
+	if fee.Fee, _, err = parseFloatColumn(values, ColumnUnblendedCost.ColumnName); err != nil {
+		return nil, err
+	}
+	unusedHours, ok, err := parseFloatColumn(values, columnUnusedQuantity)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		fee.UnusedHours = &unusedHours
+	}
+	return &fee, nil
+}
+
+// parseFloatColumn parses the value of a numeric column of a line. Returns false if the line has no value for the column
+func parseFloatColumn(values map[string]string, columnName string) (float64, bool, error) {
+	val := values[columnName]
+	if val == "" {
+		return 0, false, nil
+	}
+	floatVal, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, false, errors.InternalErrorf(err, "Failed to parse column %s (%s): %s", columnName, val, err)
+	}
+	return floatVal, true, nil
+}
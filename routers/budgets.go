@@ -0,0 +1,179 @@
+// Copyright 2017 Applatix, Inc.
+package routers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/costquery"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/server"
+	"github.com/applatix/claudia/userdb"
+	"github.com/applatix/claudia/util"
+	"github.com/gorilla/mux"
+)
+
+// budgetsHandler is the http handler for /v1/budgets. Lists the budgets of the default report with their status, or creates a budget
+func budgetsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		report, err := sc.GetDefaultReport(si.UserID)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			budgets, err := tx.GetReportBudgets(report.ID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			tx.Commit()
+			repCtx, err := sc.NewCostReportContext(report)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			now := time.Now()
+			statuses := make([]*costquery.BudgetStatus, len(budgets))
+			for i, budget := range budgets {
+				statuses[i], err = budgetStatus(sc, repCtx, report, budget, now)
+				if util.ErrorHandler(err, w) != nil {
+					return
+				}
+			}
+			util.SuccessHandler(statuses, w)
+		case "POST":
+			budget, err := decodeBudget(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			budget.ReportID = report.ID
+			budgetID, err := tx.CreateBudget(budget)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			createdBudget, err := tx.GetReportBudget(report.ID, budgetID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			err = tx.Commit()
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			util.SuccessHandler(createdBudget, w)
+		default:
+			util.ErrorHandler(errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method), w)
+		}
+	})
+}
+
+// budgetHandler is the http handler for /v1/budgets/{budgetID}
+func budgetHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		report, err := sc.GetDefaultReport(si.UserID)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		budgetID := mux.Vars(r)["budgetID"]
+		var budget *userdb.Budget
+		if r.Method == "PUT" {
+			budget, err = decodeBudget(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+		}
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			budget, err = tx.GetReportBudget(report.ID, budgetID)
+		case "PUT":
+			budget.ID = budgetID
+			budget.ReportID = report.ID
+			err = tx.UpdateBudget(budget)
+			if err == nil {
+				budget, err = tx.GetReportBudget(report.ID, budgetID)
+			}
+		case "DELETE":
+			err = tx.DeleteBudget(report.ID, budgetID)
+			budget = nil
+		default:
+			err = errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method)
+		}
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		err = tx.Commit()
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		if budget == nil {
+			util.SuccessHandler(nil, w)
+			return
+		}
+		if r.Method != "GET" {
+			util.SuccessHandler(budget, w)
+			return
+		}
+		repCtx, err := sc.NewCostReportContext(report)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		status, err := budgetStatus(sc, repCtx, report, budget, time.Now())
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		util.SuccessHandler(status, w)
+	})
+}
+
+// budgetStatus evaluates a budget, and includes the threshold crossings recorded in its current period
+func budgetStatus(sc *server.ServerContext, repCtx *costdb.CostReportContext, report *userdb.Report, budget *userdb.Budget, now time.Time) (*costquery.BudgetStatus, error) {
+	status, err := costquery.EvaluateBudget(repCtx, report, budget, now)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := sc.UserDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	status.Crossings, err = tx.GetBudgetCrossings(budget.ID, status.PeriodStart)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	tx.Commit()
+	return status, nil
+}
+
+// decodeBudget decodes a budget from the request body, and verifies its filters
+func decodeBudget(r *http.Request) (*userdb.Budget, error) {
+	budget := userdb.Budget{}
+	err := json.NewDecoder(r.Body).Decode(&budget)
+	if err != nil {
+		return nil, errors.New(errors.CodeBadRequest, "Invalid budget JSON")
+	}
+	_, err = costquery.BudgetFilters(&budget)
+	if err != nil {
+		return nil, err
+	}
+	return &budget, nil
+}
@@ -2,14 +2,19 @@
 package routers
 
 import (
+	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/applatix/claudia"
 	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/costquery"
 	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/export"
 	"github.com/applatix/claudia/parser"
 	"github.com/applatix/claudia/server"
 	"github.com/applatix/claudia/userdb"
@@ -19,10 +24,12 @@ import (
 )
 
 // writeReportHTTPCacheHeaders writes HTTP headers to enable client side caching
-func writeReportHTTPCacheHeaders(report *userdb.Report, w http.ResponseWriter) {
+func writeReportHTTPCacheHeaders(report *userdb.Report, r *http.Request, w http.ResponseWriter) {
 	// See http://stackoverflow.com/questions/1046966/whats-the-difference-between-cache-control-max-age-0-and-no-cache
 	w.Header().Set("Cache-Control", "max-age=0")
-	w.Header().Set("ETag", report.ETag())
+	w.Header().Set("ETag", reportETag(report, r))
+	// Cost queries may be exported as spreadsheets depending on the Accept header
+	w.Header().Set("Vary", "Accept")
 }
 
 // checkCacheReuse responds to the client 304 NotModified if requestor supplied a up-to-date ETag. Returns true if cache is reusable
@@ -30,13 +37,23 @@ func checkCacheReuse(report *userdb.Report, r *http.Request, w http.ResponseWrit
 	if report.Status == claudia.ReportStatusProcessing {
 		return false
 	}
-	if etag, ok := r.Header["If-None-Match"]; ok && len(etag) > 0 && report.ETag() == etag[0] {
+	if etag, ok := r.Header["If-None-Match"]; ok && len(etag) > 0 && reportETag(report, r) == etag[0] {
 		w.WriteHeader(http.StatusNotModified)
 		return true
 	}
 	return false
 }
 
+// reportETag returns the ETag of a response of a report. Spreadsheet exports of a query are distinct representations
+// from its JSON response, so the export format is part of their ETag
+func reportETag(report *userdb.Report, r *http.Request) string {
+	format, err := parseExportFormat(r.URL.Query(), r)
+	if err != nil || format == "" {
+		return report.ETag()
+	}
+	return report.ETag() + "/" + format
+}
+
 // rootDimensionHandler is a http handler to /v1/dimensions
 func rootDimensionHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -51,17 +68,20 @@ func rootDimensionHandler(sc *server.ServerContext) func(http.ResponseWriter, *h
 		if checkCacheReuse(report, r, w) {
 			return
 		}
-		dimNames := []string{
-			parser.ColumnUsageAccountID.APIName,
-			parser.ColumnRegion.APIName,
-			"resourcetags",
-			parser.ColumnService.APIName,
+		// Cost categories of the report are root dimensions following the built-in dimensions
+		categories, err := costquery.ReportCostCategories(sc.UserDB, report.ID)
+		if util.ErrorHandler(err, w) != nil {
+			return
 		}
-		items, err := dimensionHandlerHelper(sc, report, dimNames, w, r)
+		dimensionNames := append([]string{}, costdb.RootDimensionNames...)
+		for _, category := range categories {
+			dimensionNames = append(dimensionNames, category.APIName())
+		}
+		items, err := dimensionHandlerHelper(sc, report, dimensionNames, w, r)
 		if err != nil {
 			return
 		}
-		writeReportHTTPCacheHeaders(report, w)
+		writeReportHTTPCacheHeaders(report, r, w)
 		util.SuccessHandler(items, w)
 	})
 }
@@ -98,23 +118,40 @@ func dimensionHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.
 			err := errors.Errorf(errors.CodeNotFound, "Dimension %s not found", subdimName)
 			util.ErrorHandler(err, w)
 		} else {
-			writeReportHTTPCacheHeaders(report, w)
+			writeReportHTTPCacheHeaders(report, r, w)
 			util.SuccessHandler(dimension, w)
 		}
 	})
 }
 
 func dimensionHandlerHelper(sc *server.ServerContext, report *userdb.Report, dimensionNames []string, w http.ResponseWriter, r *http.Request) ([]*costdb.Dimension, error) {
-	repCtx := sc.CostDB.NewCostReportContext(report.ID)
+	repCtx, err := sc.NewCostReportContext(report)
+	if util.ErrorHandler(err, w) != nil {
+		return nil, err
+	}
 	filters, err := parseDimensionFiltersStrict(r.URL.Query())
 	if util.ErrorHandler(err, w) != nil {
 		return nil, err
 	}
 	items := make([]*costdb.Dimension, 0)
+	// Dimensions are served from the report's dimension snapshot, unless the filters require a query of the cost database
+	var tree []*costdb.Dimension
 	for _, dimName := range dimensionNames {
-		dimension, err := repCtx.GetDimension(dimName, filters)
-		if util.ErrorHandler(err, w) != nil {
-			return nil, err
+		var dimension *costdb.Dimension
+		if costdb.CanFilterDimensionTree(dimName, filters) {
+			if tree == nil {
+				tree, err = costquery.DimensionTree(sc.UserDB, repCtx, report)
+				if err != nil {
+					log.Printf("Failed to get dimension tree of report %s: %s", report.ID, err)
+				}
+			}
+			dimension = costdb.FilterDimensionTree(tree, dimName, filters)
+		}
+		if dimension == nil {
+			dimension, err = repCtx.GetDimension(dimName, filters)
+			if util.ErrorHandler(err, w) != nil {
+				return nil, err
+			}
 		}
 		aliases := sc.GetDisplayNameAliases(dimName, report)
 		if aliases != nil {
@@ -161,49 +198,158 @@ func costHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Reque
 		if checkCacheReuse(report, r, w) {
 			return
 		}
-		repCtx := sc.CostDB.NewCostReportContext(report.ID)
-		costQuery, err := parseCostQueryParams(r.URL.Query())
+		serveCost(sc, report, r.URL.Query(), w, r)
+	})
+}
+
+// serveCost executes a cost query of a report from its query args, and responds with the series (or their export)
+func serveCost(sc *server.ServerContext, report *userdb.Report, params url.Values, w http.ResponseWriter, r *http.Request) {
+	repCtx, err := sc.NewCostReportContext(report)
+	if util.ErrorHandler(err, w) != nil {
+		return
+	}
+	format, err := parseExportFormat(params, r)
+	if util.ErrorHandler(err, w) != nil {
+		return
+	}
+	// Shared costs are allocated by the named allocation ruleset of the report
+	costQuery, allocate, err := costquery.ParseReportCostQuery(params, report)
+	if util.ErrorHandler(err, w) != nil {
+		return
+	}
+	if allocate != "" {
+		allocated, err := costquery.AllocatedCost(sc.UserDB, repCtx, report.ID, costQuery, allocate)
 		if util.ErrorHandler(err, w) != nil {
 			return
 		}
-		rows, err := repCtx.Cost(costQuery)
+		transformRows(sc, report, costQuery, allocated.Series)
+		writeReportHTTPCacheHeaders(report, r, w)
+		writePageHeaders(costQuery, allocated.Series, w)
+		if format != "" {
+			writeExport(w, format, "cost", costQuery, allocated.Series)
+			return
+		}
+		util.SuccessHandler(allocated, w)
+		return
+	}
+	if format != "" {
+		serveExport(sc, report, repCtx, costQuery, format, "cost", w, r)
+		return
+	}
+	rows, err := repCtx.Cost(costQuery)
+	if util.ErrorHandler(err, w) != nil {
+		return
+	}
+	transformRows(sc, report, costQuery, rows)
+	writeReportHTTPCacheHeaders(report, r, w)
+	writePageHeaders(costQuery, rows, w)
+	util.SuccessHandler(rows, w)
+}
+
+// costCompareHandler is the http handler for /v1/cost/compare
+func costCompareHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		report, err := sc.GetDefaultReport(si.UserID)
 		if util.ErrorHandler(err, w) != nil {
 			return
 		}
-		transformRows(sc, report, costQuery, rows)
-		writeReportHTTPCacheHeaders(report, w)
-		util.SuccessHandler(rows, w)
+		if checkCacheReuse(report, r, w) {
+			return
+		}
+		params := r.URL.Query()
+		compareTo := params.Get("compare_to")
+		if compareTo == "" {
+			compareTo = costquery.CompareToPreviousPeriod
+		}
+		params.Del("compare_to")
+		costQuery, err := costquery.ParseCostQueryParams(params)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		costQuery.Calendar = costquery.ReportFiscalCalendar(report)
+		comparisonQuery, err := costquery.ComparisonQuery(costQuery, compareTo)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		repCtx, err := sc.NewCostReportContext(report)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		comparisons, err := repCtx.CompareCost(costQuery, comparisonQuery)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		aliases := sc.GetDisplayNameAliases(costQuery.GroupBy, report)
+		if aliases != nil {
+			for _, c := range comparisons {
+				if alias, ok := aliases[c.Name]; ok {
+					c.DisplayName = alias
+				}
+			}
+		}
+		writeReportHTTPCacheHeaders(report, r, w)
+		util.SuccessHandler(comparisons, w)
 	})
 }
 
-// transformRows will add dimension metadata to the cost data, such dimension name and display name (if available)
-func transformRows(sc *server.ServerContext, report *userdb.Report, costQuery *costdb.CostQuery, rows []models.Row) {
-	//repCtx := sc.CostDB.NewCostReportContext(report.ID)
-	aliases := sc.GetDisplayNameAliases(costQuery.GroupBy, report)
-	for _, row := range rows {
-		if row.Tags == nil {
-			continue
-		}
-		var seriesName string
-		// The tag field from the influxdb result will be a mapping of the column name to column value
-		// e.g. "tags": {"claudia/EC2InstanceType": "m3.2xlarge"}
-		// We want to transform this to include: dimension API name, display name, and name
-		// This enables some navigation elements
-		for k, v := range row.Tags {
-			seriesName = v
-			delete(row.Tags, k) // remove the database column name from payload
-			break
+// forecastHandler is the http handler for /v1/forecast
+func forecastHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		report, err := sc.GetDefaultReport(si.UserID)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		params := r.URL.Query()
+		horizon := 0
+		if horizonStr := params.Get("horizon"); horizonStr != "" {
+			horizon, err = strconv.Atoi(horizonStr)
+			if err != nil {
+				util.ErrorHandler(errors.Errorf(errors.CodeBadRequest, "Invalid horizon: %s", horizonStr), w)
+				return
+			}
+		}
+		params.Del("horizon")
+		costQuery, err := costquery.ParseCostQueryParams(params)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		if !costQuery.From.IsZero() || !costQuery.To.IsZero() || costQuery.Interval != "" {
+			err = errors.New(errors.CodeBadRequest, "Forecasts do not accept a timeframe or interval")
+			util.ErrorHandler(err, w)
+			return
+		}
+		costQuery.Calendar = costquery.ReportFiscalCalendar(report)
+		repCtx, err := sc.NewCostReportContext(report)
+		if util.ErrorHandler(err, w) != nil {
+			return
 		}
-		displayName := seriesName
+		result, err := repCtx.Forecast(costQuery, time.Now(), horizon)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		aliases := sc.GetDisplayNameAliases(costQuery.GroupBy, report)
 		if aliases != nil {
-			if alias, ok := aliases[seriesName]; ok {
-				displayName = alias
+			for _, f := range result.Forecasts {
+				if alias, ok := aliases[f.Name]; ok {
+					f.DisplayName = alias
+				}
 			}
 		}
-		row.Tags["dimension"] = costQuery.GroupBy
-		row.Tags["name"] = seriesName
-		row.Tags["display_name"] = displayName
-	}
+		util.SuccessHandler(result, w)
+	})
+}
+
+// transformRows will add dimension metadata to the cost data, such dimension name and display name (if available)
+func transformRows(sc *server.ServerContext, report *userdb.Report, costQuery *costdb.CostQuery, rows []models.Row) {
+	costquery.TransformRows(sc.UserDB, report, costQuery, rows)
 }
 
 // countHandler is the http handler for /v1/count
@@ -220,19 +366,33 @@ func countHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Requ
 		if checkCacheReuse(report, r, w) {
 			return
 		}
-		repCtx := sc.CostDB.NewCostReportContext(report.ID)
-		costQuery, err := parseCostQueryParams(r.URL.Query())
+		repCtx, err := sc.NewCostReportContext(report)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		params := r.URL.Query()
+		format, err := parseExportFormat(params, r)
 		if util.ErrorHandler(err, w) != nil {
 			return
 		}
+		costQuery, err := parsePagedCostQueryParams(params)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		costQuery.Calendar = costquery.ReportFiscalCalendar(report)
 		costQuery.Aggregator = "COUNT(DISTINCT(\"%s\"))"
 		costQuery.Field = parser.ColumnResourceID.ColumnName
+		if format != "" {
+			serveExport(sc, report, repCtx, costQuery, format, "count", w, r)
+			return
+		}
 		rows, err := repCtx.Cost(costQuery)
 		if util.ErrorHandler(err, w) != nil {
 			return
 		}
 		transformRows(sc, report, costQuery, rows)
-		writeReportHTTPCacheHeaders(report, w)
+		writeReportHTTPCacheHeaders(report, r, w)
+		writePageHeaders(costQuery, rows, w)
 		util.SuccessHandler(rows, w)
 	})
 }
@@ -258,87 +418,337 @@ func usageHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Requ
 		if checkCacheReuse(report, r, w) {
 			return
 		}
-		costQuery, err := parseCostQueryParams(r.URL.Query())
+		params := r.URL.Query()
+		format, err := parseExportFormat(params, r)
 		if util.ErrorHandler(err, w) != nil {
 			return
 		}
+		statistic, err := costquery.ParseStatisticParam(params)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		costQuery, err := parsePagedCostQueryParams(params)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		costQuery.Statistic = statistic
+		costQuery.Calendar = costquery.ReportFiscalCalendar(report)
 		costQuery.Field = parser.ColumnUsageAmount.ColumnName
 		costQuery.Filters[parser.ColumnService.ColumnName] = []string{serviceName}
 
-		repCtx := sc.CostDB.NewCostReportContext(report.ID)
-		usageUnits, err := repCtx.GetUsageUnits(serviceName)
+		repCtx, err := sc.NewCostReportContext(report)
 		if util.ErrorHandler(err, w) != nil {
 			return
 		}
-		if len(usageUnits) > 1 {
-			metricName, ok := vars["metric"]
-			if !ok {
-				validUnits := make([]string, len(usageUnits))
-				for i, u := range usageUnits {
-					validUnits[i] = u.Name
-				}
-				err = errors.Errorf(errors.CodeBadRequest, "Usage query of service '%s' is ambiguous. Choose from units: %s", serviceName, strings.Join(validUnits, ", "))
+		err = applyUsageUnitFilter(repCtx, costQuery, serviceName, vars)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		if format != "" {
+			serveExport(sc, report, repCtx, costQuery, format, "usage", w, r)
+			return
+		}
+		rows, err := repCtx.Cost(costQuery)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		transformRows(sc, report, costQuery, rows)
+		writeReportHTTPCacheHeaders(report, r, w)
+		writePageHeaders(costQuery, rows, w)
+		util.SuccessHandler(rows, w)
+	})
+}
+
+// rateHandler is the http handler for /v1/rate/{service}/{metric}. Returns the effective rate (cost per unit of usage) of a usage metric
+func rateHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		serviceName, ok := vars["service"]
+		if !ok {
+			err = errors.New(errors.CodeBadRequest, "Rate query must supply a service")
+			util.ErrorHandler(err, w)
+			return
+		}
+		report, err := sc.GetDefaultReport(si.UserID)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		if checkCacheReuse(report, r, w) {
+			return
+		}
+		costQuery, err := costquery.ParseCostQueryParams(r.URL.Query())
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		costQuery.Calendar = costquery.ReportFiscalCalendar(report)
+		costQuery.Filters[parser.ColumnService.ColumnName] = []string{serviceName}
+
+		repCtx, err := sc.NewCostReportContext(report)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		err = applyUsageUnitFilter(repCtx, costQuery, serviceName, vars)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		rows, err := repCtx.Rate(costQuery)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		transformRows(sc, report, costQuery, rows)
+		writeReportHTTPCacheHeaders(report, r, w)
+		util.SuccessHandler(rows, w)
+	})
+}
+
+// Limits of the number of resources returned by /v1/resources
+const (
+	resourcesDefaultLimit = 25
+	resourcesMaxLimit     = 1000
+)
+
+// resourcesHandler is the http handler for /v1/resources. Returns the most costly resources, e.g. /v1/resources?service=AWS EC2 Instance&limit=10
+func resourcesHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		report, err := sc.GetDefaultReport(si.UserID)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		if checkCacheReuse(report, r, w) {
+			return
+		}
+		params := r.URL.Query()
+		if service := params.Get("service"); service != "" {
+			params.Del("service")
+			params.Set(parser.ColumnService.APIName, service)
+		}
+		limit := resourcesDefaultLimit
+		if limitStr := params.Get("limit"); limitStr != "" {
+			params.Del("limit")
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit < 1 || limit > resourcesMaxLimit {
+				err = errors.Errorf(errors.CodeBadRequest, "Limit must be between 1 and %d", resourcesMaxLimit)
 				util.ErrorHandler(err, w)
 				return
 			}
-			var usageUnit *costdb.UsageUnit
-			for _, u := range usageUnits {
-				if u.Name == metricName {
-					usageUnit = u
-					break
-				}
-			}
-			if usageUnit == nil {
-				err = errors.Errorf(errors.CodeBadRequest, "Usage unit %s is not a valid metric of %s", metricName, serviceName)
+		}
+		costQuery, err := costquery.ParseCostQueryParams(params)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		if costQuery.GroupBy != "" || costQuery.Interval != "" {
+			err = errors.New(errors.CodeBadRequest, "Resource queries do not support group_by or interval")
+			util.ErrorHandler(err, w)
+			return
+		}
+		repCtx, err := sc.NewCostReportContext(report)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		resources, err := repCtx.TopResources(costQuery, limit)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		writeReportHTTPCacheHeaders(report, r, w)
+		util.SuccessHandler(resources, w)
+	})
+}
+
+// tagCoverageHandler is the http handler for /v1/tagcoverage. Returns the cost and number of resources missing each
+// required tag key per group and interval, and the most costly untagged resources, e.g. /v1/tagcoverage?keys=owner,team&group_by=accounts
+func tagCoverageHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		report, err := sc.GetDefaultReport(si.UserID)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		if checkCacheReuse(report, r, w) {
+			return
+		}
+		params := r.URL.Query()
+		keys, err := costquery.ParseTagKeys(params.Get("keys"))
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		params.Del("keys")
+		limit := resourcesDefaultLimit
+		if limitStr := params.Get("limit"); limitStr != "" {
+			params.Del("limit")
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit < 1 || limit > resourcesMaxLimit {
+				err = errors.Errorf(errors.CodeBadRequest, "Limit must be between 1 and %d", resourcesMaxLimit)
 				util.ErrorHandler(err, w)
 				return
 			}
-			_, exists := costQuery.Filters[parser.ColumnUsageFamily.ColumnName]
-			if !exists {
-				// We must apply the usage family filter if user query did not supply it, in order for the usage query to make sense
-				costQuery.Filters[parser.ColumnUsageFamily.ColumnName] = usageUnit.UsageFamilies
-			}
 		}
-		rows, err := repCtx.Cost(costQuery)
+		costQuery, err := costquery.ParseCostQueryParams(params)
 		if util.ErrorHandler(err, w) != nil {
 			return
 		}
-		transformRows(sc, report, costQuery, rows)
-		writeReportHTTPCacheHeaders(report, w)
-		util.SuccessHandler(rows, w)
+		costQuery.Calendar = costquery.ReportFiscalCalendar(report)
+		repCtx, err := sc.NewCostReportContext(report)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		coverage, err := repCtx.TagCoverage(costQuery, keys, costquery.ResourceOnlyTagKeys(report, keys), limit)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		aliases := costquery.DisplayNameAliases(sc.UserDB, costQuery.GroupBy, report)
+		for _, group := range coverage.Groups {
+			if alias, ok := aliases[group.Name]; ok {
+				group.DisplayName = alias
+			}
+		}
+		writeReportHTTPCacheHeaders(report, r, w)
+		util.SuccessHandler(coverage, w)
 	})
 }
 
-// Attempt multiple acceptable time formats
-func parseTime(timeStr string) (time.Time, error) {
-	t, err := time.Parse("2006-01-02", timeStr)
+// applyUsageUnitFilter filters the query of a service to a single usage unit. Services with usage measured in more than one unit
+// (e.g. hours and GB) require the metric to be supplied, which is used to filter the query to the usage families of that unit
+func applyUsageUnitFilter(repCtx *costdb.CostReportContext, costQuery *costdb.CostQuery, serviceName string, vars map[string]string) error {
+	usageUnits, err := repCtx.GetUsageUnits(serviceName)
 	if err != nil {
-		return t, errors.Errorf(errors.CodeBadRequest, "Invalid time: %s", timeStr)
+		return err
+	}
+	if len(usageUnits) > 1 {
+		metricName, ok := vars["metric"]
+		if !ok {
+			validUnits := make([]string, len(usageUnits))
+			for i, u := range usageUnits {
+				validUnits[i] = u.Name
+			}
+			return errors.Errorf(errors.CodeBadRequest, "Usage query of service '%s' is ambiguous. Choose from units: %s", serviceName, strings.Join(validUnits, ", "))
+		}
+		var usageUnit *costdb.UsageUnit
+		for _, u := range usageUnits {
+			if u.Name == metricName {
+				usageUnit = u
+				break
+			}
+		}
+		if usageUnit == nil {
+			return errors.Errorf(errors.CodeBadRequest, "Usage unit %s is not a valid metric of %s", metricName, serviceName)
+		}
+		_, exists := costQuery.Filters[parser.ColumnUsageFamily.ColumnName]
+		if !exists {
+			// We must apply the usage family filter if user query did not supply it, in order for the usage query to make sense
+			costQuery.Filters[parser.ColumnUsageFamily.ColumnName] = usageUnit.UsageFamilies
+		}
 	}
-	return t, nil
+	return nil
 }
 
-// parseDimensionFilters parses query args related to dimensions
-func parseDimensionFilters(params url.Values) (map[string][]string, url.Values) {
-	filters := make(map[string][]string)
-	remaining := make(url.Values)
-	for k, v := range params {
-		val := v[0]
-		columnName := parser.APINameToColumnName(k)
-		if columnName == nil {
-			remaining[k] = v
-		} else {
-			// NOTE: comma is acceptable as a delimiter because resouce tags cannot have commas
-			// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/Using_Tags.html#tag-restrictions
-			filters[*columnName] = strings.Split(val, ",")
+// parsePagedCostQueryParams parses the query args of a cost query which supports pagination of its series
+func parsePagedCostQueryParams(params url.Values) (*costdb.CostQuery, error) {
+	limit, offset, err := costquery.ParsePageParams(params)
+	if err != nil {
+		return nil, err
+	}
+	costQuery, err := costquery.ParseCostQueryParams(params)
+	if err != nil {
+		return nil, err
+	}
+	costQuery.SeriesLimit = limit
+	costQuery.SeriesOffset = offset
+	return costQuery, nil
+}
+
+// writePageHeaders writes the cursor of the next page of series (if any) in the X-Next-Cursor header of a paged cost query
+func writePageHeaders(costQuery *costdb.CostQuery, rows []models.Row, w http.ResponseWriter) {
+	if nextCursor := costquery.NextCursor(costQuery, len(rows)); nextCursor != "" {
+		w.Header().Set("X-Next-Cursor", nextCursor)
+	}
+}
+
+// parseExportFormat parses and removes the 'format' query arg, which requests a query to be exported as a spreadsheet (csv or xlsx).
+// When not supplied, the format is negotiated from the Accept header. Returns the empty string for a JSON response
+func parseExportFormat(params url.Values, r *http.Request) (string, error) {
+	format := params.Get("format")
+	params.Del("format")
+	if format == "" {
+		return export.FormatFromAccept(r.Header.Get("Accept")), nil
+	}
+	if strings.ToLower(format) == "json" {
+		return "", nil
+	}
+	return export.ParseFormat(format)
+}
+
+// exportPageSize is the number of series queried at a time when exporting a query
+const exportPageSize = 500
+
+// writeExport writes the rows of a query as a spreadsheet attachment
+func writeExport(w http.ResponseWriter, format, name string, costQuery *costdb.CostQuery, rows []models.Row) {
+	writeExportHeaders(w, format, name)
+	err := export.WriteCostTable(w, format, costQuery, rows)
+	if err != nil {
+		// Headers have already been written. The best we can do is log the error
+		log.Printf("Failed to export %s: %s", name, err)
+	}
+}
+
+// writeExportHeaders writes the headers of a spreadsheet attachment
+func writeExportHeaders(w http.ResponseWriter, format, name string) {
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", name, format))
+}
+
+// serveExport performs a query and responds with its series as a spreadsheet attachment. Unless the client requested a page
+// of series, a grouped query is performed in pages of exportPageSize series, and each page is written as it is returned so
+// that a large result is never held in memory at once. Statistics are not paged and are exported at once
+func serveExport(sc *server.ServerContext, report *userdb.Report, repCtx *costdb.CostReportContext, costQuery *costdb.CostQuery, format, name string, w http.ResponseWriter, r *http.Request) {
+	paged := costQuery.SeriesLimit == 0 && costQuery.GroupBy != "" && costQuery.Statistic.IsTotal()
+	if paged {
+		costQuery.SeriesLimit = exportPageSize
+	}
+	rows, err := repCtx.Cost(costQuery)
+	if util.ErrorHandler(err, w) != nil {
+		return
+	}
+	transformRows(sc, report, costQuery, rows)
+	writeReportHTTPCacheHeaders(report, r, w)
+	if !paged {
+		writePageHeaders(costQuery, rows, w)
+	}
+	writeExportHeaders(w, format, name)
+	ct, err := export.NewCostTableWriter(w, format, costQuery)
+	for err == nil {
+		err = ct.WriteRows(rows)
+		if err != nil || !paged || len(rows) < costQuery.SeriesLimit {
+			break
+		}
+		costQuery.SeriesOffset += costQuery.SeriesLimit
+		rows, err = repCtx.Cost(costQuery)
+		if err == nil {
+			transformRows(sc, report, costQuery, rows)
 		}
 	}
-	return filters, remaining
+	if err == nil {
+		err = ct.Close()
+	}
+	if err != nil {
+		// Headers have already been written. The best we can do is log the error
+		log.Printf("Failed to export %s: %s", name, err)
+	}
 }
 
 // parseDimensionFiltersStrict parses query args related to dimensions and returns error if any unrecognized dimensions
 func parseDimensionFiltersStrict(params url.Values) (map[string][]string, error) {
-	filters, remaining := parseDimensionFilters(params)
+	filters, remaining := costquery.ParseDimensionFilters(params)
 	if len(remaining) > 0 {
 		keys := make([]string, len(remaining))
 		i := 0
@@ -351,39 +761,3 @@ func parseDimensionFiltersStrict(params url.Values) (map[string][]string, error)
 	}
 	return filters, nil
 }
-
-func parseCostQueryParams(params url.Values) (*costdb.CostQuery, error) {
-	costQuery := costdb.CostQuery{}
-	var err error
-	filters, remaining := parseDimensionFilters(params)
-	costQuery.Filters = filters
-	for k, v := range remaining {
-		val := v[0]
-		switch k {
-		case "from":
-			costQuery.From, err = parseTime(val)
-		case "to":
-			costQuery.To, err = parseTime(val)
-		case "group_by":
-			costQuery.GroupBy = val
-		case "interval":
-			// TODO: decide if we want to round down 'from' date if interval is weekly
-			costQuery.Interval, err = costdb.ParseInterval(val)
-		case "blended":
-			val = strings.ToLower(val)
-			if val == "true" || val == "1" || val == "t" {
-				costQuery.Field = parser.ColumnBlendedCost.ColumnName
-			}
-		default:
-			err = errors.Errorf(errors.CodeBadRequest, "Unknown param: %s", k)
-		}
-		if err != nil {
-			return nil, err
-		}
-	}
-	if costQuery.Interval != "" && costQuery.From.IsZero() && costQuery.To.IsZero() {
-		err = errors.New(errors.CodeBadRequest, "Timeframe required when supplying interval")
-		return nil, err
-	}
-	return &costQuery, nil
-}
@@ -0,0 +1,228 @@
+// Copyright 2017 Applatix, Inc.
+package routers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/notification"
+	"github.com/applatix/claudia/server"
+	"github.com/applatix/claudia/userdb"
+	"github.com/applatix/claudia/util"
+	"github.com/gorilla/mux"
+)
+
+const (
+	deliveriesDefaultLimit = 100
+	deliveriesMaxLimit     = 1000
+)
+
+// reportChannelsHandler is the handler for /v1/reports/{reportID}/channels
+func reportChannelsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		reportID := mux.Vars(r)["reportID"]
+		switch r.Method {
+		case "GET":
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			_, err = tx.GetUserReport(si.UserID, reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			channels, err := tx.GetReportNotificationChannels(reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			tx.Commit()
+			for _, channel := range channels {
+				channel.HideSecrets()
+			}
+			util.SuccessHandler(channels, w)
+		case "POST":
+			channel, err := decodeNotificationChannel(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			_, err = tx.GetUserReport(si.UserID, reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			channel.ReportID = reportID
+			channelID, err := tx.CreateNotificationChannel(channel)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			createdChannel, err := tx.GetReportNotificationChannel(reportID, channelID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			err = tx.Commit()
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			createdChannel.HideSecrets()
+			util.SuccessHandler(createdChannel, w)
+		default:
+			util.ErrorHandler(errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method), w)
+		}
+	})
+}
+
+// reportChannelHandler is the handler for /v1/reports/{reportID}/channels/{channelID}
+func reportChannelHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		channelID := vars["channelID"]
+		var channel *userdb.NotificationChannel
+		if r.Method == "PUT" {
+			channel, err = decodeNotificationChannel(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+		}
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		_, err = tx.GetUserReport(si.UserID, reportID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			channel, err = tx.GetReportNotificationChannel(reportID, channelID)
+		case "PUT":
+			channel.ID = channelID
+			channel.ReportID = reportID
+			err = tx.UpdateNotificationChannel(channel)
+			if err == nil {
+				channel, err = tx.GetReportNotificationChannel(reportID, channelID)
+			}
+		case "DELETE":
+			err = tx.DeleteNotificationChannel(reportID, channelID)
+			channel = nil
+		default:
+			err = errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method)
+		}
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		err = tx.Commit()
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		if channel == nil {
+			util.SuccessHandler(nil, w)
+			return
+		}
+		channel.HideSecrets()
+		util.SuccessHandler(channel, w)
+	})
+}
+
+// reportChannelDeliveriesHandler is the handler for /v1/reports/{reportID}/channels/{channelID}/deliveries. Returns the delivery log of a channel
+func reportChannelDeliveriesHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		channelID := vars["channelID"]
+		limit := deliveriesDefaultLimit
+		if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit < 1 || limit > deliveriesMaxLimit {
+				err = errors.Errorf(errors.CodeBadRequest, "Limit must be between 1 and %d", deliveriesMaxLimit)
+				util.ErrorHandler(err, w)
+				return
+			}
+		}
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		_, err = tx.GetUserReport(si.UserID, reportID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		_, err = tx.GetReportNotificationChannel(reportID, channelID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		deliveries, err := tx.GetNotificationDeliveries(channelID, limit)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		tx.Commit()
+		util.SuccessHandler(deliveries, w)
+	})
+}
+
+// reportChannelTestHandler is the handler for /v1/reports/{reportID}/channels/{channelID}/test. Queues a test notification
+// to the channel, which is delivered by ingestd, and can be followed in the channel's delivery log
+func reportChannelTestHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		channelID := vars["channelID"]
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		report, err := tx.GetUserReport(si.UserID, reportID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		channel, err := tx.GetReportNotificationChannel(reportID, channelID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		message := fmt.Sprintf("This is a test notification of the %s channel of %s", channel.Name, report.ReportName)
+		event := notification.NewEvent(report, userdb.NotificationEventTest, "Test notification", message, nil)
+		now := time.Now()
+		_, err = tx.QueueNotificationDelivery(channelID, fmt.Sprintf("%s:%d", event.Type, now.UnixNano()), now, event)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		err = tx.Commit()
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		util.SuccessHandler(nil, w)
+	})
+}
+
+// decodeNotificationChannel decodes a notification channel from the request body
+func decodeNotificationChannel(r *http.Request) (*userdb.NotificationChannel, error) {
+	channel := userdb.NotificationChannel{}
+	err := json.NewDecoder(r.Body).Decode(&channel)
+	if err != nil {
+		return nil, errors.New(errors.CodeBadRequest, "Invalid notification channel JSON")
+	}
+	return &channel, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Applatix, Inc.
+package routers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/applatix/claudia/commitments"
+	"github.com/applatix/claudia/costquery"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/server"
+	"github.com/applatix/claudia/util"
+)
+
+const (
+	recommendationsDefaultLookback   = 30
+	recommendationsMaxLookback       = 90
+	recommendationsDefaultPercentile = 10
+)
+
+// commitmentRecommendationsHandler is the http handler for /v1/recommendations/commitments. Returns the reservations and
+// savings plans recommended for the OnDemand instance hours of the last lookback days, whose baseline is a percentile
+// of the hourly usage, e.g. /v1/recommendations/commitments?lookback=30&percentile=10&regions=us-west-2.
+// Results are not cached, since the window moves daily and rates come from the price sheet loaded at startup
+func commitmentRecommendationsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		if sc.PriceSheet == nil {
+			util.ErrorHandler(errors.New(errors.CodeNotFound, "No price sheet is loaded. Commitment recommendations are disabled"), w)
+			return
+		}
+		report, err := sc.GetDefaultReport(si.UserID)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		params := r.URL.Query()
+		lookback := recommendationsDefaultLookback
+		if lookbackStr := params.Get("lookback"); lookbackStr != "" {
+			params.Del("lookback")
+			lookback, err = strconv.Atoi(lookbackStr)
+			if err != nil || lookback < 1 || lookback > recommendationsMaxLookback {
+				err = errors.Errorf(errors.CodeBadRequest, "Lookback must be between 1 and %d days", recommendationsMaxLookback)
+				util.ErrorHandler(err, w)
+				return
+			}
+		}
+		percentile := float64(recommendationsDefaultPercentile)
+		if percentileStr := params.Get("percentile"); percentileStr != "" {
+			params.Del("percentile")
+			percentile, err = strconv.ParseFloat(percentileStr, 64)
+			if err != nil || percentile < 0 || percentile > 100 {
+				util.ErrorHandler(errors.New(errors.CodeBadRequest, "Percentile must be between 0 and 100"), w)
+				return
+			}
+		}
+		costQuery, err := costquery.ParseCostQueryParams(params)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		if !costQuery.From.IsZero() || !costQuery.To.IsZero() || costQuery.GroupBy != "" || costQuery.Interval != "" {
+			err = errors.New(errors.CodeBadRequest, "Commitment recommendations do not support from, to, group_by or interval")
+			util.ErrorHandler(err, w)
+			return
+		}
+		repCtx, err := sc.NewCostReportContext(report)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		recommendations, err := commitments.Recommend(repCtx, sc.PriceSheet, costQuery.Filters, lookback, percentile, time.Now())
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		util.SuccessHandler(recommendations, w)
+	})
+}
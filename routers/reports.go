@@ -3,12 +3,18 @@ package routers
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/applatix/claudia/billingbucket"
+	"github.com/applatix/claudia/costquery"
 	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/export"
 	"github.com/applatix/claudia/server"
 	"github.com/applatix/claudia/userdb"
 	"github.com/applatix/claudia/util"
@@ -62,6 +68,10 @@ func reportsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Re
 			if util.TXErrorHandler(err, tx, w) != nil {
 				return
 			}
+			_, err = repCtx.UpdateRetentionTiers(createdReport.DailyRetentionDays(), createdReport.MonthlyRetentionDays())
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
 			err = tx.Commit()
 			if util.TXErrorHandler(err, tx, w) != nil {
 				return
@@ -156,7 +166,7 @@ func reportHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Req
 				return
 			}
 			// This call will verify the user actually owns the report
-			_, err = tx.GetUserReport(si.UserID, report.ID)
+			currentReport, err := tx.GetUserReport(si.UserID, report.ID)
 			if util.TXErrorHandler(err, tx, w) != nil {
 				return
 			}
@@ -176,6 +186,17 @@ func reportHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Req
 			if util.TXErrorHandler(err, tx, w) != nil {
 				return
 			}
+			if updatedReport.RetentionDays < currentReport.RetentionDays {
+				// Data beyond the reduced retention is dropped by the cost database
+				err = tx.IncrementReportDataGeneration(updatedReport.ID)
+				if util.TXErrorHandler(err, tx, w) != nil {
+					return
+				}
+			}
+			tierCreated, err := repCtx.UpdateRetentionTiers(updatedReport.DailyRetentionDays(), updatedReport.MonthlyRetentionDays())
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
 			err = tx.Commit()
 			if util.TXErrorHandler(err, tx, w) != nil {
 				return
@@ -186,6 +207,15 @@ func reportHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Req
 				// Notify ingest (in case retention was increased, to reprocess data)
 				go sc.NotifyUpdate()
 			}
+			if tierCreated {
+				// Downsample the data already ingested into the new tier. Subsequent ingests are downsampled by ingestd
+				go func() {
+					err := repCtx.Downsample(time.Time{}, time.Now())
+					if err != nil {
+						log.Printf("Failed to downsample report %s: %s", repCtx.ReportID, err)
+					}
+				}()
+			}
 		case "DELETE":
 			tx, err := sc.UserDB.Begin()
 			if util.TXErrorHandler(err, tx, w) != nil {
@@ -199,6 +229,10 @@ func reportHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Req
 			if util.TXErrorHandler(err, tx, w) != nil {
 				return
 			}
+			err = os.RemoveAll(server.StatementsDir(reportID))
+			if err != nil {
+				log.Printf("Failed to remove statements of report %s: %s", reportID, err)
+			}
 			util.SuccessHandler(nil, w)
 			go sc.NotifyUpdate()
 		default:
@@ -224,6 +258,40 @@ func reportStatusHandler(sc *server.ServerContext) func(http.ResponseWriter, *ht
 	})
 }
 
+// Limits of the number of ingest attempts returned by /v1/reports/{reportID}/ingests
+const (
+	ingestsDefaultLimit = 100
+	ingestsMaxLimit     = 1000
+)
+
+// reportIngestsHandler is the handler for /v1/reports/{reportID}/ingests. Returns the history of ingest attempts, most recent first,
+// e.g. /v1/reports/{reportID}/ingests?billing_period=20170101-20170201&limit=10
+func reportIngestsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		params := r.URL.Query()
+		limit := ingestsDefaultLimit
+		if limitStr := params.Get("limit"); limitStr != "" {
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit < 1 || limit > ingestsMaxLimit {
+				err = errors.Errorf(errors.CodeBadRequest, "Limit must be between 1 and %d", ingestsMaxLimit)
+				util.ErrorHandler(err, w)
+				return
+			}
+		}
+		attempts, err := sc.GetUserReportIngestHistory(si.UserID, reportID, params.Get("billing_period"), limit)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		util.SuccessHandler(attempts, w)
+	})
+}
+
 // reportAccountsHandler is the handler for /v1/reports/{reportID}/accounts
 func reportAccountsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -310,6 +378,90 @@ func reportAccountHandler(sc *server.ServerContext) func(http.ResponseWriter, *h
 	})
 }
 
+// reportAnomaliesHandler is the handler for /v1/reports/{reportID}/anomalies
+func reportAnomaliesHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		status := r.URL.Query().Get("status")
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		report, err := tx.GetUserReport(si.UserID, reportID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		anomalies, err := tx.GetReportAnomalies(reportID, status)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		tx.Commit()
+		aliasesByDimension := make(map[string]map[string]string)
+		for _, a := range anomalies {
+			aliases, ok := aliasesByDimension[a.Dimension]
+			if !ok {
+				aliases = sc.GetDisplayNameAliases(a.Dimension, report)
+				aliasesByDimension[a.Dimension] = aliases
+			}
+			a.DisplayName = a.Name
+			if alias, exists := aliases[a.Name]; exists {
+				a.DisplayName = alias
+			}
+		}
+		util.SuccessHandler(anomalies, w)
+	})
+}
+
+// reportAnomalyHandler is the handler for /v1/reports/{reportID}/anomalies/{anomalyID}. Anomalies are acknowledged or dismissed by updating their status
+func reportAnomalyHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		anomalyID := vars["anomalyID"]
+		switch r.Method {
+		case "PUT":
+			decoder := json.NewDecoder(r.Body)
+			anomaly := userdb.Anomaly{}
+			err = decoder.Decode(&anomaly)
+			if err != nil {
+				err = errors.New(errors.CodeBadRequest, "Invalid anomaly JSON")
+			}
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			report, err := tx.GetUserReport(si.UserID, reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			updatedAnomaly, err := tx.UpdateAnomalyStatus(report.ID, anomalyID, anomaly.Status)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			tx.Commit()
+			updatedAnomaly.DisplayName = updatedAnomaly.Name
+			if alias, exists := sc.GetDisplayNameAliases(updatedAnomaly.Dimension, report)[updatedAnomaly.Name]; exists {
+				updatedAnomaly.DisplayName = alias
+			}
+			util.SuccessHandler(updatedAnomaly, w)
+		default:
+			util.ErrorHandler(errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method), w)
+		}
+	})
+}
+
 // reportBucketsHandler is the handler for /v1/reports/{reportID}/buckets
 func reportBucketsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -465,3 +617,411 @@ func hideAWSSecretAccessKeys(report *userdb.Report) {
 		bucket.AWSSecretAccessKey = ""
 	}
 }
+
+// reportCategoriesHandler is the handler for /v1/reports/{reportID}/categories
+func reportCategoriesHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		switch r.Method {
+		case "GET":
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			_, err = tx.GetUserReport(si.UserID, reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			categories, err := tx.GetReportCostCategories(reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			tx.Commit()
+			util.SuccessHandler(categories, w)
+		case "POST":
+			category, err := decodeCostCategory(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			_, err = tx.GetUserReport(si.UserID, reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			category.ReportID = reportID
+			categoryID, err := tx.CreateCostCategory(category)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			createdCategory, err := tx.GetReportCostCategory(reportID, categoryID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			err = tx.Commit()
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			util.SuccessHandler(createdCategory, w)
+		default:
+			util.ErrorHandler(errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method), w)
+		}
+	})
+}
+
+// reportCategoryHandler is the handler for /v1/reports/{reportID}/categories/{categoryID}
+func reportCategoryHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		categoryID := vars["categoryID"]
+		var category *userdb.CostCategory
+		if r.Method == "PUT" {
+			category, err = decodeCostCategory(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+		}
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		_, err = tx.GetUserReport(si.UserID, reportID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			category, err = tx.GetReportCostCategory(reportID, categoryID)
+		case "PUT":
+			category.ID = categoryID
+			category.ReportID = reportID
+			err = tx.UpdateCostCategory(category)
+			if err == nil {
+				category, err = tx.GetReportCostCategory(reportID, categoryID)
+			}
+		case "DELETE":
+			err = tx.DeleteCostCategory(reportID, categoryID)
+			category = nil
+		default:
+			err = errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method)
+		}
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		err = tx.Commit()
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		if category == nil {
+			util.SuccessHandler(nil, w)
+			return
+		}
+		util.SuccessHandler(category, w)
+	})
+}
+
+// decodeCostCategory decodes a cost category from the request body, and verifies its rules can be evaluated
+func decodeCostCategory(r *http.Request) (*userdb.CostCategory, error) {
+	category := userdb.CostCategory{}
+	err := json.NewDecoder(r.Body).Decode(&category)
+	if err != nil {
+		return nil, errors.New(errors.CodeBadRequest, "Invalid cost category JSON")
+	}
+	_, err = costquery.CostCategory(&category)
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+// reportAllocationsHandler is the handler for /v1/reports/{reportID}/allocations
+func reportAllocationsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		switch r.Method {
+		case "GET":
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			_, err = tx.GetUserReport(si.UserID, reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			rulesets, err := tx.GetReportAllocationRulesets(reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			tx.Commit()
+			util.SuccessHandler(rulesets, w)
+		case "POST":
+			ruleset, err := decodeAllocationRuleset(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			_, err = tx.GetUserReport(si.UserID, reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			ruleset.ReportID = reportID
+			rulesetID, err := tx.CreateAllocationRuleset(ruleset)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			createdRuleset, err := tx.GetReportAllocationRuleset(reportID, rulesetID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			err = tx.Commit()
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			util.SuccessHandler(createdRuleset, w)
+		default:
+			util.ErrorHandler(errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method), w)
+		}
+	})
+}
+
+// reportAllocationHandler is the handler for /v1/reports/{reportID}/allocations/{rulesetID}
+func reportAllocationHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		rulesetID := vars["rulesetID"]
+		var ruleset *userdb.AllocationRuleset
+		if r.Method == "PUT" {
+			ruleset, err = decodeAllocationRuleset(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+		}
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		_, err = tx.GetUserReport(si.UserID, reportID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			ruleset, err = tx.GetReportAllocationRuleset(reportID, rulesetID)
+		case "PUT":
+			ruleset.ID = rulesetID
+			ruleset.ReportID = reportID
+			err = tx.UpdateAllocationRuleset(ruleset)
+			if err == nil {
+				ruleset, err = tx.GetReportAllocationRuleset(reportID, rulesetID)
+			}
+		case "DELETE":
+			err = tx.DeleteAllocationRuleset(reportID, rulesetID)
+			ruleset = nil
+		default:
+			err = errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method)
+		}
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		err = tx.Commit()
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		if ruleset == nil {
+			util.SuccessHandler(nil, w)
+			return
+		}
+		util.SuccessHandler(ruleset, w)
+	})
+}
+
+// decodeAllocationRuleset decodes an allocation ruleset from the request body, and verifies its dimensions are valid
+func decodeAllocationRuleset(r *http.Request) (*userdb.AllocationRuleset, error) {
+	ruleset := userdb.AllocationRuleset{}
+	err := json.NewDecoder(r.Body).Decode(&ruleset)
+	if err != nil {
+		return nil, errors.New(errors.CodeBadRequest, "Invalid allocation ruleset JSON")
+	}
+	_, err = costquery.AllocationRuleset(&ruleset)
+	if err != nil {
+		return nil, err
+	}
+	return &ruleset, nil
+}
+
+// reportStatementsHandler is the handler for /v1/reports/{reportID}/statements
+func reportStatementsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		switch r.Method {
+		case "GET":
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			_, err = tx.GetUserReport(si.UserID, reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			statements, err := tx.GetReportStatements(reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			tx.Commit()
+			util.SuccessHandler(statements, w)
+		case "POST":
+			statement := userdb.Statement{}
+			err := json.NewDecoder(r.Body).Decode(&statement)
+			if err != nil {
+				util.ErrorHandler(errors.New(errors.CodeBadRequest, "Invalid statement JSON"), w)
+				return
+			}
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			report, err := tx.GetUserReport(si.UserID, reportID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			statement.ReportID = reportID
+			statement.ID, err = tx.CreateStatement(&statement)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			// The statement is only recorded once all of its files have been generated
+			err = sc.GenerateStatement(report, &statement)
+			if err == nil {
+				err = tx.UpdateStatementGroups(&statement)
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				server.RemoveStatementFiles(&statement)
+			}
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			util.SuccessHandler(statement, w)
+		default:
+			util.ErrorHandler(errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method), w)
+		}
+	})
+}
+
+// reportStatementHandler is the handler for /v1/reports/{reportID}/statements/{statementID}
+func reportStatementHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		statementID := vars["statementID"]
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		_, err = tx.GetUserReport(si.UserID, reportID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		statement, err := tx.GetReportStatement(reportID, statementID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "DELETE":
+			err = tx.DeleteStatement(reportID, statementID)
+			if err == nil {
+				err = server.RemoveStatementFiles(statement)
+			}
+			statement = nil
+		default:
+			err = errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method)
+		}
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		err = tx.Commit()
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		if statement == nil {
+			util.SuccessHandler(nil, w)
+			return
+		}
+		util.SuccessHandler(statement, w)
+	})
+}
+
+// reportStatementFileHandler is the handler for /v1/reports/{reportID}/statements/{statementID}/files/{fileName}
+func reportStatementFileHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		vars := mux.Vars(r)
+		reportID := vars["reportID"]
+		fileName := vars["fileName"]
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		_, err = tx.GetUserReport(si.UserID, reportID)
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		statement, err := tx.GetReportStatement(reportID, vars["statementID"])
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		tx.Commit()
+		// Only generated files are served, so that the file name cannot refer outside of the statement's directory
+		if !statement.HasFile(fileName) {
+			util.ErrorHandler(errors.Errorf(errors.CodeNotFound, "Statement file %s does not exist", fileName), w)
+			return
+		}
+		if strings.HasSuffix(fileName, ".csv") {
+			w.Header().Set("Content-Type", export.ContentTypeCSV)
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		http.ServeFile(w, r, server.StatementFilePath(statement, fileName))
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Applatix, Inc.
+package routers
+
+import (
+	"net/http"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/costquery"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/server"
+	"github.com/applatix/claudia/util"
+)
+
+// riCoverageHandler is the http handler for /v1/ri/coverage. Returns the share of EC2 instance hours covered by reservations
+// per instance family, region and account, e.g. /v1/ri/coverage?from=2017-01-01&to=2017-01-31&regions=us-west-2
+func riCoverageHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return riHandler(sc, func(repCtx *costdb.CostReportContext, costQuery *costdb.CostQuery) (interface{}, error) {
+		return repCtx.RICoverage(costQuery)
+	})
+}
+
+// riUtilizationHandler is the http handler for /v1/ri/utilization. Returns the used and reserved hours of each reservation
+// during the billing periods of the timeframe, e.g. /v1/ri/utilization?from=2017-01-01&to=2017-03-31
+func riUtilizationHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return riHandler(sc, func(repCtx *costdb.CostReportContext, costQuery *costdb.CostQuery) (interface{}, error) {
+		return repCtx.RIUtilization(costQuery)
+	})
+}
+
+// riHandler returns an http handler which performs a reservation query against the default report of the user. Reservation
+// queries accept the timeframe and filters of a cost query, but not its grouping or interval
+func riHandler(sc *server.ServerContext, query func(*costdb.CostReportContext, *costdb.CostQuery) (interface{}, error)) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		report, err := sc.GetDefaultReport(si.UserID)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		if checkCacheReuse(report, r, w) {
+			return
+		}
+		costQuery, err := costquery.ParseCostQueryParams(r.URL.Query())
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		if costQuery.GroupBy != "" || costQuery.Interval != "" {
+			err = errors.New(errors.CodeBadRequest, "Reservation queries do not support group_by or interval")
+			util.ErrorHandler(err, w)
+			return
+		}
+		repCtx, err := sc.NewCostReportContext(report)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		result, err := query(repCtx, costQuery)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		writeReportHTTPCacheHeaders(report, r, w)
+		util.SuccessHandler(result, w)
+	})
+}
@@ -129,18 +129,48 @@ func InitializeRoutes(sc *server.ServerContext) *mux.Router {
 	r.HandleFunc("/v1/config", configHandler(sc)).Methods("GET", "PUT")
 	r.HandleFunc("/v1/account", accountHandler(sc)).Methods("GET", "PUT")
 	r.HandleFunc("/v1/cost", costHandler(sc))
+	r.HandleFunc("/v1/cost/compare", costCompareHandler(sc))
 	r.HandleFunc("/v1/count", countHandler(sc))
+	r.HandleFunc("/v1/forecast", forecastHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/budgets", budgetsHandler(sc)).Methods("GET", "POST")
+	r.HandleFunc("/v1/budgets/{budgetID}", budgetHandler(sc)).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/v1/views", viewsHandler(sc)).Methods("GET", "POST")
+	r.HandleFunc("/v1/views/{viewID}", viewHandler(sc)).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/v1/views/{viewID}/cost", viewCostHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/schedules", schedulesHandler(sc)).Methods("GET", "POST")
+	r.HandleFunc("/v1/schedules/{scheduleID}", scheduleHandler(sc)).Methods("GET", "PUT", "DELETE")
 	r.HandleFunc("/v1/usage/{service}", usageHandler(sc))
 	r.HandleFunc("/v1/usage/{service}/{metric}", usageHandler(sc))
 	r.HandleFunc("/v1/usage", usageHandler(sc))
+	r.HandleFunc("/v1/rate/{service}", rateHandler(sc))
+	r.HandleFunc("/v1/rate/{service}/{metric}", rateHandler(sc))
+	r.HandleFunc("/v1/resources", resourcesHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/tagcoverage", tagCoverageHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/ri/coverage", riCoverageHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/ri/utilization", riUtilizationHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/recommendations/commitments", commitmentRecommendationsHandler(sc)).Methods("GET")
 	r.HandleFunc("/v1/dimensions", rootDimensionHandler(sc))
 	r.HandleFunc("/v1/dimensions/{dimension}", dimensionHandler(sc))
 	r.HandleFunc("/v1/dimensions/{dimension}/{subdimension}", dimensionHandler(sc))
 	r.HandleFunc("/v1/reports/{reportID}/status", reportStatusHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/reports/{reportID}/ingests", reportIngestsHandler(sc)).Methods("GET")
 	r.HandleFunc("/v1/reports/{reportID}/buckets", reportBucketsHandler(sc)).Methods("GET", "POST")
 	r.HandleFunc("/v1/reports/{reportID}/buckets/{bucketID}", reportBucketHandler(sc)).Methods("GET", "PUT", "DELETE")
 	r.HandleFunc("/v1/reports/{reportID}/accounts", reportAccountsHandler(sc))
 	r.HandleFunc("/v1/reports/{reportID}/accounts/{accountID}", reportAccountHandler(sc)).Methods("GET", "PUT")
+	r.HandleFunc("/v1/reports/{reportID}/anomalies", reportAnomaliesHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/reports/{reportID}/anomalies/{anomalyID}", reportAnomalyHandler(sc)).Methods("PUT")
+	r.HandleFunc("/v1/reports/{reportID}/categories", reportCategoriesHandler(sc)).Methods("GET", "POST")
+	r.HandleFunc("/v1/reports/{reportID}/categories/{categoryID}", reportCategoryHandler(sc)).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/v1/reports/{reportID}/allocations", reportAllocationsHandler(sc)).Methods("GET", "POST")
+	r.HandleFunc("/v1/reports/{reportID}/allocations/{rulesetID}", reportAllocationHandler(sc)).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/v1/reports/{reportID}/statements", reportStatementsHandler(sc)).Methods("GET", "POST")
+	r.HandleFunc("/v1/reports/{reportID}/statements/{statementID}", reportStatementHandler(sc)).Methods("GET", "DELETE")
+	r.HandleFunc("/v1/reports/{reportID}/statements/{statementID}/files/{fileName}", reportStatementFileHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/reports/{reportID}/channels", reportChannelsHandler(sc)).Methods("GET", "POST")
+	r.HandleFunc("/v1/reports/{reportID}/channels/{channelID}", reportChannelHandler(sc)).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/v1/reports/{reportID}/channels/{channelID}/deliveries", reportChannelDeliveriesHandler(sc)).Methods("GET")
+	r.HandleFunc("/v1/reports/{reportID}/channels/{channelID}/test", reportChannelTestHandler(sc)).Methods("POST")
 	r.HandleFunc("/v1/reports/{reportID}", reportHandler(sc)).Methods("GET", "PUT", "DELETE")
 	r.HandleFunc("/v1/reports", reportsHandler(sc)).Methods("GET", "POST")
 	r.HandleFunc("/v1/auth/identity", authIdentityHandler(sc))
@@ -0,0 +1,150 @@
+// Copyright 2017 Applatix, Inc.
+package routers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/scheduler"
+	"github.com/applatix/claudia/server"
+	"github.com/applatix/claudia/userdb"
+	"github.com/applatix/claudia/util"
+	"github.com/gorilla/mux"
+)
+
+// schedulesHandler is the http handler for /v1/schedules. Lists the schedules of the user, or creates a schedule
+func schedulesHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			schedules, err := tx.GetUserSchedules(si.UserID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			tx.Commit()
+			for _, schedule := range schedules {
+				schedule.HideSecrets()
+			}
+			util.SuccessHandler(schedules, w)
+		case "POST":
+			schedule, err := decodeSchedule(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			if schedule.ViewID != nil {
+				_, err = tx.GetUserView(si.UserID, *schedule.ViewID)
+				if util.TXErrorHandler(err, tx, w) != nil {
+					return
+				}
+			}
+			schedule.OwnerUserID = si.UserID
+			scheduleID, err := tx.CreateSchedule(schedule)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			createdSchedule, err := tx.GetUserSchedule(si.UserID, scheduleID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			err = tx.Commit()
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			createdSchedule.HideSecrets()
+			util.SuccessHandler(createdSchedule, w)
+		default:
+			util.ErrorHandler(errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method), w)
+		}
+	})
+}
+
+// scheduleHandler is the http handler for /v1/schedules/{scheduleID}
+func scheduleHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		scheduleID := mux.Vars(r)["scheduleID"]
+		var schedule *userdb.Schedule
+		if r.Method == "PUT" {
+			schedule, err = decodeSchedule(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+		}
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			schedule, err = tx.GetUserSchedule(si.UserID, scheduleID)
+		case "PUT":
+			if schedule.ViewID != nil {
+				_, err = tx.GetUserView(si.UserID, *schedule.ViewID)
+			}
+			if err == nil {
+				schedule.ID = scheduleID
+				schedule.OwnerUserID = si.UserID
+				err = tx.UpdateSchedule(schedule)
+			}
+			if err == nil {
+				schedule, err = tx.GetUserSchedule(si.UserID, scheduleID)
+			}
+		case "DELETE":
+			err = tx.DeleteSchedule(si.UserID, scheduleID)
+			schedule = nil
+		default:
+			err = errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method)
+		}
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		err = tx.Commit()
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		if schedule == nil {
+			util.SuccessHandler(nil, w)
+			return
+		}
+		schedule.HideSecrets()
+		util.SuccessHandler(schedule, w)
+	})
+}
+
+// decodeSchedule decodes a schedule from the request body, verifies its cron expression and time zone, and computes its next run.
+// A schedule without a view delivers the summary dashboard
+func decodeSchedule(r *http.Request) (*userdb.Schedule, error) {
+	schedule := userdb.Schedule{}
+	err := json.NewDecoder(r.Body).Decode(&schedule)
+	if err != nil {
+		return nil, errors.New(errors.CodeBadRequest, "Invalid schedule JSON")
+	}
+	if schedule.ViewID != nil && *schedule.ViewID == "" {
+		schedule.ViewID = nil
+	}
+	if schedule.TZ == "" {
+		schedule.TZ = "UTC"
+	}
+	schedule.NextRun, err = scheduler.NextRun(schedule.Cron, schedule.TZ, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
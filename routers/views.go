@@ -0,0 +1,183 @@
+// Copyright 2017 Applatix, Inc.
+package routers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/applatix/claudia/costquery"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/server"
+	"github.com/applatix/claudia/userdb"
+	"github.com/applatix/claudia/util"
+	"github.com/gorilla/mux"
+)
+
+// viewOverrideParams are the query args of /v1/views/{viewID}/cost which override (or supplement) the stored query of the view
+var viewOverrideParams = []string{"from", "to", "format", "limit", "cursor"}
+
+// viewsHandler is the http handler for /v1/views. Lists the views of the user and the views shared by others, or creates a view
+func viewsHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			views, err := tx.GetUserViews(si.UserID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			tx.Commit()
+			util.SuccessHandler(views, w)
+		case "POST":
+			view, err := decodeView(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			tx, err := sc.UserDB.Begin()
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+			view.OwnerUserID = si.UserID
+			viewID, err := tx.CreateView(view)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			createdView, err := tx.GetUserView(si.UserID, viewID)
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			err = tx.Commit()
+			if util.TXErrorHandler(err, tx, w) != nil {
+				return
+			}
+			util.SuccessHandler(createdView, w)
+		default:
+			util.ErrorHandler(errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method), w)
+		}
+	})
+}
+
+// viewHandler is the http handler for /v1/views/{viewID}. Shared views can be read by all users, but only modified by their owner
+func viewHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		viewID := mux.Vars(r)["viewID"]
+		var view *userdb.SavedView
+		if r.Method == "PUT" {
+			view, err = decodeView(r)
+			if util.ErrorHandler(err, w) != nil {
+				return
+			}
+		}
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			view, err = tx.GetUserView(si.UserID, viewID)
+		case "PUT":
+			view.ID = viewID
+			view.OwnerUserID = si.UserID
+			err = tx.UpdateView(view)
+			if err == nil {
+				view, err = tx.GetUserView(si.UserID, viewID)
+			}
+		case "DELETE":
+			err = tx.DeleteView(si.UserID, viewID)
+			view = nil
+		default:
+			err = errors.Errorf(errors.CodeBadRequest, "Unsupported method %s", r.Method)
+		}
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		err = tx.Commit()
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		if view == nil {
+			util.SuccessHandler(nil, w)
+			return
+		}
+		util.SuccessHandler(view, w)
+	})
+}
+
+// viewCostHandler is the http handler for /v1/views/{viewID}/cost. Executes the stored query of a view against the default
+// report of the requesting user, so that a view shared by another user never exposes the costs of the owner's report.
+// The from and to query args override the timeframe of the view, and the format, limit and cursor args are the same as /v1/cost
+func viewCostHandler(sc *server.ServerContext) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, err := sc.SessionManager.ValidateSession(w, r)
+		if err != nil {
+			return
+		}
+		tx, err := sc.UserDB.Begin()
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		view, err := tx.GetUserView(si.UserID, mux.Vars(r)["viewID"])
+		if util.TXErrorHandler(err, tx, w) != nil {
+			return
+		}
+		tx.Commit()
+		report, err := sc.GetDefaultReport(si.UserID)
+		if util.ErrorHandler(err, w) != nil {
+			return
+		}
+		params := viewParams(view.Query)
+		overrides := r.URL.Query()
+		for _, key := range viewOverrideParams {
+			if value := overrides.Get(key); value != "" {
+				params.Set(key, value)
+			}
+		}
+		serveCost(sc, report, params, w, r)
+	})
+}
+
+// viewParams returns the query args of the stored query of a view
+func viewParams(query userdb.ViewQuery) url.Values {
+	params := make(url.Values, len(query))
+	for key, value := range query {
+		params.Set(key, value)
+	}
+	return params
+}
+
+// decodeView decodes a view from the request body, and verifies its query is a valid cost query
+func decodeView(r *http.Request) (*userdb.SavedView, error) {
+	view := userdb.SavedView{}
+	err := json.NewDecoder(r.Body).Decode(&view)
+	if err != nil {
+		return nil, errors.New(errors.CodeBadRequest, "Invalid view JSON")
+	}
+	params := viewParams(view.Query)
+	for _, key := range []string{"format", "cursor"} {
+		if params.Get(key) != "" {
+			return nil, errors.Errorf(errors.CodeBadRequest, "View query cannot include %s", key)
+		}
+	}
+	_, err = costquery.ParseStatisticParam(params)
+	if err != nil {
+		return nil, err
+	}
+	params.Del("allocate")
+	_, err = parsePagedCostQueryParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return &view, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Applatix, Inc.
+package scheduler
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// cronDescriptors are the shorthands of common cron expressions
+var cronDescriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// cronField is the range of values of a field of a cron expression
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Cron is a parsed cron expression. Each field is the set of values it matches
+type Cron struct {
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+	// A restricted day of month or day of week matches either, as in standard cron
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+// ParseCron parses a standard 5 field cron expression (minute, hour, day of month, month, day of week), which supports
+// lists, ranges and steps (e.g. "0 6 * * 1-5", "*/15 * * * *"), or one of the descriptors @hourly, @daily, @weekly or @monthly
+func ParseCron(expr string) (*Cron, error) {
+	expr = strings.TrimSpace(expr)
+	if descriptor, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		expr = descriptor
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Invalid cron expression '%s': expected %d fields", expr, len(cronFields))
+	}
+	values := make([]map[int]bool, len(cronFields))
+	for i, part := range parts {
+		var err error
+		values[i], err = parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Sunday may be written as 0 or 7
+	if values[4][7] {
+		values[4][0] = true
+		delete(values[4], 7)
+	}
+	cron := Cron{
+		minutes:       values[0],
+		hours:         values[1],
+		daysOfMonth:   values[2],
+		months:        values[3],
+		daysOfWeek:    values[4],
+		anyDayOfMonth: strings.HasPrefix(parts[2], "*"),
+		anyDayOfWeek:  strings.HasPrefix(parts[4], "*"),
+	}
+	return &cron, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges (a-b) and steps (*/n or a-b/n) of a cron field
+func parseCronField(expr string, field cronField) (map[int]bool, error) {
+	values := make(map[int]bool)
+	invalid := errors.Errorf(errors.CodeBadRequest, "Invalid %s in cron expression: '%s'", field.name, expr)
+	for _, item := range strings.Split(expr, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return nil, invalid
+			}
+			item = item[:i]
+		}
+		start, end := field.min, field.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, invalid
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, invalid
+				}
+			} else if step > 1 {
+				// A step from a single value (e.g. 5/15) continues to the end of the range
+				end = field.max
+			}
+		}
+		if start < field.min || end > field.max || start > end {
+			return nil, invalid
+		}
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// matchesDay returns whether the cron matches the day of the given time
+func (c *Cron) matchesDay(t time.Time) bool {
+	if !c.months[int(t.Month())] {
+		return false
+	}
+	dom := c.daysOfMonth[t.Day()]
+	dow := c.daysOfWeek[int(t.Weekday())]
+	switch {
+	case c.anyDayOfMonth && c.anyDayOfWeek:
+		return true
+	case c.anyDayOfMonth:
+		return dow
+	case c.anyDayOfWeek:
+		return dom
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t matched by the cron, in the location of t. Returns the zero time if the cron
+// never matches (e.g. February 30th)
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Any satisfiable expression matches within 4 years (a leap day)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Applatix, Inc.
+package scheduler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/notification"
+	"github.com/applatix/claudia/userdb"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// base64LineLength is the maximum line length of base64 encoded MIME parts
+const base64LineLength = 76
+
+// sendEmail emails a delivery. The HTML summary is the body of the message, and the CSV files are attachments
+func sendEmail(dest *userdb.ScheduleDestination, d *delivery) error {
+	var msg bytes.Buffer
+	mw := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\n", dest.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(dest.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[Claudia] "+d.subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	err := writeBase64Part(mw, "text/html; charset=utf-8", "", d.summary)
+	if err != nil {
+		return err
+	}
+	for _, f := range d.files {
+		if f.name == "summary.html" {
+			continue
+		}
+		err = writeBase64Part(mw, f.contentType, f.name, f.data)
+		if err != nil {
+			return err
+		}
+	}
+	err = mw.Close()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	return notification.SendMail(dest.Host, dest.Port, dest.Username, dest.Password, dest.From, dest.To, msg.Bytes())
+}
+
+// writeBase64Part writes a base64 encoded part of a multipart message. The part is an attachment if it has a file name
+func writeBase64Part(mw *multipart.Writer, contentType, fileName string, data []byte) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	if fileName != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	}
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := base64LineLength
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		_, err = fmt.Fprintf(part, "%s\r\n", encoded[:n])
+		if err != nil {
+			return errors.InternalError(err)
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+// writeDirectory writes the files of a delivery to the run's subdirectory of the destination directory. The path is
+// verified again, since schedules saved before directory destinations were restricted may be outside userdb.DeliveriesDir
+func writeDirectory(dest *userdb.ScheduleDestination, runDir string, d *delivery) error {
+	err := userdb.ValidateDeliveryPath(dest.Path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(dest.Path, filepath.FromSlash(runDir))
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	for _, f := range d.files {
+		err = ioutil.WriteFile(filepath.Join(dir, f.name), f.data, 0644)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+	}
+	return nil
+}
+
+// uploadS3 uploads the files of a delivery under the run's prefix of the destination bucket, using the access keys of the destination
+func uploadS3(dest *userdb.ScheduleDestination, runDir string, d *delivery) error {
+	if dest.AWSAccessKeyID == "" || dest.AWSSecretAccessKey == "" {
+		return errors.New(errors.CodeBadRequest, "S3 destination has no access keys")
+	}
+	cfg := aws.NewConfig().WithRegion(dest.Region).
+		WithCredentials(credentials.NewStaticCredentials(dest.AWSAccessKeyID, dest.AWSSecretAccessKey, ""))
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return errors.InternalErrorWithMessage(err, "failed to create session")
+	}
+	client := s3.New(sess)
+	for _, f := range d.files {
+		key := path.Join(dest.Prefix, runDir, f.name)
+		_, err = client.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(dest.Bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(f.data),
+			ContentType: aws.String(f.contentType),
+		})
+		if err != nil {
+			return errors.InternalErrorWithMessage(err, fmt.Sprintf("failed to upload s3://%s/%s", dest.Bucket, key))
+		}
+	}
+	return nil
+}
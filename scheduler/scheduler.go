@@ -0,0 +1,285 @@
+// Copyright 2017 Applatix, Inc.
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/costquery"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/export"
+	"github.com/applatix/claudia/parser"
+	"github.com/applatix/claudia/userdb"
+	"github.com/influxdata/influxdb/models"
+)
+
+// dashboardSections are the sections of the summary dashboard, which is the cost of the timeframe grouped by each dimension
+var dashboardSections = []struct {
+	title     string
+	dimension string
+}{
+	{"Cost by service", parser.ColumnService.APIName},
+	{"Cost by account", parser.ColumnUsageAccountID.APIName},
+	{"Cost by region", parser.ColumnRegion.APIName},
+}
+
+// Scheduler runs the scheduled deliveries of saved views and the summary dashboard
+type Scheduler struct {
+	userDB *userdb.UserDatabase
+	costDB *costdb.CostDatabase
+}
+
+// deliveryFile is a file of a scheduled delivery
+type deliveryFile struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// delivery is the rendered files of a run of a schedule
+type delivery struct {
+	subject string
+	summary []byte
+	files   []*deliveryFile
+}
+
+// NewScheduler returns a new Scheduler instance
+func NewScheduler(userDB *userdb.UserDatabase, costDB *costdb.CostDatabase) *Scheduler {
+	return &Scheduler{userDB: userDB, costDB: costDB}
+}
+
+// NextRun returns the first time after the given time matched by a cron expression in a time zone
+func NextRun(cronExpr, tz string, after time.Time) (time.Time, error) {
+	cron, err := ParseCron(cronExpr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc, err := costquery.ParseLocation(tz)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := cron.Next(after.In(loc))
+	if next.IsZero() {
+		return next, errors.Errorf(errors.CodeBadRequest, "Cron expression '%s' never matches", cronExpr)
+	}
+	return next, nil
+}
+
+// TimeframeRange returns the first and last date (inclusive) of the timeframe of a run at the given time
+func TimeframeRange(timeframe string, now time.Time) (time.Time, time.Time, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	yesterday := today.AddDate(0, 0, -1)
+	switch timeframe {
+	case userdb.TimeframePreviousDay:
+		return yesterday, yesterday, nil
+	case userdb.TimeframePrevious7Days:
+		return today.AddDate(0, 0, -7), yesterday, nil
+	case userdb.TimeframePrevious30Days:
+		return today.AddDate(0, 0, -30), yesterday, nil
+	case userdb.TimeframePreviousMonth:
+		monthStart := today.AddDate(0, 0, 1-today.Day())
+		return monthStart.AddDate(0, -1, 0), monthStart.AddDate(0, 0, -1), nil
+	case userdb.TimeframeMonthToDate:
+		return today.AddDate(0, 0, 1-today.Day()), today, nil
+	}
+	return time.Time{}, time.Time{}, errors.Errorf(errors.CodeBadRequest, "Invalid schedule timeframe: '%s'", timeframe)
+}
+
+// RunDue runs the schedules which are due. A schedule of a report which is being processed is deferred until the ingest
+// completes, so that deliveries never contain the partial costs of a billing period being ingested
+func (s *Scheduler) RunDue(now time.Time) error {
+	tx, err := s.userDB.Begin()
+	if err != nil {
+		return err
+	}
+	schedules, err := tx.GetDueSchedules(now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	for _, schedule := range schedules {
+		tx, err := s.userDB.Begin()
+		if err != nil {
+			return err
+		}
+		report, err := tx.GetUserDefaultReport(schedule.OwnerUserID)
+		tx.Commit()
+		if err == nil && report.Status == claudia.ReportStatusProcessing {
+			log.Printf("Deferring schedule %s (%s): report %s is processing", schedule.Name, schedule.ID, report.ID)
+			continue
+		}
+		if err == nil {
+			err = s.run(schedule, report, now)
+		}
+		err = s.recordRun(schedule, now, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run renders and delivers a schedule
+func (s *Scheduler) run(schedule *userdb.Schedule, report *userdb.Report, now time.Time) error {
+	log.Printf("Running schedule %s (%s) of report %s", schedule.Name, schedule.ID, report.ID)
+	d, err := s.render(schedule, report, now)
+	if err != nil {
+		return err
+	}
+	runDir := fmt.Sprintf("%s/%s", export.SafeFileName(schedule.Name), now.UTC().Format("20060102T150405Z"))
+	dest := schedule.Destination
+	switch dest.Type {
+	case userdb.ScheduleDestinationEmail:
+		return sendEmail(&dest, d)
+	case userdb.ScheduleDestinationDirectory:
+		return writeDirectory(&dest, runDir, d)
+	case userdb.ScheduleDestinationS3:
+		return uploadS3(&dest, runDir, d)
+	}
+	return errors.Errorf(errors.CodeInternal, "Unsupported schedule destination type: %s", dest.Type)
+}
+
+// recordRun records the outcome of a run of a schedule, and schedules its next run
+func (s *Scheduler) recordRun(schedule *userdb.Schedule, now time.Time, runErr error) error {
+	schedule.LastRun = &now
+	schedule.LastStatus = userdb.ScheduleStatusSucceeded
+	schedule.LastError = ""
+	if runErr != nil {
+		log.Printf("Schedule %s (%s) failed: %s", schedule.Name, schedule.ID, runErr)
+		schedule.LastStatus = userdb.ScheduleStatusFailed
+		schedule.LastError = runErr.Error()
+	}
+	next, err := NextRun(schedule.Cron, schedule.TZ, now)
+	if err != nil {
+		// The cron expression and time zone were verified when the schedule was saved, but the time zone database may differ
+		log.Printf("Failed to compute the next run of schedule %s (%s): %s", schedule.Name, schedule.ID, err)
+		next = now.Add(24 * time.Hour)
+	}
+	schedule.NextRun = next
+	tx, err := s.userDB.Begin()
+	if err != nil {
+		return err
+	}
+	err = tx.UpdateScheduleRun(schedule)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// render executes the queries of a schedule over its timeframe, and renders the CSV of each query and the HTML summary
+func (s *Scheduler) render(schedule *userdb.Schedule, report *userdb.Report, now time.Time) (*delivery, error) {
+	loc, err := costquery.ParseLocation(schedule.TZ)
+	if err != nil {
+		return nil, err
+	}
+	from, to, err := TimeframeRange(schedule.Timeframe, now.In(loc))
+	if err != nil {
+		return nil, err
+	}
+	categories, err := costquery.ReportCostCategories(s.userDB, report.ID)
+	if err != nil {
+		return nil, err
+	}
+	repCtx := s.costDB.NewCostReportContext(report.ID)
+	repCtx.Categories = categories
+
+	summary := export.Summary{
+		Title:      schedule.Name,
+		ReportName: report.ReportName,
+		From:       from.Format("2006-01-02"),
+		To:         to.Format("2006-01-02"),
+		Sections:   make([]*export.SummarySection, 0),
+	}
+	d := delivery{subject: fmt.Sprintf("%s: %s to %s", schedule.Name, summary.From, summary.To)}
+	addSection := func(title, fileName string, params url.Values) error {
+		params.Set("from", summary.From)
+		params.Set("to", summary.To)
+		params.Set("tz", schedule.TZ)
+		costQuery, rows, err := s.query(repCtx, report, params)
+		if err != nil {
+			return err
+		}
+		section, err := export.NewSummarySection(title, costQuery, rows)
+		if err != nil {
+			return err
+		}
+		summary.Sections = append(summary.Sections, section)
+		var buf bytes.Buffer
+		err = export.WriteCostTable(&buf, export.FormatCSV, costQuery, rows)
+		if err != nil {
+			return err
+		}
+		d.files = append(d.files, &deliveryFile{name: fileName + ".csv", contentType: export.ContentTypeCSV, data: buf.Bytes()})
+		return nil
+	}
+	if schedule.ViewID != nil {
+		tx, err := s.userDB.Begin()
+		if err != nil {
+			return nil, err
+		}
+		view, err := tx.GetUserView(schedule.OwnerUserID, *schedule.ViewID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		tx.Commit()
+		params := make(url.Values, len(view.Query))
+		for key, value := range view.Query {
+			params.Set(key, value)
+		}
+		err = addSection(view.Name, export.SafeFileName(view.Name), params)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, section := range dashboardSections {
+			params := url.Values{}
+			params.Set("group_by", section.dimension)
+			params.Set("interval", string(costdb.Day))
+			err = addSection(section.title, section.dimension, params)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	var buf bytes.Buffer
+	err = export.WriteSummaryHTML(&buf, &summary)
+	if err != nil {
+		return nil, err
+	}
+	d.summary = buf.Bytes()
+	d.files = append([]*deliveryFile{{name: "summary.html", contentType: "text/html; charset=utf-8", data: d.summary}}, d.files...)
+	return &d, nil
+}
+
+// query executes a cost query from the query args of /v1/cost, including the allocation of shared costs by a named
+// allocation ruleset. Returns the query and its rows, transformed with display names
+func (s *Scheduler) query(repCtx *costdb.CostReportContext, report *userdb.Report, params url.Values) (*costdb.CostQuery, []models.Row, error) {
+	costQuery, allocate, err := costquery.ParseReportCostQuery(params, report)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rows []models.Row
+	if allocate != "" {
+		allocated, err := costquery.AllocatedCost(s.userDB, repCtx, report.ID, costQuery, allocate)
+		if err != nil {
+			return nil, nil, err
+		}
+		rows = allocated.Series
+	} else {
+		rows, err = repCtx.Cost(costQuery)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	costquery.TransformRows(s.userDB, report, costQuery, rows)
+	return costQuery, rows, nil
+}
@@ -7,9 +7,10 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/applatix/claudia/commitments"
 	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/costquery"
 	"github.com/applatix/claudia/errors"
-	"github.com/applatix/claudia/parser"
 	"github.com/applatix/claudia/userdb"
 )
 
@@ -21,6 +22,7 @@ type ServerContext struct {
 	SessionManager *userdb.SessionManager
 	AssetsDir      string
 	Certificate    *tls.Certificate
+	PriceSheet     *commitments.PriceSheet
 }
 
 // NewServerContext returns a new ServerContext instance
@@ -95,35 +97,36 @@ func (sc *ServerContext) GetUserReportStatus(userID string, reportID string) ([]
 	return repCtx.GetReportIngestStatuses()
 }
 
-// GetDisplayNameAliases returns a mapping of account name aliases
-func (sc *ServerContext) GetDisplayNameAliases(dimensionName string, report *userdb.Report) map[string]string {
-	var aliases map[string]string
-	switch dimensionName {
-	case parser.ColumnUsageAccountID.APIName:
-		// Substitute accountIDs with names
-		aliases = make(map[string]string)
-		for _, account := range report.Accounts {
-			aliases[account.AWSAccountID] = account.Name
-		}
+// GetUserReportIngestHistory returns the ingest attempts of a report owned by the user, most recent first
+func (sc *ServerContext) GetUserReportIngestHistory(userID string, reportID string, billingPeriod string, limit int) ([]*costdb.IngestAttempt, error) {
+	tx, err := sc.UserDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	report, err := tx.GetUserReport(userID, reportID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	tx.Commit()
+	repCtx := sc.CostDB.NewCostReportContext(report.ID)
+	return repCtx.GetReportIngestHistory(billingPeriod, limit)
+}
 
-	case parser.ColumnProductCode.APIName:
-		// Substitute product codes with names
-		products, err := sc.UserDB.GetProductAliases()
-		if err != nil {
-			log.Printf("Failed to lookup product codes: %s", err)
-		} else {
-			aliases = make(map[string]string)
-			for k, product := range products {
-				aliases[k] = product.Description
-			}
-		}
-	case parser.ColumnRegion.APIName, parser.ColumnDataTransferDest.APIName, parser.ColumnDataTransferSource.APIName:
-		aliases = make(map[string]string)
-		for regionName, region := range parser.RegionMapping {
-			aliases[regionName] = region.DisplayName
-		}
+// NewCostReportContext returns a context in which to perform cost queries of the report, including its cost categories
+func (sc *ServerContext) NewCostReportContext(report *userdb.Report) (*costdb.CostReportContext, error) {
+	categories, err := costquery.ReportCostCategories(sc.UserDB, report.ID)
+	if err != nil {
+		return nil, err
 	}
-	return aliases
+	repCtx := sc.CostDB.NewCostReportContext(report.ID)
+	repCtx.Categories = categories
+	return repCtx, nil
+}
+
+// GetDisplayNameAliases returns a mapping of account name aliases
+func (sc *ServerContext) GetDisplayNameAliases(dimensionName string, report *userdb.Report) map[string]string {
+	return costquery.DisplayNameAliases(sc.UserDB, dimensionName, report)
 }
 
 // ReloadCertificate reloads SSL certificate after an update
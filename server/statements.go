@@ -0,0 +1,144 @@
+// Copyright 2017 Applatix, Inc.
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/costquery"
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/export"
+	"github.com/applatix/claudia/userdb"
+)
+
+// StatementsDir returns the directory in which the statement files of a report are stored
+func StatementsDir(reportID string) string {
+	return filepath.Join(claudia.ApplicationDir, "statements", reportID)
+}
+
+// StatementFilePath returns the path of a generated file of a statement
+func StatementFilePath(statement *userdb.Statement, fileName string) string {
+	return filepath.Join(StatementsDir(statement.ReportID), statement.ID, fileName)
+}
+
+// GenerateStatement generates the statement of each group of a statement as HTML and CSV files, and records them in the
+// statement's group statements. Groups are the values of the statement's dimension with cost in the billing period, and any
+// group with a manual adjustment. When an allocation ruleset is named, shared costs allocated to each group are adjustments
+func (sc *ServerContext) GenerateStatement(report *userdb.Report, statement *userdb.Statement) error {
+	from, to, err := statement.BillingPeriodRange()
+	if err != nil {
+		return err
+	}
+	repCtx, err := sc.NewCostReportContext(report)
+	if err != nil {
+		return err
+	}
+	var ruleset *costdb.AllocationRuleset
+	if statement.Allocation != "" {
+		ruleset, err = costquery.ReportAllocationRuleset(sc.UserDB, report.ID, statement.Allocation)
+		if err != nil {
+			return err
+		}
+	}
+	groups, err := repCtx.StatementGroups(from, to, statement.Dimension, statement.Blended, ruleset)
+	if err != nil {
+		return err
+	}
+	statements := make(map[string]*export.Statement)
+	names := make([]string, 0)
+	aliases := sc.GetDisplayNameAliases(statement.Dimension, report)
+	groupStatement := func(name string) *export.Statement {
+		s, exists := statements[name]
+		if !exists {
+			displayName := name
+			if alias, ok := aliases[name]; ok {
+				displayName = alias
+			} else if name == "" {
+				displayName = "(none)"
+			}
+			s = &export.Statement{
+				ReportName:    report.ReportName,
+				BillingPeriod: statement.BillingPeriod,
+				Dimension:     statement.Dimension,
+				Name:          name,
+				DisplayName:   displayName,
+				Lines:         make([]*costdb.StatementLine, 0),
+				Adjustments:   make([]*export.StatementAdjustment, 0),
+			}
+			statements[name] = s
+			names = append(names, name)
+		}
+		return s
+	}
+	for _, g := range groups {
+		s := groupStatement(g.Name)
+		s.Lines = g.Lines
+		pools := make([]string, 0, len(g.Allocations))
+		for pool := range g.Allocations {
+			pools = append(pools, pool)
+		}
+		sort.Strings(pools)
+		for _, pool := range pools {
+			s.Adjustments = append(s.Adjustments, &export.StatementAdjustment{Description: "Shared cost: " + pool, Amount: g.Allocations[pool]})
+		}
+	}
+	for _, adjustment := range statement.Adjustments {
+		s := groupStatement(adjustment.Group)
+		s.Adjustments = append(s.Adjustments, &export.StatementAdjustment{Description: adjustment.Description, Amount: adjustment.Amount})
+	}
+	sort.Strings(names)
+
+	dir := filepath.Join(StatementsDir(report.ID), statement.ID)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	statement.Groups = make(userdb.GroupStatements, len(names))
+	for i, name := range names {
+		s := statements[name]
+		baseName := fmt.Sprintf("%03d-%s", i+1, export.SafeFileName(s.DisplayName))
+		summary := userdb.GroupStatement{
+			Name:        s.Name,
+			DisplayName: s.DisplayName,
+			Subtotal:    s.Subtotal(),
+			Adjustments: s.AdjustmentsTotal(),
+			Total:       s.Total(),
+			HTMLFile:    baseName + ".html",
+			CSVFile:     baseName + ".csv",
+		}
+		err = writeStatementFile(filepath.Join(dir, summary.HTMLFile), s, export.WriteStatementHTML)
+		if err != nil {
+			return err
+		}
+		err = writeStatementFile(filepath.Join(dir, summary.CSVFile), s, export.WriteStatementCSV)
+		if err != nil {
+			return err
+		}
+		statement.Groups[i] = &summary
+	}
+	return nil
+}
+
+// writeStatementFile writes a statement to a file using the given writer function
+func writeStatementFile(path string, s *export.Statement, write func(io.Writer, *export.Statement) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	err = write(f, s)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return errors.InternalError(f.Close())
+}
+
+// RemoveStatementFiles removes the generated files of a statement
+func RemoveStatementFiles(statement *userdb.Statement) error {
+	return errors.InternalError(os.RemoveAll(filepath.Join(StatementsDir(statement.ReportID), statement.ID)))
+}
@@ -0,0 +1,202 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// AllocationRuleset is a named set of rules which allocate shared costs of a report (e.g. support fees, untagged spend)
+// across the values of a dimension (e.g. tag:user:Team). Maps to the 'allocation_ruleset' table
+type AllocationRuleset struct {
+	ID        string          `db:"id" json:"id"`
+	ReportID  string          `db:"report_id" json:"report_id"`
+	CTime     time.Time       `db:"ctime" json:"ctime"`
+	MTime     time.Time       `db:"mtime" json:"mtime"`
+	Name      string          `db:"name" json:"name"`
+	Dimension string          `db:"dimension" json:"dimension"`
+	Rules     AllocationRules `db:"rules" json:"rules"`
+}
+
+// AllocationRule splits the cost matching its filters (a shared pool) across values of the ruleset's dimension.
+// Filters map dimensions to values (e.g. {"service": ["AWS Support"]}). An empty value matches costs without the dimension
+// (e.g. untagged). Rules are applied in order, and cost is only allocated by the first rule it matches
+// * proportional splits the pool in proportion to the direct cost of each value
+// * even splits the pool evenly across values
+// * fixed splits the pool by the percentage weights of each value
+// Proportional and even rules split across all values with direct cost, unless targets are given
+type AllocationRule struct {
+	Name    string              `json:"name"`
+	Filters map[string][]string `json:"filters"`
+	Method  string              `json:"method"`
+	Targets []string            `json:"targets,omitempty"`
+	Weights map[string]float64  `json:"weights,omitempty"`
+}
+
+// AllocationRules is the ordered list of rules of an allocation ruleset. Stored as JSON in the 'rules' column
+type AllocationRules []*AllocationRule
+
+// allocationNameMatcher restricts the names of allocation rulesets and rules
+var allocationNameMatcher = regexp.MustCompile("^[A-Za-z0-9_ -]{1,64}$")
+
+// Value implements the driver.Valuer interface
+func (r AllocationRules) Value() (driver.Value, error) {
+	if r == nil {
+		r = AllocationRules{}
+	}
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (r *AllocationRules) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, r)
+	case string:
+		return json.Unmarshal([]byte(v), r)
+	default:
+		return fmt.Errorf("Unsupported type for allocation rules: %T", src)
+	}
+}
+
+// validateAllocationRuleset verifies the names and filters of an allocation ruleset. Dimensions, methods and weights are
+// verified by the cost database (see costquery.AllocationRuleset)
+func validateAllocationRuleset(a *AllocationRuleset) error {
+	if !allocationNameMatcher.MatchString(a.Name) {
+		return errors.Errorf(errors.CodeBadRequest, "Invalid allocation ruleset name: '%s'", a.Name)
+	}
+	if a.Dimension == "" {
+		return errors.New(errors.CodeBadRequest, "Allocation ruleset requires a dimension")
+	}
+	if len(a.Rules) == 0 {
+		return errors.New(errors.CodeBadRequest, "Allocation ruleset requires at least one rule")
+	}
+	names := make(map[string]bool)
+	for _, rule := range a.Rules {
+		if rule == nil || !allocationNameMatcher.MatchString(rule.Name) {
+			return errors.New(errors.CodeBadRequest, "Allocation rules require a valid name")
+		}
+		if names[rule.Name] {
+			return errors.Errorf(errors.CodeBadRequest, "Duplicate allocation rule: %s", rule.Name)
+		}
+		names[rule.Name] = true
+		if len(rule.Filters) == 0 {
+			return errors.Errorf(errors.CodeBadRequest, "Allocation rule %s requires filters", rule.Name)
+		}
+		for dimension, values := range rule.Filters {
+			if len(values) == 0 {
+				return errors.Errorf(errors.CodeBadRequest, "Filter %s of allocation rule %s requires at least one value", dimension, rule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// GetReportAllocationRulesets returns the allocation rulesets of a report, ordered by name
+func (tx *Tx) GetReportAllocationRulesets(reportID string) ([]*AllocationRuleset, error) {
+	rulesets := make([]*AllocationRuleset, 0)
+	err := tx.Select(&rulesets, "SELECT * FROM allocation_ruleset WHERE report_id = $1 ORDER BY name;", reportID)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return rulesets, nil
+}
+
+// GetReportAllocationRuleset returns an allocation ruleset of a report
+func (tx *Tx) GetReportAllocationRuleset(reportID, rulesetID string) (*AllocationRuleset, error) {
+	var ruleset AllocationRuleset
+	err := tx.Get(&ruleset, "SELECT * FROM allocation_ruleset WHERE report_id = $1 AND id = $2;", reportID, rulesetID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Allocation ruleset %s does not exist", rulesetID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &ruleset, nil
+}
+
+// GetReportAllocationRulesetByName returns an allocation ruleset of a report by name
+func (tx *Tx) GetReportAllocationRulesetByName(reportID, name string) (*AllocationRuleset, error) {
+	var ruleset AllocationRuleset
+	err := tx.Get(&ruleset, "SELECT * FROM allocation_ruleset WHERE report_id = $1 AND name = $2;", reportID, name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Allocation ruleset %s does not exist", name)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &ruleset, nil
+}
+
+// CreateAllocationRuleset creates an allocation ruleset in a report, and updates the report's modification time
+func (tx *Tx) CreateAllocationRuleset(a *AllocationRuleset) (string, error) {
+	err := validateAllocationRuleset(a)
+	if err != nil {
+		return "", err
+	}
+	var rulesetID string
+	err = tx.QueryRow("INSERT INTO allocation_ruleset (report_id, name, dimension, rules) VALUES ($1, $2, $3, $4) RETURNING id",
+		a.ReportID, a.Name, a.Dimension, a.Rules).Scan(&rulesetID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_allocation_ruleset") {
+			return "", errors.Errorf(errors.CodeBadRequest, "Allocation ruleset %s already exists", a.Name)
+		}
+		return "", errors.InternalError(err)
+	}
+	log.Printf("Created allocation ruleset %s (%s) in report %s", a.Name, rulesetID, a.ReportID)
+	return rulesetID, tx.UpdateUserReportMtime(a.ReportID)
+}
+
+// UpdateAllocationRuleset replaces the name, dimension and rules of an allocation ruleset, and updates the report's modification time
+func (tx *Tx) UpdateAllocationRuleset(a *AllocationRuleset) error {
+	err := validateAllocationRuleset(a)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE allocation_ruleset SET name = $1, dimension = $2, rules = $3, mtime = current_timestamp WHERE report_id = $4 AND id = $5;",
+		a.Name, a.Dimension, a.Rules, a.ReportID, a.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_allocation_ruleset") {
+			return errors.Errorf(errors.CodeBadRequest, "Allocation ruleset %s already exists", a.Name)
+		}
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return errors.Errorf(errors.CodeNotFound, "Allocation ruleset %s does not exist", a.ID)
+	}
+	log.Printf("Updated allocation ruleset %s (%s) in report %s", a.Name, a.ID, a.ReportID)
+	return tx.UpdateUserReportMtime(a.ReportID)
+}
+
+// DeleteAllocationRuleset deletes an allocation ruleset of a report, and updates the report's modification time
+func (tx *Tx) DeleteAllocationRuleset(reportID, rulesetID string) error {
+	res, err := tx.Exec("DELETE FROM allocation_ruleset WHERE report_id = $1 AND id = $2;", reportID, rulesetID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return errors.Errorf(errors.CodeNotFound, "Allocation ruleset %s does not exist", rulesetID)
+	}
+	log.Printf("Deleted allocation ruleset %s in report %s", rulesetID, reportID)
+	return tx.UpdateUserReportMtime(reportID)
+}
@@ -0,0 +1,120 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/applatix/claudia/costdb"
+	"github.com/applatix/claudia/errors"
+)
+
+// Anomaly is a spike in the daily cost of a dimension value detected by ingestd. Maps to the 'anomaly' table
+type Anomaly struct {
+	ID           string              `db:"id" json:"id"`
+	CTime        time.Time           `db:"ctime" json:"ctime"`
+	MTime        time.Time           `db:"mtime" json:"mtime"`
+	ReportID     string              `db:"report_id" json:"report_id"`
+	Day          time.Time           `db:"day" json:"day"`
+	Dimension    string              `db:"dimension" json:"dimension"`
+	Name         string              `db:"name" json:"name"`
+	DisplayName  string              `json:"display_name"`
+	Cost         float64             `db:"cost" json:"cost"`
+	Baseline     float64             `db:"baseline" json:"baseline"`
+	Score        float64             `db:"score" json:"score"`
+	Severity     string              `db:"severity" json:"severity"`
+	Contributors AnomalyContributors `db:"contributors" json:"contributors"`
+	Status       string              `db:"status" json:"status"`
+}
+
+// AnomalyContributors is the list of contributors of an anomaly. Stored as JSON in the 'contributors' column
+type AnomalyContributors []*costdb.AnomalyContributor
+
+// Statuses of an anomaly
+const (
+	AnomalyStatusOpen         = "open"
+	AnomalyStatusAcknowledged = "acknowledged"
+	AnomalyStatusDismissed    = "dismissed"
+)
+
+// Value implements the driver.Valuer interface
+func (c AnomalyContributors) Value() (driver.Value, error) {
+	if c == nil {
+		c = AnomalyContributors{}
+	}
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (c *AnomalyContributors) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	default:
+		return fmt.Errorf("Unsupported type for anomaly contributors: %T", src)
+	}
+}
+
+// UpsertAnomaly records a detected anomaly. Anomalies are re-detected as billing data is revised, in which case the
+// measurements of the existing anomaly are updated, but its status is preserved
+func (tx *Tx) UpsertAnomaly(a *Anomaly) error {
+	const sqlUpsertAnomaly = `
+	INSERT INTO anomaly (report_id, day, dimension, name, cost, baseline, score, severity, contributors, status)
+	VALUES (:report_id, :day, :dimension, :name, :cost, :baseline, :score, :severity, :contributors, :status)
+	ON CONFLICT ON CONSTRAINT unique_anomaly DO UPDATE SET
+		mtime = current_timestamp, cost = :cost, baseline = :baseline, score = :score, severity = :severity, contributors = :contributors;`
+	a.Day = a.Day.UTC()
+	if a.Status == "" {
+		a.Status = AnomalyStatusOpen
+	}
+	_, err := tx.NamedExec(sqlUpsertAnomaly, a)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	log.Printf("Upserted %s anomaly in report %s: %s %s on %s", a.Severity, a.ReportID, a.Dimension, a.Name, a.Day.Format("2006-01-02"))
+	return nil
+}
+
+// GetReportAnomalies returns the anomalies of a report, most recent first. Optionally filters by status
+func (tx *Tx) GetReportAnomalies(reportID string, status string) ([]*Anomaly, error) {
+	anomalies := make([]*Anomaly, 0)
+	var err error
+	if status == "" {
+		err = tx.Select(&anomalies, "SELECT * FROM anomaly WHERE report_id = $1 ORDER BY day DESC, score DESC;", reportID)
+	} else {
+		err = tx.Select(&anomalies, "SELECT * FROM anomaly WHERE report_id = $1 AND status = $2 ORDER BY day DESC, score DESC;", reportID, status)
+	}
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return anomalies, nil
+}
+
+// UpdateAnomalyStatus acknowledges, dismisses, or reopens an anomaly of a report
+func (tx *Tx) UpdateAnomalyStatus(reportID, anomalyID, status string) (*Anomaly, error) {
+	switch status {
+	case AnomalyStatusOpen, AnomalyStatusAcknowledged, AnomalyStatusDismissed:
+	default:
+		return nil, errors.Errorf(errors.CodeBadRequest, "Invalid anomaly status: %s", status)
+	}
+	var anomaly Anomaly
+	err := tx.Get(&anomaly, "UPDATE anomaly SET status = $1, mtime = current_timestamp WHERE report_id = $2 AND id = $3 RETURNING *;", status, reportID, anomalyID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Anomaly %s does not exist", anomalyID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	log.Printf("Updated anomaly %s status to %s", anomalyID, status)
+	return &anomaly, nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// Budget is a monthly or quarterly spending limit of the costs of a report matching a set of filters. Maps to the 'budget' table
+type Budget struct {
+	ID         string           `db:"id" json:"id"`
+	ReportID   string           `db:"report_id" json:"report_id"`
+	CTime      time.Time        `db:"ctime" json:"ctime"`
+	MTime      time.Time        `db:"mtime" json:"mtime"`
+	Name       string           `db:"name" json:"name"`
+	Filters    BudgetFilters    `db:"filters" json:"filters"`
+	Period     string           `db:"period" json:"period"`
+	Amount     float64          `db:"amount" json:"amount"`
+	Thresholds BudgetThresholds `db:"thresholds" json:"thresholds"`
+}
+
+// BudgetFilters maps dimensions to comma separated values, in the same form as the filter query args of a cost query
+// (e.g. {"accounts": "012345678910,246810121416", "tag:user:Team": "web"}). Stored as JSON in the 'filters' column
+type BudgetFilters map[string]string
+
+// BudgetThreshold is a percentage of the budget amount, which is crossed when the actual (or forecasted) spend of a period reaches it
+type BudgetThreshold struct {
+	Type    string  `json:"type"`
+	Percent float64 `json:"percent"`
+}
+
+// BudgetThresholds is the list of thresholds of a budget. Stored as JSON in the 'thresholds' column
+type BudgetThresholds []*BudgetThreshold
+
+// BudgetCrossing is the first evaluation in a budget period in which a threshold was crossed. Maps to the 'budget_crossing' table
+type BudgetCrossing struct {
+	ID               string    `db:"id" json:"id"`
+	BudgetID         string    `db:"budget_id" json:"budget_id"`
+	CTime            time.Time `db:"ctime" json:"ctime"`
+	PeriodStart      time.Time `db:"period_start" json:"period_start"`
+	ThresholdType    string    `db:"threshold_type" json:"threshold_type"`
+	ThresholdPercent float64   `db:"threshold_percent" json:"threshold_percent"`
+	Spend            float64   `db:"spend" json:"spend"`
+}
+
+// Budget periods
+const (
+	BudgetPeriodMonthly   = "monthly"
+	BudgetPeriodQuarterly = "quarterly"
+)
+
+// Budget threshold types
+const (
+	BudgetThresholdActual     = "actual"
+	BudgetThresholdForecasted = "forecasted"
+)
+
+// Value implements the driver.Valuer interface
+func (f BudgetFilters) Value() (driver.Value, error) {
+	if f == nil {
+		f = BudgetFilters{}
+	}
+	bytes, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (f *BudgetFilters) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, f)
+	case string:
+		return json.Unmarshal([]byte(v), f)
+	default:
+		return fmt.Errorf("Unsupported type for budget filters: %T", src)
+	}
+}
+
+// Value implements the driver.Valuer interface
+func (t BudgetThresholds) Value() (driver.Value, error) {
+	if t == nil {
+		t = BudgetThresholds{}
+	}
+	bytes, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (t *BudgetThresholds) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, t)
+	case string:
+		return json.Unmarshal([]byte(v), t)
+	default:
+		return fmt.Errorf("Unsupported type for budget thresholds: %T", src)
+	}
+}
+
+// validateBudget verifies the name, period, amount and thresholds of a budget. Filters are verified by the cost database
+func validateBudget(b *Budget) error {
+	if strings.TrimSpace(b.Name) == "" {
+		return errors.New(errors.CodeBadRequest, "Budget requires a name")
+	}
+	if hasLineBreak(b.Name) {
+		return errors.New(errors.CodeBadRequest, "Budget name cannot have line breaks")
+	}
+	switch b.Period {
+	case BudgetPeriodMonthly, BudgetPeriodQuarterly:
+	default:
+		return errors.Errorf(errors.CodeBadRequest, "Invalid budget period: '%s'", b.Period)
+	}
+	if b.Amount <= 0 {
+		return errors.New(errors.CodeBadRequest, "Budget amount must be positive")
+	}
+	for _, threshold := range b.Thresholds {
+		if threshold == nil {
+			return errors.New(errors.CodeBadRequest, "Invalid budget threshold")
+		}
+		switch threshold.Type {
+		case BudgetThresholdActual, BudgetThresholdForecasted:
+		default:
+			return errors.Errorf(errors.CodeBadRequest, "Invalid budget threshold type: '%s'", threshold.Type)
+		}
+		if threshold.Percent <= 0 {
+			return errors.New(errors.CodeBadRequest, "Budget threshold percentages must be positive")
+		}
+	}
+	return nil
+}
+
+// GetReportBudgets returns the budgets of a report, ordered by name
+func (tx *Tx) GetReportBudgets(reportID string) ([]*Budget, error) {
+	budgets := make([]*Budget, 0)
+	err := tx.Select(&budgets, "SELECT * FROM budget WHERE report_id = $1 ORDER BY name;", reportID)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return budgets, nil
+}
+
+// GetReportBudget returns a budget of a report
+func (tx *Tx) GetReportBudget(reportID, budgetID string) (*Budget, error) {
+	var budget Budget
+	err := tx.Get(&budget, "SELECT * FROM budget WHERE report_id = $1 AND id = $2;", reportID, budgetID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Budget %s does not exist", budgetID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &budget, nil
+}
+
+// CreateBudget creates a budget in a report
+func (tx *Tx) CreateBudget(b *Budget) (string, error) {
+	err := validateBudget(b)
+	if err != nil {
+		return "", err
+	}
+	var budgetID string
+	err = tx.QueryRow("INSERT INTO budget (report_id, name, filters, period, amount, thresholds) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		b.ReportID, b.Name, b.Filters, b.Period, b.Amount, b.Thresholds).Scan(&budgetID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_budget") {
+			return "", errors.Errorf(errors.CodeBadRequest, "Budget %s already exists", b.Name)
+		}
+		return "", errors.InternalError(err)
+	}
+	log.Printf("Created budget %s (%s) in report %s", b.Name, budgetID, b.ReportID)
+	return budgetID, nil
+}
+
+// UpdateBudget replaces the name, filters, period, amount and thresholds of a budget
+func (tx *Tx) UpdateBudget(b *Budget) error {
+	err := validateBudget(b)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE budget SET name = $1, filters = $2, period = $3, amount = $4, thresholds = $5, mtime = current_timestamp WHERE report_id = $6 AND id = $7;",
+		b.Name, b.Filters, b.Period, b.Amount, b.Thresholds, b.ReportID, b.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_budget") {
+			return errors.Errorf(errors.CodeBadRequest, "Budget %s already exists", b.Name)
+		}
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return errors.Errorf(errors.CodeNotFound, "Budget %s does not exist", b.ID)
+	}
+	log.Printf("Updated budget %s (%s) in report %s", b.Name, b.ID, b.ReportID)
+	return nil
+}
+
+// DeleteBudget deletes a budget of a report, along with its threshold crossings
+func (tx *Tx) DeleteBudget(reportID, budgetID string) error {
+	res, err := tx.Exec("DELETE FROM budget WHERE report_id = $1 AND id = $2;", reportID, budgetID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return errors.Errorf(errors.CodeNotFound, "Budget %s does not exist", budgetID)
+	}
+	log.Printf("Deleted budget %s in report %s", budgetID, reportID)
+	return nil
+}
+
+// RecordBudgetCrossing records the crossing of a budget threshold in a period. A threshold is only recorded the first
+// time it is crossed in each period. Returns true if the crossing was not previously recorded
+func (tx *Tx) RecordBudgetCrossing(c *BudgetCrossing) (bool, error) {
+	res, err := tx.Exec(`INSERT INTO budget_crossing (budget_id, period_start, threshold_type, threshold_percent, spend)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT ON CONSTRAINT unique_budget_crossing DO NOTHING;`,
+		c.BudgetID, c.PeriodStart.UTC(), c.ThresholdType, c.ThresholdPercent, c.Spend)
+	if err != nil {
+		return false, errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.InternalError(err)
+	}
+	if count > 0 {
+		log.Printf("Budget %s crossed %s threshold of %g%% (spend: %.2f)", c.BudgetID, c.ThresholdType, c.ThresholdPercent, c.Spend)
+	}
+	return count > 0, nil
+}
+
+// GetBudgetCrossings returns the threshold crossings of a budget in the period starting at periodStart, in order of crossing
+func (tx *Tx) GetBudgetCrossings(budgetID string, periodStart time.Time) ([]*BudgetCrossing, error) {
+	crossings := make([]*BudgetCrossing, 0)
+	err := tx.Select(&crossings, "SELECT * FROM budget_crossing WHERE budget_id = $1 AND period_start = $2 ORDER BY ctime, threshold_percent;",
+		budgetID, periodStart.UTC())
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return crossings, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// ReportCardinality is the series cardinality of a report, and the tag keys which were demoted to fields to limit it
+type ReportCardinality struct {
+	SeriesBudget      int    `db:"series_budget"`
+	SeriesCardinality int    `db:"series_cardinality"`
+	DemotedTagKeys    string `db:"demoted_tag_keys"`
+}
+
+// GetReportCardinality returns the current series cardinality state of a report
+func (tx *Tx) GetReportCardinality(reportID string) (*ReportCardinality, error) {
+	cardinality := ReportCardinality{}
+	err := tx.Get(&cardinality, "SELECT series_budget, series_cardinality, demoted_tag_keys FROM report WHERE id = $1", reportID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Report %s not found", reportID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &cardinality, nil
+}
+
+// UpdateReportCardinality records the series cardinality of a report after an ingest, and adds any newly demoted tag keys.
+// This does not update the report mtime since the settings of the report are unchanged
+func (tx *Tx) UpdateReportCardinality(reportID string, seriesCardinality int, demotedTagKeys []string) error {
+	cardinality, err := tx.GetReportCardinality(reportID)
+	if err != nil {
+		return err
+	}
+	keys := splitTagKeys(cardinality.DemotedTagKeys)
+	for _, newKey := range demotedTagKeys {
+		exists := false
+		for _, key := range keys {
+			if key == newKey {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			keys = append(keys, newKey)
+		}
+	}
+	_, err = tx.Exec("UPDATE report SET series_cardinality = $1, demoted_tag_keys = $2 WHERE id = $3", seriesCardinality, strings.Join(keys, ","), reportID)
+	return errors.InternalError(err)
+}
+
+// validateDemotedTagKeys verifies an update of the demoted tag keys of a report. Tag keys can only be removed from the
+// list, which stores them as tags again in subsequent ingests (unless they exceed the tag value limit again). Tag keys
+// are demoted manually with the denylist
+func (tx *Tx) validateDemotedTagKeys(reportID string, demotedTagKeys string) error {
+	cardinality, err := tx.GetReportCardinality(reportID)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool)
+	for _, key := range splitTagKeys(cardinality.DemotedTagKeys) {
+		current[key] = true
+	}
+	for _, key := range splitTagKeys(demotedTagKeys) {
+		if !current[key] {
+			return errors.Errorf(errors.CodeBadRequest, "Tag key %s is not demoted. Use the denylist to demote a tag key", key)
+		}
+	}
+	return nil
+}
+
+// Warning returns a warning for the report status if tag keys were demoted, or the series cardinality exceeds the budget
+func (c *ReportCardinality) Warning() string {
+	warnings := make([]string, 0)
+	if c.SeriesBudget > 0 && c.SeriesCardinality > c.SeriesBudget {
+		warnings = append(warnings, fmt.Sprintf("series cardinality (%d) exceeds the budget of the report (%d). Series ingested before tag keys were demoted remain until their billing period is reingested or expires", c.SeriesCardinality, c.SeriesBudget))
+	}
+	if demoted := splitTagKeys(c.DemotedTagKeys); len(demoted) > 0 {
+		warnings = append(warnings, fmt.Sprintf("tag keys with too many distinct values were demoted and can no longer be grouped or filtered on: %s", strings.Join(demoted, ", ")))
+	}
+	if len(warnings) == 0 {
+		return ""
+	}
+	return "Warning: " + strings.Join(warnings, "; ")
+}
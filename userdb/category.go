@@ -0,0 +1,203 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// CostCategory is a user defined virtual dimension of a report, which maps the values of existing dimensions to category
+// values using ordered rules. Maps to the 'cost_category' table. Costs which match none of the rules are assigned to the
+// default value. Rules are evaluated at query time (see costdb.CostCategory), so edits apply to all existing data
+type CostCategory struct {
+	ID           string            `db:"id" json:"id"`
+	ReportID     string            `db:"report_id" json:"report_id"`
+	CTime        time.Time         `db:"ctime" json:"ctime"`
+	MTime        time.Time         `db:"mtime" json:"mtime"`
+	Name         string            `db:"name" json:"name"`
+	Rules        CostCategoryRules `db:"rules" json:"rules"`
+	DefaultValue string            `db:"default_value" json:"default_value"`
+}
+
+// CostCategoryRule assigns the category value to costs matching its conditions. If match is "all", every condition must
+// match, otherwise any condition
+type CostCategoryRule struct {
+	Value      string                   `json:"value"`
+	Match      string                   `json:"match,omitempty"`
+	Conditions []*CostCategoryCondition `json:"conditions"`
+}
+
+// CostCategoryCondition compares a dimension (e.g. account, tag:user:Team) to values using an operator (e.g. equals, starts_with)
+type CostCategoryCondition struct {
+	Dimension string   `json:"dimension"`
+	Operator  string   `json:"operator"`
+	Values    []string `json:"values"`
+}
+
+// CostCategoryRules is the ordered list of rules of a cost category. Stored as JSON in the 'rules' column
+type CostCategoryRules []*CostCategoryRule
+
+// Rule matching modes of a cost category
+const (
+	CostCategoryMatchAny = "any"
+	CostCategoryMatchAll = "all"
+)
+
+// costCategoryNameMatcher restricts category names, which are used in dimension names (e.g. category:BusinessUnit)
+var costCategoryNameMatcher = regexp.MustCompile("^[A-Za-z0-9_-]{1,64}$")
+
+// Value implements the driver.Valuer interface
+func (r CostCategoryRules) Value() (driver.Value, error) {
+	if r == nil {
+		r = CostCategoryRules{}
+	}
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (r *CostCategoryRules) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, r)
+	case string:
+		return json.Unmarshal([]byte(v), r)
+	default:
+		return fmt.Errorf("Unsupported type for cost category rules: %T", src)
+	}
+}
+
+// validateCostCategory verifies the name, default value and structure of the rules of a cost category. Dimensions and
+// operators of conditions are verified by the cost database
+func validateCostCategory(c *CostCategory) error {
+	if !costCategoryNameMatcher.MatchString(c.Name) {
+		return errors.Errorf(errors.CodeBadRequest, "Invalid cost category name: '%s'. Names may contain letters, digits, '_' and '-'", c.Name)
+	}
+	if !validCategoryValue(c.DefaultValue) {
+		return errors.Errorf(errors.CodeBadRequest, "Invalid cost category default value: '%s'", c.DefaultValue)
+	}
+	if len(c.Rules) == 0 {
+		return errors.New(errors.CodeBadRequest, "Cost category requires at least one rule")
+	}
+	for _, rule := range c.Rules {
+		if rule == nil || !validCategoryValue(rule.Value) {
+			return errors.New(errors.CodeBadRequest, "Cost category rules require a value")
+		}
+		switch rule.Match {
+		case "", CostCategoryMatchAny, CostCategoryMatchAll:
+		default:
+			return errors.Errorf(errors.CodeBadRequest, "Invalid rule match: %s", rule.Match)
+		}
+		if len(rule.Conditions) == 0 {
+			return errors.Errorf(errors.CodeBadRequest, "Rule %s requires at least one condition", rule.Value)
+		}
+		for _, cond := range rule.Conditions {
+			if cond == nil || len(cond.Values) == 0 {
+				return errors.Errorf(errors.CodeBadRequest, "Conditions of rule %s require values", rule.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// validCategoryValue returns whether or not a category value is valid. Values cannot contain commas, since they are
+// filtered as comma separated lists
+func validCategoryValue(value string) bool {
+	return strings.TrimSpace(value) != "" && !strings.Contains(value, ",")
+}
+
+// GetReportCostCategories returns the cost categories of a report, ordered by name
+func (tx *Tx) GetReportCostCategories(reportID string) ([]*CostCategory, error) {
+	categories := make([]*CostCategory, 0)
+	err := tx.Select(&categories, "SELECT * FROM cost_category WHERE report_id = $1 ORDER BY name;", reportID)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return categories, nil
+}
+
+// GetReportCostCategory returns a cost category of a report
+func (tx *Tx) GetReportCostCategory(reportID, categoryID string) (*CostCategory, error) {
+	var category CostCategory
+	err := tx.Get(&category, "SELECT * FROM cost_category WHERE report_id = $1 AND id = $2;", reportID, categoryID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Cost category %s does not exist", categoryID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &category, nil
+}
+
+// CreateCostCategory creates a cost category in a report. Since categories change the results of cost queries, the report's
+// modification time is updated
+func (tx *Tx) CreateCostCategory(c *CostCategory) (string, error) {
+	err := validateCostCategory(c)
+	if err != nil {
+		return "", err
+	}
+	var categoryID string
+	err = tx.QueryRow("INSERT INTO cost_category (report_id, name, rules, default_value) VALUES ($1, $2, $3, $4) RETURNING id",
+		c.ReportID, c.Name, c.Rules, c.DefaultValue).Scan(&categoryID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_cost_category") {
+			return "", errors.Errorf(errors.CodeBadRequest, "Cost category %s already exists", c.Name)
+		}
+		return "", errors.InternalError(err)
+	}
+	log.Printf("Created cost category %s (%s) in report %s", c.Name, categoryID, c.ReportID)
+	return categoryID, tx.UpdateUserReportMtime(c.ReportID)
+}
+
+// UpdateCostCategory replaces the name, rules and default value of a cost category, and updates the report's modification time
+func (tx *Tx) UpdateCostCategory(c *CostCategory) error {
+	err := validateCostCategory(c)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE cost_category SET name = $1, rules = $2, default_value = $3, mtime = current_timestamp WHERE report_id = $4 AND id = $5;",
+		c.Name, c.Rules, c.DefaultValue, c.ReportID, c.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_cost_category") {
+			return errors.Errorf(errors.CodeBadRequest, "Cost category %s already exists", c.Name)
+		}
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return errors.Errorf(errors.CodeNotFound, "Cost category %s does not exist", c.ID)
+	}
+	log.Printf("Updated cost category %s (%s) in report %s", c.Name, c.ID, c.ReportID)
+	return tx.UpdateUserReportMtime(c.ReportID)
+}
+
+// DeleteCostCategory deletes a cost category of a report, and updates the report's modification time
+func (tx *Tx) DeleteCostCategory(reportID, categoryID string) error {
+	res, err := tx.Exec("DELETE FROM cost_category WHERE report_id = $1 AND id = $2;", reportID, categoryID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return errors.Errorf(errors.CodeNotFound, "Cost category %s does not exist", categoryID)
+	}
+	log.Printf("Deleted cost category %s in report %s", categoryID, reportID)
+	return tx.UpdateUserReportMtime(reportID)
+}
@@ -0,0 +1,389 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+	"github.com/applatix/claudia/util"
+)
+
+// NotificationChannel is a destination of notifications of the events of a report. Maps to the 'notification_channel' table
+type NotificationChannel struct {
+	ID       string                    `db:"id" json:"id"`
+	ReportID string                    `db:"report_id" json:"report_id"`
+	CTime    time.Time                 `db:"ctime" json:"ctime"`
+	MTime    time.Time                 `db:"mtime" json:"mtime"`
+	Name     string                    `db:"name" json:"name"`
+	Type     string                    `db:"type" json:"type"`
+	Config   NotificationChannelConfig `db:"config" json:"config"`
+	Events   NotificationEventTypes    `db:"events" json:"events"`
+	Enabled  bool                      `db:"enabled" json:"enabled"`
+}
+
+// NotificationChannelConfig is the configuration of a notification channel. Stored as JSON in the 'config' column
+// * URL is the URL which webhook and slack notifications are posted to
+// * Secret is the key of the HMAC-SHA256 signature of webhook payloads
+// * Host, Port, Username, Password, From and To configure the SMTP server and addresses of email notifications
+type NotificationChannelConfig struct {
+	URL      string   `json:"url,omitempty"`
+	Secret   string   `json:"secret,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// NotificationEventTypes is the list of event types a channel is subscribed to. Stored as JSON in the 'events' column
+type NotificationEventTypes []string
+
+// NotificationEvent is an event of a report which is notified to the channels subscribed to its type
+type NotificationEvent struct {
+	Type       string            `json:"type"`
+	ReportID   string            `json:"report_id"`
+	ReportName string            `json:"report_name"`
+	Time       time.Time         `json:"time"`
+	Subject    string            `json:"subject"`
+	Message    string            `json:"message"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// NotificationDelivery is the delivery of an event to a channel, which is retried until it succeeds or runs out of attempts.
+// Maps to the 'notification_delivery' table
+type NotificationDelivery struct {
+	ID          string            `db:"id" json:"id"`
+	ChannelID   string            `db:"channel_id" json:"channel_id"`
+	CTime       time.Time         `db:"ctime" json:"ctime"`
+	MTime       time.Time         `db:"mtime" json:"mtime"`
+	EventType   string            `db:"event_type" json:"event_type"`
+	DedupKey    string            `db:"dedup_key" json:"-"`
+	Payload     NotificationEvent `db:"payload" json:"payload"`
+	Status      string            `db:"status" json:"status"`
+	Attempts    int               `db:"attempts" json:"attempts"`
+	NextAttempt time.Time         `db:"next_attempt" json:"next_attempt"`
+	LastError   string            `db:"last_error" json:"last_error"`
+}
+
+// Notification channel types
+const (
+	NotificationChannelWebhook = "webhook"
+	NotificationChannelSlack   = "slack"
+	NotificationChannelSMTP    = "smtp"
+)
+
+// Notification event types
+const (
+	NotificationEventIngestFailed    = "ingest_failed"
+	NotificationEventBucketError     = "bucket_error"
+	NotificationEventReportCurrent   = "report_current"
+	NotificationEventAccountAdded    = "account_added"
+	NotificationEventBudgetThreshold = "budget_threshold"
+	NotificationEventTest            = "test"
+)
+
+// NotificationEventTypeList are the event types which channels can subscribe to
+var NotificationEventTypeList = []string{
+	NotificationEventIngestFailed,
+	NotificationEventBucketError,
+	NotificationEventReportCurrent,
+	NotificationEventAccountAdded,
+	NotificationEventBudgetThreshold,
+}
+
+// Statuses of a notification delivery
+const (
+	NotificationDeliveryPending   = "pending"
+	NotificationDeliveryDelivered = "delivered"
+	NotificationDeliveryFailed    = "failed"
+)
+
+// Value implements the driver.Valuer interface
+func (c NotificationChannelConfig) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (c *NotificationChannelConfig) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	default:
+		return fmt.Errorf("Unsupported type for notification channel config: %T", src)
+	}
+}
+
+// Value implements the driver.Valuer interface
+func (e NotificationEventTypes) Value() (driver.Value, error) {
+	if e == nil {
+		e = NotificationEventTypes{}
+	}
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (e *NotificationEventTypes) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, e)
+	case string:
+		return json.Unmarshal([]byte(v), e)
+	default:
+		return fmt.Errorf("Unsupported type for notification event types: %T", src)
+	}
+}
+
+// Value implements the driver.Valuer interface
+func (e NotificationEvent) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (e *NotificationEvent) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, e)
+	case string:
+		return json.Unmarshal([]byte(v), e)
+	default:
+		return fmt.Errorf("Unsupported type for notification event: %T", src)
+	}
+}
+
+// Subscribed returns whether or not the channel is subscribed to the event type. Test events are delivered to every channel
+func (c *NotificationChannel) Subscribed(eventType string) bool {
+	if eventType == NotificationEventTest {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// HideSecrets removes the webhook secret and SMTP password from the channel, so that it can be returned to the client
+func (c *NotificationChannel) HideSecrets() {
+	c.Config.Secret = ""
+	c.Config.Password = ""
+}
+
+// validateNotificationChannel verifies the type, configuration and subscriptions of a notification channel
+func validateNotificationChannel(c *NotificationChannel) error {
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New(errors.CodeBadRequest, "Notification channel requires a name")
+	}
+	if hasLineBreak(c.Name) {
+		return errors.New(errors.CodeBadRequest, "Notification channel name cannot have line breaks")
+	}
+	switch c.Type {
+	case NotificationChannelWebhook, NotificationChannelSlack:
+		u, err := url.Parse(c.Config.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf(errors.CodeBadRequest, "Invalid notification URL: '%s'", c.Config.URL)
+		}
+		// The host is resolved again when notifications are sent, in case it was rebound to an internal address
+		_, err = util.ResolvePublicHost(u.Hostname())
+		if err != nil {
+			return err
+		}
+	case NotificationChannelSMTP:
+		if c.Config.Host == "" || c.Config.From == "" || len(c.Config.To) == 0 {
+			return errors.New(errors.CodeBadRequest, "SMTP notification channels require a host, from address and to addresses")
+		}
+		if c.Config.Port < 0 || c.Config.Port > 65535 {
+			return errors.Errorf(errors.CodeBadRequest, "Invalid SMTP port: %d", c.Config.Port)
+		}
+		err := validateEmailSettings(c.Config.Host, c.Config.From, c.Config.To)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf(errors.CodeBadRequest, "Invalid notification channel type: '%s'", c.Type)
+	}
+	for _, eventType := range c.Events {
+		valid := false
+		for _, validType := range NotificationEventTypeList {
+			if eventType == validType {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return errors.Errorf(errors.CodeBadRequest, "Invalid notification event type: '%s'", eventType)
+		}
+	}
+	return nil
+}
+
+// GetReportNotificationChannels returns the notification channels of a report, ordered by name
+func (tx *Tx) GetReportNotificationChannels(reportID string) ([]*NotificationChannel, error) {
+	channels := make([]*NotificationChannel, 0)
+	err := tx.Select(&channels, "SELECT * FROM notification_channel WHERE report_id = $1 ORDER BY name;", reportID)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return channels, nil
+}
+
+// GetReportNotificationChannel returns a notification channel of a report
+func (tx *Tx) GetReportNotificationChannel(reportID, channelID string) (*NotificationChannel, error) {
+	var channel NotificationChannel
+	err := tx.Get(&channel, "SELECT * FROM notification_channel WHERE report_id = $1 AND id = $2;", reportID, channelID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Notification channel %s does not exist", channelID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &channel, nil
+}
+
+// CreateNotificationChannel creates a notification channel in a report
+func (tx *Tx) CreateNotificationChannel(c *NotificationChannel) (string, error) {
+	err := validateNotificationChannel(c)
+	if err != nil {
+		return "", err
+	}
+	var channelID string
+	err = tx.QueryRow("INSERT INTO notification_channel (report_id, name, type, config, events, enabled) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		c.ReportID, c.Name, c.Type, c.Config, c.Events, c.Enabled).Scan(&channelID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_notification_channel") {
+			return "", errors.Errorf(errors.CodeBadRequest, "Notification channel %s already exists", c.Name)
+		}
+		return "", errors.InternalError(err)
+	}
+	log.Printf("Created %s notification channel %s (%s) in report %s", c.Type, c.Name, channelID, c.ReportID)
+	return channelID, nil
+}
+
+// UpdateNotificationChannel replaces the settings of a notification channel. A webhook secret or SMTP password which is
+// omitted keeps its existing value, since secrets are never returned to the client
+func (tx *Tx) UpdateNotificationChannel(c *NotificationChannel) error {
+	existing, err := tx.GetReportNotificationChannel(c.ReportID, c.ID)
+	if err != nil {
+		return err
+	}
+	if c.Config.Secret == "" {
+		c.Config.Secret = existing.Config.Secret
+	}
+	if c.Config.Password == "" {
+		c.Config.Password = existing.Config.Password
+	}
+	err = validateNotificationChannel(c)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE notification_channel SET name = $1, type = $2, config = $3, events = $4, enabled = $5, mtime = current_timestamp WHERE report_id = $6 AND id = $7;",
+		c.Name, c.Type, c.Config, c.Events, c.Enabled, c.ReportID, c.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_notification_channel") {
+			return errors.Errorf(errors.CodeBadRequest, "Notification channel %s already exists", c.Name)
+		}
+		return errors.InternalError(err)
+	}
+	log.Printf("Updated notification channel %s (%s) in report %s", c.Name, c.ID, c.ReportID)
+	return nil
+}
+
+// DeleteNotificationChannel deletes a notification channel of a report, along with its deliveries
+func (tx *Tx) DeleteNotificationChannel(reportID, channelID string) error {
+	res, err := tx.Exec("DELETE FROM notification_channel WHERE report_id = $1 AND id = $2;", reportID, channelID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return errors.Errorf(errors.CodeNotFound, "Notification channel %s does not exist", channelID)
+	}
+	log.Printf("Deleted notification channel %s in report %s", channelID, reportID)
+	return nil
+}
+
+// QueueNotificationDelivery queues the delivery of an event to a channel. If the channel was already sent an event with
+// the same deduplication key since the given time, the event is not queued again. Returns true if the delivery was queued
+func (tx *Tx) QueueNotificationDelivery(channelID, dedupKey string, since time.Time, event *NotificationEvent) (bool, error) {
+	res, err := tx.Exec(`INSERT INTO notification_delivery (channel_id, event_type, dedup_key, payload, status)
+		SELECT $1::uuid, $2::text, $3::text, $4::jsonb, $5::text WHERE NOT EXISTS
+		(SELECT 1 FROM notification_delivery WHERE channel_id = $1 AND dedup_key = $3 AND ctime >= $6);`,
+		channelID, event.Type, dedupKey, *event, NotificationDeliveryPending, since.UTC())
+	if err != nil {
+		return false, errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.InternalError(err)
+	}
+	return count > 0, nil
+}
+
+// GetDueNotificationDeliveries returns pending deliveries whose next attempt is due, oldest first
+func (tx *Tx) GetDueNotificationDeliveries(limit int) ([]*NotificationDelivery, error) {
+	deliveries := make([]*NotificationDelivery, 0)
+	err := tx.Select(&deliveries, "SELECT * FROM notification_delivery WHERE status = $1 AND next_attempt <= $2 ORDER BY next_attempt LIMIT $3;",
+		NotificationDeliveryPending, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return deliveries, nil
+}
+
+// GetNotificationChannel returns a notification channel by ID. Used by ingestd, which delivers notifications of all reports
+func (tx *Tx) GetNotificationChannel(channelID string) (*NotificationChannel, error) {
+	var channel NotificationChannel
+	err := tx.Get(&channel, "SELECT * FROM notification_channel WHERE id = $1;", channelID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Notification channel %s does not exist", channelID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &channel, nil
+}
+
+// UpdateNotificationDelivery records the outcome of an attempt to deliver a notification
+func (tx *Tx) UpdateNotificationDelivery(d *NotificationDelivery) error {
+	_, err := tx.Exec("UPDATE notification_delivery SET status = $1, attempts = $2, next_attempt = $3, last_error = $4, mtime = current_timestamp WHERE id = $5;",
+		d.Status, d.Attempts, d.NextAttempt.UTC(), d.LastError, d.ID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	return nil
+}
+
+// GetNotificationDeliveries returns the delivery log of a channel, most recent first
+func (tx *Tx) GetNotificationDeliveries(channelID string, limit int) ([]*NotificationDelivery, error) {
+	deliveries := make([]*NotificationDelivery, 0)
+	err := tx.Select(&deliveries, "SELECT * FROM notification_delivery WHERE channel_id = $1 ORDER BY ctime DESC LIMIT $2;", channelID, limit)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return deliveries, nil
+}
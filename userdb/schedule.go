@@ -0,0 +1,294 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia"
+	"github.com/applatix/claudia/errors"
+)
+
+// Schedule is the recurring delivery of a saved view (or the summary dashboard when ViewID is nil), run by ingestd on
+// a cron schedule. Schedules are executed against the default report of their owner. Maps to the 'schedule' table
+// * Cron is evaluated in the time zone TZ, which is also the time zone of the timeframe of each run
+// * Timeframe is the period of costs delivered, relative to the time of each run
+// * NextRun is the next time the schedule is due, and LastStatus and LastError are the outcome of the last run
+type Schedule struct {
+	ID          string              `db:"id" json:"id"`
+	OwnerUserID string              `db:"owner_user_id" json:"owner_user_id"`
+	ViewID      *string             `db:"view_id" json:"view_id"`
+	CTime       time.Time           `db:"ctime" json:"ctime"`
+	MTime       time.Time           `db:"mtime" json:"mtime"`
+	Name        string              `db:"name" json:"name"`
+	Cron        string              `db:"cron" json:"cron"`
+	TZ          string              `db:"tz" json:"tz"`
+	Timeframe   string              `db:"timeframe" json:"timeframe"`
+	Destination ScheduleDestination `db:"destination" json:"destination"`
+	Enabled     bool                `db:"enabled" json:"enabled"`
+	NextRun     time.Time           `db:"next_run" json:"next_run"`
+	LastRun     *time.Time          `db:"last_run" json:"last_run"`
+	LastStatus  string              `db:"last_status" json:"last_status"`
+	LastError   string              `db:"last_error" json:"last_error"`
+}
+
+// ScheduleDestination is where the files of a scheduled delivery are delivered. Stored as JSON in the 'destination' column
+// * email: Host, Port, Username, Password, From and To configure the SMTP server and addresses
+// * directory: Path is the absolute path of the directory on the ingestd host in which files are written, within DeliveriesDir
+// * s3: Bucket, Region and Prefix locate the files, and the access keys (which are required) authenticate
+// Each run is delivered to a subdirectory (or key prefix) named by the schedule and the time of the run
+type ScheduleDestination struct {
+	Type               string   `json:"type"`
+	Host               string   `json:"host,omitempty"`
+	Port               int      `json:"port,omitempty"`
+	Username           string   `json:"username,omitempty"`
+	Password           string   `json:"password,omitempty"`
+	From               string   `json:"from,omitempty"`
+	To                 []string `json:"to,omitempty"`
+	Path               string   `json:"path,omitempty"`
+	Bucket             string   `json:"bucket,omitempty"`
+	Region             string   `json:"region,omitempty"`
+	Prefix             string   `json:"prefix,omitempty"`
+	AWSAccessKeyID     string   `json:"aws_access_key_id,omitempty"`
+	AWSSecretAccessKey string   `json:"aws_secret_access_key,omitempty"`
+}
+
+// Schedule destination types
+const (
+	ScheduleDestinationEmail     = "email"
+	ScheduleDestinationDirectory = "directory"
+	ScheduleDestinationS3        = "s3"
+)
+
+// Schedule timeframes
+const (
+	TimeframePreviousDay    = "previous_day"
+	TimeframePrevious7Days  = "previous_7_days"
+	TimeframePrevious30Days = "previous_30_days"
+	TimeframePreviousMonth  = "previous_month"
+	TimeframeMonthToDate    = "month_to_date"
+)
+
+// Statuses of the last run of a schedule
+const (
+	ScheduleStatusSucceeded = "succeeded"
+	ScheduleStatusFailed    = "failed"
+)
+
+// Value implements the driver.Valuer interface
+func (d ScheduleDestination) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (d *ScheduleDestination) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, d)
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	default:
+		return fmt.Errorf("Unsupported type for schedule destination: %T", src)
+	}
+}
+
+// HideSecrets removes the SMTP password and AWS secret access key from the schedule, so that it can be returned to the client
+func (s *Schedule) HideSecrets() {
+	s.Destination.Password = ""
+	s.Destination.AWSSecretAccessKey = ""
+}
+
+// DeliveriesDir returns the directory of the ingestd host under which the directory destinations of schedules are written
+func DeliveriesDir() string {
+	return filepath.Join(claudia.ApplicationDir, "deliveries")
+}
+
+// ValidateDeliveryPath verifies that the path of a directory destination is a clean absolute path within DeliveriesDir
+func ValidateDeliveryPath(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return errors.Errorf(errors.CodeBadRequest, "Directory destinations require a clean absolute path: '%s'", path)
+	}
+	if path != DeliveriesDir() && !strings.HasPrefix(path, DeliveriesDir()+string(filepath.Separator)) {
+		return errors.Errorf(errors.CodeBadRequest, "Directory destinations must be within %s: '%s'", DeliveriesDir(), path)
+	}
+	return nil
+}
+
+// awsRegionMatcher matches the name of an AWS region, e.g. us-west-2 or us-gov-east-1
+var awsRegionMatcher = regexp.MustCompile("^[a-z]{2}(-[a-z]+)+-[0-9]+$")
+
+// validateSchedule verifies the name, timeframe and destination of a schedule. The cron expression and time zone are
+// verified by the API server, which computes the next run
+func validateSchedule(s *Schedule) error {
+	if strings.TrimSpace(s.Name) == "" {
+		return errors.New(errors.CodeBadRequest, "Schedule requires a name")
+	}
+	if hasLineBreak(s.Name) {
+		return errors.New(errors.CodeBadRequest, "Schedule name cannot have line breaks")
+	}
+	switch s.Timeframe {
+	case TimeframePreviousDay, TimeframePrevious7Days, TimeframePrevious30Days, TimeframePreviousMonth, TimeframeMonthToDate:
+	default:
+		return errors.Errorf(errors.CodeBadRequest, "Invalid schedule timeframe: '%s'", s.Timeframe)
+	}
+	d := s.Destination
+	switch d.Type {
+	case ScheduleDestinationEmail:
+		if d.Host == "" || d.From == "" || len(d.To) == 0 {
+			return errors.New(errors.CodeBadRequest, "Email destinations require a host, from address and to addresses")
+		}
+		if d.Port < 0 || d.Port > 65535 {
+			return errors.Errorf(errors.CodeBadRequest, "Invalid SMTP port: %d", d.Port)
+		}
+		err := validateEmailSettings(d.Host, d.From, d.To)
+		if err != nil {
+			return err
+		}
+	case ScheduleDestinationDirectory:
+		err := ValidateDeliveryPath(d.Path)
+		if err != nil {
+			return err
+		}
+	case ScheduleDestinationS3:
+		if d.Bucket == "" || d.Region == "" {
+			return errors.New(errors.CodeBadRequest, "S3 destinations require a bucket and region")
+		}
+		// The region determines the S3 endpoint which files are uploaded to
+		if !awsRegionMatcher.MatchString(d.Region) {
+			return errors.Errorf(errors.CodeBadRequest, "Invalid AWS region: '%s'", d.Region)
+		}
+		// The ambient credentials of the ingestd host are never used, since they may grant access to other buckets
+		if d.AWSAccessKeyID == "" || d.AWSSecretAccessKey == "" {
+			return errors.New(errors.CodeBadRequest, "S3 destinations require an access key ID and secret access key")
+		}
+	default:
+		return errors.Errorf(errors.CodeBadRequest, "Invalid schedule destination type: '%s'", d.Type)
+	}
+	return nil
+}
+
+// GetUserSchedules returns the schedules of a user, ordered by name
+func (tx *Tx) GetUserSchedules(userID string) ([]*Schedule, error) {
+	schedules := make([]*Schedule, 0)
+	err := tx.Select(&schedules, "SELECT * FROM schedule WHERE owner_user_id = $1 ORDER BY name;", userID)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return schedules, nil
+}
+
+// GetUserSchedule returns a schedule of a user
+func (tx *Tx) GetUserSchedule(userID, scheduleID string) (*Schedule, error) {
+	var schedule Schedule
+	err := tx.Get(&schedule, "SELECT * FROM schedule WHERE owner_user_id = $1 AND id = $2;", userID, scheduleID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Schedule %s does not exist", scheduleID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &schedule, nil
+}
+
+// CreateSchedule creates a schedule of a user
+func (tx *Tx) CreateSchedule(s *Schedule) (string, error) {
+	err := validateSchedule(s)
+	if err != nil {
+		return "", err
+	}
+	var scheduleID string
+	err = tx.QueryRow(`INSERT INTO schedule (owner_user_id, view_id, name, cron, tz, timeframe, destination, enabled, next_run)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		s.OwnerUserID, s.ViewID, s.Name, s.Cron, s.TZ, s.Timeframe, s.Destination, s.Enabled, s.NextRun.UTC()).Scan(&scheduleID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_schedule") {
+			return "", errors.Errorf(errors.CodeBadRequest, "Schedule %s already exists", s.Name)
+		}
+		return "", errors.InternalError(err)
+	}
+	log.Printf("Created schedule %s (%s) of user %s", s.Name, scheduleID, s.OwnerUserID)
+	return scheduleID, nil
+}
+
+// UpdateSchedule replaces the settings of a schedule. An SMTP password or AWS secret access key which is omitted keeps
+// its existing value, since secrets are never returned to the client
+func (tx *Tx) UpdateSchedule(s *Schedule) error {
+	existing, err := tx.GetUserSchedule(s.OwnerUserID, s.ID)
+	if err != nil {
+		return err
+	}
+	if s.Destination.Password == "" {
+		s.Destination.Password = existing.Destination.Password
+	}
+	if s.Destination.AWSSecretAccessKey == "" {
+		s.Destination.AWSSecretAccessKey = existing.Destination.AWSSecretAccessKey
+	}
+	err = validateSchedule(s)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE schedule SET view_id = $1, name = $2, cron = $3, tz = $4, timeframe = $5, destination = $6, enabled = $7,
+		next_run = $8, mtime = current_timestamp WHERE owner_user_id = $9 AND id = $10;`,
+		s.ViewID, s.Name, s.Cron, s.TZ, s.Timeframe, s.Destination, s.Enabled, s.NextRun.UTC(), s.OwnerUserID, s.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_schedule") {
+			return errors.Errorf(errors.CodeBadRequest, "Schedule %s already exists", s.Name)
+		}
+		return errors.InternalError(err)
+	}
+	log.Printf("Updated schedule %s (%s) of user %s", s.Name, s.ID, s.OwnerUserID)
+	return nil
+}
+
+// DeleteSchedule deletes a schedule of a user
+func (tx *Tx) DeleteSchedule(userID, scheduleID string) error {
+	res, err := tx.Exec("DELETE FROM schedule WHERE owner_user_id = $1 AND id = $2;", userID, scheduleID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return errors.Errorf(errors.CodeNotFound, "Schedule %s does not exist", scheduleID)
+	}
+	log.Printf("Deleted schedule %s of user %s", scheduleID, userID)
+	return nil
+}
+
+// GetDueSchedules returns the enabled schedules whose next run is due, in order of their next run
+func (tx *Tx) GetDueSchedules(now time.Time) ([]*Schedule, error) {
+	schedules := make([]*Schedule, 0)
+	err := tx.Select(&schedules, "SELECT * FROM schedule WHERE enabled AND next_run <= $1 ORDER BY next_run;", now.UTC())
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return schedules, nil
+}
+
+// UpdateScheduleRun records the outcome of a run of a schedule, and its next run
+func (tx *Tx) UpdateScheduleRun(s *Schedule) error {
+	var lastRun *time.Time
+	if s.LastRun != nil {
+		utc := s.LastRun.UTC()
+		lastRun = &utc
+	}
+	_, err := tx.Exec("UPDATE schedule SET last_run = $1, last_status = $2, last_error = $3, next_run = $4 WHERE id = $5;",
+		lastRun, s.LastStatus, s.LastError, s.NextRun.UTC(), s.ID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	return nil
+}
@@ -2,7 +2,11 @@
 package userdb
 
 // SchemaVersion is the user database schema version of this version of the app
-const SchemaVersion = 1
+const SchemaVersion = 13
+
+// schemaVersions are the statements to create each version of the schema from the previous version.
+// The statements at index i upgrade the schema to version i+1
+var schemaVersions = [][]string{schemaV1, schemaV2, schemaV3, schemaV4, schemaV5, schemaV6, schemaV7, schemaV8, schemaV9, schemaV10, schemaV11, schemaV12, schemaV13}
 
 var schemaV1 = []string{`
 -- single row table to store configuration & system information
@@ -69,3 +73,219 @@ CREATE TABLE aws_product (
 );
 `,
 }
+
+// schemaV2 adds the fiscal calendar settings of a report
+var schemaV2 = []string{`
+ALTER TABLE report
+	ADD COLUMN fiscal_year_start_month INT NOT NULL DEFAULT 1,
+	ADD COLUMN fiscal_periods          TEXT NOT NULL DEFAULT 'monthly';
+`,
+}
+
+// schemaV3 adds cost anomalies detected by ingestd, and the tag keys of a report which are evaluated for anomalies
+var schemaV3 = []string{`
+ALTER TABLE report
+	ADD COLUMN anomaly_tag_keys TEXT NOT NULL DEFAULT '';
+`, `
+CREATE TABLE anomaly (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	mtime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	report_id          UUID NOT NULL REFERENCES report(id) ON DELETE CASCADE,
+	day                TIMESTAMP NOT NULL,
+	dimension          TEXT NOT NULL,
+	name               TEXT NOT NULL,
+	cost               DOUBLE PRECISION NOT NULL,
+	baseline           DOUBLE PRECISION NOT NULL,
+	score              DOUBLE PRECISION NOT NULL,
+	severity           TEXT NOT NULL,
+	contributors       JSONB NOT NULL,
+	status             TEXT NOT NULL,
+	CONSTRAINT unique_anomaly UNIQUE (report_id, day, dimension, name)
+);
+`,
+}
+
+// schemaV4 adds snapshots of the dimension tree of a report, built by ingestd after each ingest. Snapshots are keyed on
+// a generation of the report's cost data, which is incremented whenever data is ingested or purged
+var schemaV4 = []string{`
+ALTER TABLE report
+	ADD COLUMN data_generation BIGINT NOT NULL DEFAULT 0;
+`, `
+CREATE TABLE dimension_snapshot (
+	report_id          UUID PRIMARY KEY REFERENCES report(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	data_generation    BIGINT NOT NULL,
+	dimensions         JSONB NOT NULL
+);
+`,
+}
+
+// schemaV5 adds the series cardinality governance settings of a report, and the cardinality state maintained by ingestd
+var schemaV5 = []string{`
+ALTER TABLE report
+	ADD COLUMN tag_key_allowlist  TEXT NOT NULL DEFAULT '',
+	ADD COLUMN tag_key_denylist   TEXT NOT NULL DEFAULT '',
+	ADD COLUMN tag_value_limit    INT NOT NULL DEFAULT 1000,
+	ADD COLUMN series_budget      INT NOT NULL DEFAULT 100000,
+	ADD COLUMN series_cardinality INT NOT NULL DEFAULT 0,
+	ADD COLUMN demoted_tag_keys   TEXT NOT NULL DEFAULT '';
+`,
+}
+
+// schemaV6 adds the retention of the daily and monthly downsampling tiers of a report
+var schemaV6 = []string{`
+ALTER TABLE report
+	ADD COLUMN daily_retention    TEXT NOT NULL DEFAULT 'off',
+	ADD COLUMN monthly_retention  TEXT NOT NULL DEFAULT 'off';
+`,
+}
+
+// schemaV7 adds the user defined cost categories of a report
+var schemaV7 = []string{`
+CREATE TABLE cost_category (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	report_id          UUID NOT NULL REFERENCES report(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	mtime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	name               TEXT NOT NULL,
+	rules              JSONB NOT NULL,
+	default_value      TEXT NOT NULL,
+	CONSTRAINT unique_cost_category UNIQUE (report_id, name)
+);
+`,
+}
+
+// schemaV8 adds the cost allocation rulesets of a report
+var schemaV8 = []string{`
+CREATE TABLE allocation_ruleset (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	report_id          UUID NOT NULL REFERENCES report(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	mtime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	name               TEXT NOT NULL,
+	dimension          TEXT NOT NULL,
+	rules              JSONB NOT NULL,
+	CONSTRAINT unique_allocation_ruleset UNIQUE (report_id, name)
+);
+`,
+}
+
+// schemaV9 adds the chargeback statements generated for a report. Statement files are stored in the application directory
+var schemaV9 = []string{`
+CREATE TABLE statement (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	report_id          UUID NOT NULL REFERENCES report(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	billing_period     TEXT NOT NULL,
+	dimension          TEXT NOT NULL,
+	allocation         TEXT NOT NULL DEFAULT '',
+	blended            BOOLEAN NOT NULL DEFAULT false,
+	adjustments        JSONB NOT NULL,
+	group_statements   JSONB NOT NULL
+);
+`,
+}
+
+// schemaV10 adds the budgets of a report, and the crossings of their thresholds recorded by ingestd
+var schemaV10 = []string{`
+CREATE TABLE budget (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	report_id          UUID NOT NULL REFERENCES report(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	mtime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	name               TEXT NOT NULL,
+	filters            JSONB NOT NULL,
+	period             TEXT NOT NULL,
+	amount             DOUBLE PRECISION NOT NULL,
+	thresholds         JSONB NOT NULL,
+	CONSTRAINT unique_budget UNIQUE (report_id, name)
+);
+`, `
+CREATE TABLE budget_crossing (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	budget_id          UUID NOT NULL REFERENCES budget(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	period_start       TIMESTAMP NOT NULL,
+	threshold_type     TEXT NOT NULL,
+	threshold_percent  DOUBLE PRECISION NOT NULL,
+	spend              DOUBLE PRECISION NOT NULL,
+	CONSTRAINT unique_budget_crossing UNIQUE (budget_id, period_start, threshold_type, threshold_percent)
+);
+`,
+}
+
+// schemaV11 adds the notification channels of a report, and the log of notifications delivered to them
+var schemaV11 = []string{`
+CREATE TABLE notification_channel (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	report_id          UUID NOT NULL REFERENCES report(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	mtime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	name               TEXT NOT NULL,
+	type               TEXT NOT NULL,
+	config             JSONB NOT NULL,
+	events             JSONB NOT NULL,
+	enabled            BOOLEAN NOT NULL DEFAULT true,
+	CONSTRAINT unique_notification_channel UNIQUE (report_id, name)
+);
+`, `
+CREATE TABLE notification_delivery (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	channel_id         UUID NOT NULL REFERENCES notification_channel(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	mtime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	event_type         TEXT NOT NULL,
+	dedup_key          TEXT NOT NULL,
+	payload            JSONB NOT NULL,
+	status             TEXT NOT NULL,
+	attempts           INT NOT NULL DEFAULT 0,
+	next_attempt       TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	last_error         TEXT NOT NULL DEFAULT ''
+);
+`, `
+CREATE INDEX notification_delivery_pending ON notification_delivery (status, next_attempt);
+`,
+}
+
+// schemaV12 adds the saved views of users
+var schemaV12 = []string{`
+CREATE TABLE saved_view (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	owner_user_id      UUID NOT NULL REFERENCES appuser(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	mtime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	name               TEXT NOT NULL,
+	description        TEXT NOT NULL DEFAULT '',
+	query              JSONB NOT NULL,
+	chart_type         TEXT NOT NULL,
+	shared             BOOLEAN NOT NULL DEFAULT false,
+	CONSTRAINT unique_saved_view UNIQUE (owner_user_id, name)
+);
+`,
+}
+
+// schemaV13 adds the scheduled deliveries of saved views and the summary dashboard
+var schemaV13 = []string{`
+CREATE TABLE schedule (
+	id                 UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	owner_user_id      UUID NOT NULL REFERENCES appuser(id) ON DELETE CASCADE,
+	view_id            UUID REFERENCES saved_view(id) ON DELETE CASCADE,
+	ctime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	mtime              TIMESTAMP NOT NULL DEFAULT current_timestamp,
+	name               TEXT NOT NULL,
+	cron               TEXT NOT NULL,
+	tz                 TEXT NOT NULL DEFAULT 'UTC',
+	timeframe          TEXT NOT NULL,
+	destination        JSONB NOT NULL,
+	enabled            BOOLEAN NOT NULL DEFAULT true,
+	next_run           TIMESTAMP NOT NULL,
+	last_run           TIMESTAMP,
+	last_status        TEXT NOT NULL DEFAULT '',
+	last_error         TEXT NOT NULL DEFAULT '',
+	CONSTRAINT unique_schedule UNIQUE (owner_user_id, name)
+);
+`, `
+CREATE INDEX schedule_next_run ON schedule (enabled, next_run);
+`,
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// DimensionSnapshot is the dimension tree of a report as of a generation of the report's cost data. Maps to the 'dimension_snapshot' table.
+// The dimensions are stored as the JSON encoded tree
+type DimensionSnapshot struct {
+	ReportID       string    `db:"report_id" json:"report_id"`
+	CTime          time.Time `db:"ctime" json:"ctime"`
+	DataGeneration int64     `db:"data_generation" json:"data_generation"`
+	Dimensions     []byte    `db:"dimensions" json:"-"`
+}
+
+// GetDimensionSnapshot returns the dimension snapshot of a report, or nil if the report has no snapshot
+func (tx *Tx) GetDimensionSnapshot(reportID string) (*DimensionSnapshot, error) {
+	snapshot := DimensionSnapshot{}
+	err := tx.Get(&snapshot, "SELECT * FROM dimension_snapshot WHERE report_id = $1", reportID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &snapshot, nil
+}
+
+// UpsertDimensionSnapshot replaces the dimension snapshot of a report
+func (tx *Tx) UpsertDimensionSnapshot(snapshot *DimensionSnapshot) error {
+	const sqlUpsertSnapshot = `
+	INSERT INTO dimension_snapshot (report_id, data_generation, dimensions)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (report_id) DO UPDATE SET ctime = current_timestamp, data_generation = $2, dimensions = $3;`
+	_, err := tx.Exec(sqlUpsertSnapshot, snapshot.ReportID, snapshot.DataGeneration, string(snapshot.Dimensions))
+	return errors.InternalError(err)
+}
+
+// GetReportDataGeneration returns the generation of the cost data of a report
+func (tx *Tx) GetReportDataGeneration(reportID string) (int64, error) {
+	var generation int64
+	err := tx.Get(&generation, "SELECT data_generation FROM report WHERE id = $1", reportID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return generation, errors.Errorf(errors.CodeNotFound, "Report %s does not exist", reportID)
+		}
+		return generation, errors.InternalError(err)
+	}
+	return generation, nil
+}
+
+// IncrementReportDataGeneration records that the cost data of a report has changed (e.g. data was ingested or purged),
+// which invalidates its dimension snapshot. This does not update the report mtime since the settings of the report are unchanged
+func (tx *Tx) IncrementReportDataGeneration(reportID string) error {
+	_, err := tx.Exec("UPDATE report SET data_generation = data_generation + 1 WHERE id = $1", reportID)
+	return errors.InternalError(err)
+}
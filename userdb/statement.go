@@ -0,0 +1,205 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// Statement is a set of chargeback statements of a report for a billing period, one per value of a dimension (e.g. per team).
+// The statement of each group is generated as HTML and CSV files in the application directory. Maps to the 'statement' table
+type Statement struct {
+	ID            string               `db:"id" json:"id"`
+	ReportID      string               `db:"report_id" json:"report_id"`
+	CTime         time.Time            `db:"ctime" json:"ctime"`
+	BillingPeriod string               `db:"billing_period" json:"billing_period"`
+	Dimension     string               `db:"dimension" json:"dimension"`
+	Allocation    string               `db:"allocation" json:"allocation"`
+	Blended       bool                 `db:"blended" json:"blended"`
+	Adjustments   StatementAdjustments `db:"adjustments" json:"adjustments"`
+	Groups        GroupStatements      `db:"group_statements" json:"groups"`
+}
+
+// StatementAdjustment is a manual adjustment of the statement of a group (e.g. a credit)
+type StatementAdjustment struct {
+	Group       string  `json:"group"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+// StatementAdjustments is the list of manual adjustments of a statement. Stored as JSON in the 'adjustments' column
+type StatementAdjustments []*StatementAdjustment
+
+// GroupStatement summarizes the statement of a group, and names its generated files
+type GroupStatement struct {
+	Name        string  `json:"name"`
+	DisplayName string  `json:"display_name"`
+	Subtotal    float64 `json:"subtotal"`
+	Adjustments float64 `json:"adjustments"`
+	Total       float64 `json:"total"`
+	HTMLFile    string  `json:"html_file"`
+	CSVFile     string  `json:"csv_file"`
+}
+
+// GroupStatements is the list of group statements of a statement. Stored as JSON in the 'group_statements' column
+type GroupStatements []*GroupStatement
+
+// statementBillingPeriodFormat is the format of the billing period of a statement (e.g. 2017-01)
+const statementBillingPeriodFormat = "2006-01"
+
+// Value implements the driver.Valuer interface
+func (a StatementAdjustments) Value() (driver.Value, error) {
+	if a == nil {
+		a = StatementAdjustments{}
+	}
+	bytes, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (a *StatementAdjustments) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, a)
+	case string:
+		return json.Unmarshal([]byte(v), a)
+	default:
+		return fmt.Errorf("Unsupported type for statement adjustments: %T", src)
+	}
+}
+
+// Value implements the driver.Valuer interface
+func (g GroupStatements) Value() (driver.Value, error) {
+	if g == nil {
+		g = GroupStatements{}
+	}
+	bytes, err := json.Marshal(g)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (g *GroupStatements) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, g)
+	case string:
+		return json.Unmarshal([]byte(v), g)
+	default:
+		return fmt.Errorf("Unsupported type for group statements: %T", src)
+	}
+}
+
+// BillingPeriodRange returns the start of the statement's billing period, and the start of the next (in UTC)
+func (s *Statement) BillingPeriodRange() (time.Time, time.Time, error) {
+	from, err := time.Parse(statementBillingPeriodFormat, s.BillingPeriod)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Errorf(errors.CodeBadRequest, "Invalid billing period: '%s' (expected YYYY-MM)", s.BillingPeriod)
+	}
+	return from, from.AddDate(0, 1, 0), nil
+}
+
+// HasFile returns whether or not the file name is a generated file of the statement
+func (s *Statement) HasFile(fileName string) bool {
+	for _, g := range s.Groups {
+		if g.HTMLFile == fileName || g.CSVFile == fileName {
+			return true
+		}
+	}
+	return false
+}
+
+// validateStatement verifies the billing period, dimension and adjustments of a statement. The dimension is
+// verified by the cost database when the statement is generated
+func validateStatement(s *Statement) error {
+	_, _, err := s.BillingPeriodRange()
+	if err != nil {
+		return err
+	}
+	if s.Dimension == "" {
+		return errors.New(errors.CodeBadRequest, "Statement requires a dimension")
+	}
+	for _, adjustment := range s.Adjustments {
+		if adjustment == nil || adjustment.Description == "" {
+			return errors.New(errors.CodeBadRequest, "Statement adjustments require a description")
+		}
+	}
+	return nil
+}
+
+// GetReportStatements returns the statements of a report, most recent first
+func (tx *Tx) GetReportStatements(reportID string) ([]*Statement, error) {
+	statements := make([]*Statement, 0)
+	err := tx.Select(&statements, "SELECT * FROM statement WHERE report_id = $1 ORDER BY ctime DESC;", reportID)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return statements, nil
+}
+
+// GetReportStatement returns a statement of a report
+func (tx *Tx) GetReportStatement(reportID, statementID string) (*Statement, error) {
+	var statement Statement
+	err := tx.Get(&statement, "SELECT * FROM statement WHERE report_id = $1 AND id = $2;", reportID, statementID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "Statement %s does not exist", statementID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &statement, nil
+}
+
+// CreateStatement records a statement of a report, along with its group statements
+func (tx *Tx) CreateStatement(s *Statement) (string, error) {
+	err := validateStatement(s)
+	if err != nil {
+		return "", err
+	}
+	var statementID string
+	err = tx.QueryRow(`INSERT INTO statement (report_id, billing_period, dimension, allocation, blended, adjustments, group_statements)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		s.ReportID, s.BillingPeriod, s.Dimension, s.Allocation, s.Blended, s.Adjustments, s.Groups).Scan(&statementID)
+	if err != nil {
+		return "", errors.InternalError(err)
+	}
+	log.Printf("Created statement %s (%s by %s) in report %s", statementID, s.BillingPeriod, s.Dimension, s.ReportID)
+	return statementID, nil
+}
+
+// UpdateStatementGroups updates the group statements of a statement, after its files have been generated
+func (tx *Tx) UpdateStatementGroups(s *Statement) error {
+	_, err := tx.Exec("UPDATE statement SET group_statements = $1 WHERE report_id = $2 AND id = $3;", s.Groups, s.ReportID, s.ID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	return nil
+}
+
+// DeleteStatement deletes a statement of a report
+func (tx *Tx) DeleteStatement(reportID, statementID string) error {
+	res, err := tx.Exec("DELETE FROM statement WHERE report_id = $1 AND id = $2;", reportID, statementID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return errors.Errorf(errors.CodeNotFound, "Statement %s does not exist", statementID)
+	}
+	log.Printf("Deleted statement %s in report %s", statementID, reportID)
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -57,18 +58,46 @@ type User struct {
 
 // Report is the struct representing a cost & usage report. Maps to the 'report' table
 type Report struct {
-	ID            string               `db:"id" json:"id"`
-	CTime         time.Time            `db:"ctime" json:"ctime"`
-	MTime         time.Time            `db:"mtime" json:"mtime"`
-	Status        claudia.ReportStatus `db:"status" json:"status"`
-	StatusDetail  string               `db:"status_detail" json:"status_detail"`
-	OwnerUserID   string               `db:"owner_user_id" json:"owner_user_id"`
-	ReportName    string               `db:"report_name" json:"report_name"`
-	RetentionDays int                  `db:"retention_days" json:"retention_days"`
-	Buckets       []*Bucket            `json:"buckets"`
-	Accounts      []*AWSAccountInfo    `json:"accounts"`
+	ID                   string               `db:"id" json:"id"`
+	CTime                time.Time            `db:"ctime" json:"ctime"`
+	MTime                time.Time            `db:"mtime" json:"mtime"`
+	Status               claudia.ReportStatus `db:"status" json:"status"`
+	StatusDetail         string               `db:"status_detail" json:"status_detail"`
+	OwnerUserID          string               `db:"owner_user_id" json:"owner_user_id"`
+	ReportName           string               `db:"report_name" json:"report_name"`
+	RetentionDays        int                  `db:"retention_days" json:"retention_days"`
+	FiscalYearStartMonth int                  `db:"fiscal_year_start_month" json:"fiscal_year_start_month"`
+	FiscalPeriods        string               `db:"fiscal_periods" json:"fiscal_periods"`
+	AnomalyTagKeys       *string              `db:"anomaly_tag_keys" json:"anomaly_tag_keys"`
+	TagKeyAllowlist      *string              `db:"tag_key_allowlist" json:"tag_key_allowlist"`
+	TagKeyDenylist       *string              `db:"tag_key_denylist" json:"tag_key_denylist"`
+	TagValueLimit        *int                 `db:"tag_value_limit" json:"tag_value_limit"`
+	SeriesBudget         *int                 `db:"series_budget" json:"series_budget"`
+	SeriesCardinality    int                  `db:"series_cardinality" json:"series_cardinality"`
+	DemotedTagKeys       *string              `db:"demoted_tag_keys" json:"demoted_tag_keys"`
+	DailyRetention       string               `db:"daily_retention" json:"daily_retention"`
+	MonthlyRetention     string               `db:"monthly_retention" json:"monthly_retention"`
+	DataGeneration       int64                `db:"data_generation" json:"-"`
+	Buckets              []*Bucket            `json:"buckets"`
+	Accounts             []*AWSAccountInfo    `json:"accounts"`
 }
 
+// Valid fiscal periods of a report. Fiscal periods are either calendar months or follow a week pattern
+// of the three periods in each quarter (e.g. 4-4-5)
+const (
+	FiscalPeriodsMonthly = "monthly"
+	FiscalPeriods445     = "4-4-5"
+	FiscalPeriods454     = "4-5-4"
+	FiscalPeriods544     = "5-4-4"
+)
+
+// Retention settings of the downsampling tiers of a report. A tier is either disabled, kept forever, or kept for a
+// number of days (e.g. 1095d)
+const (
+	RetentionTierOff     = "off"
+	RetentionTierForever = "inf"
+)
+
 // AWSAccountInfo represents an AWS account mapping of ID to name in a cost & usage report
 type AWSAccountInfo struct {
 	AWSAccountID string `db:"aws_account_id" json:"aws_account_id"`
@@ -117,6 +146,94 @@ func (r *Report) GetBucket(bucketname, reportPath string) *Bucket {
 	return nil
 }
 
+// AnomalyTagKeyList returns the tag keys of the report which are evaluated for anomalies
+func (r *Report) AnomalyTagKeyList() []string {
+	return splitTagKeys(stringValue(r.AnomalyTagKeys))
+}
+
+// TagKeyAllowlistKeys returns the tag keys of the report which are always stored as tags. If non-empty, all other tag keys are stored as fields
+func (r *Report) TagKeyAllowlistKeys() []string {
+	return splitTagKeys(stringValue(r.TagKeyAllowlist))
+}
+
+// TagKeyDenylistKeys returns the tag keys of the report which are never stored as tags
+func (r *Report) TagKeyDenylistKeys() []string {
+	return splitTagKeys(stringValue(r.TagKeyDenylist))
+}
+
+// DemotedTagKeyList returns the tag keys of the report which were demoted from tags to fields due to high cardinality
+func (r *Report) DemotedTagKeyList() []string {
+	return splitTagKeys(stringValue(r.DemotedTagKeys))
+}
+
+// GetTagValueLimit returns the maximum distinct values of a tag key during an ingest before it is demoted (0 if unlimited)
+func (r *Report) GetTagValueLimit() int {
+	return intValue(r.TagValueLimit)
+}
+
+// GetSeriesBudget returns the series cardinality budget of the report (0 if unlimited)
+func (r *Report) GetSeriesBudget() int {
+	return intValue(r.SeriesBudget)
+}
+
+// DailyRetentionDays returns the retention in days of the daily downsampling tier of the report
+// (0 if kept forever, or claudia.RetentionTierDisabled)
+func (r *Report) DailyRetentionDays() int {
+	days, _ := parseRetentionTier(r.DailyRetention)
+	return days
+}
+
+// MonthlyRetentionDays returns the retention in days of the monthly downsampling tier of the report
+// (0 if kept forever, or claudia.RetentionTierDisabled)
+func (r *Report) MonthlyRetentionDays() int {
+	days, _ := parseRetentionTier(r.MonthlyRetention)
+	return days
+}
+
+// hasLineBreak returns whether or not a string has a carriage return or line feed, which would inject headers into the
+// emails it is written to (e.g. a budget name in the subject of a notification)
+func hasLineBreak(s string) bool {
+	return strings.ContainsAny(s, "\r\n")
+}
+
+// validateEmailSettings verifies that the SMTP host and addresses of an email notification or delivery do not have line breaks
+func validateEmailSettings(host, from string, to []string) error {
+	for _, value := range append([]string{host, from}, to...) {
+		if hasLineBreak(value) {
+			return errors.Errorf(errors.CodeBadRequest, "Invalid email setting: %q", value)
+		}
+	}
+	return nil
+}
+
+// stringValue returns the value of an optional string setting, or the empty string if it is unset
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// intValue returns the value of an optional integer setting, or 0 if it is unset
+func intValue(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+// splitTagKeys splits a comma separated list of tag keys, ignoring empty entries
+func splitTagKeys(tagKeys string) []string {
+	keys := make([]string, 0)
+	for _, key := range strings.Split(tagKeys, ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
 // ETag returns an HTTP ETag string to enable client side caching of report results
 func (r *Report) ETag() string {
 	return fmt.Sprintf("%s/%s", r.ID, r.MTime.UTC().String())
@@ -167,9 +284,11 @@ func (db *UserDatabase) Init() error {
 	if err != nil {
 		return err
 	}
-	for _, stmt := range schemaV1 {
-		log.Println(stmt)
-		tx.MustExec(stmt)
+	for _, schema := range schemaVersions {
+		for _, stmt := range schema {
+			log.Println(stmt)
+			tx.MustExec(stmt)
+		}
 	}
 	defaultPassword := getDefaultPassword()
 	_, err = tx.CreateUser(claudia.ApplicationAdminUsername, defaultPassword)
@@ -196,6 +315,41 @@ func (db *UserDatabase) Init() error {
 	return nil
 }
 
+// Upgrade upgrades the database schema from the version of a previous version of the app
+func (db *UserDatabase) Upgrade() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	conf, err := tx.GetConfiguration()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if conf.SchemaVersion >= SchemaVersion {
+		tx.Rollback()
+		return nil
+	}
+	for version := conf.SchemaVersion + 1; version <= SchemaVersion; version++ {
+		log.Printf("Upgrading database schema to version %d", version)
+		for _, stmt := range schemaVersions[version-1] {
+			log.Println(stmt)
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				tx.Rollback()
+				return errors.InternalError(err)
+			}
+		}
+	}
+	_, err = tx.Exec("UPDATE configuration SET schema_version = $1", SchemaVersion)
+	if err != nil {
+		tx.Rollback()
+		return errors.InternalError(err)
+	}
+	log.Printf("Successfully upgraded database schema from %d to %d", conf.SchemaVersion, SchemaVersion)
+	return tx.Commit()
+}
+
 // Wait blocks until the database is ready
 func (db *UserDatabase) Wait() {
 	log.Println("Waiting for user db to become ready")
@@ -542,6 +696,18 @@ func (tx *Tx) GetUserReport(userID string, reportID string) (*Report, error) {
 	return reports[0], nil
 }
 
+// GetReport retrieves the specified report
+func (tx *Tx) GetReport(reportID string) (*Report, error) {
+	reports, err := tx.getReportsHelper(selectReportsQuery+" WHERE r.id = $1;", reportID)
+	if err != nil {
+		return nil, err
+	}
+	if len(reports) == 0 {
+		return nil, errors.Errorf(errors.CodeNotFound, "Report %s not found", reportID)
+	}
+	return reports[0], nil
+}
+
 // GetUserDefaultReport retrieves the default report owned by the user. Returns nil if no reports are configured
 // Since the database currently has a constraint of one report per user, this simply returns the first row (for now).
 func (tx *Tx) GetUserDefaultReport(userID string) (*Report, error) {
@@ -574,8 +740,50 @@ func (tx *Tx) CreateUserReport(userID string, r *Report) (string, error) {
 	} else {
 		retentionDays = r.RetentionDays
 	}
-	err := tx.QueryRow("INSERT INTO report (owner_user_id, report_name, retention_days, status, status_detail) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		userID, reportName, retentionDays, string(claudia.ReportStatusCurrent), "").Scan(&reportID)
+	fiscalYearStartMonth := 1
+	if r.FiscalYearStartMonth != 0 {
+		fiscalYearStartMonth = r.FiscalYearStartMonth
+	}
+	fiscalPeriods := FiscalPeriodsMonthly
+	if r.FiscalPeriods != "" {
+		fiscalPeriods = r.FiscalPeriods
+	}
+	err := validateFiscalCalendar(fiscalYearStartMonth, fiscalPeriods)
+	if err != nil {
+		return "", err
+	}
+	err = validateAnomalyTagKeys(stringValue(r.AnomalyTagKeys))
+	if err != nil {
+		return "", err
+	}
+	err = validateCardinalitySettings(r)
+	if err != nil {
+		return "", err
+	}
+	dailyRetention := RetentionTierOff
+	if r.DailyRetention != "" {
+		dailyRetention = r.DailyRetention
+	}
+	monthlyRetention := RetentionTierOff
+	if r.MonthlyRetention != "" {
+		monthlyRetention = r.MonthlyRetention
+	}
+	err = validateRetentionTiers(retentionDays, dailyRetention, monthlyRetention)
+	if err != nil {
+		return "", err
+	}
+	// An explicit limit or budget of 0 disables it
+	tagValueLimit := claudia.ReportDefaultTagValueLimit
+	if r.TagValueLimit != nil {
+		tagValueLimit = *r.TagValueLimit
+	}
+	seriesBudget := claudia.ReportDefaultSeriesBudget
+	if r.SeriesBudget != nil {
+		seriesBudget = *r.SeriesBudget
+	}
+	err = tx.QueryRow("INSERT INTO report (owner_user_id, report_name, retention_days, status, status_detail, fiscal_year_start_month, fiscal_periods, anomaly_tag_keys, tag_key_allowlist, tag_key_denylist, tag_value_limit, series_budget, daily_retention, monthly_retention) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id",
+		userID, reportName, retentionDays, string(claudia.ReportStatusCurrent), "", fiscalYearStartMonth, fiscalPeriods, stringValue(r.AnomalyTagKeys),
+		stringValue(r.TagKeyAllowlist), stringValue(r.TagKeyDenylist), tagValueLimit, seriesBudget, dailyRetention, monthlyRetention).Scan(&reportID)
 	if err != nil {
 		// If we violate the constraint, report_owner_user_id_key, user is attempting to create multiple reports
 		// pq: duplicate key value violates unique constraint \"report_owner_user_id_key\""
@@ -588,6 +796,100 @@ func (tx *Tx) CreateUserReport(userID string, r *Report) (string, error) {
 	return reportID, nil
 }
 
+// validateFiscalCalendar verifies the fiscal calendar settings of a report
+func validateFiscalCalendar(fiscalYearStartMonth int, fiscalPeriods string) error {
+	if fiscalYearStartMonth < 1 || fiscalYearStartMonth > 12 {
+		return errors.Errorf(errors.CodeBadRequest, "Invalid fiscal year start month: %d", fiscalYearStartMonth)
+	}
+	switch fiscalPeriods {
+	case FiscalPeriodsMonthly, FiscalPeriods445, FiscalPeriods454, FiscalPeriods544:
+		return nil
+	default:
+		return errors.Errorf(errors.CodeBadRequest, "Invalid fiscal periods: %s", fiscalPeriods)
+	}
+}
+
+// validateAnomalyTagKeys verifies the comma separated tag keys (e.g. tag:user:Team) of a report which are evaluated for anomalies
+func validateAnomalyTagKeys(anomalyTagKeys string) error {
+	return validateTagKeys("anomaly", anomalyTagKeys)
+}
+
+// validateTagKeys verifies a comma separated list of tag keys (e.g. tag:user:Team) of a report setting
+func validateTagKeys(setting string, tagKeys string) error {
+	for _, tagKey := range splitTagKeys(tagKeys) {
+		if !strings.HasPrefix(tagKey, "tag:") || len(tagKey) <= len("tag:") {
+			return errors.Errorf(errors.CodeBadRequest, "Invalid %s tag key: %s", setting, tagKey)
+		}
+	}
+	return nil
+}
+
+// validateCardinalitySettings verifies the tag allowlist and denylist, and the cardinality limits of a report
+func validateCardinalitySettings(r *Report) error {
+	err := validateTagKeys("allowlist", stringValue(r.TagKeyAllowlist))
+	if err != nil {
+		return err
+	}
+	err = validateTagKeys("denylist", stringValue(r.TagKeyDenylist))
+	if err != nil {
+		return err
+	}
+	if r.GetTagValueLimit() < 0 {
+		return errors.Errorf(errors.CodeBadRequest, "Invalid tag value limit: %d", r.GetTagValueLimit())
+	}
+	if r.GetSeriesBudget() < 0 {
+		return errors.Errorf(errors.CodeBadRequest, "Invalid series budget: %d", r.GetSeriesBudget())
+	}
+	return nil
+}
+
+// parseRetentionTier parses the retention of a downsampling tier (e.g. off, inf, 1095d) as days
+// (0 if kept forever, or claudia.RetentionTierDisabled)
+func parseRetentionTier(setting string) (int, error) {
+	switch setting {
+	case "", RetentionTierOff:
+		return claudia.RetentionTierDisabled, nil
+	case RetentionTierForever:
+		return 0, nil
+	}
+	days, err := strconv.Atoi(strings.TrimSuffix(setting, "d"))
+	if err != nil || !strings.HasSuffix(setting, "d") || days < 7 {
+		return claudia.RetentionTierDisabled, errors.Errorf(errors.CodeBadRequest, "Invalid tier retention: %s", setting)
+	}
+	return days, nil
+}
+
+// FormatRetentionTier formats the retention in days of a downsampling tier as a tier retention setting (e.g. off, inf, 1095d)
+func FormatRetentionTier(days int) string {
+	switch days {
+	case claudia.RetentionTierDisabled:
+		return RetentionTierOff
+	case 0:
+		return RetentionTierForever
+	}
+	return fmt.Sprintf("%dd", days)
+}
+
+// validateRetentionTiers verifies the retention of the daily and monthly downsampling tiers of a report. Since each tier
+// is downsampled from the finer data, a tier must be retained longer than the data it is downsampled from
+func validateRetentionTiers(retentionDays int, dailyRetention, monthlyRetention string) error {
+	finerDays := retentionDays
+	for _, setting := range []string{dailyRetention, monthlyRetention} {
+		days, err := parseRetentionTier(setting)
+		if err != nil {
+			return err
+		}
+		if days == claudia.RetentionTierDisabled {
+			continue
+		}
+		if finerDays == 0 || (days != 0 && days <= finerDays) {
+			return errors.Errorf(errors.CodeBadRequest, "Tier retention %s must be longer than the retention of the data it is downsampled from", setting)
+		}
+		finerDays = days
+	}
+	return nil
+}
+
 // UpdateUserReport applies updates to a report
 func (tx *Tx) UpdateUserReport(r *Report) error {
 	log.Printf("Updating report %s", r.ID)
@@ -602,6 +904,83 @@ func (tx *Tx) UpdateUserReport(r *Report) error {
 		}
 		updates["retention_days"] = r.RetentionDays
 	}
+	if r.FiscalYearStartMonth != 0 || r.FiscalPeriods != "" {
+		// Unspecified settings are validated against valid placeholders since they will not be updated
+		fiscalYearStartMonth := r.FiscalYearStartMonth
+		if fiscalYearStartMonth == 0 {
+			fiscalYearStartMonth = 1
+		} else {
+			updates["fiscal_year_start_month"] = r.FiscalYearStartMonth
+		}
+		fiscalPeriods := r.FiscalPeriods
+		if fiscalPeriods == "" {
+			fiscalPeriods = FiscalPeriodsMonthly
+		} else {
+			updates["fiscal_periods"] = r.FiscalPeriods
+		}
+		err := validateFiscalCalendar(fiscalYearStartMonth, fiscalPeriods)
+		if err != nil {
+			return err
+		}
+	}
+	if r.AnomalyTagKeys != nil {
+		// An empty list clears the tag keys evaluated for anomalies
+		err := validateAnomalyTagKeys(*r.AnomalyTagKeys)
+		if err != nil {
+			return err
+		}
+		updates["anomaly_tag_keys"] = *r.AnomalyTagKeys
+	}
+	err := validateCardinalitySettings(r)
+	if err != nil {
+		return err
+	}
+	// Empty lists clear the allowlist and denylist, and a limit or budget of 0 disables it
+	if r.TagKeyAllowlist != nil {
+		updates["tag_key_allowlist"] = *r.TagKeyAllowlist
+	}
+	if r.TagKeyDenylist != nil {
+		updates["tag_key_denylist"] = *r.TagKeyDenylist
+	}
+	if r.TagValueLimit != nil {
+		updates["tag_value_limit"] = *r.TagValueLimit
+	}
+	if r.SeriesBudget != nil {
+		updates["series_budget"] = *r.SeriesBudget
+	}
+	if r.DemotedTagKeys != nil {
+		err := tx.validateDemotedTagKeys(r.ID, *r.DemotedTagKeys)
+		if err != nil {
+			return err
+		}
+		updates["demoted_tag_keys"] = *r.DemotedTagKeys
+	}
+	if r.RetentionDays != 0 || r.DailyRetention != "" || r.MonthlyRetention != "" {
+		// Tier retentions depend on each other, so unspecified settings are validated against their current values
+		var current Report
+		err := tx.Get(&current, "SELECT * FROM report WHERE id = $1", r.ID)
+		if err != nil {
+			return errors.InternalError(err)
+		}
+		retentionDays := current.RetentionDays
+		if r.RetentionDays != 0 {
+			retentionDays = r.RetentionDays
+		}
+		dailyRetention := current.DailyRetention
+		if r.DailyRetention != "" {
+			dailyRetention = r.DailyRetention
+			updates["daily_retention"] = r.DailyRetention
+		}
+		monthlyRetention := current.MonthlyRetention
+		if r.MonthlyRetention != "" {
+			monthlyRetention = r.MonthlyRetention
+			updates["monthly_retention"] = r.MonthlyRetention
+		}
+		err = validateRetentionTiers(retentionDays, dailyRetention, monthlyRetention)
+		if err != nil {
+			return err
+		}
+	}
 	if !r.MTime.IsZero() {
 		updates["mtime"] = r.MTime.UTC()
 	} else if len(updates) > 0 {
@@ -614,8 +993,8 @@ func (tx *Tx) UpdateUserReport(r *Report) error {
 		updates["status_detail"] = r.StatusDetail
 	}
 	if r.Status == claudia.ReportStatusCurrent {
-		// If status is current, there's no detail necessary
-		updates["status_detail"] = ""
+		// If status is current, the only detail is a warning (e.g. high cardinality), otherwise it is cleared
+		updates["status_detail"] = r.StatusDetail
 	}
 	if len(updates) > 0 {
 		assignments := make([]string, len(updates))
@@ -750,23 +1129,24 @@ func (tx *Tx) DeleteBucket(bucket Bucket) error {
 	return nil
 }
 
-// AddReportAccount creates an account. This will only be called by ingestd, not by user. If account already exists, this is a noop
-func (tx *Tx) AddReportAccount(reportID string, accountID string) error {
+// AddReportAccount creates an account, and returns whether it was added. This will only be called by ingestd, not by user.
+// If account already exists, this is a noop
+func (tx *Tx) AddReportAccount(reportID string, accountID string) (bool, error) {
 	log.Printf("Adding account %s under reportID: %s", accountID, reportID)
 	_, err := tx.Exec("INSERT INTO aws_account (report_id, aws_account_id, name) VALUES ($1, $2, $3)", reportID, accountID, accountID)
 	if err != nil {
 		if strings.Contains(err.Error(), "unique_account") {
 			log.Printf("Account %s already exists in reportID %s", accountID, reportID)
-			return nil
+			return false, nil
 		}
-		return errors.InternalError(err)
+		return false, errors.InternalError(err)
 	}
 	err = tx.UpdateUserReportMtime(reportID)
 	if err != nil {
-		return err
+		return false, err
 	}
 	log.Printf("Successfully added account %s under reportID: %s", accountID, reportID)
-	return nil
+	return true, nil
 }
 
 // DeleteReportAccount deletes an AWS account associated with a report. This will only be called by ingestd, not by user
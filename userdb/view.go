@@ -0,0 +1,176 @@
+// Copyright 2017 Applatix, Inc.
+package userdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// SavedView is a named cost query and the chart it is displayed with. A view is owned by a user, and may be shared with
+// all other users, who can read and execute it but not modify it. Maps to the 'saved_view' table
+type SavedView struct {
+	ID          string    `db:"id" json:"id"`
+	OwnerUserID string    `db:"owner_user_id" json:"owner_user_id"`
+	CTime       time.Time `db:"ctime" json:"ctime"`
+	MTime       time.Time `db:"mtime" json:"mtime"`
+	Name        string    `db:"name" json:"name"`
+	Description string    `db:"description" json:"description"`
+	Query       ViewQuery `db:"query" json:"query"`
+	ChartType   string    `db:"chart_type" json:"chart_type"`
+	Shared      bool      `db:"shared" json:"shared"`
+}
+
+// ViewQuery maps the query args of a /v1/cost query to their values (e.g. {"from": "2017-01-01", "group_by": "service",
+// "accounts": "012345678910,246810121416"}). Stored as JSON in the 'query' column
+type ViewQuery map[string]string
+
+// Chart types of a saved view
+const (
+	ChartTypeLine       = "line"
+	ChartTypeBar        = "bar"
+	ChartTypeStackedBar = "stacked_bar"
+	ChartTypeArea       = "area"
+	ChartTypePie        = "pie"
+	ChartTypeTable      = "table"
+)
+
+// Value implements the driver.Valuer interface
+func (q ViewQuery) Value() (driver.Value, error) {
+	if q == nil {
+		q = ViewQuery{}
+	}
+	bytes, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Scan implements the sql.Scanner interface
+func (q *ViewQuery) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, q)
+	case string:
+		return json.Unmarshal([]byte(v), q)
+	default:
+		return fmt.Errorf("Unsupported type for view query: %T", src)
+	}
+}
+
+// validateSavedView verifies the name and chart type of a view. The query is verified by the API server
+func validateSavedView(v *SavedView) error {
+	if strings.TrimSpace(v.Name) == "" {
+		return errors.New(errors.CodeBadRequest, "View requires a name")
+	}
+	if hasLineBreak(v.Name) {
+		return errors.New(errors.CodeBadRequest, "View name cannot have line breaks")
+	}
+	switch v.ChartType {
+	case ChartTypeLine, ChartTypeBar, ChartTypeStackedBar, ChartTypeArea, ChartTypePie, ChartTypeTable:
+	default:
+		return errors.Errorf(errors.CodeBadRequest, "Invalid chart type: '%s'", v.ChartType)
+	}
+	return nil
+}
+
+// GetUserViews returns the views owned by a user, and the views shared by other users, ordered by name
+func (tx *Tx) GetUserViews(userID string) ([]*SavedView, error) {
+	views := make([]*SavedView, 0)
+	err := tx.Select(&views, "SELECT * FROM saved_view WHERE owner_user_id = $1 OR shared ORDER BY name, ctime;", userID)
+	if err != nil {
+		return nil, errors.InternalError(err)
+	}
+	return views, nil
+}
+
+// GetUserView returns a view which is owned by, or shared with the user
+func (tx *Tx) GetUserView(userID, viewID string) (*SavedView, error) {
+	var view SavedView
+	err := tx.Get(&view, "SELECT * FROM saved_view WHERE id = $1 AND (owner_user_id = $2 OR shared);", viewID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf(errors.CodeNotFound, "View %s does not exist", viewID)
+		}
+		return nil, errors.InternalError(err)
+	}
+	return &view, nil
+}
+
+// CreateView creates a view owned by a user
+func (tx *Tx) CreateView(v *SavedView) (string, error) {
+	err := validateSavedView(v)
+	if err != nil {
+		return "", err
+	}
+	var viewID string
+	err = tx.QueryRow("INSERT INTO saved_view (owner_user_id, name, description, query, chart_type, shared) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		v.OwnerUserID, v.Name, v.Description, v.Query, v.ChartType, v.Shared).Scan(&viewID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_saved_view") {
+			return "", errors.Errorf(errors.CodeBadRequest, "View %s already exists", v.Name)
+		}
+		return "", errors.InternalError(err)
+	}
+	log.Printf("Created view %s (%s) of user %s", v.Name, viewID, v.OwnerUserID)
+	return viewID, nil
+}
+
+// UpdateView replaces the settings of a view. Only the owner of a view may update it
+func (tx *Tx) UpdateView(v *SavedView) error {
+	err := validateSavedView(v)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE saved_view SET name = $1, description = $2, query = $3, chart_type = $4, shared = $5, mtime = current_timestamp WHERE owner_user_id = $6 AND id = $7;",
+		v.Name, v.Description, v.Query, v.ChartType, v.Shared, v.OwnerUserID, v.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "unique_saved_view") {
+			return errors.Errorf(errors.CodeBadRequest, "View %s already exists", v.Name)
+		}
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return tx.viewNotOwnedError(v.OwnerUserID, v.ID)
+	}
+	log.Printf("Updated view %s (%s) of user %s", v.Name, v.ID, v.OwnerUserID)
+	return nil
+}
+
+// DeleteView deletes a view. Only the owner of a view may delete it
+func (tx *Tx) DeleteView(userID, viewID string) error {
+	res, err := tx.Exec("DELETE FROM saved_view WHERE owner_user_id = $1 AND id = $2;", userID, viewID)
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return errors.InternalError(err)
+	}
+	if count == 0 {
+		return tx.viewNotOwnedError(userID, viewID)
+	}
+	log.Printf("Deleted view %s of user %s", viewID, userID)
+	return nil
+}
+
+// viewNotOwnedError returns the error of modifying a view which the user does not own. A view shared by another user is
+// forbidden, while any other view does not exist
+func (tx *Tx) viewNotOwnedError(userID, viewID string) error {
+	_, err := tx.GetUserView(userID, viewID)
+	if err != nil {
+		return err
+	}
+	return errors.Errorf(errors.CodeForbidden, "View %s is owned by another user", viewID)
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Applatix, Inc.
+package util
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/applatix/claudia/errors"
+)
+
+// nonPublicNetworks are the private, shared and reserved networks which are not covered by the net.IP predicates
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// IsPublicIP returns whether or not the IP address is publicly routable, i.e. not a loopback, private, link-local,
+// unspecified or multicast address
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolvePublicHost resolves a host name (or IP address), and returns its addresses if all of them are public
+func ResolvePublicHost(host string) ([]net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, errors.Errorf(errors.CodeBadRequest, "Failed to resolve %s: %s", host, err)
+	}
+	for _, ip := range ips {
+		if !IsPublicIP(ip) {
+			return nil, errors.Errorf(errors.CodeBadRequest, "%s resolves to a non-public address: %s", host, ip)
+		}
+	}
+	return ips, nil
+}
+
+// dialPublic connects to an address whose host resolves only to public addresses. The host is resolved when connecting,
+// rather than only when it was validated, so that a host cannot be rebound to an internal address after validation
+func dialPublic(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := ResolvePublicHost(host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// NewPublicHTTPClient returns a HTTP client which only connects to public addresses. Proxies are not used, since the
+// proxy would connect on behalf of the client
+func NewPublicHTTPClient(timeout time.Duration) *http.Client {
+	transport := http.Transport{
+		DialContext:         dialPublic,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &http.Client{Timeout: timeout, Transport: &transport}
+}